@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"time"
 
+	"github.com/boltdb/bolt"
 	"github.com/juju/errors"
 	"github.com/synapse-garden/mf-proto/db"
 	"github.com/synapse-garden/mf-proto/user"
@@ -11,7 +12,10 @@ import (
 )
 
 const (
+	// Admins holds Admins by ID.
 	Admins db.Bucket = "admin-admins"
+
+	// Emails holds Admin IDs by email.
 	Emails db.Bucket = "admin-emails"
 )
 
@@ -20,15 +24,47 @@ func Buckets() []db.Bucket {
 	return []db.Bucket{
 		Admins,
 		Emails,
+		Keys,
+		Sessions,
+		Impersonations,
 	}
 }
 
-// Admin is a user as considered by the admin package.
-type Admin user.User
+// Admin is an admin account.  Its Keys are kept apart from it, so that
+// they can be rotated and revoked without changing who the Admin is.
+type Admin struct {
+	// ID identifies the Admin for good.
+	ID string `json:"id,omitempty"`
+
+	Email string    `json:"email,omitempty"`
+	Salt  util.Salt `json:"salt,omitempty"`
+	Hash  util.Hash `json:"hash,omitempty"`
+
+	// Key is only set on Admins kept before they had separate Keys, and
+	// on responses carrying a new Key.
+	Key util.Key `json:"key,omitempty"`
+
+	Created *time.Time `json:"created,omitempty"`
+
+	// Disabled is set while the Admin may not use their Keys or log in.
+	Disabled bool `json:"disabled,omitempty"`
+
+	// TOTP is the Admin's two-factor authentication, which their
+	// password logins must also pass.
+	TOTP *user.TOTP `json:"totp,omitempty"`
+}
+
+func newID() (string, error) {
+	k, err := util.NewKey()
+	if err != nil {
+		return "", err
+	}
+	return string(k[:16]), nil
+}
 
 // IsAdmin returns nil if there exists an Admin for the given util.Key.
-func IsAdmin(d db.DB, key util.Key) error {
-	if _, err := Get(d, key); err != nil {
+func (s *Service) IsAdmin(key util.Key) error {
+	if _, err := s.Get(key); err != nil {
 		return err
 	}
 
@@ -36,23 +72,54 @@ func IsAdmin(d db.DB, key util.Key) error {
 }
 
 // IsAdminEmail returns nil if there exists an Admin for the given email.
-func IsAdminEmail(d db.DB, email string) error {
-	if _, err := GetByEmail(d, email); err != nil {
+func (s *Service) IsAdminEmail(email string) error {
+	if _, err := s.GetByEmail(email); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-// Get retrieves an *Admin from the database for a given key.
-func Get(d db.DB, key util.Key) (*Admin, error) {
-	adminJSON, err := db.GetByKey(d, Admins, []byte(key))
+// Get retrieves the *Admin which has the given key, and notes that the key
+// was used.  The key may also be that of a Session, which is extended.
+// Disabled Admins are not got.
+func (s *Service) Get(key util.Key) (*Admin, error) {
+	k, err := s.getKey(key)
+	if errors.IsUserNotFound(err) {
+		id, err := s.session(key)
+		if err != nil {
+			return nil, err
+		}
+		adm, err := s.GetByID(id)
+		if err != nil {
+			return nil, err
+		}
+		return adm, adm.enabled()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	adm, err := s.GetByID(k.Admin)
+	if err != nil {
+		return nil, err
+	}
+	if err := adm.enabled(); err != nil {
+		return nil, err
+	}
+
+	return adm, s.touchKey(key, k)
+}
+
+// GetByID retrieves the *Admin with the given ID.
+func (s *Service) GetByID(id string) (*Admin, error) {
+	adminJSON, err := db.GetByKey(s.DB, Admins, []byte(id))
 
 	switch {
 	case err != nil:
 		return nil, err
 	case len(adminJSON) == 0:
-		return nil, errors.UserNotFoundf("admin for key %s:", key)
+		return nil, errors.UserNotFoundf("admin %s:", id)
 	}
 
 	admin := new(Admin)
@@ -61,84 +128,133 @@ func Get(d db.DB, key util.Key) (*Admin, error) {
 }
 
 // GetByEmail retrieves an *Admin from the database for a given email.
-func GetByEmail(d db.DB, email string) (*Admin, error) {
-	adminJSON, err := db.GetByKey(d, Emails, []byte(email))
+func (s *Service) GetByEmail(email string) (*Admin, error) {
+	id, err := db.GetByKey(s.DB, Emails, []byte(email))
 
 	switch {
 	case err != nil:
 		return nil, err
-	case len(adminJSON) == 0:
+	case len(id) == 0:
 		return nil, errors.UserNotFoundf("admin for email %s:", email)
 	}
 
-	admin := new(Admin)
-	err = json.Unmarshal(adminJSON, admin)
-	return admin, err
+	return s.GetByID(string(id))
+}
+
+// Create makes a new Admin account with a given email and pwhash, and
+// returns its first Key, which is named "default".  Setup is closed once
+// it exists.
+func (s *Service) Create(email, pwhash string) (util.Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.create(email, pwhash)
 }
 
-// Create makes a new Admin account with a given email and pwhash.
-func Create(d db.DB, email, pwhash string) (util.Key, error) {
+// create makes a new Admin and closes setup.  s.mu must be held.
+func (s *Service) create(email, pwhash string) (util.Key, error) {
 	var none util.Key
-	adminJSON, err := db.GetByKey(d, Emails, []byte(email))
 
-	switch {
-	case err != nil:
+	id, err := newID()
+	if err != nil {
 		return none, err
-	case len(adminJSON) != 0:
-		return none, errors.AlreadyExistsf("admin for email %s:", email)
 	}
 
-	hash, salt := util.HashedAndSalt(pwhash, time.Now().String())
-	seed := time.Now().String()
-	key := util.SaltedHash(string(hash), seed)
-
+	now := s.Clock.Now()
+	hash, salt := util.HashedAndSalt(pwhash, now.String())
 	adm := &Admin{
-		Email: email,
-		Salt:  salt,
-		Hash:  hash,
-		Key:   key,
+		ID:      id,
+		Email:   email,
+		Salt:    salt,
+		Hash:    hash,
+		Created: &now,
 	}
 
-	if err := db.StoreKeyValue(d, Admins, []byte(key), adm); err != nil {
+	key, k, err := newKey(id, "default", now)
+	if err != nil {
 		return none, err
 	}
 
-	return key, db.StoreKeyValue(d, Emails, []byte(email), adm)
-}
+	err = s.DB.Update(func(tx *bolt.Tx) error {
+		es := tx.Bucket([]byte(Emails))
+		if es == nil {
+			return db.BucketNotFoundErr(Emails)
+		}
+		if len(es.Get([]byte(email))) != 0 {
+			return errors.AlreadyExistsf("admin for email %s:", email)
+		}
 
-// Delete deletes the admin which has the given key.
-func Delete(d db.DB, key util.Key) error {
-	adminJSON, err := db.GetByKey(d, Admins, []byte(key))
-
-	switch {
-	case err != nil:
-		return err
-	case len(adminJSON) == 0:
-		return errors.UserNotFoundf("admin for key %s:", key)
+		if err := putJSON(tx, Admins, []byte(id), adm); err != nil {
+			return err
+		}
+		if err := putJSON(tx, Keys, []byte(util.HashKey(key)), k); err != nil {
+			return err
+		}
+		return es.Put([]byte(email), []byte(id))
+	})
+	if err != nil {
+		return none, err
 	}
+	s.setup = ""
 
-	adm := new(Admin)
-	if err := json.Unmarshal(adminJSON, adm); err != nil {
-		return err
-	}
+	return key, runHooks(s.Hooks.Created, email)
+}
 
-	if err := db.DeleteByKey(d, Admins, []byte(key)); err != nil {
+// Delete deletes the admin which has the given key, and their Keys,
+// Sessions and Impersonations.
+func (s *Service) Delete(key util.Key) error {
+	adm, err := s.Get(key)
+	if err != nil {
 		return err
 	}
 
-	return db.DeleteByKey(d, Emails, []byte(adm.Email))
+	return s.delete(adm)
 }
 
 // DeleteByEmail deletes the admin which has the given email.
-func DeleteByEmail(d db.DB, email string) error {
-	adm, err := GetByEmail(d, email)
+func (s *Service) DeleteByEmail(email string) error {
+	adm, err := s.GetByEmail(email)
 	if err != nil {
 		return err
 	}
 
-	if err := db.DeleteByKey(d, Admins, []byte(adm.Key)); err != nil {
+	return s.delete(adm)
+}
+
+// delete deletes the Admin and its Keys, Sessions and Impersonations.
+func (s *Service) delete(adm *Admin) error {
+	err := s.DB.Update(func(tx *bolt.Tx) error {
+		if err := deleteKeys(tx, func(k *Key) bool { return k.Admin == adm.ID }); err != nil {
+			return err
+		}
+		if err := deleteSessions(tx, func(sn *Session) bool { return sn.Admin == adm.ID }); err != nil {
+			return err
+		}
+		if err := deleteImpersonations(tx, func(imp *Impersonation) bool { return imp.Admin == adm.ID }); err != nil {
+			return err
+		}
+		if err := tx.Bucket([]byte(Admins)).Delete([]byte(adm.ID)); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(Emails)).Delete([]byte(adm.Email))
+	})
+	if err != nil {
 		return err
 	}
 
-	return db.DeleteByKey(d, Emails, []byte(email))
+	return runHooks(s.Hooks.Deleted, adm.Email)
+}
+
+// putJSON marshals v as JSON and puts it in the bucket of tx at k.
+func putJSON(tx *bolt.Tx, bucket db.Bucket, k []byte, v interface{}) error {
+	b := tx.Bucket([]byte(bucket))
+	if b == nil {
+		return db.BucketNotFoundErr(bucket)
+	}
+
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put(k, bs)
 }
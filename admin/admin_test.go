@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/synapse-garden/mf-proto/admin"
 	"github.com/synapse-garden/mf-proto/db"
@@ -18,6 +19,8 @@ func Test(t *testing.T) { gc.TestingT(t) }
 
 type AdminSuite struct {
 	d      *t.DB
+	clock  *t.Clock
+	svc    *admin.Service
 	admins map[string]t.TestAdmin
 }
 
@@ -30,6 +33,8 @@ func (s *AdminSuite) SetUpTest(c *gc.C) {
 	)
 	c.Assert(err, jc.ErrorIsNil)
 	s.d = d
+	s.clock = t.NewClock(time.Date(2016, 1, 14, 0, 0, 0, 0, time.UTC))
+	s.svc = admin.NewService(s.d, admin.WithClock(s.clock))
 
 	s.admins = map[string]t.TestAdmin{
 		"bob": {
@@ -45,7 +50,7 @@ func (s *AdminSuite) SetUpTest(c *gc.C) {
 
 func (s *AdminSuite) createAdmins(c *gc.C) {
 	for name, u := range s.admins {
-		key, err := admin.Create(s.d, u.Email, u.Pwhash)
+		key, err := s.svc.Create(u.Email, u.Pwhash)
 		c.Assert(err, jc.ErrorIsNil)
 		u.Key = key
 		s.admins[name] = u
@@ -54,7 +59,7 @@ func (s *AdminSuite) createAdmins(c *gc.C) {
 
 func (s *AdminSuite) deleteAdmins(c *gc.C) {
 	for _, u := range s.admins {
-		err := admin.Delete(s.d, u.Key)
+		err := s.svc.Delete(u.Key)
 		c.Assert(err, jc.ErrorIsNil)
 	}
 }
@@ -95,15 +100,20 @@ func (s *AdminSuite) TestCreate(c *gc.C) {
 }
 
 func (s *AdminSuite) createTests(adm t.TestAdmin, c *gc.C) error {
-	key, err := admin.Create(s.d, adm.Email, adm.Pwhash)
+	key, err := s.svc.Create(adm.Email, adm.Pwhash)
 	if err != nil {
 		return err
 	}
 
-	err = admin.IsAdmin(s.d, util.Key(key))
+	err = s.svc.IsAdmin(util.Key(key))
 	c.Assert(err, jc.ErrorIsNil)
 
-	adminBytes, err := db.GetByKey(s.d, admin.Admins, []byte(key))
+	id, err := db.GetByKey(s.d, admin.Emails, []byte(adm.Email))
+	if err != nil {
+		return err
+	}
+
+	adminBytes, err := db.GetByKey(s.d, admin.Admins, id)
 	if err != nil {
 		return err
 	}
@@ -114,7 +124,9 @@ func (s *AdminSuite) createTests(adm t.TestAdmin, c *gc.C) error {
 		return err
 	}
 
+	c.Check(tmpAdmin.ID, gc.Equals, string(id))
 	c.Check(tmpAdmin.Email, gc.Equals, adm.Email)
+	c.Check(tmpAdmin.Key, gc.Equals, util.Key(""))
 	return nil
 }
 
@@ -145,12 +157,14 @@ func (s *AdminSuite) TestGetByEmail(c *gc.C) {
 }
 
 func (s *AdminSuite) getByEmailTests(adm t.TestAdmin, c *gc.C) error {
-	tmpAdmin, err := admin.GetByEmail(s.d, adm.Email)
+	tmpAdmin, err := s.svc.GetByEmail(adm.Email)
 	if err != nil {
 		return err
 	}
 
-	c.Check(tmpAdmin.Key, gc.Equals, adm.Key)
+	byKey, err := s.svc.Get(adm.Key)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(tmpAdmin.ID, gc.Equals, byKey.ID)
 	return nil
 }
 
@@ -173,9 +187,9 @@ func (s *AdminSuite) TestIsAdmin(c *gc.C) {
 		c.Logf("test %d: should %s", i, t.should)
 
 		if t.expectError == "" {
-			c.Check(admin.IsAdmin(s.d, t.admin.Key), jc.ErrorIsNil)
+			c.Check(s.svc.IsAdmin(t.admin.Key), jc.ErrorIsNil)
 		} else {
-			c.Check(admin.IsAdmin(s.d, t.admin.Key), gc.ErrorMatches, t.expectError)
+			c.Check(s.svc.IsAdmin(t.admin.Key), gc.ErrorMatches, t.expectError)
 		}
 	}
 }
@@ -199,9 +213,9 @@ func (s *AdminSuite) TestIsAdminEmail(c *gc.C) {
 		c.Logf("test %d: should %s", i, t.should)
 
 		if t.expectError == "" {
-			c.Check(admin.IsAdminEmail(s.d, t.admin.Email), jc.ErrorIsNil)
+			c.Check(s.svc.IsAdminEmail(t.admin.Email), jc.ErrorIsNil)
 		} else {
-			c.Check(admin.IsAdminEmail(s.d, t.admin.Email), gc.ErrorMatches, t.expectError)
+			c.Check(s.svc.IsAdminEmail(t.admin.Email), gc.ErrorMatches, t.expectError)
 		}
 	}
 }
@@ -232,12 +246,12 @@ func (s *AdminSuite) TestDelete(c *gc.C) {
 }
 
 func (s *AdminSuite) deleteTests(adm t.TestAdmin, c *gc.C) error {
-	if err := admin.Delete(s.d, adm.Key); err != nil {
+	if err := s.svc.Delete(adm.Key); err != nil {
 		c.Logf("failed to delete admin %q", adm.Email)
 		return err
 	}
 
-	err := admin.IsAdmin(s.d, adm.Key)
+	err := s.svc.IsAdmin(adm.Key)
 	c.Assert(err, gc.ErrorMatches, fmt.Sprintf("admin for key %s: user not found", adm.Key))
 	return nil
 }
@@ -268,12 +282,95 @@ func (s *AdminSuite) TestDeleteByEmail(c *gc.C) {
 }
 
 func (s *AdminSuite) deleteByEmailTests(adm t.TestAdmin, c *gc.C) error {
-	if err := admin.DeleteByEmail(s.d, adm.Email); err != nil {
+	if err := s.svc.DeleteByEmail(adm.Email); err != nil {
 		c.Logf("failed to delete admin %q", adm.Email)
 		return err
 	}
 
-	err := admin.IsAdminEmail(s.d, adm.Email)
+	err := s.svc.IsAdminEmail(adm.Email)
 	c.Assert(err, gc.ErrorMatches, fmt.Sprintf("admin for email %s: user not found", adm.Email))
 	return nil
 }
+
+func (s *AdminSuite) TestSetup(c *gc.C) {
+	bob, larry := s.admins["bob"], s.admins["larry"]
+
+	// Setup is closed until it is opened.
+	c.Check(s.svc.SetupOpen(), jc.IsFalse)
+	_, err := s.svc.CreateFirst("", bob.Email, bob.Pwhash)
+	c.Check(err, gc.ErrorMatches, `setup is closed`)
+
+	_, err = s.svc.OpenSetup("too-short")
+	c.Check(err, gc.ErrorMatches, `setup token shorter than 20 characters not valid`)
+
+	token, err := s.svc.OpenSetup("")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(token, gc.Not(gc.Equals), util.Key(""))
+	c.Check(s.svc.SetupOpen(), jc.IsTrue)
+
+	// A given token replaces it.
+	given := util.Key("a-setup-token-from-the-environment")
+	token, err = s.svc.OpenSetup(given)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(token, gc.Equals, given)
+
+	for i, t := range []struct {
+		should      string
+		token       util.Key
+		email       string
+		pwhash      string
+		expectError string
+	}{{
+		should:      "refuse the wrong token",
+		token:       "not-the-setup-token-at-all",
+		email:       bob.Email,
+		pwhash:      bob.Pwhash,
+		expectError: `bad setup token`,
+	}, {
+		should:      "refuse an admin without a password",
+		token:       given,
+		email:       bob.Email,
+		expectError: `admin without email or password not valid`,
+	}, {
+		should: "create the first admin",
+		token:  given,
+		email:  bob.Email,
+		pwhash: bob.Pwhash,
+	}, {
+		should:      "not create another",
+		token:       given,
+		email:       larry.Email,
+		pwhash:      larry.Pwhash,
+		expectError: `setup is closed`,
+	}} {
+		c.Logf("test %d: should %s", i, t.should)
+
+		key, err := s.svc.CreateFirst(t.token, t.email, t.pwhash)
+		if t.expectError != "" {
+			c.Check(err, gc.ErrorMatches, t.expectError)
+			continue
+		}
+		c.Assert(err, jc.ErrorIsNil)
+		c.Check(s.svc.IsAdmin(key), jc.ErrorIsNil)
+	}
+
+	c.Check(s.svc.SetupOpen(), jc.IsFalse)
+	_, err = s.svc.OpenSetup("")
+	c.Check(err, gc.ErrorMatches, `an admin already exists`)
+}
+
+func (s *AdminSuite) TestSetupClosedByCreate(c *gc.C) {
+	token, err := s.svc.OpenSetup("")
+	c.Assert(err, jc.ErrorIsNil)
+
+	// An admin made any other way closes setup.
+	s.createAdmins(c)
+	c.Check(s.svc.SetupOpen(), jc.IsFalse)
+	_, err = s.svc.CreateFirst(token, "carol@pepper.org", "99999")
+	c.Check(err, gc.ErrorMatches, `setup is closed`)
+
+	// Even once they are deleted.
+	s.deleteAdmins(c)
+	_, err = s.svc.CreateFirst(token, "carol@pepper.org", "99999")
+	c.Check(err, gc.ErrorMatches, `setup is closed`)
+}
@@ -0,0 +1,193 @@
+package admin
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/juju/errors"
+	"github.com/synapse-garden/mf-proto/db"
+	"github.com/synapse-garden/mf-proto/util"
+)
+
+const (
+	// Impersonations holds Impersonations by the hash of their key.
+	Impersonations db.Bucket = "admin-impersonations"
+
+	// ImpersonationPrefix begins every Impersonation's key.
+	ImpersonationPrefix = "mfi_"
+
+	// DefaultImpersonation is how long an Impersonation lasts unless
+	// asked otherwise.
+	DefaultImpersonation = 15 * time.Minute
+
+	// MaxImpersonation is the longest an Impersonation may last.
+	MaxImpersonation = time.Hour
+)
+
+// Impersonation lets an Admin act as a user until it Expires, using its
+// key in place of the user's.  Its key is only kept hashed.
+type Impersonation struct {
+	ID string `json:"id"`
+
+	// Admin is the ID of the Admin impersonating, and User the ID of the
+	// user impersonated.
+	Admin string `json:"admin"`
+	User  string `json:"user"`
+
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+
+	// Key is only set when the Impersonation is made.
+	Key util.Key `json:"key,omitempty"`
+}
+
+// Impersonate starts an Impersonation of the user with the given ID and
+// email by the admin with the given email, lasting for ttl, which may be
+// at most MaxImpersonation.  Admins may not impersonate a user whose email
+// is an admin's.
+func (s *Service) Impersonate(adminEmail, userID, userEmail string, ttl time.Duration) (*Impersonation, error) {
+	switch {
+	case ttl <= 0 || ttl > MaxImpersonation:
+		return nil, errors.NotValidf("impersonation for %s", ttl)
+	case userID == "":
+		return nil, errors.NotValidf("impersonation of nobody")
+	}
+
+	adm, err := s.GetByEmail(adminEmail)
+	if err != nil {
+		return nil, err
+	}
+	if err := adm.enabled(); err != nil {
+		return nil, err
+	}
+
+	switch err := s.IsAdminEmail(userEmail); {
+	case err == nil:
+		return nil, util.Forbiddenf("%s may not impersonate admin %s", adminEmail, userEmail)
+	case !errors.IsUserNotFound(err):
+		return nil, err
+	}
+
+	secret, err := util.NewKey()
+	if err != nil {
+		return nil, err
+	}
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.Clock.Now()
+	imp := &Impersonation{
+		ID:      id,
+		Admin:   adm.ID,
+		User:    userID,
+		Created: now,
+		Expires: now.Add(ttl),
+	}
+
+	key := ImpersonationPrefix + secret
+	err = s.DB.Update(func(tx *bolt.Tx) error {
+		if err := deleteImpersonations(tx, func(imp *Impersonation) bool {
+			return !now.Before(imp.Expires)
+		}); err != nil {
+			return err
+		}
+		return putJSON(tx, Impersonations, []byte(util.HashKey(key)), imp)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	imp.Key = key
+	return imp, nil
+}
+
+// Impersonating returns the unexpired Impersonation with the given key, and
+// its Admin, who must still exist.
+func (s *Service) Impersonating(key util.Key) (*Impersonation, *Admin, error) {
+	bs, err := db.GetByKey(s.DB, Impersonations, []byte(util.HashKey(key)))
+	switch {
+	case err != nil:
+		return nil, nil, err
+	case len(key) == 0 || len(bs) == 0:
+		return nil, nil, errors.NotValidf("impersonation key")
+	}
+
+	imp := new(Impersonation)
+	if err := json.Unmarshal(bs, imp); err != nil {
+		return nil, nil, err
+	}
+
+	if !s.Clock.Now().Before(imp.Expires) {
+		return nil, nil, errors.Unauthorizedf("impersonation %s expired", imp.ID)
+	}
+
+	adm, err := s.GetByID(imp.Admin)
+	if err != nil {
+		return nil, nil, errors.NotValidf("impersonation key")
+	}
+	if err := adm.enabled(); err != nil {
+		return nil, nil, err
+	}
+
+	return imp, adm, nil
+}
+
+// EndImpersonation ends the Impersonation with the given ID by the admin
+// with the given email.
+func (s *Service) EndImpersonation(adminEmail, id string) error {
+	adm, err := s.GetByEmail(adminEmail)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	err = s.DB.Update(func(tx *bolt.Tx) error {
+		return deleteImpersonations(tx, func(imp *Impersonation) bool {
+			match := imp.Admin == adm.ID && imp.ID == id
+			found = found || match
+			return match
+		})
+	})
+	switch {
+	case err != nil:
+		return err
+	case !found:
+		return errors.NotFoundf("impersonation %q", id)
+	}
+	return nil
+}
+
+// deleteImpersonations deletes the Impersonations which match.
+func deleteImpersonations(tx *bolt.Tx, match func(*Impersonation) bool) error {
+	b := tx.Bucket([]byte(Impersonations))
+	if b == nil {
+		return db.BucketNotFoundErr(Impersonations)
+	}
+
+	// Buckets can't be changed during ForEach, so find the Impersonations
+	// first.
+	var del [][]byte
+	err := b.ForEach(func(h, v []byte) error {
+		imp := new(Impersonation)
+		if err := json.Unmarshal(v, imp); err != nil {
+			return err
+		}
+		if match(imp) {
+			del = append(del, append([]byte(nil), h...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, h := range del {
+		if err := b.Delete(h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
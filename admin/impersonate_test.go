@@ -0,0 +1,103 @@
+package admin_test
+
+import (
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	"github.com/synapse-garden/mf-proto/admin"
+	"github.com/synapse-garden/mf-proto/util"
+
+	gc "gopkg.in/check.v1"
+)
+
+func (s *AdminSuite) TestImpersonate(c *gc.C) {
+	s.createAdmins(c)
+	bob := s.admins["bob"]
+
+	for i, t := range []struct {
+		should      string
+		admin       string
+		userEmail   string
+		ttl         time.Duration
+		expectError string
+	}{{
+		should:    "impersonate a user",
+		admin:     bob.Email,
+		userEmail: "jove@olympus.mons",
+		ttl:       admin.DefaultImpersonation,
+	}, {
+		should:      "not impersonate an admin",
+		admin:       bob.Email,
+		userEmail:   s.admins["larry"].Email,
+		ttl:         admin.DefaultImpersonation,
+		expectError: `bob@tomato.com may not impersonate admin larry@cucumber.net`,
+	}, {
+		should:      "not impersonate for too long",
+		admin:       bob.Email,
+		userEmail:   "jove@olympus.mons",
+		ttl:         admin.MaxImpersonation + time.Second,
+		expectError: `impersonation for 1h0m1s not valid`,
+	}, {
+		should:      "not impersonate for no time",
+		admin:       bob.Email,
+		userEmail:   "jove@olympus.mons",
+		expectError: `impersonation for 0s not valid`,
+	}, {
+		should:      "not impersonate for someone who isn't an admin",
+		admin:       "jove@olympus.mons",
+		userEmail:   "juno@olympus.mons",
+		ttl:         time.Minute,
+		expectError: `admin for email jove@olympus.mons: user not found`,
+	}} {
+		c.Logf("test %d: should %s", i, t.should)
+		imp, err := s.svc.Impersonate(t.admin, "j0ve", t.userEmail, t.ttl)
+		if t.expectError != "" {
+			c.Check(err, gc.ErrorMatches, t.expectError)
+			continue
+		}
+		c.Assert(err, jc.ErrorIsNil)
+		c.Check(strings.HasPrefix(string(imp.Key), admin.ImpersonationPrefix), jc.IsTrue)
+		c.Check(imp.Expires, gc.Equals, s.clock.Now().Add(t.ttl))
+
+		got, adm, err := s.svc.Impersonating(imp.Key)
+		c.Assert(err, jc.ErrorIsNil)
+		c.Check(got.User, gc.Equals, "j0ve")
+		c.Check(got.Key, gc.Equals, util.Key(""))
+		c.Check(adm.Email, gc.Equals, t.admin)
+
+		// An Impersonation is not an admin key.
+		c.Check(s.svc.IsAdmin(imp.Key), jc.Satisfies, errors.IsUserNotFound)
+	}
+}
+
+func (s *AdminSuite) TestImpersonationEnds(c *gc.C) {
+	s.createAdmins(c)
+	bob, larry := s.admins["bob"], s.admins["larry"]
+
+	imp, err := s.svc.Impersonate(bob.Email, "j0ve", "jove@olympus.mons", time.Minute)
+	c.Assert(err, jc.ErrorIsNil)
+
+	// Impersonations expire.
+	s.clock.Advance(time.Minute)
+	_, _, err = s.svc.Impersonating(imp.Key)
+	c.Check(err, gc.ErrorMatches, `impersonation .* expired`)
+	_, _, err = s.svc.Impersonating("mfi_nonsense")
+	c.Check(err, gc.ErrorMatches, `impersonation key not valid`)
+
+	// Only the admin impersonating may end it.
+	imp, err = s.svc.Impersonate(bob.Email, "j0ve", "jove@olympus.mons", time.Minute)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(s.svc.EndImpersonation(larry.Email, imp.ID), jc.Satisfies, errors.IsNotFound)
+	c.Assert(s.svc.EndImpersonation(bob.Email, imp.ID), jc.ErrorIsNil)
+	_, _, err = s.svc.Impersonating(imp.Key)
+	c.Check(err, gc.ErrorMatches, `impersonation key not valid`)
+
+	// Deleting an admin ends their Impersonations.
+	imp, err = s.svc.Impersonate(bob.Email, "j0ve", "jove@olympus.mons", time.Minute)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(s.svc.DeleteByEmail(bob.Email), jc.ErrorIsNil)
+	_, _, err = s.svc.Impersonating(imp.Key)
+	c.Check(err, gc.ErrorMatches, `impersonation key not valid`)
+}
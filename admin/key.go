@@ -0,0 +1,245 @@
+package admin
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/boltdb/bolt"
+	"github.com/juju/errors"
+	"github.com/synapse-garden/mf-proto/db"
+	"github.com/synapse-garden/mf-proto/util"
+)
+
+const (
+	// Keys holds admins' Keys by the hash of their secret.
+	Keys db.Bucket = "admin-keys"
+
+	// KeyPrefix begins every admin key, to tell them apart from users'.
+	// Keys made before admins had several have none.
+	KeyPrefix = "mfa_"
+
+	// MaxKeyName is the longest a Key's name may be.
+	MaxKeyName = 64
+
+	// KeyTouch is how often a Key's LastUsed time is updated.
+	KeyTouch = time.Minute
+)
+
+// Key describes one of an Admin's keys.  Its secret is only kept hashed.
+type Key struct {
+	// ID identifies the Key to its Admin, who may revoke or rotate it.
+	ID string `json:"id"`
+
+	// Admin is the ID of the Admin the Key is for.
+	Admin string `json:"admin"`
+
+	Name     string     `json:"name"`
+	Created  time.Time  `json:"created"`
+	LastUsed *time.Time `json:"last_used,omitempty"`
+}
+
+// newKey makes a Key with a new secret for the Admin with the given ID.
+func newKey(admin, name string, now time.Time) (util.Key, *Key, error) {
+	name = strings.TrimSpace(name)
+	switch {
+	case name == "":
+		return "", nil, errors.NotValidf("empty key name")
+	case utf8.RuneCountInString(name) > MaxKeyName:
+		return "", nil, errors.NotValidf("key name longer than %d characters", MaxKeyName)
+	}
+
+	secret, err := util.NewKey()
+	if err != nil {
+		return "", nil, err
+	}
+
+	id, err := newID()
+	if err != nil {
+		return "", nil, err
+	}
+
+	return KeyPrefix + secret, &Key{
+		ID:      id,
+		Admin:   admin,
+		Name:    name,
+		Created: now,
+	}, nil
+}
+
+// getKey returns the Key for the given secret.
+func (s *Service) getKey(key util.Key) (*Key, error) {
+	bs, err := db.GetByKey(s.DB, Keys, []byte(util.HashKey(key)))
+
+	switch {
+	case err != nil:
+		return nil, err
+	case len(key) == 0 || len(bs) == 0:
+		return nil, errors.UserNotFoundf("admin for key %s:", key)
+	}
+
+	k := new(Key)
+	err = json.Unmarshal(bs, k)
+	return k, err
+}
+
+// KeyOf returns the Key for the given secret, such as one just returned by
+// Create, so that it can be named by its ID rather than its secret.
+func (s *Service) KeyOf(key util.Key) (*Key, error) {
+	return s.getKey(key)
+}
+
+// touchKey notes that the Key was used, at most once per KeyTouch.
+func (s *Service) touchKey(key util.Key, k *Key) error {
+	now := s.Clock.Now()
+	if k.LastUsed != nil && now.Before(k.LastUsed.Add(KeyTouch)) {
+		return nil
+	}
+
+	k.LastUsed = &now
+	return db.StoreKeyValue(s.DB, Keys, []byte(util.HashKey(key)), k)
+}
+
+// AddKey makes a new named Key for the admin with the given email.  It
+// returns the Key's secret, which is not kept.
+func (s *Service) AddKey(email, name string) (util.Key, *Key, error) {
+	adm, err := s.GetByEmail(email)
+	if err != nil {
+		return "", nil, err
+	}
+
+	key, k, err := newKey(adm.ID, name, s.Clock.Now())
+	if err != nil {
+		return "", nil, err
+	}
+
+	if err := db.StoreKeyValue(s.DB, Keys, []byte(util.HashKey(key)), k); err != nil {
+		return "", nil, err
+	}
+	return key, k, nil
+}
+
+// KeysOf returns the Keys of the admin with the given email, oldest first.
+func (s *Service) KeysOf(email string) ([]Key, error) {
+	adm, err := s.GetByEmail(email)
+	if err != nil {
+		return nil, err
+	}
+
+	var ks []Key
+	err = s.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(Keys))
+		if b == nil {
+			return db.BucketNotFoundErr(Keys)
+		}
+
+		return b.ForEach(func(_, v []byte) error {
+			var k Key
+			if err := json.Unmarshal(v, &k); err != nil {
+				return err
+			}
+			if k.Admin == adm.ID {
+				ks = append(ks, k)
+			}
+			return nil
+		})
+	})
+
+	sort.Slice(ks, func(i, j int) bool { return ks[i].Created.Before(ks[j].Created) })
+	return ks, err
+}
+
+// RevokeKey revokes the Key with the given ID of the admin with the given
+// email.
+func (s *Service) RevokeKey(email, id string) error {
+	adm, err := s.GetByEmail(email)
+	if err != nil {
+		return err
+	}
+
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		_, err := takeKey(tx, adm.ID, id)
+		return err
+	})
+}
+
+// RotateKey replaces the Key with the given ID of the admin with the given
+// email by a new Key with the same name, and returns the new Key's secret.
+func (s *Service) RotateKey(email, id string) (util.Key, *Key, error) {
+	adm, err := s.GetByEmail(email)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var (
+		key util.Key
+		k   *Key
+	)
+	err = s.DB.Update(func(tx *bolt.Tx) error {
+		old, err := takeKey(tx, adm.ID, id)
+		if err != nil {
+			return err
+		}
+
+		if key, k, err = newKey(adm.ID, old.Name, s.Clock.Now()); err != nil {
+			return err
+		}
+		return putJSON(tx, Keys, []byte(util.HashKey(key)), k)
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return key, k, nil
+}
+
+// takeKey deletes and returns the Admin's Key with the given ID.
+func takeKey(tx *bolt.Tx, admin, id string) (*Key, error) {
+	var found *Key
+	err := deleteKeys(tx, func(k *Key) bool {
+		if k.Admin == admin && k.ID == id {
+			found = k
+			return true
+		}
+		return false
+	})
+	switch {
+	case err != nil:
+		return nil, err
+	case found == nil:
+		return nil, errors.NotFoundf("key %q", id)
+	}
+	return found, nil
+}
+
+// deleteKeys deletes the Keys which match.
+func deleteKeys(tx *bolt.Tx, match func(*Key) bool) error {
+	b := tx.Bucket([]byte(Keys))
+	if b == nil {
+		return db.BucketNotFoundErr(Keys)
+	}
+
+	// Buckets can't be changed during ForEach, so find the Keys first.
+	var del [][]byte
+	err := b.ForEach(func(h, v []byte) error {
+		k := new(Key)
+		if err := json.Unmarshal(v, k); err != nil {
+			return err
+		}
+		if match(k) {
+			del = append(del, append([]byte(nil), h...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, h := range del {
+		if err := b.Delete(h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
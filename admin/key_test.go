@@ -0,0 +1,114 @@
+package admin_test
+
+import (
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	"github.com/synapse-garden/mf-proto/admin"
+	"github.com/synapse-garden/mf-proto/db"
+	"github.com/synapse-garden/mf-proto/util"
+
+	gc "gopkg.in/check.v1"
+)
+
+func (s *AdminSuite) TestKeys(c *gc.C) {
+	s.createAdmins(c)
+	bob, larry := s.admins["bob"], s.admins["larry"]
+	c.Check(strings.HasPrefix(string(bob.Key), admin.KeyPrefix), jc.IsTrue)
+
+	ks, err := s.svc.KeysOf(bob.Email)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(ks, gc.HasLen, 1)
+	c.Check(ks[0].Name, gc.Equals, "default")
+	c.Check(ks[0].LastUsed, gc.IsNil)
+
+	// Using a key notes when.
+	used, err := s.svc.Get(bob.Key)
+	c.Assert(err, jc.ErrorIsNil)
+	ks, err = s.svc.KeysOf(bob.Email)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(ks[0].LastUsed, gc.NotNil)
+	c.Check(ks[0].LastUsed.Equal(s.clock.Now()), jc.IsTrue)
+
+	_, _, err = s.svc.AddKey(bob.Email, " ")
+	c.Check(err, gc.ErrorMatches, `empty key name not valid`)
+
+	s.clock.Advance(time.Minute)
+	laptop, k, err := s.svc.AddKey(bob.Email, "laptop")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(k.Name, gc.Equals, "laptop")
+
+	got, err := s.svc.KeyOf(laptop)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(got, jc.DeepEquals, k)
+	_, err = s.svc.KeyOf("mfa_nope")
+	c.Check(err, gc.ErrorMatches, `admin for key .*: user not found`)
+
+	adm, err := s.svc.Get(laptop)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(adm.ID, gc.Equals, used.ID)
+
+	ks, err = s.svc.KeysOf(bob.Email)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(ks, gc.HasLen, 2)
+	c.Check(ks[1].ID, gc.Equals, k.ID)
+
+	// Keys can only be revoked and rotated by their own admin.
+	c.Check(s.svc.RevokeKey(larry.Email, k.ID), jc.Satisfies, errors.IsNotFound)
+	_, _, err = s.svc.RotateKey(larry.Email, k.ID)
+	c.Check(err, jc.Satisfies, errors.IsNotFound)
+
+	rotated, r, err := s.svc.RotateKey(bob.Email, k.ID)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(r.Name, gc.Equals, "laptop")
+	c.Check(r.ID, gc.Not(gc.Equals), k.ID)
+	c.Check(s.svc.IsAdmin(laptop), gc.ErrorMatches, `admin for key .*: user not found`)
+	c.Check(s.svc.IsAdmin(rotated), jc.ErrorIsNil)
+	c.Check(s.svc.IsAdmin(bob.Key), jc.ErrorIsNil)
+
+	c.Assert(s.svc.RevokeKey(bob.Email, r.ID), jc.ErrorIsNil)
+	c.Check(s.svc.IsAdmin(rotated), gc.ErrorMatches, `admin for key .*: user not found`)
+	c.Check(s.svc.RevokeKey(bob.Email, r.ID), jc.Satisfies, errors.IsNotFound)
+
+	// Deleting an admin deletes their keys.
+	c.Assert(s.svc.DeleteByEmail(bob.Email), jc.ErrorIsNil)
+	c.Check(s.svc.IsAdmin(bob.Key), gc.ErrorMatches, `admin for key .*: user not found`)
+	c.Check(s.svc.IsAdmin(larry.Key), jc.ErrorIsNil)
+}
+
+func (s *AdminSuite) TestMigrate(c *gc.C) {
+	old := &admin.Admin{
+		Email: "bob@tomato.com",
+		Salt:  "salt",
+		Hash:  "hash",
+		Key:   "an-old-key",
+	}
+	c.Assert(db.StoreKeyValue(s.d, admin.Admins, []byte(old.Key), old), jc.ErrorIsNil)
+	c.Assert(db.StoreKeyValue(s.d, admin.Emails, []byte(old.Email), old), jc.ErrorIsNil)
+
+	n, err := s.svc.Migrate()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(n, gc.Equals, 1)
+
+	adm, err := s.svc.Get(util.Key("an-old-key"))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(adm.ID, gc.Not(gc.Equals), "")
+	c.Check(adm.Email, gc.Equals, old.Email)
+	c.Check(adm.Hash, gc.Equals, old.Hash)
+	c.Check(adm.Key, gc.Equals, util.Key(""))
+
+	byEmail, err := s.svc.GetByEmail(old.Email)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(byEmail.ID, gc.Equals, adm.ID)
+
+	ks, err := s.svc.KeysOf(old.Email)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(ks, gc.HasLen, 1)
+	c.Check(ks[0].Name, gc.Equals, "default")
+
+	n, err = s.svc.Migrate()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(n, gc.Equals, 0)
+}
@@ -0,0 +1,146 @@
+package admin
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/boltdb/bolt"
+	"github.com/juju/errors"
+	"github.com/synapse-garden/mf-proto/db"
+	"github.com/synapse-garden/mf-proto/util"
+)
+
+// All returns every Admin, in email order.
+func (s *Service) All() ([]*Admin, error) {
+	var as []*Admin
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(Admins))
+		if b == nil {
+			return db.BucketNotFoundErr(Admins)
+		}
+
+		return b.ForEach(func(_, v []byte) error {
+			adm := new(Admin)
+			if err := json.Unmarshal(v, adm); err != nil {
+				return err
+			}
+			as = append(as, adm)
+			return nil
+		})
+	})
+
+	sort.Slice(as, func(i, j int) bool { return as[i].Email < as[j].Email })
+	return as, err
+}
+
+// Disable stops the admin with the given email from using their Keys or
+// logging in until they are enabled again.  Their Sessions and
+// Impersonations are ended.  The last enabled Admin can't be disabled.
+func (s *Service) Disable(email string) error {
+	adm, err := s.GetByEmail(email)
+	if err != nil {
+		return err
+	}
+
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		enabled := 0
+		if err := tx.Bucket([]byte(Admins)).ForEach(func(_, v []byte) error {
+			other := new(Admin)
+			if err := json.Unmarshal(v, other); err != nil {
+				return err
+			}
+			if !other.Disabled && other.ID != adm.ID {
+				enabled++
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		if enabled == 0 {
+			return errors.NotValidf("disabling the last enabled admin")
+		}
+
+		if err := deleteSessions(tx, func(sn *Session) bool { return sn.Admin == adm.ID }); err != nil {
+			return err
+		}
+		if err := deleteImpersonations(tx, func(imp *Impersonation) bool { return imp.Admin == adm.ID }); err != nil {
+			return err
+		}
+
+		adm.Disabled = true
+		return putJSON(tx, Admins, []byte(adm.ID), adm)
+	})
+}
+
+// Enable lets a disabled admin use their Keys and log in again.
+func (s *Service) Enable(email string) error {
+	adm, err := s.GetByEmail(email)
+	if err != nil {
+		return err
+	}
+
+	adm.Disabled = false
+	return db.StoreKeyValue(s.DB, Admins, []byte(adm.ID), adm)
+}
+
+// ResetKeys revokes every Key of the admin with the given email and gives
+// them a new one named "default", whose secret it returns.
+func (s *Service) ResetKeys(email string) (util.Key, *Key, error) {
+	adm, err := s.GetByEmail(email)
+	if err != nil {
+		return "", nil, err
+	}
+
+	key, k, err := newKey(adm.ID, "default", s.Clock.Now())
+	if err != nil {
+		return "", nil, err
+	}
+
+	err = s.DB.Update(func(tx *bolt.Tx) error {
+		if err := deleteKeys(tx, func(k *Key) bool { return k.Admin == adm.ID }); err != nil {
+			return err
+		}
+		return putJSON(tx, Keys, []byte(util.HashKey(key)), k)
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return key, k, nil
+}
+
+// SessionsOf returns how many unexpired Sessions the admin with the given
+// email has, not counting Pending ones.
+func (s *Service) SessionsOf(email string) (int, error) {
+	adm, err := s.GetByEmail(email)
+	if err != nil {
+		return 0, err
+	}
+
+	n, now := 0, s.Clock.Now()
+	err = s.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(Sessions))
+		if b == nil {
+			return db.BucketNotFoundErr(Sessions)
+		}
+
+		return b.ForEach(func(_, v []byte) error {
+			sn := new(Session)
+			if err := json.Unmarshal(v, sn); err != nil {
+				return err
+			}
+			if sn.Admin == adm.ID && !sn.Pending && now.Before(sn.Timeout) {
+				n++
+			}
+			return nil
+		})
+	})
+	return n, err
+}
+
+// enabled returns an error if the Admin is disabled.
+func (adm *Admin) enabled() error {
+	if adm.Disabled {
+		return errors.Unauthorizedf("admin %s is disabled", adm.Email)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package admin_test
+
+import (
+	"time"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+
+	gc "gopkg.in/check.v1"
+)
+
+func (s *AdminSuite) TestAll(c *gc.C) {
+	as, err := s.svc.All()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(as, gc.HasLen, 0)
+
+	s.createAdmins(c)
+	as, err = s.svc.All()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(as, gc.HasLen, 2)
+	c.Check(as[0].Email, gc.Equals, "bob@tomato.com")
+	c.Check(as[1].Email, gc.Equals, "larry@cucumber.net")
+}
+
+func (s *AdminSuite) TestDisable(c *gc.C) {
+	s.createAdmins(c)
+	bob, larry := s.admins["bob"], s.admins["larry"]
+
+	l, err := s.svc.Login("", bob.Email, bob.Pwhash)
+	c.Assert(err, jc.ErrorIsNil)
+	imp, err := s.svc.Impersonate(bob.Email, "j0ve", "jove@olympus.mons", time.Minute)
+	c.Assert(err, jc.ErrorIsNil)
+
+	c.Assert(s.svc.Disable(bob.Email), jc.ErrorIsNil)
+
+	adm, err := s.svc.GetByEmail(bob.Email)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(adm.Disabled, jc.IsTrue)
+
+	// Disabled admins can't use their keys, sessions or impersonations.
+	c.Check(s.svc.IsAdmin(bob.Key), gc.ErrorMatches, `admin bob@tomato.com is disabled`)
+	c.Check(s.svc.IsAdmin(bob.Key), jc.Satisfies, errors.IsUnauthorized)
+	c.Check(s.svc.IsAdmin(l.Key), jc.Satisfies, errors.IsUserNotFound)
+	_, _, err = s.svc.Impersonating(imp.Key)
+	c.Check(err, gc.ErrorMatches, `impersonation key not valid`)
+	_, err = s.svc.Login("", bob.Email, bob.Pwhash)
+	c.Check(err, gc.ErrorMatches, `admin bob@tomato.com is disabled`)
+	_, err = s.svc.Login("", bob.Email, "wrong")
+	c.Check(err, gc.ErrorMatches, `invalid email or password`)
+
+	// The last enabled admin stays enabled.
+	c.Check(s.svc.Disable(larry.Email), gc.ErrorMatches, `disabling the last enabled admin not valid`)
+	c.Check(s.svc.IsAdmin(larry.Key), jc.ErrorIsNil)
+
+	// Enabled admins get their keys back.
+	c.Assert(s.svc.Enable(bob.Email), jc.ErrorIsNil)
+	c.Check(s.svc.IsAdmin(bob.Key), jc.ErrorIsNil)
+
+	c.Check(s.svc.Disable("nobody@tomato.com"), jc.Satisfies, errors.IsUserNotFound)
+}
+
+func (s *AdminSuite) TestResetKeys(c *gc.C) {
+	s.createAdmins(c)
+	bob, larry := s.admins["bob"], s.admins["larry"]
+
+	laptop, _, err := s.svc.AddKey(bob.Email, "laptop")
+	c.Assert(err, jc.ErrorIsNil)
+
+	key, k, err := s.svc.ResetKeys(bob.Email)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(k.Name, gc.Equals, "default")
+
+	c.Check(s.svc.IsAdmin(bob.Key), jc.Satisfies, errors.IsUserNotFound)
+	c.Check(s.svc.IsAdmin(laptop), jc.Satisfies, errors.IsUserNotFound)
+	c.Check(s.svc.IsAdmin(key), jc.ErrorIsNil)
+	c.Check(s.svc.IsAdmin(larry.Key), jc.ErrorIsNil)
+
+	ks, err := s.svc.KeysOf(bob.Email)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(ks, gc.HasLen, 1)
+}
+
+func (s *AdminSuite) TestSessionsOf(c *gc.C) {
+	s.createAdmins(c)
+	bob := s.admins["bob"]
+
+	n, err := s.svc.SessionsOf(bob.Email)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(n, gc.Equals, 0)
+
+	for i := 0; i < 2; i++ {
+		_, err := s.svc.Login("", bob.Email, bob.Pwhash)
+		c.Assert(err, jc.ErrorIsNil)
+	}
+	n, err = s.svc.SessionsOf(bob.Email)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(n, gc.Equals, 2)
+
+	s.clock.Advance(2 * s.svc.SessionTimeout)
+	n, err = s.svc.SessionsOf(bob.Email)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(n, gc.Equals, 0)
+}
@@ -0,0 +1,77 @@
+package admin
+
+import (
+	"encoding/json"
+
+	"github.com/boltdb/bolt"
+	"github.com/synapse-garden/mf-proto/db"
+	"github.com/synapse-garden/mf-proto/util"
+)
+
+// Migrate gives IDs to Admins kept by their key, before they had separate
+// Keys.  Each keeps its key as a Key named "default".  It returns how many
+// were migrated.
+func (s *Service) Migrate() (int, error) {
+	if err := db.SetupBuckets(s.DB, Buckets()); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	err := s.DB.Update(func(tx *bolt.Tx) error {
+		as := tx.Bucket([]byte(Admins))
+		es := tx.Bucket([]byte(Emails))
+
+		// Buckets can't be changed during ForEach, so find the old
+		// Admins first.
+		var old []*Admin
+		err := as.ForEach(func(k, v []byte) error {
+			adm := new(Admin)
+			if err := json.Unmarshal(v, adm); err != nil {
+				return err
+			}
+			if adm.ID == "" {
+				old = append(old, adm)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		now := s.Clock.Now()
+		for _, adm := range old {
+			id, err := newID()
+			if err != nil {
+				return err
+			}
+			key := adm.Key
+			adm.ID, adm.Key = id, ""
+
+			k, err := newID()
+			if err != nil {
+				return err
+			}
+
+			if err := as.Delete([]byte(key)); err != nil {
+				return err
+			}
+			if err := putJSON(tx, Admins, []byte(id), adm); err != nil {
+				return err
+			}
+			if err := putJSON(tx, Keys, []byte(util.HashKey(key)), &Key{
+				ID:      k,
+				Admin:   id,
+				Name:    "default",
+				Created: now,
+			}); err != nil {
+				return err
+			}
+			if err := es.Put([]byte(adm.Email), []byte(id)); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
@@ -0,0 +1,114 @@
+package admin
+
+import (
+	"sync"
+	"time"
+
+	"github.com/synapse-garden/mf-proto/db"
+	"github.com/synapse-garden/mf-proto/user"
+	"github.com/synapse-garden/mf-proto/util"
+)
+
+// Hook is called with an admin's email after some event has happened to the
+// admin.  If it returns an error, the error is returned to the caller.
+type Hook func(email string) error
+
+// Hooks are the Hooks a Service calls after each kind of event.
+type Hooks struct {
+	Created []Hook
+	Deleted []Hook
+}
+
+func runHooks(hs []Hook, email string) error {
+	for _, h := range hs {
+		if err := h(email); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Throttler throttles logins for an account from an address, as a
+// user.Service does.
+type Throttler interface {
+	// Check throttles a password, which the given func says is good or
+	// not.
+	Check(addr, account string, check func() (bool, error)) error
+
+	// CheckFactor throttles a second factor as Check does, counting its
+	// failures apart from failed passwords.
+	CheckFactor(addr, account string, check func() (bool, error)) error
+
+	// Succeed forgets the account's failures once its login is complete.
+	Succeed(account string) error
+}
+
+// Service performs admin operations against its own DB, using its own Clock.
+// Admins logging in by password get sessions which time out after going
+// unused for its SessionTimeout.
+type Service struct {
+	DB    db.DB
+	Clock util.Clock
+	Hooks Hooks
+
+	SessionTimeout time.Duration
+
+	// Issuer names the service in admins' authenticator apps.
+	Issuer string
+
+	// Throttler throttles logins.  Logins are not throttled if it is nil.
+	Throttler Throttler
+
+	// mu guards setup, the hash of the setup token while setup is open.
+	mu    sync.Mutex
+	setup util.Hash
+}
+
+// Option configures a Service.
+type Option func(*Service)
+
+// WithClock sets the Clock a Service uses.
+func WithClock(c util.Clock) Option {
+	return func(s *Service) { s.Clock = c }
+}
+
+// WithSessionTimeout sets how long a Service's sessions last unused.
+func WithSessionTimeout(t time.Duration) Option {
+	return func(s *Service) { s.SessionTimeout = t }
+}
+
+// WithIssuer sets the name admins' authenticator apps show for the Service.
+func WithIssuer(issuer string) Option {
+	return func(s *Service) { s.Issuer = issuer }
+}
+
+// WithThrottler sets the Throttler a Service throttles logins with.
+func WithThrottler(t Throttler) Option {
+	return func(s *Service) { s.Throttler = t }
+}
+
+// OnCreated adds Hooks to be called after an admin is created.
+func OnCreated(hs ...Hook) Option {
+	return func(s *Service) { s.Hooks.Created = append(s.Hooks.Created, hs...) }
+}
+
+// OnDeleted adds Hooks to be called after an admin is deleted.
+func OnDeleted(hs ...Hook) Option {
+	return func(s *Service) { s.Hooks.Deleted = append(s.Hooks.Deleted, hs...) }
+}
+
+// NewService makes a new Service for the given DB using the system clock,
+// the users' default login timeout for sessions, and "Mindfork" as its
+// Issuer, unless otherwise configured by the given Options.
+func NewService(d db.DB, opts ...Option) *Service {
+	s := &Service{
+		DB:             d,
+		Clock:          util.SystemClock{},
+		SessionTimeout: user.DefaultTimeout,
+		Issuer:         "Mindfork",
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
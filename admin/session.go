@@ -0,0 +1,266 @@
+package admin
+
+import (
+	"encoding/json"
+
+	"github.com/boltdb/bolt"
+	"github.com/juju/errors"
+	"github.com/synapse-garden/mf-proto/db"
+	"github.com/synapse-garden/mf-proto/user"
+	"github.com/synapse-garden/mf-proto/util"
+)
+
+const (
+	// Sessions holds admins' Sessions by the hash of their key.
+	Sessions db.Bucket = "admin-sessions"
+
+	// accountPrefix namespaces admins' failed logins from users'.
+	accountPrefix = "admin:"
+)
+
+// Session is an admin's password login.  Its Key may be used as an admin
+// key until it times out, which it does as user logins do.  A Pending
+// Session is not an admin key; it only lets its admin CompleteLogin.
+type Session struct {
+	// Admin is the ID of the Admin logged in.
+	Admin string `json:"admin"`
+
+	user.Login
+}
+
+// Login checks the admin's password and starts a new Session for them,
+// from the given address.  It returns the Session's Login, whose Key is
+// only kept hashed.  If the admin has two-factor authentication enabled,
+// the Login is Pending, and its Key must be passed to CompleteLogin along
+// with a code before it can be used.
+func (s *Service) Login(addr, email, pwhash string) (*user.Login, error) {
+	var adm *Admin
+	check := func() (bool, error) {
+		var err error
+		adm, err = s.GetByEmail(email)
+		switch {
+		case errors.IsUserNotFound(err):
+			// Take as long as a real check would.
+			util.CheckHashedPw(pwhash, "", "")
+			return false, nil
+		case err != nil:
+			return false, err
+		}
+		return util.CheckHashedPw(pwhash, adm.Salt, adm.Hash), nil
+	}
+
+	t := s.throttler()
+	if err := t.Check(addr, accountPrefix+email, check); err != nil {
+		return nil, err
+	}
+	if err := adm.enabled(); err != nil {
+		return nil, err
+	}
+
+	// A Pending login is not complete, so its failures aren't forgotten.
+	if adm.TOTP.Active() {
+		return s.newSession(adm, nil, true)
+	}
+	if err := t.Succeed(accountPrefix + email); err != nil {
+		return nil, err
+	}
+	return s.newSession(adm, nil, false)
+}
+
+// CompleteLogin finishes the login of an admin with two-factor
+// authentication, from the given address, given the Key of their Pending
+// Login and a code or recovery code.  The Pending Session is replaced by a
+// new one, whose Login is returned.  A bad code fails as a bad password
+// does, but is counted apart from bad passwords, so that logging in again
+// doesn't forget it.
+func (s *Service) CompleteLogin(addr string, key util.Key, code string) (*user.Login, error) {
+	h := []byte(util.HashKey(key))
+	bs, err := db.GetByKey(s.DB, Sessions, h)
+	if err != nil {
+		return nil, err
+	}
+
+	sn := new(Session)
+	if len(key) > 0 && len(bs) > 0 {
+		if err := json.Unmarshal(bs, sn); err != nil {
+			return nil, err
+		}
+	}
+	if !sn.Pending || !s.Clock.Now().Before(sn.Timeout) {
+		return nil, errors.Unauthorizedf("no pending login for key")
+	}
+
+	adm, err := s.GetByID(sn.Admin)
+	if err != nil {
+		return nil, err
+	}
+	if !adm.TOTP.Active() {
+		return nil, errors.NotFoundf("two-factor authentication for admin %s", adm.Email)
+	}
+
+	check := func() (bool, error) {
+		return adm.TOTP.Check(code, s.Clock.Now()) == nil, nil
+	}
+	t := s.throttler()
+	if err := t.CheckFactor(addr, accountPrefix+adm.Email, check); err != nil {
+		return nil, err
+	}
+	if err := adm.enabled(); err != nil {
+		return nil, err
+	}
+	if err := t.Succeed(accountPrefix + adm.Email); err != nil {
+		return nil, err
+	}
+
+	// Keep the last used code, so that it cannot be used again.
+	if err := db.StoreKeyValue(s.DB, Admins, []byte(adm.ID), adm); err != nil {
+		return nil, err
+	}
+
+	return s.newSession(adm, h, false)
+}
+
+// throttler returns the Service's Throttler, or one which doesn't throttle
+// if it has none.
+func (s *Service) throttler() Throttler {
+	if s.Throttler == nil {
+		return unthrottled{}
+	}
+	return s.Throttler
+}
+
+// newSession stores a new Session for the Admin, which is Pending if it
+// awaits their second factor, and returns its Login.  If replaced is not
+// nil, the Session with that key hash is deleted.  Timed out Sessions are
+// also deleted.
+func (s *Service) newSession(adm *Admin, replaced []byte, pending bool) (*user.Login, error) {
+	key, err := util.NewKey()
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.Clock.Now()
+	sn := &Session{
+		Admin: adm.ID,
+		Login: user.Login{Timeout: now.Add(s.SessionTimeout), Pending: pending},
+	}
+
+	err = s.DB.Update(func(tx *bolt.Tx) error {
+		if err := deleteSessions(tx, func(sn *Session) bool {
+			return !now.Before(sn.Timeout)
+		}); err != nil {
+			return err
+		}
+		if replaced != nil {
+			if err := tx.Bucket([]byte(Sessions)).Delete(replaced); err != nil {
+				return err
+			}
+		}
+		return putJSON(tx, Sessions, []byte(util.HashKey(key)), sn)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &user.Login{Key: key, Timeout: sn.Timeout, Pending: pending}, nil
+}
+
+// unthrottled is the Throttler of a Service which doesn't throttle logins.
+type unthrottled struct{}
+
+func (unthrottled) Check(addr, account string, check func() (bool, error)) error {
+	switch ok, err := check(); {
+	case err != nil:
+		return err
+	case !ok:
+		return errors.Unauthorizedf("invalid email or password")
+	}
+	return nil
+}
+
+func (u unthrottled) CheckFactor(addr, account string, check func() (bool, error)) error {
+	return u.Check(addr, account, check)
+}
+
+func (unthrottled) Succeed(account string) error { return nil }
+
+// Logout ends the Session with the given key.
+func (s *Service) Logout(key util.Key) error {
+	h := []byte(util.HashKey(key))
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(Sessions))
+		if b == nil {
+			return db.BucketNotFoundErr(Sessions)
+		}
+
+		if len(key) == 0 || len(b.Get(h)) == 0 {
+			return errors.NotFoundf("session")
+		}
+		return b.Delete(h)
+	})
+}
+
+// session returns the ID of the Admin with the Session for the given key,
+// and extends it.
+func (s *Service) session(key util.Key) (string, error) {
+	h := []byte(util.HashKey(key))
+	bs, err := db.GetByKey(s.DB, Sessions, h)
+
+	switch {
+	case err != nil:
+		return "", err
+	case len(key) == 0 || len(bs) == 0:
+		return "", errors.UserNotFoundf("admin for key %s:", key)
+	}
+
+	sn := new(Session)
+	if err := json.Unmarshal(bs, sn); err != nil {
+		return "", err
+	}
+
+	if sn.Pending {
+		return "", errors.UserNotFoundf("admin for key %s:", key)
+	}
+
+	now := s.Clock.Now()
+	if !now.Before(sn.Timeout) {
+		if err := db.DeleteByKey(s.DB, Sessions, h); err != nil {
+			return "", err
+		}
+		return "", errors.UserNotFoundf("admin for key %s:", key)
+	}
+
+	sn.Timeout = now.Add(s.SessionTimeout)
+	return sn.Admin, db.StoreKeyValue(s.DB, Sessions, h, sn)
+}
+
+// deleteSessions deletes the Sessions which match.
+func deleteSessions(tx *bolt.Tx, match func(*Session) bool) error {
+	b := tx.Bucket([]byte(Sessions))
+	if b == nil {
+		return db.BucketNotFoundErr(Sessions)
+	}
+
+	// Buckets can't be changed during ForEach, so find the Sessions first.
+	var del [][]byte
+	err := b.ForEach(func(h, v []byte) error {
+		sn := new(Session)
+		if err := json.Unmarshal(v, sn); err != nil {
+			return err
+		}
+		if match(sn) {
+			del = append(del, append([]byte(nil), h...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, h := range del {
+		if err := b.Delete(h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package admin_test
+
+import (
+	"time"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	"github.com/synapse-garden/mf-proto/admin"
+	t "github.com/synapse-garden/mf-proto/testing"
+	"github.com/synapse-garden/mf-proto/totp"
+	"github.com/synapse-garden/mf-proto/user"
+
+	gc "gopkg.in/check.v1"
+)
+
+func (s *AdminSuite) TestLogin(c *gc.C) {
+	s.createAdmins(c)
+	bob := s.admins["bob"]
+
+	_, err := s.svc.Login("", bob.Email, "wrong")
+	c.Check(err, gc.ErrorMatches, `invalid email or password`)
+	_, err = s.svc.Login("", "nobody@tomato.com", bob.Pwhash)
+	c.Check(err, gc.ErrorMatches, `invalid email or password`)
+
+	l, err := s.svc.Login("", bob.Email, bob.Pwhash)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(l.Key, gc.Not(gc.Equals), bob.Key)
+	c.Check(l.Timeout.Equal(s.clock.Now().Add(user.DefaultTimeout)), jc.IsTrue)
+
+	adm, err := s.svc.Get(l.Key)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(adm.Email, gc.Equals, bob.Email)
+
+	// Sessions time out as user logins do, unless they are used.
+	s.clock.Advance(user.DefaultTimeout - time.Second)
+	c.Check(s.svc.IsAdmin(l.Key), jc.ErrorIsNil)
+	s.clock.Advance(user.DefaultTimeout - time.Second)
+	c.Check(s.svc.IsAdmin(l.Key), jc.ErrorIsNil)
+	s.clock.Advance(user.DefaultTimeout)
+	c.Check(s.svc.IsAdmin(l.Key), gc.ErrorMatches, `admin for key .*: user not found`)
+
+	// Sessions can be ended, and aren't keys.
+	l, err = s.svc.Login("", bob.Email, bob.Pwhash)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(s.svc.Logout(bob.Key), jc.Satisfies, errors.IsNotFound)
+	c.Assert(s.svc.Logout(l.Key), jc.ErrorIsNil)
+	c.Check(s.svc.IsAdmin(l.Key), gc.ErrorMatches, `admin for key .*: user not found`)
+	c.Check(s.svc.IsAdmin(bob.Key), jc.ErrorIsNil)
+
+	// Deleting an admin ends their sessions.
+	l, err = s.svc.Login("", bob.Email, bob.Pwhash)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(s.svc.DeleteByEmail(bob.Email), jc.ErrorIsNil)
+	c.Check(s.svc.IsAdmin(l.Key), gc.ErrorMatches, `admin for key .*: user not found`)
+}
+
+func (s *AdminSuite) TestLoginThrottled(c *gc.C) {
+	us := user.NewService(s.d, user.WithClock(s.clock))
+	c.Assert(t.SetupBuckets(user.Buckets())(s.d), jc.ErrorIsNil)
+	s.svc = admin.NewService(s.d,
+		admin.WithClock(s.clock),
+		admin.WithThrottler(us),
+		admin.WithSessionTimeout(time.Hour),
+	)
+	s.createAdmins(c)
+	bob := s.admins["bob"]
+
+	for i := 0; i < user.DefaultThrottle.Free; i++ {
+		_, err := s.svc.Login("10.0.0.1", bob.Email, "wrong")
+		c.Check(err, gc.ErrorMatches, `invalid email or password`)
+	}
+	_, err := s.svc.Login("10.0.0.1", bob.Email, "wrong")
+	c.Check(err, gc.ErrorMatches, `invalid email or password`)
+	_, err = s.svc.Login("10.0.0.1", bob.Email, bob.Pwhash)
+	c.Check(err, gc.ErrorMatches, `too many failed logins, try again after .*`)
+
+	// Admins' failed logins are apart from users'.
+	_, locked, err := us.LockedUntil(bob.Email)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(locked, jc.IsFalse)
+	c.Assert(us.UnlockAddr("10.0.0.1"), jc.ErrorIsNil)
+	c.Assert(us.Unlock("admin:"+bob.Email), jc.ErrorIsNil)
+
+	l, err := s.svc.Login("10.0.0.1", bob.Email, bob.Pwhash)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(l.Timeout.Equal(s.clock.Now().Add(time.Hour)), jc.IsTrue)
+}
+
+func (s *AdminSuite) TestLoginThrottledSecondFactor(c *gc.C) {
+	us := user.NewService(s.d,
+		user.WithClock(s.clock),
+		user.WithThrottle(user.Throttle{
+			Free:      100,
+			LockAfter: 5,
+			LockFor:   time.Hour,
+			Window:    24 * time.Hour,
+		}),
+	)
+	c.Assert(t.SetupBuckets(user.Buckets())(s.d), jc.ErrorIsNil)
+	s.svc = admin.NewService(s.d, admin.WithClock(s.clock), admin.WithThrottler(us))
+	s.createAdmins(c)
+	bob := s.admins["bob"]
+	s.enableTOTP(bob.Email, c)
+	s.clock.Advance(totp.Period)
+
+	// Logging in again with the right password doesn't forget bad codes.
+	for i := 0; i < 5; i++ {
+		l, err := s.svc.Login("10.0.0.1", bob.Email, bob.Pwhash)
+		c.Assert(err, jc.ErrorIsNil)
+		c.Assert(l.Pending, jc.IsTrue)
+		_, err = s.svc.CompleteLogin("10.0.0.1", l.Key, "000000")
+		c.Check(err, gc.ErrorMatches, `invalid email or password`)
+	}
+
+	_, locked, err := us.LockedUntil("admin:" + bob.Email)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(locked, jc.IsTrue)
+	_, err = s.svc.Login("10.0.0.2", bob.Email, bob.Pwhash)
+	c.Check(err, gc.ErrorMatches, `too many failed logins, .*`)
+}
@@ -0,0 +1,109 @@
+package admin
+
+import (
+	"crypto/subtle"
+
+	"github.com/boltdb/bolt"
+	"github.com/juju/errors"
+	"github.com/synapse-garden/mf-proto/db"
+	"github.com/synapse-garden/mf-proto/util"
+)
+
+// MinSetupToken is the shortest setup token which may be given to
+// OpenSetup, since it is all that guards a fresh database.
+const MinSetupToken = 20
+
+// Any returns true if any admin exists.
+func (s *Service) Any() (bool, error) {
+	found := false
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(Emails))
+		if b == nil {
+			return db.BucketNotFoundErr(Emails)
+		}
+		k, _ := b.Cursor().First()
+		found = k != nil
+		return nil
+	})
+	return found, err
+}
+
+// OpenSetup allows the first admin to be made with CreateFirst by whoever
+// has the given setup token, as long as no admin exists yet.  If the token
+// is empty, a random one is made.  It returns the token, or an error if an
+// admin already exists.  The token is only kept in memory.
+func (s *Service) OpenSetup(token util.Key) (util.Key, error) {
+	if token != "" && len(token) < MinSetupToken {
+		return "", errors.NotValidf("setup token shorter than %d characters", MinSetupToken)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch found, err := s.Any(); {
+	case err != nil:
+		return "", err
+	case found:
+		s.setup = ""
+		return "", errors.AlreadyExistsf("an admin")
+	}
+
+	if token == "" {
+		var err error
+		if token, err = util.NewKey(); err != nil {
+			return "", err
+		}
+	}
+
+	s.setup = util.HashKey(token)
+	return token, nil
+}
+
+// SetupOpen returns true if the first admin may be made with CreateFirst.
+func (s *Service) SetupOpen() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.setup == "" {
+		return false
+	}
+
+	switch found, err := s.Any(); {
+	case err != nil:
+		return false
+	case found:
+		s.setup = ""
+		return false
+	}
+	return true
+}
+
+// CreateFirst makes the first admin with the given email and pwhash, if
+// the setup token is the one given to OpenSetup.  Setup is closed once any
+// admin exists, however it was made.
+func (s *Service) CreateFirst(token util.Key, email, pwhash string) (util.Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.setup == "" {
+		return "", errors.Unauthorizedf("setup is closed")
+	}
+
+	switch found, err := s.Any(); {
+	case err != nil:
+		return "", err
+	case found:
+		s.setup = ""
+		return "", errors.Unauthorizedf("setup is closed")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(util.HashKey(token)), []byte(s.setup)) != 1 {
+		return "", errors.Unauthorizedf("bad setup token")
+	}
+
+	if email == "" || pwhash == "" {
+		return "", errors.NotValidf("admin without email or password")
+	}
+
+	return s.create(email, pwhash)
+}
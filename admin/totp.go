@@ -0,0 +1,76 @@
+package admin
+
+import (
+	"github.com/juju/errors"
+	"github.com/synapse-garden/mf-proto/db"
+	"github.com/synapse-garden/mf-proto/totp"
+	"github.com/synapse-garden/mf-proto/user"
+)
+
+// EnrollTOTP starts two-factor authentication setup for the admin with the
+// given email, returning the new secret and its otpauth:// URI for their
+// authenticator app.  It is not enabled until the admin calls ConfirmTOTP.
+func (s *Service) EnrollTOTP(email string) (secret, uri string, err error) {
+	adm, err := s.GetByEmail(email)
+	if err != nil {
+		return "", "", err
+	}
+
+	if adm.TOTP.Active() {
+		return "", "", errors.AlreadyExistsf("two-factor authentication for admin %s", email)
+	}
+
+	if secret, err = totp.NewSecret(); err != nil {
+		return "", "", err
+	}
+
+	adm.TOTP = &user.TOTP{Secret: secret}
+	if err := db.StoreKeyValue(s.DB, Admins, []byte(adm.ID), adm); err != nil {
+		return "", "", err
+	}
+
+	return secret, totp.URI(s.Issuer, email, secret), nil
+}
+
+// ConfirmTOTP enables two-factor authentication for the admin with the given
+// email who has enrolled, given a current code from their app.  It returns
+// the admin's recovery codes, which are only stored hashed and cannot be
+// shown again.
+func (s *Service) ConfirmTOTP(email, code string) ([]string, error) {
+	adm, err := s.GetByEmail(email)
+	switch {
+	case err != nil:
+		return nil, err
+	case adm.TOTP == nil:
+		return nil, errors.NotFoundf("two-factor enrollment for admin %s", email)
+	case adm.TOTP.Enabled:
+		return nil, errors.AlreadyExistsf("two-factor authentication for admin %s", email)
+	}
+
+	codes, err := adm.TOTP.Confirm(code, s.Clock.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, db.StoreKeyValue(s.DB, Admins, []byte(adm.ID), adm)
+}
+
+// DisableTOTP turns off two-factor authentication for the admin with the
+// given email, given a current code or recovery code.
+func (s *Service) DisableTOTP(email, code string) error {
+	adm, err := s.GetByEmail(email)
+	if err != nil {
+		return err
+	}
+
+	if !adm.TOTP.Active() {
+		return errors.NotFoundf("two-factor authentication for admin %s", email)
+	}
+
+	if err := adm.TOTP.Check(code, s.Clock.Now()); err != nil {
+		return err
+	}
+
+	adm.TOTP = nil
+	return db.StoreKeyValue(s.DB, Admins, []byte(adm.ID), adm)
+}
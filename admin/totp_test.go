@@ -0,0 +1,110 @@
+package admin_test
+
+import (
+	jc "github.com/juju/testing/checkers"
+	"github.com/synapse-garden/mf-proto/totp"
+	"github.com/synapse-garden/mf-proto/user"
+
+	gc "gopkg.in/check.v1"
+)
+
+// enableTOTP enables two-factor authentication for the admin with the given
+// email, returning its secret and recovery codes.
+func (s *AdminSuite) enableTOTP(email string, c *gc.C) (string, []string) {
+	_, err := s.svc.ConfirmTOTP(email, "000000")
+	c.Check(err, gc.ErrorMatches, `two-factor enrollment for admin .* not found`)
+
+	secret, uri, err := s.svc.EnrollTOTP(email)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(uri, gc.Equals, totp.URI("Mindfork", email, secret))
+
+	code, err := totp.Code(secret, s.clock.Now())
+	c.Assert(err, jc.ErrorIsNil)
+
+	_, err = s.svc.ConfirmTOTP(email, "000000")
+	c.Check(err, gc.ErrorMatches, `code "000000" not valid`)
+
+	codes, err := s.svc.ConfirmTOTP(email, code)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(codes, gc.HasLen, user.RecoveryCodes)
+
+	_, _, err = s.svc.EnrollTOTP(email)
+	c.Check(err, gc.ErrorMatches, `two-factor authentication for admin .* already exists`)
+
+	return secret, codes
+}
+
+func (s *AdminSuite) TestTOTPLogin(c *gc.C) {
+	s.createAdmins(c)
+	bob := s.admins["bob"]
+	secret, _ := s.enableTOTP(bob.Email, c)
+	used, err := totp.Code(secret, s.clock.Now())
+	c.Assert(err, jc.ErrorIsNil)
+
+	s.clock.Advance(totp.Period)
+	l, err := s.svc.Login("", bob.Email, bob.Pwhash)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(l.Pending, jc.IsTrue)
+
+	// A Pending Session is not an admin key.
+	c.Check(s.svc.IsAdmin(l.Key), gc.ErrorMatches, `admin for key .*: user not found`)
+	n, err := s.svc.SessionsOf(bob.Email)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(n, gc.Equals, 0)
+
+	// The code used to confirm enrollment can't be used again.
+	_, err = s.svc.CompleteLogin("", l.Key, used)
+	c.Check(err, gc.ErrorMatches, `invalid email or password`)
+
+	code, err := totp.Code(secret, s.clock.Now())
+	c.Assert(err, jc.ErrorIsNil)
+
+	_, err = s.svc.CompleteLogin("", bob.Key, code)
+	c.Check(err, gc.ErrorMatches, `no pending login for key`)
+
+	done, err := s.svc.CompleteLogin("", l.Key, code)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(done.Pending, jc.IsFalse)
+	c.Check(done.Key, gc.Not(gc.Equals), l.Key)
+
+	adm, err := s.svc.Get(done.Key)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(adm.Email, gc.Equals, bob.Email)
+
+	// The Pending Session was replaced.
+	_, err = s.svc.CompleteLogin("", l.Key, code)
+	c.Check(err, gc.ErrorMatches, `no pending login for key`)
+	_, err = s.svc.CompleteLogin("", done.Key, code)
+	c.Check(err, gc.ErrorMatches, `no pending login for key`)
+
+	// Keys are not password logins, so they need no second factor.
+	c.Check(s.svc.IsAdmin(bob.Key), jc.ErrorIsNil)
+}
+
+func (s *AdminSuite) TestTOTPRecoveryCodes(c *gc.C) {
+	s.createAdmins(c)
+	bob := s.admins["bob"]
+	_, codes := s.enableTOTP(bob.Email, c)
+
+	l, err := s.svc.Login("", bob.Email, bob.Pwhash)
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = s.svc.CompleteLogin("", l.Key, codes[3])
+	c.Assert(err, jc.ErrorIsNil)
+
+	// Recovery codes only work once.
+	l, err = s.svc.Login("", bob.Email, bob.Pwhash)
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = s.svc.CompleteLogin("", l.Key, codes[3])
+	c.Check(err, gc.ErrorMatches, `invalid email or password`)
+	_, err = s.svc.CompleteLogin("", l.Key, codes[4])
+	c.Assert(err, jc.ErrorIsNil)
+
+	c.Check(s.svc.DisableTOTP(bob.Email, codes[3]), gc.ErrorMatches, `code ".*" not valid`)
+	c.Check(s.svc.DisableTOTP(bob.Email, codes[5]), jc.ErrorIsNil)
+	c.Check(s.svc.DisableTOTP(bob.Email, codes[6]), gc.ErrorMatches, `two-factor authentication for admin .* not found`)
+
+	l, err = s.svc.Login("", bob.Email, bob.Pwhash)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(l.Pending, jc.IsFalse)
+	c.Check(s.svc.IsAdmin(l.Key), jc.ErrorIsNil)
+}
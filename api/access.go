@@ -0,0 +1,100 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	htr "github.com/julienschmidt/httprouter"
+	"github.com/synapse-garden/mf-proto/user"
+
+	"github.com/juju/errors"
+)
+
+// DefaultAccessTokenTTL is how long an access token lasts if no ttl is given.
+const DefaultAccessTokenTTL = 90 * 24 * time.Hour
+
+// AccessTokens binds the personal access token API for the given Service to
+// a Router, guarded by the given Guard.  Access tokens can only be managed
+// with a login key, not with another access token.
+func AccessTokens(us *user.Service, g *Guard) API {
+	return func(r *htr.Router) error {
+		login := Scope(user.ScopeLogin)
+		r.GET("/user/tokens", g.UserScoped(login, handleUserTokens(us)))
+		g.handle(r, "POST", "/user/tokens", "/user/token/create", g.UserScoped(login, handleUserTokenCreate(us)))
+		g.handle(r, "DELETE", "/user/tokens/:id", "/user/token/revoke", g.UserScoped(login, handleUserTokenRevoke(us)))
+		return nil
+	}
+}
+
+// parseScopes splits a comma-separated list of Scopes.
+func parseScopes(s string) []user.Scope {
+	var scs []user.Scope
+	for _, sc := range strings.Split(s, ",") {
+		if sc = strings.TrimSpace(sc); sc != "" {
+			scs = append(scs, user.Scope(sc))
+		}
+	}
+	return scs
+}
+
+func handleUserTokens(us *user.Service) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		email := r.Form.Get("email")
+
+		ts, err := us.AccessTokens(email)
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("error listing access tokens of %q: %s", email, err.Error())
+			return
+		}
+
+		WriteResponse(w, ts)
+	}
+}
+
+// handleUserTokenCreate mints an access token using the name, ttl and
+// scopes values of the request.  Scopes are separated by commas.
+func handleUserTokenCreate(us *user.Service) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		email, name := r.Form.Get("email"), r.Form.Get("name")
+
+		ttl := DefaultAccessTokenTTL
+		if t := r.Form.Get("ttl"); t != "" {
+			d, err := time.ParseDuration(t)
+			if err != nil {
+				err = errors.NotValidf("ttl %q", t)
+				WriteResponse(w, newApiError(err.Error(), err))
+				log.Printf("bad access token ttl for %q: %s", email, err.Error())
+				return
+			}
+			ttl = d
+		}
+
+		t, err := us.CreateAccessToken(email, name, ttl, parseScopes(r.Form.Get("scopes"))...)
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("error creating access token for %q: %s", email, err.Error())
+			return
+		}
+
+		log.Printf("user %q created access token %q", email, t.ID)
+		WriteResponse(w, t)
+	}
+}
+
+func handleUserTokenRevoke(us *user.Service) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		email, id := r.Form.Get("email"), r.Form.Get("id")
+
+		if err := us.RevokeAccessToken(email, id); err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("error revoking access token %q of %q: %s", id, email, err.Error())
+			return
+		}
+
+		log.Printf("user %q revoked access token %q", email, id)
+		WriteResponse(w, "ok")
+	}
+}
@@ -7,67 +7,119 @@ import (
 	htr "github.com/julienschmidt/httprouter"
 	"github.com/synapse-garden/mf-proto/admin"
 	"github.com/synapse-garden/mf-proto/db"
+	"github.com/synapse-garden/mf-proto/rbac"
 	"github.com/synapse-garden/mf-proto/util"
 )
 
-func Admin(d db.DB) API {
+// Admin binds the admin API for the given Service to a Router, guarded by
+// the given Guard.
+func Admin(as *admin.Service, g *Guard) API {
 	return func(r *htr.Router) error {
-		if err := db.SetupBuckets(d, admin.Buckets()); err != nil {
+		if err := db.SetupBuckets(as.DB, admin.Buckets()); err != nil {
 			return err
 		}
-		r.GET("/admin/valid", handleAdminValid(d))
-		r.GET("/admin/create", handleAdminCreate(d))
-		r.GET("/admin/delete", handleAdminDelete(d))
+		r.GET("/admin/setup", handleAdminSetupOpen(as))
+		g.handle(r, "POST", "/admin/setup", "", g.Anonymous(handleAdminSetup(as, g)))
+		r.GET("/admin/valid", g.Admin(handleAdminValid()))
+		g.handle(r, "POST", "/admin/login", "/admin/login", g.Anonymous(handleAdminLogin(as)))
+		g.handle(r, "POST", "/admin/login/complete", "", g.Anonymous(handleAdminLoginComplete(as)))
+		g.handle(r, "DELETE", "/admin/login", "/admin/logout", g.Admin(handleAdminLogout(as)))
+		g.handle(r, "POST", "/admin", "/admin/create", g.Require(rbac.AdminManage, handleAdminCreate(as, g)))
+		g.handle(r, "DELETE", "/admin", "/admin/delete", g.Admin(handleAdminDelete(as, g)))
+		r.GET("/admin/keys", g.Admin(handleAdminKeys(as)))
+		g.handle(r, "POST", "/admin/keys", "/admin/key/create", g.Admin(handleAdminKeyCreate(as, g)))
+		g.handle(r, "POST", "/admin/keys/:id/rotate", "/admin/key/rotate", g.Admin(handleAdminKeyRotate(as, g)))
+		g.handle(r, "DELETE", "/admin/keys/:id", "/admin/key/revoke", g.Admin(handleAdminKeyRevoke(as, g)))
+		g.handle(r, "POST", "/admin/totp", "", g.Admin(handleAdminTOTPEnroll(as, g)))
+		g.handle(r, "POST", "/admin/totp/confirm", "", g.Admin(handleAdminTOTPConfirm(as, g)))
+		g.handle(r, "DELETE", "/admin/totp", "", g.Admin(handleAdminTOTPDisable(as, g)))
 		return nil
 	}
 }
 
-func handleAdminValid(d db.DB) htr.Handle {
+func handleAdminValid() htr.Handle {
 	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
-		if err := r.ParseForm(); err != nil {
+		WriteResponse(w, "ok")
+		log.Printf("%s verified", principal(r))
+	}
+}
+
+// handleAdminLogin starts a session for an admin by email and password.  Its
+// key is used as an admin key until it times out.  Admins with two-factor
+// authentication are challenged, as users are.
+func handleAdminLogin(as *admin.Service) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		email := r.Form.Get("email")
+		login, err := as.Login(remoteAddr(r), email, r.Form.Get("pwhash"))
+		if err != nil {
 			WriteResponse(w, newApiError(err.Error(), err))
-			log.Printf("bad admin request: %#v", r)
+			log.Printf("error logging in admin %s from %s: %s", email, r.RemoteAddr, err.Error())
 			return
 		}
 
-		key := r.Form.Get("key")
-		if err := admin.IsAdmin(d, util.Key(key)); err != nil {
-			WriteResponse(w, newApiError(err.Error(), err))
-			log.Printf("bad admin request: %s", err.Error())
+		if login.Pending {
+			log.Printf("admin %s challenged for second factor", email)
+			WriteResponse(w, &challenge{
+				Email:   email,
+				Key:     login.Key,
+				Pending: true,
+				Expires: login.Timeout,
+			})
 			return
 		}
 
-		WriteResponse(w, "ok")
-		log.Printf("admin %s verified", key)
+		log.Printf("admin %s logged in", email)
+		WriteResponse(w, login)
 	}
 }
 
-func handleAdminCreate(d db.DB) htr.Handle {
+func handleAdminLoginComplete(as *admin.Service) htr.Handle {
 	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
-		if err := r.ParseForm(); err != nil {
+		key := util.Key(r.Form.Get("key"))
+		login, err := as.CompleteLogin(remoteAddr(r), key, r.Form.Get("code"))
+		if err = unauthenticated(err); err != nil {
 			WriteResponse(w, newApiError(err.Error(), err))
-			log.Printf("bad admin request: %#v", r)
+			log.Printf("second factor for admin from %s failed: %s", r.RemoteAddr, err.Error())
 			return
 		}
 
-		key := util.Key(r.Form.Get("key"))
-		if err := admin.IsAdmin(d, key); err != nil {
+		log.Printf("admin logged in with second factor from %s", r.RemoteAddr)
+		WriteResponse(w, login)
+	}
+}
+
+func handleAdminLogout(as *admin.Service) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		if err := as.Logout(util.Key(r.Form.Get("key"))); err != nil {
 			WriteResponse(w, newApiError(err.Error(), err))
-			log.Printf("bad admin request: %s", err.Error())
+			log.Printf("error logging out %s: %s", principal(r), err.Error())
 			return
 		}
 
+		log.Printf("%s logged out", principal(r))
+		WriteResponse(w, "ok")
+	}
+}
+
+func handleAdminCreate(as *admin.Service, g *Guard) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
 		email := r.Form.Get("email")
 		pwhash := r.Form.Get("pwhash")
 
-		key, err := admin.Create(d, email, pwhash)
+		key, err := as.Create(email, pwhash)
+		g.record(r, "", "admin.create", rbac.Admin(email).String(), err)
 		if err != nil {
 			WriteResponse(w, newApiError(err.Error(), err))
 			log.Printf("error creating admin %s: %s", email, err.Error())
 			return
 		}
 
-		log.Printf("admin %s created with key %s", email, key)
+		// Keys are only kept hashed, so never log the secret.
+		if k, err := as.KeyOf(key); err == nil {
+			log.Printf("admin %s created with key %q", email, k.ID)
+		} else {
+			log.Printf("admin %s created", email)
+		}
 		WriteResponse(w, &admin.Admin{
 			Email: email,
 			Hash:  util.Hash(pwhash),
@@ -76,30 +128,127 @@ func handleAdminCreate(d db.DB) htr.Handle {
 	}
 }
 
-func handleAdminDelete(d db.DB) htr.Handle {
+func handleAdminDelete(as *admin.Service, g *Guard) htr.Handle {
 	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
-		if err := r.ParseForm(); err != nil {
+		key := util.Key(r.Form.Get("key"))
+		err := as.Delete(key)
+		g.record(r, "", "admin.delete", principal(r).String(), err)
+		if err != nil {
 			WriteResponse(w, newApiError(err.Error(), err))
-			log.Printf("bad admin request: %#v", r)
+			log.Printf("error deleting admin for %s: %s", key, err.Error())
 			return
 		}
 
-		key := util.Key(r.Form.Get("key"))
-		if err := admin.IsAdmin(d, key); err != nil {
+		log.Printf("admin %s deleted", key)
+		WriteResponse(w, &admin.Admin{
+			Key: key,
+		})
+	}
+}
+
+// newAdminKey is the response carrying a new admin key, which is only
+// shown once.
+type newAdminKey struct {
+	*admin.Key
+	Secret util.Key `json:"key"`
+}
+
+// keyID returns the ID of k, which may be nil.
+func keyID(k *admin.Key) string {
+	if k == nil {
+		return ""
+	}
+	return k.ID
+}
+
+// handleAdminKeys lists the keys of the admin making the request.
+func handleAdminKeys(as *admin.Service) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		p := principal(r)
+		ks, err := as.KeysOf(p.ID)
+		if err != nil {
 			WriteResponse(w, newApiError(err.Error(), err))
-			log.Printf("bad admin request: %s", err.Error())
+			log.Printf("error listing keys of %s: %s", p, err.Error())
 			return
 		}
 
-		if err := admin.Delete(d, key); err != nil {
+		WriteResponse(w, ks)
+	}
+}
+
+func handleAdminKeyCreate(as *admin.Service, g *Guard) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		p := principal(r)
+		key, k, err := as.AddKey(p.ID, r.Form.Get("name"))
+		g.record(r, "", "admin.key.create", p.String()+" key "+keyID(k), err)
+		if err != nil {
 			WriteResponse(w, newApiError(err.Error(), err))
-			log.Printf("error deleting admin for %s: %s", key, err.Error())
+			log.Printf("error creating key for %s: %s", p, err.Error())
 			return
 		}
 
-		log.Printf("admin %s deleted", key)
+		log.Printf("%s created key %q", p, k.ID)
+		WriteResponse(w, &newAdminKey{Key: k, Secret: key})
+	}
+}
+
+func handleAdminKeyRotate(as *admin.Service, g *Guard) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		p, id := principal(r), r.Form.Get("id")
+		key, k, err := as.RotateKey(p.ID, id)
+		g.record(r, "", "admin.key.rotate", p.String()+" key "+id, err)
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("error rotating key %q of %s: %s", id, p, err.Error())
+			return
+		}
+
+		log.Printf("%s rotated key %q to %q", p, id, k.ID)
+		WriteResponse(w, &newAdminKey{Key: k, Secret: key})
+	}
+}
+
+func handleAdminKeyRevoke(as *admin.Service, g *Guard) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		p, id := principal(r), r.Form.Get("id")
+		err := as.RevokeKey(p.ID, id)
+		g.record(r, "", "admin.key.revoke", p.String()+" key "+id, err)
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("error revoking key %q of %s: %s", id, p, err.Error())
+			return
+		}
+
+		log.Printf("%s revoked key %q", p, id)
+		WriteResponse(w, "ok")
+	}
+}
+
+// handleAdminSetupOpen tells whether the first admin may be made at
+// /admin/setup.
+func handleAdminSetupOpen(as *admin.Service) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		WriteResponse(w, as.SetupOpen())
+	}
+}
+
+// handleAdminSetup makes the first admin for whoever has the setup token,
+// on a database with no admin.
+func handleAdminSetup(as *admin.Service, g *Guard) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		email := r.PostForm.Get("email")
+		key, err := as.CreateFirst(util.Key(r.PostForm.Get("token")), email, r.PostForm.Get("pwhash"))
+		g.record(r, "setup@"+remoteAddr(r), "admin.setup", rbac.Admin(email).String(), err)
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("error setting up admin %s from %s: %s", email, r.RemoteAddr, err.Error())
+			return
+		}
+
+		log.Printf("first admin %s created from %s", email, r.RemoteAddr)
 		WriteResponse(w, &admin.Admin{
-			Key: key,
+			Email: email,
+			Key:   key,
 		})
 	}
 }
@@ -1,22 +1,31 @@
 package api
 
 import (
+	"bytes"
 	"fmt"
+	"net"
+	"net/url"
 	"strings"
+	"text/tabwriter"
 	"time"
 
 	"github.com/synapse-garden/mf-proto/admin"
+	"github.com/synapse-garden/mf-proto/audit"
 	"github.com/synapse-garden/mf-proto/cli"
 	"github.com/synapse-garden/mf-proto/db"
+	"github.com/synapse-garden/mf-proto/rbac"
+	"github.com/synapse-garden/mf-proto/user"
 	"github.com/synapse-garden/mf-proto/util"
 
 	"github.com/juju/errors"
 	"gopkg.in/readline.v1"
 )
 
-func AdminCLI(d db.DB) cli.Binding {
+// AdminCLI binds the admin console commands for the given Services to a CLI.
+// Changes made with them are recorded in the audit log.
+func AdminCLI(as *admin.Service, us *user.Service, rs *rbac.Service, au *audit.Service) cli.Binding {
 	return func(c *cli.CLI) error {
-		if err := db.SetupBuckets(d, admin.Buckets()); err != nil {
+		if err := db.SetupBuckets(as.DB, admin.Buckets()); err != nil {
 			return err
 		}
 
@@ -24,17 +33,108 @@ func AdminCLI(d db.DB) cli.Binding {
 			Name:        "create",
 			Description: "create a new admin",
 			Aliases:     []string{"c", "admin", "new"},
-			Fn:          cliCreate(c, d),
+			Fn:          cliCreate(c, as, au),
 		}, &cli.Command{
 			Name:        "delete",
 			Description: "delete an admin by email",
 			Aliases:     []string{"d", "kill"},
-			Fn:          cliDelete(d),
+			Fn:          cliDelete(as, au),
+		}, &cli.Command{
+			Name:        "list",
+			Description: "list admins with their roles",
+			Aliases:     []string{"admins", "ls"},
+			Fn:          cliList(as, rs),
+		}, &cli.Command{
+			Name:        "show",
+			Description: "show an admin's roles, sessions and keys by email",
+			Fn:          cliShow(as, rs),
+		}, &cli.Command{
+			Name:        "disable",
+			Description: "stop an admin using their keys or logging in, by email",
+			Fn:          cliDisable(as, au, true),
+		}, &cli.Command{
+			Name:        "enable",
+			Description: "let a disabled admin use their keys and log in again, by email",
+			Fn:          cliDisable(as, au, false),
+		}, &cli.Command{
+			Name:        "set-role",
+			Description: "replace an admin's roles with one, e.g. set-role alice@tomato.com support",
+			Fn:          cliSetRole(as, rs, au),
+		}, &cli.Command{
+			Name:        "reset-key",
+			Description: "revoke all of an admin's keys and make them a new one, by email",
+			Fn:          cliResetKey(as, au),
+		}, &cli.Command{
+			Name:        "keys",
+			Description: "list an admin's keys by email",
+			Fn:          cliKeys(as),
+		}, &cli.Command{
+			Name:        "key-create",
+			Description: "make a new named key for an admin, e.g. key-create alice@tomato.com laptop",
+			Fn:          cliKeyCreate(as, au),
+		}, &cli.Command{
+			Name:        "key-rotate",
+			Description: "replace an admin's key by email and key ID",
+			Fn:          cliKeyRotate(as, au),
+		}, &cli.Command{
+			Name:        "key-revoke",
+			Description: "revoke an admin's key by email and key ID",
+			Fn:          cliKeyRevoke(as, au),
+		}, &cli.Command{
+			Name:        "reset-2fa",
+			Description: "remove a user's two-factor authentication by email",
+			Aliases:     []string{"reset-totp"},
+			Fn:          cliResetTOTP(us, au),
+		}, &cli.Command{
+			Name:        "unlock",
+			Description: "clear failed logins for a user's email, admin:<email> for an admin, or an IP address",
+			Fn:          cliUnlock(us, au),
+		}, &cli.Command{
+			Name:        "registration",
+			Description: "show or set the registration policy, e.g. mode=domain domains=a.com,b.org minlength=10 mixed=true",
+			Aliases:     []string{"policy"},
+			Fn:          cliRegistration(us, au),
+		}, &cli.Command{
+			Name:        "invite",
+			Description: "mint a registration invite, e.g. uses=5 ttl=72h",
+			Fn:          cliInvite(us, au),
+		}, &cli.Command{
+			Name:        "invites",
+			Description: "list registration invites",
+			Fn:          cliInvites(us),
+		}, &cli.Command{
+			Name:        "revoke-invite",
+			Description: "revoke a registration invite by code",
+			Fn:          cliRevokeInvite(us, au),
+		}, &cli.Command{
+			Name:        "roles",
+			Description: "list roles and their permissions",
+			Fn:          cliRoles(rs),
+		}, &cli.Command{
+			Name:        "role-set",
+			Description: "create or replace a role, e.g. role-set support user:read:any object:read:any",
+			Fn:          cliRoleSet(rs, au),
+		}, &cli.Command{
+			Name:        "role-delete",
+			Description: "delete a role by name",
+			Fn:          cliRoleDelete(rs, au),
+		}, &cli.Command{
+			Name:        "assign",
+			Description: "assign a role, e.g. assign user:bob@tomato.com support",
+			Fn:          cliAssign(rs, us, au, true),
+		}, &cli.Command{
+			Name:        "unassign",
+			Description: "unassign a role, e.g. unassign admin:alice@tomato.com admin",
+			Fn:          cliAssign(rs, us, au, false),
+		}, &cli.Command{
+			Name:        "jwt-rotate",
+			Description: "make a new key to sign JWT logins with",
+			Fn:          cliJWTRotate(us, au),
 		})
 	}
 }
 
-func getAdminEmail(rl *readline.Instance, d db.DB) (string, error) {
+func getAdminEmail(rl *readline.Instance, as *admin.Service) (string, error) {
 	none := ""
 
 	rl.SetPrompt("Enter email: ")
@@ -45,7 +145,7 @@ func getAdminEmail(rl *readline.Instance, d db.DB) (string, error) {
 		return none, err
 	}
 
-	if err := admin.IsAdminEmail(d, email); err != nil {
+	if err := as.IsAdminEmail(email); err != nil {
 		if errors.IsUserNotFound(err) {
 			return email, nil
 		}
@@ -55,7 +155,7 @@ func getAdminEmail(rl *readline.Instance, d db.DB) (string, error) {
 	return none, fmt.Errorf("admin %s already exists", email)
 }
 
-func cliCreate(c *cli.CLI, d db.DB) cli.CommandFunc {
+func cliCreate(c *cli.CLI, as *admin.Service, au *audit.Service) cli.CommandFunc {
 	return func(args ...string) (cli.Response, error) {
 		var (
 			createArgs = make(map[string]string)
@@ -80,7 +180,7 @@ func cliCreate(c *cli.CLI, d db.DB) cli.CommandFunc {
 
 		email, ok := createArgs["email"]
 		if !ok {
-			email, err = getAdminEmail(rl, d)
+			email, err = getAdminEmail(rl, as)
 			if err != nil {
 				return none, err
 			}
@@ -96,9 +196,10 @@ func cliCreate(c *cli.CLI, d db.DB) cli.CommandFunc {
 			pw = string(b)
 		}
 
-		pwhash = string(util.SaltedHash(string(pw), time.Now().String()))
+		pwhash = string(util.SaltedHash(string(pw), as.Clock.Now().String()))
 
-		key, err := admin.Create(d, email, pwhash)
+		key, err := as.Create(email, pwhash)
+		consoleRecord(au, "admin.create", rbac.Admin(email).String(), err)
 		if err != nil {
 			return none, err
 		}
@@ -107,16 +208,483 @@ func cliCreate(c *cli.CLI, d db.DB) cli.CommandFunc {
 	}
 }
 
-func cliDelete(d db.DB) cli.CommandFunc {
+func cliDelete(as *admin.Service, au *audit.Service) cli.CommandFunc {
 	return func(args ...string) (cli.Response, error) {
 		if len(args) != 1 {
 			return "", errors.New("delete takes an email as its arg")
 		}
 
-		if err := admin.DeleteByEmail(d, args[0]); err != nil {
+		err := as.DeleteByEmail(args[0])
+		consoleRecord(au, "admin.delete", rbac.Admin(args[0]).String(), err)
+		if err != nil {
 			return "", err
 		}
 
 		return cli.Response(fmt.Sprintf("admin %s deleted ok", args[0])), nil
 	}
 }
+
+// table lays out rows in columns under a header.
+func table(header []string, rows [][]string) string {
+	buf := new(bytes.Buffer)
+	tw := tabwriter.NewWriter(buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	tw.Flush()
+	return strings.TrimRight(buf.String(), "\n")
+}
+
+// roleNames returns the names of the Roles of p, joined by commas.
+func roleNames(rs *rbac.Service, p rbac.Principal) (string, error) {
+	roles, err := rs.RolesOf(p)
+	if err != nil {
+		return "", err
+	}
+
+	names := make([]string, len(roles))
+	for i, r := range roles {
+		names[i] = r.Name
+	}
+	return strings.Join(names, ","), nil
+}
+
+// status returns whether an Admin is enabled or disabled.
+func status(adm *admin.Admin) string {
+	if adm.Disabled {
+		return "disabled"
+	}
+	return "enabled"
+}
+
+// optTime formats an optional time, or "-" if it is not set.
+func optTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+func cliList(as *admin.Service, rs *rbac.Service) cli.CommandFunc {
+	return func(args ...string) (cli.Response, error) {
+		adms, err := as.All()
+		if err != nil {
+			return "", err
+		}
+
+		rows := make([][]string, len(adms))
+		for i, adm := range adms {
+			roles, err := roleNames(rs, rbac.Admin(adm.Email))
+			if err != nil {
+				return "", err
+			}
+			rows[i] = []string{adm.Email, adm.ID, status(adm), roles, optTime(adm.Created)}
+		}
+
+		return cli.Response(table([]string{"EMAIL", "ID", "STATUS", "ROLES", "CREATED"}, rows)), nil
+	}
+}
+
+func cliShow(as *admin.Service, rs *rbac.Service) cli.CommandFunc {
+	return func(args ...string) (cli.Response, error) {
+		if len(args) != 1 {
+			return "", errors.New("show takes an admin's email as its arg")
+		}
+
+		adm, err := as.GetByEmail(args[0])
+		if err != nil {
+			return "", err
+		}
+		roles, err := roleNames(rs, rbac.Admin(adm.Email))
+		if err != nil {
+			return "", err
+		}
+		sessions, err := as.SessionsOf(adm.Email)
+		if err != nil {
+			return "", err
+		}
+		ks, err := as.KeysOf(adm.Email)
+		if err != nil {
+			return "", err
+		}
+
+		rows := make([][]string, len(ks))
+		for i, k := range ks {
+			rows[i] = []string{k.ID, k.Name, k.Created.Format(time.RFC3339), optTime(k.LastUsed)}
+		}
+
+		return cli.Response(fmt.Sprintf(
+			"email: %s\nid: %s\nstatus: %s\nroles: %s\ncreated: %s\nsessions: %d\n\n%s",
+			adm.Email, adm.ID, status(adm), roles, optTime(adm.Created), sessions,
+			table([]string{"KEY", "NAME", "CREATED", "LAST USED"}, rows),
+		)), nil
+	}
+}
+
+// cliDisable disables an admin, or enables them if disable is false.
+func cliDisable(as *admin.Service, au *audit.Service, disable bool) cli.CommandFunc {
+	return func(args ...string) (cli.Response, error) {
+		change, name, did, action := as.Disable, "disable", "disabled", "admin.disable"
+		if !disable {
+			change, name, did, action = as.Enable, "enable", "enabled", "admin.enable"
+		}
+
+		if len(args) != 1 {
+			return "", fmt.Errorf("%s takes an admin's email as its arg", name)
+		}
+
+		err := change(args[0])
+		consoleRecord(au, action, rbac.Admin(args[0]).String(), err)
+		if err != nil {
+			return "", err
+		}
+
+		return cli.Response(fmt.Sprintf("admin %s %s ok", args[0], did)), nil
+	}
+}
+
+// cliSetRole replaces the Roles assigned to an admin with the given Role.
+func cliSetRole(as *admin.Service, rs *rbac.Service, au *audit.Service) cli.CommandFunc {
+	return func(args ...string) (cli.Response, error) {
+		if len(args) != 2 {
+			return "", errors.New("set-role takes an admin's email and a role name as its args")
+		}
+
+		if err := as.IsAdminEmail(args[0]); err != nil {
+			return "", err
+		}
+		if _, err := rs.GetRole(args[1]); err != nil {
+			return "", err
+		}
+
+		p := rbac.Admin(args[0])
+		err := rs.Clear(p)
+		if err == nil {
+			err = rs.Assign(p, args[1])
+		}
+		consoleRecord(au, "admin.role.set", p.String()+" role:"+args[1], err)
+		if err != nil {
+			return "", err
+		}
+
+		return cli.Response(fmt.Sprintf("admin %s has role %s ok", args[0], args[1])), nil
+	}
+}
+
+func cliResetKey(as *admin.Service, au *audit.Service) cli.CommandFunc {
+	return func(args ...string) (cli.Response, error) {
+		if len(args) != 1 {
+			return "", errors.New("reset-key takes an admin's email as its arg")
+		}
+
+		key, k, err := as.ResetKeys(args[0])
+		consoleRecord(au, "admin.key.reset", rbac.Admin(args[0]).String()+" key "+keyID(k), err)
+		if err != nil {
+			return "", err
+		}
+
+		return cli.Response(fmt.Sprintf("all keys of %s revoked ok, new key %s: %s", args[0], k.ID, key)), nil
+	}
+}
+
+func cliKeys(as *admin.Service) cli.CommandFunc {
+	return func(args ...string) (cli.Response, error) {
+		if len(args) != 1 {
+			return "", errors.New("keys takes an admin's email as its arg")
+		}
+
+		ks, err := as.KeysOf(args[0])
+		if err != nil {
+			return "", err
+		}
+
+		rows := make([][]string, len(ks))
+		for i, k := range ks {
+			rows[i] = []string{k.ID, k.Name, k.Created.Format(time.RFC3339), optTime(k.LastUsed)}
+		}
+
+		return cli.Response(table([]string{"KEY", "NAME", "CREATED", "LAST USED"}, rows)), nil
+	}
+}
+
+func cliKeyCreate(as *admin.Service, au *audit.Service) cli.CommandFunc {
+	return func(args ...string) (cli.Response, error) {
+		if len(args) < 2 {
+			return "", errors.New("key-create takes an admin's email and a key name as its args")
+		}
+
+		key, k, err := as.AddKey(args[0], strings.Join(args[1:], " "))
+		consoleRecord(au, "admin.key.create", rbac.Admin(args[0]).String()+" key "+keyID(k), err)
+		if err != nil {
+			return "", err
+		}
+
+		return cli.Response(fmt.Sprintf("key %s: %s", k.ID, key)), nil
+	}
+}
+
+func cliKeyRotate(as *admin.Service, au *audit.Service) cli.CommandFunc {
+	return func(args ...string) (cli.Response, error) {
+		if len(args) != 2 {
+			return "", errors.New("key-rotate takes an admin's email and a key ID as its args")
+		}
+
+		key, k, err := as.RotateKey(args[0], args[1])
+		consoleRecord(au, "admin.key.rotate", rbac.Admin(args[0]).String()+" key "+args[1], err)
+		if err != nil {
+			return "", err
+		}
+
+		return cli.Response(fmt.Sprintf("key %s: %s", k.ID, key)), nil
+	}
+}
+
+func cliKeyRevoke(as *admin.Service, au *audit.Service) cli.CommandFunc {
+	return func(args ...string) (cli.Response, error) {
+		if len(args) != 2 {
+			return "", errors.New("key-revoke takes an admin's email and a key ID as its args")
+		}
+
+		err := as.RevokeKey(args[0], args[1])
+		consoleRecord(au, "admin.key.revoke", rbac.Admin(args[0]).String()+" key "+args[1], err)
+		if err != nil {
+			return "", err
+		}
+
+		return cli.Response(fmt.Sprintf("key %s of %s revoked ok", args[1], args[0])), nil
+	}
+}
+
+func cliResetTOTP(us *user.Service, au *audit.Service) cli.CommandFunc {
+	return func(args ...string) (cli.Response, error) {
+		if len(args) != 1 {
+			return "", errors.New("reset-2fa takes a user's email as its arg")
+		}
+
+		err := us.ResetTOTP(args[0])
+		consoleRecord(au, "user.totp.reset", userTarget(us, args[0]), err)
+		if err != nil {
+			return "", err
+		}
+
+		return cli.Response(fmt.Sprintf("two-factor authentication for %s reset ok", args[0])), nil
+	}
+}
+
+func cliUnlock(us *user.Service, au *audit.Service) cli.CommandFunc {
+	return func(args ...string) (cli.Response, error) {
+		if len(args) != 1 {
+			return "", errors.New("unlock takes a user's email or an IP address as its arg")
+		}
+
+		unlock := us.Unlock
+		if net.ParseIP(args[0]) != nil {
+			unlock = us.UnlockAddr
+		}
+
+		err := unlock(args[0])
+		consoleRecord(au, "unlock", args[0], err)
+		if err != nil {
+			return "", err
+		}
+
+		return cli.Response(fmt.Sprintf("%s unlocked ok", args[0])), nil
+	}
+}
+
+// cliValues parses key=value args into url.Values.
+func cliValues(args ...string) (url.Values, error) {
+	vs := make(url.Values)
+	for _, arg := range args {
+		splt := strings.SplitN(arg, "=", 2)
+		if len(splt) < 2 {
+			return nil, fmt.Errorf("arg %q must be of the form key=value", arg)
+		}
+		vs.Add(splt[0], splt[1])
+	}
+	return vs, nil
+}
+
+func cliRegistration(us *user.Service, au *audit.Service) cli.CommandFunc {
+	return func(args ...string) (cli.Response, error) {
+		p, err := us.GetPolicy()
+		if err != nil {
+			return "", err
+		}
+
+		if len(args) > 0 {
+			vs, err := cliValues(args...)
+			if err != nil {
+				return "", err
+			}
+			if err := updatePolicy(p, vs); err != nil {
+				return "", err
+			}
+			err = us.SetPolicy(*p)
+			consoleRecord(au, "registration.set", "registration", err)
+			if err != nil {
+				return "", err
+			}
+		}
+
+		return cli.Response(fmt.Sprintf(
+			"mode: %s\ndomains: %s\nminlength: %d\nmixed: %t",
+			p.Mode, strings.Join(p.Domains, ","),
+			p.Password.MinLength, p.Password.Mixed,
+		)), nil
+	}
+}
+
+func cliInvite(us *user.Service, au *audit.Service) cli.CommandFunc {
+	return func(args ...string) (cli.Response, error) {
+		vs, err := cliValues(args...)
+		if err != nil {
+			return "", err
+		}
+
+		inv, err := newInvite(us, vs)
+		consoleRecord(au, "invite.create", "invite", err)
+		if err != nil {
+			return "", err
+		}
+
+		return cli.Response(fmt.Sprintf(
+			"invite: %s (%d uses, expires %s)",
+			inv.Code, inv.MaxUses, inv.Expires.Format(time.RFC3339),
+		)), nil
+	}
+}
+
+func cliInvites(us *user.Service) cli.CommandFunc {
+	return func(args ...string) (cli.Response, error) {
+		invs, err := us.Invites()
+		if err != nil {
+			return "", err
+		}
+
+		lines := make([]string, len(invs))
+		for i, inv := range invs {
+			lines[i] = fmt.Sprintf(
+				"%s  %d/%d used  expires %s",
+				inv.Code, inv.Uses, inv.MaxUses,
+				inv.Expires.Format(time.RFC3339),
+			)
+		}
+
+		return cli.Response(strings.Join(lines, "\n")), nil
+	}
+}
+
+func cliRevokeInvite(us *user.Service, au *audit.Service) cli.CommandFunc {
+	return func(args ...string) (cli.Response, error) {
+		if len(args) != 1 {
+			return "", errors.New("revoke-invite takes an invite code as its arg")
+		}
+
+		err := us.RevokeInvite(util.Key(args[0]))
+		consoleRecord(au, "invite.revoke", "invite", err)
+		if err != nil {
+			return "", err
+		}
+
+		return cli.Response(fmt.Sprintf("invite %s revoked ok", args[0])), nil
+	}
+}
+
+func cliJWTRotate(us *user.Service, au *audit.Service) cli.CommandFunc {
+	return func(args ...string) (cli.Response, error) {
+		kid, err := us.RotateJWTKey()
+		consoleRecord(au, "jwt.rotate", "jwt key "+kid, err)
+		if err != nil {
+			return "", err
+		}
+
+		return cli.Response(fmt.Sprintf("JWT logins now signed by key %s ok", kid)), nil
+	}
+}
+
+func cliRoles(rs *rbac.Service) cli.CommandFunc {
+	return func(args ...string) (cli.Response, error) {
+		roles, err := rs.AllRoles()
+		if err != nil {
+			return "", err
+		}
+
+		lines := make([]string, len(roles))
+		for i, r := range roles {
+			perms := make([]string, len(r.Permissions))
+			for j, p := range r.Permissions {
+				perms[j] = string(p)
+			}
+			lines[i] = fmt.Sprintf("%s: %s", r.Name, strings.Join(perms, " "))
+		}
+
+		return cli.Response(strings.Join(lines, "\n")), nil
+	}
+}
+
+func cliRoleSet(rs *rbac.Service, au *audit.Service) cli.CommandFunc {
+	return func(args ...string) (cli.Response, error) {
+		if len(args) < 1 {
+			return "", errors.New("role-set takes a role name and its permissions as its args")
+		}
+
+		perms := make([]rbac.Permission, len(args)-1)
+		for i, p := range args[1:] {
+			perms[i] = rbac.Permission(p)
+		}
+
+		err := rs.PutRole(args[0], perms...)
+		consoleRecord(au, "role.set", "role:"+args[0], err)
+		if err != nil {
+			return "", err
+		}
+
+		return cli.Response(fmt.Sprintf("role %s set ok", args[0])), nil
+	}
+}
+
+func cliRoleDelete(rs *rbac.Service, au *audit.Service) cli.CommandFunc {
+	return func(args ...string) (cli.Response, error) {
+		if len(args) != 1 {
+			return "", errors.New("role-delete takes a role name as its arg")
+		}
+
+		err := rs.DeleteRole(args[0])
+		consoleRecord(au, "role.delete", "role:"+args[0], err)
+		if err != nil {
+			return "", err
+		}
+
+		return cli.Response(fmt.Sprintf("role %s deleted ok", args[0])), nil
+	}
+}
+
+// cliAssign assigns a role to a principal, or unassigns it if assign is
+// false.
+func cliAssign(rs *rbac.Service, us *user.Service, au *audit.Service, assign bool) cli.CommandFunc {
+	return func(args ...string) (cli.Response, error) {
+		if len(args) != 2 {
+			return "", errors.New("takes a principal such as user:bob@tomato.com and a role name as its args")
+		}
+
+		p, err := resolvePrincipal(us, args[0])
+		if err != nil {
+			return "", err
+		}
+
+		change, did, action := rs.Assign, "assigned", "role.assign"
+		if !assign {
+			change, did, action = rs.Unassign, "unassigned", "role.unassign"
+		}
+
+		err = change(p, args[1])
+		consoleRecord(au, action, p.String()+" role:"+args[1], err)
+		if err != nil {
+			return "", err
+		}
+
+		return cli.Response(fmt.Sprintf("role %s %s to %s ok", args[1], did, args[0])), nil
+	}
+}
@@ -0,0 +1,31 @@
+package api_test
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+
+	jc "github.com/juju/testing/checkers"
+	"github.com/synapse-garden/mf-proto/admin"
+
+	gc "gopkg.in/check.v1"
+)
+
+func (s *APISuite) TestAdminCreateLogsKeyID(c *gc.C) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	w := s.request("POST", "/admin", `{"email":"larry@tomato.com","pwhash":"larry-pwhash"}`, s.adminKey)
+	checkOK(w, c)
+	var adm admin.Admin
+	value(w, &adm, c)
+	c.Assert(adm.Key, gc.Not(gc.Equals), "")
+
+	// Only the key's ID is logged, never its secret.
+	k, err := s.as.KeyOf(adm.Key)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(strings.Contains(buf.String(), string(adm.Key)), jc.IsFalse, gc.Commentf("log %q", buf.String()))
+	c.Check(buf.String(), gc.Matches, `(?s).*admin larry@tomato\.com created with key "`+k.ID+`".*`)
+}
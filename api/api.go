@@ -1,27 +1,28 @@
 package api
 
 import (
+	"bytes"
 	"encoding/json"
-	"fmt"
 	"log"
+	"net"
 	"net/http"
 
-	"github.com/juju/errors"
 	htr "github.com/julienschmidt/httprouter"
 )
 
 // API defines how a new API will be attached to the router.
 // api packages should export a function such as:
 //
-// func Auth(d db.DB) API {
+// func Auth(us *user.Service) API {
 //	return func(r *htr.Router) error {
-// 		r.GET("/user/auth", handleAuth(d))
+// 		r.GET("/user/auth", handleAuth(us))
 //	}
 // }
 type API func(*htr.Router) error
 
 func Routes(apis ...API) (*htr.Router, error) {
 	r := htr.New()
+	routeErrors(r)
 	for _, a := range apis {
 		if err := a(r); err != nil {
 			return nil, err
@@ -30,35 +31,39 @@ func Routes(apis ...API) (*htr.Router, error) {
 	return r, nil
 }
 
-type apiError struct {
-	Code    int    `json:"code,omitempty"`
-	Message string `json:"msg,omitempty"`
+// remoteAddr returns the IP address a request came from.
+func remoteAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
 }
 
-func newApiError(msg string, err error) apiError {
-	e := apiError{
-		Message: msg,
-		Code:    http.StatusInternalServerError,
-	}
-	if errors.IsNotFound(err) {
-		e.Message = fmt.Sprintf("not found: %s", msg)
-		e.Code = http.StatusNotFound
+// WriteResponse writes the values as a JSON response.  If one of them is an
+// apiError, its Status is the response's.  If they can't be encoded, the
+// response is a fatal one with status 500 instead.
+func WriteResponse(w http.ResponseWriter, values ...interface{}) {
+	status := http.StatusOK
+	for _, v := range values {
+		if ae, ok := v.(apiError); ok {
+			status = ae.Status
+			break
+		}
 	}
 
-	return e
-}
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(newResponse(values...)); err != nil {
+		status = http.StatusInternalServerError
+		log.Printf("failed to write response: %s", err.Error())
+		buf.Reset()
+		buf.WriteString(newFatalResponse("failed to write response", status) + "\n")
+	}
 
-func WriteResponse(w http.ResponseWriter, values ...interface{}) {
-	e := json.NewEncoder(w)
-	response := newResponse(values...)
-	if err := e.Encode(response); err != nil {
-		code := http.StatusInternalServerError
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err := w.Write(buf.Bytes()); err != nil {
 		log.Printf("failed to write response: %s", err.Error())
-		http.Error(
-			w,
-			newFatalResponse("failed to write response", code),
-			code,
-		)
 	}
 }
 
@@ -0,0 +1,170 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	"github.com/synapse-garden/mf-proto/admin"
+	"github.com/synapse-garden/mf-proto/api"
+	"github.com/synapse-garden/mf-proto/audit"
+	"github.com/synapse-garden/mf-proto/oauth"
+	"github.com/synapse-garden/mf-proto/rbac"
+	t "github.com/synapse-garden/mf-proto/testing"
+	"github.com/synapse-garden/mf-proto/user"
+	"github.com/synapse-garden/mf-proto/util"
+
+	gc "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { gc.TestingT(t) }
+
+type APISuite struct {
+	d     *t.DB
+	clock *t.Clock
+	as    *admin.Service
+	us    *user.Service
+	au    *audit.Service
+	oas   *oauth.Service
+	rs    *rbac.Service
+	g     *api.Guard
+	h     http.Handler
+
+	adminKey util.Key
+	users    map[string]t.TestUser
+}
+
+var _ = gc.Suite(&APISuite{})
+
+func (s *APISuite) SetUpTest(c *gc.C) {
+	d, err := t.NewDB(t.SetupBolt("test.db"))
+	c.Assert(err, jc.ErrorIsNil)
+	s.d = d
+	s.clock = t.NewClock(time.Date(2016, 1, 14, 0, 0, 0, 0, time.UTC))
+	s.us = user.NewService(s.d, user.WithClock(s.clock))
+	s.as = admin.NewService(s.d, admin.WithClock(s.clock), admin.WithThrottler(s.us))
+	s.au = audit.NewService(s.d)
+	s.oas = oauth.NewService(s.d, s.us)
+	s.rs = rbac.NewService(s.d)
+	s.g = api.NewGuard(s.as, s.us, s.rs, s.au)
+	s.routes(c)
+
+	s.adminKey, err = s.as.Create("admin@tomato.com", "admin-pwhash")
+	c.Assert(err, jc.ErrorIsNil)
+
+	s.users = map[string]t.TestUser{
+		"bob": {
+			Email:  "bob@tomato.com",
+			Pwhash: "12345678",
+		},
+		"larry": {
+			Email:  "larry@cucumber.net",
+			Pwhash: "87654321",
+		},
+	}
+	for _, u := range s.users {
+		c.Assert(s.us.Create(u.Email, u.Pwhash), jc.ErrorIsNil)
+	}
+}
+
+func (s *APISuite) TearDownTest(c *gc.C) {
+	s.users = nil
+	c.Assert(t.CleanupDB(s.d), jc.ErrorIsNil)
+}
+
+// routes binds the APIs under test to the Suite's handler, so that changes
+// to its Guard, such as Legacy, take effect.
+func (s *APISuite) routes(c *gc.C) {
+	h, err := s.g.Routes(
+		api.Admin(s.as, s.g),
+		api.User(s.us, s.g),
+		api.AccessTokens(s.us, s.g),
+		api.OAuth(s.oas, s.us, s.g),
+		api.Audit(s.au, s.g),
+		api.Roles(s.rs, s.us, s.g),
+	)
+	c.Assert(err, jc.ErrorIsNil)
+	s.h = h
+}
+
+// request serves a request for method and path with the given JSON body,
+// which may be empty.  If key is not empty, it is sent as a Bearer token.
+func (s *APISuite) request(method, path, body string, key util.Key) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	if key != "" {
+		r.Header.Set("Authorization", "Bearer "+string(key))
+	}
+
+	w := httptest.NewRecorder()
+	s.h.ServeHTTP(w, r)
+	return w
+}
+
+// requestForm serves a request for method and path with the given form as
+// its body.
+func (s *APISuite) requestForm(method, path string, form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	w := httptest.NewRecorder()
+	s.h.ServeHTTP(w, r)
+	return w
+}
+
+// login logs in the given user, returning their login key.
+func (s *APISuite) login(name string, c *gc.C) util.Key {
+	u := s.users[name]
+	l, err := s.us.LoginUser(u.Email, u.Pwhash)
+	c.Assert(err, jc.ErrorIsNil)
+	return l.Key
+}
+
+// value decodes the only value of the JSON response w into v.
+func value(w *httptest.ResponseRecorder, v interface{}, c *gc.C) {
+	var resp struct {
+		Values []json.RawMessage `json:"values"`
+	}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &resp), jc.ErrorIsNil, gc.Commentf("body %q", w.Body.String()))
+	c.Assert(resp.Values, gc.HasLen, 1, gc.Commentf("body %q", w.Body.String()))
+	c.Assert(json.Unmarshal(resp.Values[0], v), jc.ErrorIsNil)
+}
+
+// apiError is the wire form of an API error.
+type apiError struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"msg"`
+}
+
+// checkOK checks that w is a successful JSON response.
+func checkOK(w *httptest.ResponseRecorder, c *gc.C) {
+	c.Check(w.Code, gc.Equals, http.StatusOK, gc.Commentf("body %q", w.Body.String()))
+	c.Check(w.Header().Get("Content-Type"), gc.Equals, "application/json")
+}
+
+// checkError checks that w is an API error with the given status and code.
+func checkError(w *httptest.ResponseRecorder, status int, code string, c *gc.C) {
+	c.Check(w.Code, gc.Equals, status, gc.Commentf("body %q", w.Body.String()))
+	c.Check(w.Header().Get("Content-Type"), gc.Equals, "application/json")
+
+	var e apiError
+	value(w, &e, c)
+	c.Check(e.Status, gc.Equals, status)
+	c.Check(e.Code, gc.Equals, code)
+}
+
+// mustID returns the ID of the user with the given email.
+func (s *APISuite) mustID(email string, c *gc.C) string {
+	id, err := s.us.ID(email)
+	c.Assert(err, jc.ErrorIsNil)
+	return id
+}
@@ -0,0 +1,199 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	htr "github.com/julienschmidt/httprouter"
+	"github.com/synapse-garden/mf-proto/audit"
+	"github.com/synapse-garden/mf-proto/cli"
+	"github.com/synapse-garden/mf-proto/db"
+	"github.com/synapse-garden/mf-proto/rbac"
+
+	"github.com/juju/errors"
+)
+
+const (
+	// DefaultAuditLimit is how many audit entries are returned when no
+	// limit is given.
+	DefaultAuditLimit = 100
+
+	// MaxAuditLimit is the most audit entries returned at once.
+	MaxAuditLimit = 1000
+
+	// consoleActor is the actor of actions taken at the admin console.
+	consoleActor = "console"
+)
+
+// Audit binds the audit log API for the given Service to a Router, guarded
+// by the given Guard.
+func Audit(au *audit.Service, g *Guard) API {
+	return func(r *htr.Router) error {
+		if err := db.SetupBuckets(au.DB, audit.Buckets()); err != nil {
+			return err
+		}
+		r.GET("/admin/audit", g.Require(rbac.AuditRead, handleAudit(au)))
+		r.GET("/admin/audit/verify", g.Require(rbac.AuditRead, handleAuditVerify(au)))
+		return nil
+	}
+}
+
+// auditFilter makes an audit.Filter from the actor, action, target, since,
+// until, after and limit values in form.  Times are RFC 3339.
+func auditFilter(form url.Values) (audit.Filter, error) {
+	f := audit.Filter{
+		Actor:  form.Get("actor"),
+		Action: form.Get("action"),
+		Target: form.Get("target"),
+		Limit:  DefaultAuditLimit,
+	}
+
+	for name, t := range map[string]*time.Time{
+		"since": &f.Since,
+		"until": &f.Until,
+	} {
+		if v := form.Get(name); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return f, errors.NotValidf("%s %q", name, v)
+			}
+			*t = parsed
+		}
+	}
+
+	if a := form.Get("after"); a != "" {
+		n, err := strconv.ParseUint(a, 10, 64)
+		if err != nil {
+			return f, errors.NotValidf("after %q", a)
+		}
+		f.After = n
+	}
+
+	if l := form.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 || n > MaxAuditLimit {
+			return f, errors.NotValidf("limit %q", l)
+		}
+		f.Limit = n
+	}
+
+	return f, nil
+}
+
+func handleAudit(au *audit.Service) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		f, err := auditFilter(r.Form)
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("bad audit query: %s", err.Error())
+			return
+		}
+
+		es, err := au.Query(f)
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("error querying audit log: %s", err.Error())
+			return
+		}
+
+		WriteResponse(w, es)
+	}
+}
+
+// auditVerified is the response to a verified audit log.
+type auditVerified struct {
+	Entries int `json:"entries"`
+}
+
+func handleAuditVerify(au *audit.Service) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		n, err := au.Verify()
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("audit log failed verification for %s: %s", principal(r), err.Error())
+			return
+		}
+
+		WriteResponse(w, &auditVerified{Entries: n})
+	}
+}
+
+// consoleRecord records an action taken at the admin console in the audit
+// log, if there is one.
+func consoleRecord(au *audit.Service, action, target string, err error) {
+	if au == nil {
+		return
+	}
+
+	if _, aerr := au.Record(consoleActor, action, target, "", err); aerr != nil {
+		log.Printf("error auditing %s of %q at console: %s", action, target, aerr.Error())
+	}
+}
+
+// AuditCLI binds the audit log admin console commands for the given Service
+// to a CLI.
+func AuditCLI(au *audit.Service) cli.Binding {
+	return func(c *cli.CLI) error {
+		if err := db.SetupBuckets(au.DB, audit.Buckets()); err != nil {
+			return err
+		}
+
+		return c.AddCommands(&cli.Command{
+			Name:        "audit",
+			Description: "show the audit log, e.g. audit actor=console action=user.delete since=2016-01-14T00:00:00Z limit=20",
+			Fn:          cliAudit(au),
+		}, &cli.Command{
+			Name:        "audit-verify",
+			Description: "check that the audit log has not been tampered with",
+			Fn:          cliAuditVerify(au),
+		})
+	}
+}
+
+func cliAudit(au *audit.Service) cli.CommandFunc {
+	return func(args ...string) (cli.Response, error) {
+		vs, err := cliValues(args...)
+		if err != nil {
+			return "", err
+		}
+
+		f, err := auditFilter(vs)
+		if err != nil {
+			return "", err
+		}
+
+		es, err := au.Query(f)
+		if err != nil {
+			return "", err
+		}
+
+		lines := make([]string, len(es))
+		for i, e := range es {
+			outcome := e.Outcome
+			if e.Error != "" {
+				outcome += ": " + e.Error
+			}
+			lines[i] = fmt.Sprintf("%6d  %s  %-32s %-20s %-40s %s",
+				e.Seq, e.Time.Format(time.RFC3339), e.Actor, e.Action, e.Target, outcome,
+			)
+		}
+
+		return cli.Response(strings.Join(lines, "\n")), nil
+	}
+}
+
+func cliAuditVerify(au *audit.Service) cli.CommandFunc {
+	return func(args ...string) (cli.Response, error) {
+		n, err := au.Verify()
+		if err != nil {
+			return "", err
+		}
+
+		return cli.Response(fmt.Sprintf("%d audit entries verified ok", n)), nil
+	}
+}
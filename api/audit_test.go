@@ -0,0 +1,200 @@
+package api_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+
+	jc "github.com/juju/testing/checkers"
+	"github.com/synapse-garden/mf-proto/api"
+	"github.com/synapse-garden/mf-proto/audit"
+	"github.com/synapse-garden/mf-proto/group"
+	"github.com/synapse-garden/mf-proto/mail"
+	"github.com/synapse-garden/mf-proto/rbac"
+	"github.com/synapse-garden/mf-proto/totp"
+	"github.com/synapse-garden/mf-proto/user"
+
+	gc "gopkg.in/check.v1"
+)
+
+// checkAudited checks that the last audit Entry for action was by actor,
+// on target, with the given outcome.
+func (s *APISuite) checkAudited(action, actor, target, outcome string, c *gc.C) {
+	es, err := s.au.Query(audit.Filter{Action: action})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(es, gc.Not(gc.HasLen), 0, gc.Commentf("no %s entry", action))
+
+	e := es[len(es)-1]
+	c.Check(e.Actor, gc.Equals, actor, gc.Commentf("%s", action))
+	c.Check(e.Target, gc.Equals, target, gc.Commentf("%s", action))
+	c.Check(e.Outcome, gc.Equals, outcome, gc.Commentf("%s", action))
+	c.Check(e.RequestID, gc.Not(gc.Equals), "", gc.Commentf("%s", action))
+}
+
+// mailedToken returns the token in the link last mailed to email.
+func mailedToken(m *mail.Memory, email string, c *gc.C) string {
+	msg, ok := m.Last(email)
+	c.Assert(ok, jc.IsTrue, gc.Commentf("nothing mailed to %s", email))
+	link, err := url.Parse(regexp.MustCompile(`https?://\S+`).FindString(msg.Body))
+	c.Assert(err, jc.ErrorIsNil)
+	return link.Query().Get("token")
+}
+
+func (s *APISuite) TestAuditUserChanges(c *gc.C) {
+	m := new(mail.Memory)
+	s.us = user.NewService(s.d,
+		user.WithClock(s.clock),
+		user.WithMailer(m, "mf@synapsegarden.net"),
+		user.WithVerifyURL("https://mf.test/user/verify"),
+		user.WithResetURL("https://mf.test/reset"),
+		user.WithEmailURL("https://mf.test/user/email/confirm"),
+	)
+	s.g = api.NewGuard(s.as, s.us, s.rs, s.au)
+	s.routes(c)
+
+	const anonymous = "anonymous@192.0.2.1"
+	carol := "carol@tomato.com"
+	c.Assert(s.us.Create(carol, "carol-pwhash"), jc.ErrorIsNil)
+	id := s.mustID(carol, c)
+	target := rbac.User(id).String()
+
+	checkError(s.request("GET", "/user/verify?token=nope", "", ""), http.StatusUnprocessableEntity, "not_valid", c)
+	s.checkAudited("user.verify", anonymous, "", audit.Failed, c)
+	checkOK(s.request("GET", "/user/verify?token="+url.QueryEscape(mailedToken(m, carol, c)), "", ""), c)
+	s.checkAudited("user.verify", anonymous, target, audit.OK, c)
+
+	l, err := s.us.LoginUser(carol, "carol-pwhash")
+	c.Assert(err, jc.ErrorIsNil)
+	key := l.Key
+
+	// Two-factor enrollment, confirmation and removal.
+	w := s.request("POST", "/user/totp", fmt.Sprintf(`{"email":%q}`, carol), key)
+	checkOK(w, c)
+	var enr struct {
+		Secret string `json:"secret"`
+	}
+	value(w, &enr, c)
+	s.checkAudited("user.totp.enroll", target, target, audit.OK, c)
+
+	w = s.request("POST", "/user/totp/confirm", fmt.Sprintf(`{"email":%q,"code":"000000"}`, carol), key)
+	c.Check(w.Code, gc.Not(gc.Equals), http.StatusOK)
+	s.checkAudited("user.totp.confirm", target, target, audit.Failed, c)
+	w = s.request("POST", "/user/totp/confirm", fmt.Sprintf(`{"email":%q,"code":%q}`, carol, s.code(enr.Secret, c)), key)
+	checkOK(w, c)
+	s.checkAudited("user.totp.confirm", target, target, audit.OK, c)
+
+	s.clock.Advance(totp.Period)
+	w = s.request("DELETE", "/user/totp", fmt.Sprintf(`{"email":%q,"code":%q}`, carol, s.code(enr.Secret, c)), key)
+	checkOK(w, c)
+	s.checkAudited("user.totp.disable", target, target, audit.OK, c)
+
+	// Email change, requested and confirmed by link.
+	const newCarol = "carol@pepper.org"
+	w = s.request("POST", "/user/email", fmt.Sprintf(`{"email":%q,"pwhash":"carol-pwhash","newemail":%q}`, carol, newCarol), key)
+	checkOK(w, c)
+	s.checkAudited("user.email.request", target, target, audit.OK, c)
+	checkOK(s.request("GET", "/user/email/confirm?token="+url.QueryEscape(mailedToken(m, newCarol, c)), "", ""), c)
+	s.checkAudited("user.email.change", anonymous, target, audit.OK, c)
+	carol = newCarol
+
+	// Password change, and reset by link.
+	w = s.request("POST", "/user/password", fmt.Sprintf(`{"email":%q,"pwhash":"wrong","newpwhash":"new-pwhash"}`, carol), key)
+	c.Check(w.Code, gc.Not(gc.Equals), http.StatusOK)
+	s.checkAudited("user.password.change", target, target, audit.Failed, c)
+	w = s.request("POST", "/user/password", fmt.Sprintf(`{"email":%q,"pwhash":"carol-pwhash","newpwhash":"new-pwhash"}`, carol), key)
+	checkOK(w, c)
+	s.checkAudited("user.password.change", target, target, audit.OK, c)
+
+	c.Assert(s.us.RequestPasswordReset(carol), jc.ErrorIsNil)
+	w = s.request("POST", "/user/password/reset", fmt.Sprintf(`{"token":%q,"pwhash":"newer-pwhash"}`, mailedToken(m, carol, c)), "")
+	checkOK(w, c)
+	s.checkAudited("user.password.reset", anonymous, target, audit.OK, c)
+}
+
+func (s *APISuite) TestAuditAdminTOTP(c *gc.C) {
+	const target = "admin:admin@tomato.com"
+
+	w := s.request("POST", "/admin/totp", "", s.adminKey)
+	checkOK(w, c)
+	var enr struct {
+		Secret string `json:"secret"`
+	}
+	value(w, &enr, c)
+	s.checkAudited("admin.totp.enroll", target, target, audit.OK, c)
+
+	w = s.request("POST", "/admin/totp/confirm", fmt.Sprintf(`{"code":%q}`, s.code(enr.Secret, c)), s.adminKey)
+	checkOK(w, c)
+	s.checkAudited("admin.totp.confirm", target, target, audit.OK, c)
+
+	s.clock.Advance(totp.Period)
+	w = s.request("DELETE", "/admin/totp", fmt.Sprintf(`{"code":%q}`, s.code(enr.Secret, c)), s.adminKey)
+	checkOK(w, c)
+	s.checkAudited("admin.totp.disable", target, target, audit.OK, c)
+}
+
+func (s *APISuite) TestAuditGroupChanges(c *gc.C) {
+	gs := group.NewService(s.d, group.WithClock(s.clock))
+	h, err := s.g.Routes(api.Group(gs, s.us, s.g))
+	c.Assert(err, jc.ErrorIsNil)
+	s.h = h
+
+	bob, larry := s.users["bob"].Email, s.users["larry"].Email
+	bobKey, larryKey := s.login("bob", c), s.login("larry", c)
+	asBob := rbac.User(s.mustID(bob, c)).String()
+	asLarry := rbac.User(s.mustID(larry, c)).String()
+
+	w := s.request("POST", "/group", fmt.Sprintf(`{"email":%q,"name":"Growers"}`, bob), bobKey)
+	checkOK(w, c)
+	var grp group.Group
+	value(w, &grp, c)
+	target := "group " + grp.ID
+	withLarry := target + " " + asLarry
+	s.checkAudited("group.create", asBob, target, audit.OK, c)
+
+	invite := func() string {
+		w := s.request("POST", "/group/invite", fmt.Sprintf(`{"email":%q,"id":%q,"member":%q}`, bob, grp.ID, larry), bobKey)
+		checkOK(w, c)
+		var inv group.Invite
+		value(w, &inv, c)
+		s.checkAudited("group.invite", asBob, withLarry, audit.OK, c)
+		return string(inv.Code)
+	}
+
+	checkOK(s.request("POST", "/group/decline", fmt.Sprintf(`{"email":%q,"code":%q}`, larry, invite()), larryKey), c)
+	s.checkAudited("group.decline", asLarry, "group", audit.OK, c)
+
+	checkOK(s.request("DELETE", "/group/invite", fmt.Sprintf(`{"email":%q,"id":%q,"code":%q}`, bob, grp.ID, invite()), bobKey), c)
+	s.checkAudited("group.invite.revoke", asBob, target, audit.OK, c)
+
+	checkOK(s.request("POST", "/group/accept", fmt.Sprintf(`{"email":%q,"code":%q}`, larry, invite()), larryKey), c)
+	s.checkAudited("group.accept", asLarry, target, audit.OK, c)
+
+	// Only owners may change roles.
+	w = s.request("PUT", "/group/member/role", fmt.Sprintf(`{"email":%q,"id":%q,"member":%q,"role":"owner"}`, larry, grp.ID, larry), larryKey)
+	c.Check(w.Code, gc.Not(gc.Equals), http.StatusOK)
+	s.checkAudited("group.member.role", asLarry, withLarry, audit.Failed, c)
+	checkOK(s.request("PUT", "/group/member/role", fmt.Sprintf(`{"email":%q,"id":%q,"member":%q,"role":"owner"}`, bob, grp.ID, larry), bobKey), c)
+	s.checkAudited("group.member.role", asBob, withLarry, audit.OK, c)
+
+	checkOK(s.request("POST", "/group/leave", fmt.Sprintf(`{"email":%q,"id":%q}`, larry, grp.ID), larryKey), c)
+	s.checkAudited("group.leave", asLarry, target, audit.OK, c)
+
+	checkOK(s.request("POST", "/group/accept", fmt.Sprintf(`{"email":%q,"code":%q}`, larry, invite()), larryKey), c)
+	checkOK(s.request("DELETE", "/group/member", fmt.Sprintf(`{"email":%q,"id":%q,"member":%q}`, bob, grp.ID, larry), bobKey), c)
+	s.checkAudited("group.member.remove", asBob, withLarry, audit.OK, c)
+
+	checkOK(s.request("PUT", "/group/name", fmt.Sprintf(`{"email":%q,"id":%q,"name":"Tomato Growers"}`, bob, grp.ID), bobKey), c)
+	s.checkAudited("group.rename", asBob, target, audit.OK, c)
+
+	// Looking at a group changes nothing, so is not recorded.
+	checkOK(s.request("GET", "/group/get?email="+url.QueryEscape(bob)+"&id="+grp.ID, "", bobKey), c)
+	es, err := s.au.Query(audit.Filter{Action: ""})
+	c.Assert(err, jc.ErrorIsNil)
+	for _, e := range es {
+		c.Check(e.Action, gc.Not(gc.Equals), "")
+	}
+
+	checkOK(s.request("DELETE", "/group", fmt.Sprintf(`{"email":%q,"id":%q}`, bob, grp.ID), bobKey), c)
+	s.checkAudited("group.delete", asBob, target, audit.OK, c)
+}
@@ -0,0 +1,204 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	htr "github.com/julienschmidt/httprouter"
+
+	"github.com/juju/errors"
+)
+
+// maxBody is the largest JSON request body which is read into a form.
+const maxBody = 1 << 20
+
+// credentials are the request values which may not be given in a URL's
+// query, since URLs are kept in logs and browser history.  A key may be
+// given in an Authorization header instead.
+var credentials = []string{
+	"key", "pwhash", "newpwhash", "token", "code", "invite", "client_secret",
+}
+
+// handle binds h to a Router for method at path.  If the Guard serves
+// Legacy routes, h is also bound for GET at legacy, its old path, with
+// headers marking it deprecated.  legacy may be empty for new routes.
+func (g *Guard) handle(r *htr.Router, method, path, legacy string, h htr.Handle) {
+	r.Handle(method, path, body(h))
+	if g.Legacy && legacy != "" {
+		r.GET(legacy, g.compat(deprecated(method, path, h)))
+	}
+}
+
+// compat wraps h so that, if the Guard serves Legacy routes, its requests
+// may still carry credentials in their URL's query.
+func (g *Guard) compat(h htr.Handle) htr.Handle {
+	if !g.Legacy {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		h(w, r.WithContext(context.WithValue(r.Context(), compatKey{}, true)), ps)
+	}
+}
+
+type compatKey struct{}
+
+func isCompat(r *http.Request) bool {
+	ok, _ := r.Context().Value(compatKey{}).(bool)
+	return ok
+}
+
+type linkedKey struct{}
+
+func isLinked(r *http.Request) bool {
+	ok, _ := r.Context().Value(linkedKey{}).(bool)
+	return ok
+}
+
+// deprecated wraps h, which is bound to an old GET route, so that its
+// responses point to method and path, where it moved.
+func deprecated(method, path string, h htr.Handle) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", path))
+		w.Header().Set("Warning", fmt.Sprintf("299 - \"GET %s is deprecated; use %s %s\"", r.URL.Path, method, path))
+		log.Printf("deprecated GET %s; should be %s %s", r.URL.Path, method, path)
+		h(w, r, ps)
+	}
+}
+
+// parseForm parses the request's form, and takes its key from an
+// Authorization Bearer header if it has one.  Credentials in the URL's query
+// are refused, unless the request followed a link or came through compat.
+func parseForm(w http.ResponseWriter, r *http.Request) error {
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+
+	for _, c := range queryCredentials(r) {
+		if isLinked(r) {
+			break
+		}
+		if !isCompat(r) {
+			return errors.NewNotValid(nil, fmt.Sprintf(
+				"%s may not be given in the URL; send it in the body or an Authorization header", c,
+			))
+		}
+		w.Header().Set("Deprecation", "true")
+		log.Printf("deprecated %s in URL query of %s", c, r.URL.Path)
+	}
+
+	if key := bearer(r); key != "" {
+		r.Form.Set("key", key)
+	}
+	return nil
+}
+
+// queryCredentials returns the credentials given in the request's URL query.
+func queryCredentials(r *http.Request) []string {
+	var cs []string
+	q := r.URL.Query()
+	for _, c := range credentials {
+		if _, ok := q[c]; ok {
+			cs = append(cs, c)
+		}
+	}
+	return cs
+}
+
+// bearer returns the token of the request's Authorization Bearer header,
+// if it has one.
+func bearer(r *http.Request) string {
+	const prefix = "bearer "
+	h := r.Header.Get("Authorization")
+	if len(h) < len(prefix) || !strings.EqualFold(h[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(h[len(prefix):])
+}
+
+// body wraps h so that the request's form also holds the values of a JSON
+// object body, and the route's params.
+func body(h htr.Handle) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		if err := parseBody(r, ps); err != nil {
+			WriteResponse(w, newApiError("bad request: "+err.Error(), badRequest(err)))
+			log.Printf("bad request body for %s: %s", r.URL.Path, err.Error())
+			return
+		}
+		h(w, r, ps)
+	}
+}
+
+func parseBody(r *http.Request, ps htr.Params) error {
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt == "application/json" {
+		vs, err := jsonForm(io.LimitReader(r.Body, maxBody))
+		if err != nil {
+			return err
+		}
+		r.PostForm = vs
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+	for _, p := range ps {
+		r.Form.Set(p.Key, p.Value)
+	}
+	return nil
+}
+
+// jsonForm reads a JSON object into form values.  Arrays are joined by
+// commas, as lists are in forms; nested objects are not valid.
+func jsonForm(rd io.Reader) (url.Values, error) {
+	var obj map[string]interface{}
+	dec := json.NewDecoder(rd)
+	dec.UseNumber()
+	if err := dec.Decode(&obj); err != nil {
+		return nil, errors.NewNotValid(err, "JSON body")
+	}
+
+	vs := make(url.Values, len(obj))
+	for k, v := range obj {
+		s, err := formValue(v)
+		if err != nil {
+			return nil, errors.Annotate(err, k)
+		}
+		vs.Set(k, s)
+	}
+	return vs, nil
+}
+
+func formValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case []interface{}:
+		ss := make([]string, len(v))
+		for i, e := range v {
+			s, err := formValue(e)
+			if err != nil {
+				return "", err
+			}
+			if _, ok := e.([]interface{}); ok {
+				return "", errors.NotValidf("nested array")
+			}
+			ss[i] = s
+		}
+		return strings.Join(ss, ","), nil
+	}
+	return "", errors.NotValidf("object value")
+}
@@ -0,0 +1,152 @@
+package api_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+
+	jc "github.com/juju/testing/checkers"
+	"github.com/synapse-garden/mf-proto/api"
+	"github.com/synapse-garden/mf-proto/mail"
+	"github.com/synapse-garden/mf-proto/user"
+	"github.com/synapse-garden/mf-proto/util"
+
+	gc "gopkg.in/check.v1"
+)
+
+func (s *APISuite) TestRoutesChangeByMethod(c *gc.C) {
+	bob := s.users["bob"]
+
+	w := s.request("POST", "/user/login", fmt.Sprintf(`{"email":%q,"pwhash":%q}`, bob.Email, bob.Pwhash), "")
+	checkOK(w, c)
+	var u user.User
+	value(w, &u, c)
+	c.Check(u.Email, gc.Equals, bob.Email)
+	c.Check(s.us.ValidLogin(bob.Email, u.Key), jc.ErrorIsNil)
+
+	// Without Legacy, the old GET routes are gone, and GET is not allowed
+	// where other methods are.
+	checkError(s.request("GET", "/user/login", "", ""), http.StatusMethodNotAllowed, "method_not_allowed", c)
+	checkError(s.request("GET", "/user/logout", "", ""), http.StatusNotFound, "not_found", c)
+
+	w = s.request("DELETE", "/user/login", fmt.Sprintf(`{"email":%q}`, bob.Email), u.Key)
+	checkOK(w, c)
+	c.Check(w.Header().Get("Deprecation"), gc.Equals, "")
+	c.Check(s.us.ValidLogin(bob.Email, u.Key), gc.NotNil)
+
+	// Forms work as well as JSON.
+	w = s.request("POST", "/admin/login", "", "")
+	checkError(w, http.StatusUnauthorized, "unauthorized", c)
+	r := url.Values{"email": {"admin@tomato.com"}, "pwhash": {"admin-pwhash"}}
+	w = s.requestForm("POST", "/admin/login", r)
+	checkOK(w, c)
+	var l user.Login
+	value(w, &l, c)
+	c.Check(s.as.IsAdmin(l.Key), jc.ErrorIsNil)
+
+	checkOK(s.request("DELETE", "/admin/login", "", l.Key), c)
+	c.Check(s.as.IsAdmin(l.Key), gc.NotNil)
+}
+
+func (s *APISuite) TestLegacyRoutes(c *gc.C) {
+	s.g.Legacy = true
+	s.routes(c)
+	bob := s.users["bob"]
+
+	q := url.Values{"email": {bob.Email}, "pwhash": {bob.Pwhash}}
+	w := s.request("GET", "/user/login?"+q.Encode(), "", "")
+	checkOK(w, c)
+	c.Check(w.Header().Get("Deprecation"), gc.Equals, "true")
+	c.Check(w.Header().Get("Link"), gc.Equals, `</user/login>; rel="successor-version"`)
+	c.Check(w.Header().Get("Warning"), gc.Matches, `299 - "GET /user/login is deprecated; use POST /user/login"`)
+	var u user.User
+	value(w, &u, c)
+
+	q = url.Values{"email": {bob.Email}, "key": {string(u.Key)}}
+	w = s.request("GET", "/user/logout?"+q.Encode(), "", "")
+	checkOK(w, c)
+	c.Check(w.Header().Get("Link"), gc.Equals, `</user/login>; rel="successor-version"`)
+	c.Check(s.us.ValidLogin(bob.Email, u.Key), gc.NotNil)
+
+	// The new routes are still served.
+	w = s.request("POST", "/user/login", fmt.Sprintf(`{"email":%q,"pwhash":%q}`, bob.Email, bob.Pwhash), "")
+	checkOK(w, c)
+	c.Check(w.Header().Get("Deprecation"), gc.Equals, "")
+}
+
+func (s *APISuite) TestQueryCredentials(c *gc.C) {
+	bob := s.users["bob"]
+	key := s.login("bob", c)
+
+	for i, t := range []struct {
+		method, path, body string
+		key                util.Key
+	}{{
+		method: "POST",
+		path:   "/user/login?pwhash=" + bob.Pwhash,
+		body:   fmt.Sprintf(`{"email":%q}`, bob.Email),
+	}, {
+		method: "DELETE",
+		path:   "/user/login?key=" + string(key),
+		body:   fmt.Sprintf(`{"email":%q}`, bob.Email),
+	}, {
+		method: "GET",
+		path:   "/user/valid?email=" + url.QueryEscape(bob.Email) + "&key=" + string(key),
+	}, {
+		method: "POST",
+		path:   "/admin/keys?key=" + string(s.adminKey),
+		body:   `{"name":"ci"}`,
+	}} {
+		c.Logf("test %d: %s %s", i, t.method, t.path)
+		checkError(s.request(t.method, t.path, t.body, t.key), http.StatusBadRequest, "bad_request", c)
+	}
+
+	// The login was not ended.
+	c.Check(s.us.ValidLogin(bob.Email, key), jc.ErrorIsNil)
+
+	// The same key is fine in an Authorization header.
+	checkOK(s.request("GET", "/user/valid?email="+url.QueryEscape(bob.Email), "", key), c)
+}
+
+func (s *APISuite) TestOAuthConsentQueryCredentials(c *gc.C) {
+	bob := s.users["bob"]
+	form := url.Values{"email": {bob.Email}, "allow": {"true"}}
+	w := s.requestForm("POST", "/oauth/authorize?pwhash="+bob.Pwhash, form)
+	checkError(w, http.StatusBadRequest, "bad_request", c)
+
+	// Legacy Guards allow credentials in the query, but never for consent.
+	s.g.Legacy = true
+	s.routes(c)
+	w = s.requestForm("POST", "/oauth/authorize?pwhash="+bob.Pwhash, form)
+	c.Check(w.Code, gc.Equals, http.StatusBadRequest)
+	c.Check(w.Body.String(), gc.Matches, `bad request: pwhash may not be given in the URL\n`)
+}
+
+func (s *APISuite) TestLinkedRoutes(c *gc.C) {
+	m := new(mail.Memory)
+	s.us = user.NewService(s.d,
+		user.WithClock(s.clock),
+		user.WithMailer(m, "mf@synapsegarden.net"),
+		user.WithVerifyURL("https://mf.test/user/verify"),
+	)
+	s.g = api.NewGuard(s.as, s.us, s.rs, s.au)
+	s.routes(c)
+
+	const carol = "carol@tomato.com"
+	c.Assert(s.us.Create(carol, "carol-pwhash"), jc.ErrorIsNil)
+	msg, ok := m.Last(carol)
+	c.Assert(ok, jc.IsTrue)
+	link, err := url.Parse(regexp.MustCompile(`https?://\S+`).FindString(msg.Body))
+	c.Assert(err, jc.ErrorIsNil)
+
+	// The mailed link's token is in its query.
+	w := s.request("GET", "/user/verify?"+link.RawQuery, "", "")
+	checkOK(w, c)
+	var u user.User
+	value(w, &u, c)
+	c.Check(u.Email, gc.Equals, carol)
+
+	w = s.request("GET", "/user/verify?"+link.RawQuery, "", "")
+	checkError(w, http.StatusUnprocessableEntity, "not_valid", c)
+}
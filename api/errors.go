@@ -0,0 +1,126 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	htr "github.com/julienschmidt/httprouter"
+	"github.com/synapse-garden/mf-proto/util"
+
+	"github.com/juju/errors"
+)
+
+// Error codes name the kind of an API error.  Unlike its message, an
+// error's code is stable, so clients may rely on it.
+const (
+	CodeBadRequest       = "bad_request"
+	CodeUnauthorized     = "unauthorized"
+	CodeForbidden        = "forbidden"
+	CodeNotFound         = "not_found"
+	CodeUserNotFound     = "user_not_found"
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeAlreadyExists    = "already_exists"
+	CodeNotValid         = "not_valid"
+	CodeNotSupported     = "not_supported"
+	CodeNotProvisioned   = "not_provisioned"
+	CodeInternal         = "internal"
+)
+
+// apiError is the response to a request which failed.  Its Status is also
+// the HTTP status of the response.
+type apiError struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"msg,omitempty"`
+}
+
+// newApiError makes the apiError for err, which msg describes.
+func newApiError(msg string, err error) apiError {
+	status, code := errorStatus(err)
+	if code == CodeNotFound || code == CodeUserNotFound {
+		msg = fmt.Sprintf("not found: %s", msg)
+	}
+
+	return apiError{
+		Status:  status,
+		Code:    code,
+		Message: msg,
+	}
+}
+
+// errorStatus returns the HTTP status and error code for the kind of err.
+// Errors of no known kind are internal.
+func errorStatus(err error) (int, string) {
+	switch {
+	case isBadRequest(err):
+		return http.StatusBadRequest, CodeBadRequest
+	case util.IsForbidden(err):
+		return http.StatusForbidden, CodeForbidden
+	case errors.IsUnauthorized(err):
+		return http.StatusUnauthorized, CodeUnauthorized
+	case errors.IsUserNotFound(err):
+		return http.StatusNotFound, CodeUserNotFound
+	case errors.IsNotFound(err):
+		return http.StatusNotFound, CodeNotFound
+	case errors.IsAlreadyExists(err):
+		return http.StatusConflict, CodeAlreadyExists
+	case errors.IsNotValid(err):
+		return http.StatusUnprocessableEntity, CodeNotValid
+	case errors.IsNotSupported(err), errors.IsNotImplemented(err):
+		return http.StatusNotImplemented, CodeNotSupported
+	case errors.IsNotProvisioned(err):
+		return http.StatusServiceUnavailable, CodeNotProvisioned
+	}
+	return http.StatusInternalServerError, CodeInternal
+}
+
+// requestError is an error with the form of a request, rather than with
+// what it asks for.
+type requestError struct {
+	error
+}
+
+// Cause is nil, so that a requestError is the Cause of errors wrapping it,
+// rather than the error it marks.
+func (e *requestError) Cause() error { return nil }
+
+// badRequest marks err as being with the form of a request, such as one
+// whose body can't be parsed.
+func badRequest(err error) error {
+	return &requestError{err}
+}
+
+// isBadRequest returns whether the Cause of err was marked by badRequest.
+func isBadRequest(err error) bool {
+	_, ok := errors.Cause(err).(*requestError)
+	return ok
+}
+
+// unauthenticated makes an error from authenticating a request, such as a
+// bad or unknown key, Unauthorized.  Errors which say nothing about the
+// request's credentials are kept.
+func unauthenticated(err error) error {
+	switch {
+	case err == nil, errors.IsUnauthorized(err):
+		return err
+	case errors.IsNotValid(err), errors.IsNotFound(err), errors.IsUserNotFound(err):
+		return errors.NewUnauthorized(err, "")
+	}
+	return err
+}
+
+// routeErrors makes the Router answer requests for unknown routes, or with
+// the wrong method, with an apiError.
+func routeErrors(r *htr.Router) {
+	r.NotFound = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		err := errors.NotFoundf("route %s", req.URL.Path)
+		WriteResponse(w, newApiError(err.Error(), err))
+	})
+	r.MethodNotAllowed = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		WriteResponse(w, apiError{
+			Status:  http.StatusMethodNotAllowed,
+			Code:    CodeMethodNotAllowed,
+			Message: fmt.Sprintf("%s not allowed for %s", req.Method, req.URL.Path),
+		})
+	})
+}
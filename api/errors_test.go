@@ -0,0 +1,98 @@
+package api_test
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/juju/errors"
+	"github.com/synapse-garden/mf-proto/api"
+	"github.com/synapse-garden/mf-proto/util"
+
+	gc "gopkg.in/check.v1"
+)
+
+func (s *APISuite) TestErrorStatus(c *gc.C) {
+	for i, t := range []struct {
+		given  error
+		status int
+		code   string
+	}{{
+		given:  api.BadRequest(errors.New("bad json")),
+		status: http.StatusBadRequest, code: api.CodeBadRequest,
+	}, {
+		given:  errors.Annotate(api.BadRequest(errors.NotValidf("form")), "parsing"),
+		status: http.StatusBadRequest, code: api.CodeBadRequest,
+	}, {
+		given:  errors.Trace(api.BadRequest(errors.NotFoundf("key"))),
+		status: http.StatusBadRequest, code: api.CodeBadRequest,
+	}, {
+		given:  util.Forbiddenf("admin route"),
+		status: http.StatusForbidden, code: api.CodeForbidden,
+	}, {
+		given:  errors.Unauthorizedf("no key"),
+		status: http.StatusUnauthorized, code: api.CodeUnauthorized,
+	}, {
+		given:  api.Unauthenticated(errors.NotValidf("key")),
+		status: http.StatusUnauthorized, code: api.CodeUnauthorized,
+	}, {
+		given:  errors.UserNotFoundf("bob"),
+		status: http.StatusNotFound, code: api.CodeUserNotFound,
+	}, {
+		given:  errors.NotFoundf("object"),
+		status: http.StatusNotFound, code: api.CodeNotFound,
+	}, {
+		given:  errors.AlreadyExistsf("user"),
+		status: http.StatusConflict, code: api.CodeAlreadyExists,
+	}, {
+		given:  errors.NotValidf("email"),
+		status: http.StatusUnprocessableEntity, code: api.CodeNotValid,
+	}, {
+		given:  errors.NotSupportedf("scope"),
+		status: http.StatusNotImplemented, code: api.CodeNotSupported,
+	}, {
+		given:  errors.NotImplementedf("import"),
+		status: http.StatusNotImplemented, code: api.CodeNotSupported,
+	}, {
+		given:  errors.NotProvisionedf("mailer"),
+		status: http.StatusServiceUnavailable, code: api.CodeNotProvisioned,
+	}, {
+		given:  errors.New("disk on fire"),
+		status: http.StatusInternalServerError, code: api.CodeInternal,
+	}} {
+		c.Logf("test %d: %s", i, t.given)
+		status, code := api.ErrorStatus(t.given)
+		c.Check(status, gc.Equals, t.status)
+		c.Check(code, gc.Equals, t.code)
+	}
+}
+
+func (s *APISuite) TestErrorWireShape(c *gc.C) {
+	w := httptest.NewRecorder()
+	api.WriteResponse(w, api.NewApiError("email not valid", errors.NotValidf("email")))
+	c.Check(w.Code, gc.Equals, http.StatusUnprocessableEntity)
+	c.Check(w.Header().Get("Content-Type"), gc.Equals, "application/json")
+	c.Check(w.Body.String(), gc.Equals,
+		`{"values":[{"status":422,"code":"not_valid","msg":"email not valid"}]}`+"\n")
+
+	w = httptest.NewRecorder()
+	api.WriteResponse(w, api.NewApiError("bob", errors.UserNotFoundf("bob")))
+	c.Check(w.Code, gc.Equals, http.StatusNotFound)
+	c.Check(w.Body.String(), gc.Equals,
+		`{"values":[{"status":404,"code":"user_not_found","msg":"not found: bob"}]}`+"\n")
+}
+
+func (s *APISuite) TestWriteResponseEncodeFailure(c *gc.C) {
+	// The header is only written once, after the values are encoded, so a
+	// failure to encode them is not sent with the apiError's status.
+	w := httptest.NewRecorder()
+	api.WriteResponse(w, api.NewApiError("email not valid", errors.NotValidf("email")), math.Inf(1))
+	c.Check(w.Code, gc.Equals, http.StatusInternalServerError)
+	c.Check(w.Header().Get("Content-Type"), gc.Equals, "application/json")
+	c.Check(w.Body.String(), gc.Equals, `{"code":500,"msg":"failed to write response"}`+"\n")
+
+	w = httptest.NewRecorder()
+	api.WriteResponse(w, "ok")
+	checkOK(w, c)
+	c.Check(w.Body.String(), gc.Equals, `{"values":["ok"]}`+"\n")
+}
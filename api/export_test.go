@@ -0,0 +1,8 @@
+package api
+
+var (
+	BadRequest      = badRequest
+	ErrorStatus     = errorStatus
+	NewApiError     = newApiError
+	Unauthenticated = unauthenticated
+)
@@ -0,0 +1,233 @@
+package api
+
+import (
+	"log"
+	"net/http"
+
+	htr "github.com/julienschmidt/httprouter"
+	"github.com/synapse-garden/mf-proto/db"
+	"github.com/synapse-garden/mf-proto/group"
+	"github.com/synapse-garden/mf-proto/user"
+	"github.com/synapse-garden/mf-proto/util"
+)
+
+// Group binds the group API for the given Services to a Router, guarded by
+// the given Guard.  Group members are named by email in the member value,
+// since the email value is the requesting user's own.
+func Group(gs *group.Service, us *user.Service, g *Guard) API {
+	return func(r *htr.Router) error {
+		if err := db.SetupBuckets(gs.DB, group.Buckets()); err != nil {
+			return err
+		}
+
+		g.handle(r, "POST", "/group", "/group/create", g.User(handleGroupCreate(gs, g)))
+		r.GET("/group/list", g.User(handleGroupList(gs)))
+		r.GET("/group/invites", g.User(handleGroupInvites(gs)))
+		g.handle(r, "POST", "/group/accept", "/group/accept", g.User(handleGroupAccept(gs, g)))
+		g.handle(r, "POST", "/group/decline", "/group/decline", g.User(handleGroupDecline(gs, g)))
+
+		r.GET("/group/get", g.User(groupHandle(gs, us, g, group.RoleMember, "", "getting",
+			func(r *http.Request, grp *group.Group) (interface{}, error) {
+				return grp, nil
+			},
+		)))
+		g.handle(r, "POST", "/group/leave", "/group/leave", g.User(groupHandle(gs, us, g, group.RoleMember, "group.leave", "leaving",
+			func(r *http.Request, grp *group.Group) (interface{}, error) {
+				return "ok", gs.RemoveMember(grp.ID, principal(r).ID)
+			},
+		)))
+		g.handle(r, "PUT", "/group/name", "/group/rename", g.User(groupHandle(gs, us, g, group.RoleOwner, "group.rename", "renaming",
+			func(r *http.Request, grp *group.Group) (interface{}, error) {
+				return "ok", gs.Rename(grp.ID, r.Form.Get("name"))
+			},
+		)))
+		g.handle(r, "DELETE", "/group", "/group/delete", g.User(groupHandle(gs, us, g, group.RoleOwner, "group.delete", "deleting",
+			func(r *http.Request, grp *group.Group) (interface{}, error) {
+				return "ok", gs.Delete(grp.ID)
+			},
+		)))
+		g.handle(r, "POST", "/group/invite", "/group/invite", g.User(groupHandle(gs, us, g, group.RoleOwner, "group.invite", "inviting to",
+			func(r *http.Request, grp *group.Group) (interface{}, error) {
+				id, err := us.ID(r.Form.Get("member"))
+				if err != nil {
+					return nil, err
+				}
+				return gs.Invite(grp.ID, principal(r).ID, id, groupRole(r))
+			},
+		)))
+		g.handle(r, "DELETE", "/group/invite", "/group/invite/revoke", g.User(groupHandle(gs, us, g, group.RoleOwner, "group.invite.revoke", "revoking invite to",
+			func(r *http.Request, grp *group.Group) (interface{}, error) {
+				return "ok", gs.RevokeInvite(grp.ID, util.Key(r.Form.Get("code")))
+			},
+		)))
+		r.GET("/group/pending", g.User(groupHandle(gs, us, g, group.RoleOwner, "", "listing invites to",
+			func(r *http.Request, grp *group.Group) (interface{}, error) {
+				return gs.GroupInvites(grp.ID)
+			},
+		)))
+		g.handle(r, "PUT", "/group/member/role", "/group/member/role", g.User(groupHandle(gs, us, g, group.RoleOwner, "group.member.role", "setting role in",
+			func(r *http.Request, grp *group.Group) (interface{}, error) {
+				id, err := us.ID(r.Form.Get("member"))
+				if err != nil {
+					return nil, err
+				}
+				return "ok", gs.SetRole(grp.ID, id, groupRole(r))
+			},
+		)))
+		g.handle(r, "DELETE", "/group/member", "/group/member/remove", g.User(groupHandle(gs, us, g, group.RoleOwner, "group.member.remove", "removing member from",
+			func(r *http.Request, grp *group.Group) (interface{}, error) {
+				id, err := us.ID(r.Form.Get("member"))
+				if err != nil {
+					return nil, err
+				}
+				return "ok", gs.RemoveMember(grp.ID, id)
+			},
+		)))
+		return nil
+	}
+}
+
+// groupRole returns the role value of the request, or member if it has none.
+func groupRole(r *http.Request) group.Role {
+	if role := r.Form.Get("role"); role != "" {
+		return group.Role(role)
+	}
+	return group.RoleMember
+}
+
+// groupTarget names the group with the given id in the audit log, or just
+// a group if it is not known.
+func groupTarget(id string) string {
+	if id == "" {
+		return "group"
+	}
+	return "group " + id
+}
+
+// groupHandle makes a Handle which checks that the requesting user has the
+// wanted Role in the group with the request's id, and then responds with
+// whatever do returns for it.  doing describes do for the log.  Unless
+// action is empty, the attempt is recorded in the audit log as action on
+// the group, and on the member the request names, if any.
+func groupHandle(
+	gs *group.Service,
+	us *user.Service,
+	g *Guard,
+	want group.Role,
+	action, doing string,
+	do func(*http.Request, *group.Group) (interface{}, error),
+) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		user, id := principal(r).ID, r.Form.Get("id")
+		record := func(err error) {
+			if action == "" {
+				return
+			}
+			target := groupTarget(id)
+			if m := r.Form.Get("member"); m != "" {
+				target += " " + userTarget(us, m)
+			}
+			g.record(r, "", action, target, err)
+		}
+
+		grp, err := gs.Authorize(user, id, want)
+		if err != nil {
+			record(err)
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("error %s group %q: %s", doing, id, err.Error())
+			return
+		}
+
+		resp, err := do(r, grp)
+		record(err)
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("error %s group %q: %s", doing, id, err.Error())
+			return
+		}
+
+		WriteResponse(w, resp)
+	}
+}
+
+func handleGroupCreate(gs *group.Service, g *Guard) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		user, name := principal(r).ID, r.Form.Get("name")
+
+		grp, err := gs.Create(user, name)
+		if err != nil {
+			g.record(r, "", "group.create", groupTarget(""), err)
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("error creating group %q: %s", name, err.Error())
+			return
+		}
+
+		g.record(r, "", "group.create", groupTarget(grp.ID), nil)
+		log.Printf("group %q created by %q", grp.ID, user)
+		WriteResponse(w, grp)
+	}
+}
+
+func handleGroupList(gs *group.Service) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		user := principal(r).ID
+
+		grps, err := gs.Of(user)
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("error listing groups of %q: %s", user, err.Error())
+			return
+		}
+
+		WriteResponse(w, grps)
+	}
+}
+
+func handleGroupInvites(gs *group.Service) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		user := principal(r).ID
+
+		invs, err := gs.Invites(user)
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("error listing group invites for %q: %s", user, err.Error())
+			return
+		}
+
+		WriteResponse(w, invs)
+	}
+}
+
+func handleGroupAccept(gs *group.Service, g *Guard) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		user, code := principal(r).ID, util.Key(r.Form.Get("code"))
+
+		grp, err := gs.Accept(user, code)
+		if err != nil {
+			g.record(r, "", "group.accept", groupTarget(""), err)
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("error accepting group invite for %q: %s", user, err.Error())
+			return
+		}
+
+		g.record(r, "", "group.accept", groupTarget(grp.ID), nil)
+		log.Printf("user %q joined group %q", user, grp.ID)
+		WriteResponse(w, grp)
+	}
+}
+
+func handleGroupDecline(gs *group.Service, g *Guard) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		user, code := principal(r).ID, util.Key(r.Form.Get("code"))
+
+		err := gs.Decline(user, code)
+		g.record(r, "", "group.decline", groupTarget(""), err)
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("error declining group invite for %q: %s", user, err.Error())
+			return
+		}
+
+		WriteResponse(w, "ok")
+	}
+}
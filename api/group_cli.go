@@ -0,0 +1,178 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/synapse-garden/mf-proto/audit"
+	"github.com/synapse-garden/mf-proto/cli"
+	"github.com/synapse-garden/mf-proto/db"
+	"github.com/synapse-garden/mf-proto/group"
+	"github.com/synapse-garden/mf-proto/user"
+
+	"github.com/juju/errors"
+)
+
+// GroupCLI binds the group admin console commands for the given Services to
+// a CLI, recording changes in the given audit log.  Members are named by
+// email.
+func GroupCLI(gs *group.Service, us *user.Service, au *audit.Service) cli.Binding {
+	return func(c *cli.CLI) error {
+		if err := db.SetupBuckets(gs.DB, group.Buckets()); err != nil {
+			return err
+		}
+
+		return c.AddCommands(&cli.Command{
+			Name:        "groups",
+			Description: "list groups",
+			Fn:          cliGroups(gs),
+		}, &cli.Command{
+			Name:        "group",
+			Description: "show a group's members by group ID",
+			Fn:          cliGroup(gs, us),
+		}, &cli.Command{
+			Name:        "group-create",
+			Description: "create a group, e.g. group-create bob@tomato.com Tomato Growers",
+			Fn:          cliGroupCreate(gs, us, au),
+		}, &cli.Command{
+			Name:        "group-delete",
+			Description: "delete a group by ID",
+			Fn:          cliGroupDelete(gs, au),
+		}, &cli.Command{
+			Name:        "group-add",
+			Description: "add a member to a group, e.g. group-add <id> larry@cucumber.net owner",
+			Fn:          cliGroupAdd(gs, us, au),
+		}, &cli.Command{
+			Name:        "group-remove",
+			Description: "remove a member from a group, e.g. group-remove <id> larry@cucumber.net",
+			Fn:          cliGroupRemove(gs, us, au),
+		})
+	}
+}
+
+func cliGroups(gs *group.Service) cli.CommandFunc {
+	return func(args ...string) (cli.Response, error) {
+		grps, err := gs.All()
+		if err != nil {
+			return "", err
+		}
+
+		lines := make([]string, len(grps))
+		for i, g := range grps {
+			lines[i] = fmt.Sprintf("%s  %-24s %d members", g.ID, g.Name, len(g.Members))
+		}
+
+		return cli.Response(strings.Join(lines, "\n")), nil
+	}
+}
+
+func cliGroup(gs *group.Service, us *user.Service) cli.CommandFunc {
+	return func(args ...string) (cli.Response, error) {
+		if len(args) != 1 {
+			return "", errors.New("group takes a group ID as its arg")
+		}
+
+		g, err := gs.Get(args[0])
+		if err != nil {
+			return "", err
+		}
+
+		lines := []string{fmt.Sprintf("%s  %s", g.ID, g.Name)}
+		for _, m := range g.Members {
+			who := m.User
+			if u, err := us.GetByID(m.User); err == nil {
+				who = u.Email
+			}
+			lines = append(lines, fmt.Sprintf("  %-32s %-6s joined %s",
+				who, m.Role, m.Joined.Format("2006-01-02"),
+			))
+		}
+
+		return cli.Response(strings.Join(lines, "\n")), nil
+	}
+}
+
+func cliGroupCreate(gs *group.Service, us *user.Service, au *audit.Service) cli.CommandFunc {
+	return func(args ...string) (cli.Response, error) {
+		if len(args) < 2 {
+			return "", errors.New("group-create takes an owner's email and a group name as its args")
+		}
+
+		owner, err := us.ID(args[0])
+		if err != nil {
+			return "", err
+		}
+
+		g, err := gs.Create(owner, strings.Join(args[1:], " "))
+		if err != nil {
+			consoleRecord(au, "group.create", groupTarget(""), err)
+			return "", err
+		}
+		consoleRecord(au, "group.create", groupTarget(g.ID), nil)
+
+		return cli.Response(fmt.Sprintf("group %s created ok", g.ID)), nil
+	}
+}
+
+func cliGroupDelete(gs *group.Service, au *audit.Service) cli.CommandFunc {
+	return func(args ...string) (cli.Response, error) {
+		if len(args) != 1 {
+			return "", errors.New("group-delete takes a group ID as its arg")
+		}
+
+		err := gs.Delete(args[0])
+		consoleRecord(au, "group.delete", groupTarget(args[0]), err)
+		if err != nil {
+			return "", err
+		}
+
+		return cli.Response(fmt.Sprintf("group %s deleted ok", args[0])), nil
+	}
+}
+
+func cliGroupAdd(gs *group.Service, us *user.Service, au *audit.Service) cli.CommandFunc {
+	return func(args ...string) (cli.Response, error) {
+		if len(args) != 2 && len(args) != 3 {
+			return "", errors.New("group-add takes a group ID, a member's email and optionally a role as its args")
+		}
+
+		id, err := us.ID(args[1])
+		if err != nil {
+			return "", err
+		}
+
+		role := group.RoleMember
+		if len(args) == 3 {
+			role = group.Role(args[2])
+		}
+
+		err = gs.AddMember(args[0], id, role)
+		consoleRecord(au, "group.member.add", groupTarget(args[0])+" "+userTarget(us, args[1]), err)
+		if err != nil {
+			return "", err
+		}
+
+		return cli.Response(fmt.Sprintf("%s added to group %s as %s ok", args[1], args[0], role)), nil
+	}
+}
+
+func cliGroupRemove(gs *group.Service, us *user.Service, au *audit.Service) cli.CommandFunc {
+	return func(args ...string) (cli.Response, error) {
+		if len(args) != 2 {
+			return "", errors.New("group-remove takes a group ID and a member's email as its args")
+		}
+
+		id, err := us.ID(args[1])
+		if err != nil {
+			return "", err
+		}
+
+		err = gs.RemoveMember(args[0], id)
+		consoleRecord(au, "group.member.remove", groupTarget(args[0])+" "+userTarget(us, args[1]), err)
+		if err != nil {
+			return "", err
+		}
+
+		return cli.Response(fmt.Sprintf("%s removed from group %s ok", args[1], args[0])), nil
+	}
+}
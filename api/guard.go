@@ -0,0 +1,406 @@
+package api
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+
+	htr "github.com/julienschmidt/httprouter"
+	"github.com/synapse-garden/mf-proto/admin"
+	"github.com/synapse-garden/mf-proto/audit"
+	"github.com/synapse-garden/mf-proto/rbac"
+	"github.com/synapse-garden/mf-proto/user"
+	"github.com/synapse-garden/mf-proto/util"
+
+	"github.com/juju/errors"
+)
+
+// Guard authenticates requests and checks that their Principal has the
+// Permissions a handler needs.  A request whose key is an admin key is from
+// that admin; otherwise it is from the user whose email and login key or
+// access token it has.  Since access tokens issued by OAuth are not given
+// with an email, the Guard sets the request's email to their user's.
+// Access tokens may only be used for handlers which allow one of their
+// Scopes.  An admin impersonating a user uses the Impersonation's key, and
+// the request is from that user, with its Context marked by
+// rbac.WithImpersonator.  Privileged actions are recorded in the Guard's
+// Audit log.
+//
+// Keys may be given in an Authorization Bearer header or in the request
+// body, but credentials are refused in the URL's query unless the Guard
+// serves Legacy routes.
+//
+// Handlers declare who may call them by how they are wrapped: Admin, User,
+// Authenticated, Require or Anonymous.  Behind Authenticate, a request is
+// authenticated at most once, however many of these ask who made it.
+type Guard struct {
+	Admins *admin.Service
+	Users  *user.Service
+	RBAC   *rbac.Service
+	Audit  *audit.Service
+
+	// Legacy is set to also serve the routes which change things by GET
+	// at their old paths, and to accept credentials in URL queries, with
+	// Deprecation headers.
+	Legacy bool
+}
+
+// NewGuard makes a new Guard for the given Services.
+func NewGuard(as *admin.Service, us *user.Service, rs *rbac.Service, au *audit.Service) *Guard {
+	return &Guard{Admins: as, Users: us, RBAC: rs, Audit: au}
+}
+
+// Routes makes a Router for the given APIs, behind Authenticate.
+func (g *Guard) Routes(apis ...API) (http.Handler, error) {
+	r, err := Routes(apis...)
+	if err != nil {
+		return nil, err
+	}
+	return g.Authenticate(r), nil
+}
+
+// Authenticate wraps h, which serves handlers wrapped by the Guard, so that
+// each request is given an ID and authenticated at most once.  The Principal
+// it is from is found when a handler first needs it, since its credentials
+// may be in its body.
+func (g *Guard) Authenticate(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = withRequestID(w, r)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authnKey{}, new(authn))))
+	})
+}
+
+// authn is the outcome of authenticating a request.
+type authn struct {
+	done bool
+	p    rbac.Principal
+	scs  user.Scopes
+	err  error
+}
+
+type authnKey struct{}
+
+// authenticate returns who made the request and the Scopes their key
+// allows, only authenticating it the first time if it came through
+// Authenticate.  The request form must be parsed by parseForm.
+func (g *Guard) authenticate(r *http.Request) (rbac.Principal, user.Scopes, error) {
+	a, ok := r.Context().Value(authnKey{}).(*authn)
+	if !ok {
+		p, scs, err := g.anyone(r)
+		return p, scs, unauthenticated(err)
+	}
+	if !a.done {
+		a.p, a.scs, a.err = g.anyone(r)
+		a.err, a.done = unauthenticated(a.err), true
+	}
+	return a.p, a.scs, a.err
+}
+
+// ScopeFunc returns the user.Scope a request needs from an access token.
+// A nil ScopeFunc allows keys with any Scope.
+type ScopeFunc func(*http.Request, htr.Params) user.Scope
+
+// Scope returns a ScopeFunc which always needs the given Scope.
+func Scope(sc user.Scope) ScopeFunc {
+	return func(*http.Request, htr.Params) user.Scope { return sc }
+}
+
+// Principal authenticates the request and returns who made it.  The request
+// form must be parsed by parseForm.
+func (g *Guard) Principal(r *http.Request) (rbac.Principal, error) {
+	p, _, err := g.authenticate(r)
+	return p, err
+}
+
+// Authorize authenticates the request and returns its Principal if it has
+// the wanted Permission.  The request form must be parsed by parseForm.
+func (g *Guard) Authorize(r *http.Request, want rbac.Permission) (rbac.Principal, error) {
+	p, err := g.Principal(r)
+	if err != nil {
+		return p, err
+	}
+	return p, g.RBAC.Can(p, want)
+}
+
+// Require wraps h so that it is only called for requests whose Principal
+// has the wanted Permission.  h can get the Principal from the request's
+// Context using rbac.FromContext.
+func (g *Guard) Require(want rbac.Permission, h htr.Handle) htr.Handle {
+	return g.guard(h, Scope(user.ScopeAll), func(p rbac.Principal) error {
+		return g.RBAC.Can(p, want)
+	})
+}
+
+// Authenticated wraps h so that it is only called for requests from admins
+// or logged-in users.  Access tokens must have user.ScopeAll.
+func (g *Guard) Authenticated(h htr.Handle) htr.Handle {
+	return g.AuthenticatedScoped(Scope(user.ScopeAll), h)
+}
+
+// AuthenticatedScoped is Authenticated for handlers which access tokens
+// with the Scope sc returns may use.
+func (g *Guard) AuthenticatedScoped(sc ScopeFunc, h htr.Handle) htr.Handle {
+	return g.guard(h, sc, nil)
+}
+
+// Admin wraps h so that it is only called for requests from admins.
+func (g *Guard) Admin(h htr.Handle) htr.Handle {
+	return g.guard(h, Scope(user.ScopeAll), only(rbac.KindAdmin))
+}
+
+// User wraps h so that it is only called for requests from logged-in users.
+// Access tokens must have user.ScopeAll.
+func (g *Guard) User(h htr.Handle) htr.Handle {
+	return g.UserScoped(Scope(user.ScopeAll), h)
+}
+
+// UserScoped is User for handlers which access tokens with the Scope sc
+// returns may use.
+func (g *Guard) UserScoped(sc ScopeFunc, h htr.Handle) htr.Handle {
+	return g.guard(h, sc, only(rbac.KindUser))
+}
+
+// Anonymous wraps h, which anyone may call, so that its request form is
+// parsed.  h may still ask the Guard for the request's Principal.
+func (g *Guard) Anonymous(h htr.Handle) htr.Handle {
+	return g.compat(func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		r = withRequestID(w, r)
+		if err := parseForm(w, r); err != nil {
+			WriteResponse(w, newApiError("bad request: "+err.Error(), badRequest(err)))
+			log.Printf("bad request to %s: %s", r.URL.Path, err.Error())
+			return
+		}
+		h(w, r, ps)
+	})
+}
+
+// Linked wraps h, which is reached by following a link, such as one mailed
+// to a user or a redirect back from another site, as Anonymous does, except
+// that the single-use token or code the link carries may be in the URL's
+// query.
+func (g *Guard) Linked(h htr.Handle) htr.Handle {
+	a := g.Anonymous(h)
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		a(w, r.WithContext(context.WithValue(r.Context(), linkedKey{}, true)), ps)
+	}
+}
+
+// only returns a check that a Principal is of the given Kind.
+func only(k rbac.Kind) func(rbac.Principal) error {
+	return func(p rbac.Principal) error {
+		if p.Kind != k {
+			return util.Forbiddenf("only %ss may do this, not %s", k, p)
+		}
+		return nil
+	}
+}
+
+// anyone authenticates an admin by key, or else a user by email and key.
+func (g *Guard) anyone(r *http.Request) (rbac.Principal, user.Scopes, error) {
+	p, scs, err := g.admin(r)
+	switch {
+	case err == nil:
+		return p, scs, nil
+	case !errors.IsUserNotFound(err):
+		return p, nil, err
+	case r.Form.Get("email") == "" && !isAccessKey(r.Form.Get("key")) && !isImpersonationKey(r.Form.Get("key")):
+		return p, nil, err
+	}
+
+	return g.user(r)
+}
+
+func (g *Guard) admin(r *http.Request) (rbac.Principal, user.Scopes, error) {
+	adm, err := g.Admins.Get(util.Key(r.Form.Get("key")))
+	if err != nil {
+		return rbac.Principal{}, nil, err
+	}
+	return rbac.Admin(adm.Email), user.Scopes{user.ScopeLogin}, nil
+}
+
+func (g *Guard) user(r *http.Request) (rbac.Principal, user.Scopes, error) {
+	email, key := r.Form.Get("email"), util.Key(r.Form.Get("key"))
+	switch {
+	case isImpersonationKey(string(key)):
+		return g.impersonation(r, key)
+	case email == "" && isAccessKey(string(key)):
+		return g.accessKey(r, key)
+	}
+
+	id, scs, err := validUserID(g.Users, email, key)
+	if err != nil {
+		return rbac.Principal{}, nil, err
+	}
+	return rbac.User(id), scs, nil
+}
+
+// accessKey authenticates a user by access token alone, and sets the
+// request's email to theirs.
+func (g *Guard) accessKey(r *http.Request, key util.Key) (rbac.Principal, user.Scopes, error) {
+	t, err := g.Users.ValidAccessKey(key)
+	if errors.IsNotValid(err) {
+		err = errors.NotValidf("bad key")
+	}
+	if err != nil {
+		return rbac.Principal{}, nil, err
+	}
+
+	u, err := g.Users.GetByID(t.User)
+	if err != nil {
+		return rbac.Principal{}, nil, err
+	}
+	r.Form.Set("email", u.Email)
+	return rbac.User(t.User), t.Scopes, nil
+}
+
+func isAccessKey(key string) bool {
+	return strings.HasPrefix(key, user.AccessTokenPrefix)
+}
+
+// impersonation authenticates the user an admin is impersonating, sets the
+// request's email to theirs, and marks its Context with the admin.
+func (g *Guard) impersonation(r *http.Request, key util.Key) (rbac.Principal, user.Scopes, error) {
+	imp, adm, err := g.Admins.Impersonating(key)
+	if err != nil {
+		return rbac.Principal{}, nil, err
+	}
+
+	u, err := g.Users.GetByID(imp.User)
+	if err != nil {
+		return rbac.Principal{}, nil, errors.NotValidf("impersonation key")
+	}
+
+	r.Form.Set("email", u.Email)
+	// The request is changed in place so that the mark outlives auth.
+	*r = *r.WithContext(rbac.WithImpersonator(r.Context(), rbac.Admin(adm.Email)))
+	log.Printf("%s impersonating %s for %s", rbac.Admin(adm.Email), rbac.User(u.ID), r.URL.Path)
+	return rbac.User(u.ID), user.Scopes{user.ScopeLogin}, nil
+}
+
+func isImpersonationKey(key string) bool {
+	return strings.HasPrefix(key, admin.ImpersonationPrefix)
+}
+
+// guard wraps h so that it is only called for authenticated requests whose
+// Principal passes check, if it is not nil, and whose key has the Scope sc
+// returns.
+func (g *Guard) guard(
+	h htr.Handle,
+	sc ScopeFunc,
+	check func(rbac.Principal) error,
+) htr.Handle {
+	return g.compat(func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		r = withRequestID(w, r)
+		if err := parseForm(w, r); err != nil {
+			WriteResponse(w, newApiError("bad request: "+err.Error(), badRequest(err)))
+			log.Printf("bad request to %s: %s", r.URL.Path, err.Error())
+			return
+		}
+
+		p, scs, err := g.authenticate(r)
+		if err == nil && check != nil {
+			err = check(p)
+		}
+		if err == nil && sc != nil {
+			if want := sc(r, ps); !scs.Grants(want) {
+				err = util.Forbiddenf("key of %s lacks scope %q", p, want)
+			}
+		}
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("unauthorized request for %s: %s", r.URL.Path, err.Error())
+			return
+		}
+
+		h(w, r.WithContext(rbac.NewContext(r.Context(), p)), ps)
+	})
+}
+
+// principal returns the Principal a Guard put in the request's Context.
+func principal(r *http.Request) rbac.Principal {
+	p, _ := rbac.FromContext(r.Context())
+	return p
+}
+
+// RequestIDHeader carries a request's ID in the response.  The ID is always
+// made by the server; one sent by the client is only kept alongside it.
+const RequestIDHeader = "X-Request-Id"
+
+// maxClientRequestID is the longest client request ID kept.
+const maxClientRequestID = 64
+
+type requestIDKey struct{}
+
+// requestIDs are the ID the server gave a request, and the sanitized ID its
+// client sent, if any.
+type requestIDs struct {
+	id, client string
+}
+
+// withRequestID gives the request an ID, unless it has one already, and
+// sends it back with the response.
+func withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	ids, ok := r.Context().Value(requestIDKey{}).(requestIDs)
+	if !ok {
+		k, err := util.NewKey()
+		if err != nil {
+			log.Printf("error making request ID: %s", err.Error())
+		} else {
+			ids.id = string(k[:16])
+		}
+		ids.client = sanitizeRequestID(r.Header.Get(RequestIDHeader))
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, ids))
+	}
+
+	w.Header().Set(RequestIDHeader, ids.id)
+	return r
+}
+
+// requestID returns the IDs withRequestID gave the request.
+func requestID(r *http.Request) requestIDs {
+	ids, _ := r.Context().Value(requestIDKey{}).(requestIDs)
+	return ids
+}
+
+// sanitizeRequestID keeps only the letters, digits, dots, dashes and
+// underscores of a client's request ID, up to maxClientRequestID of them.
+func sanitizeRequestID(id string) string {
+	bs := make([]byte, 0, maxClientRequestID)
+	for i := 0; i < len(id) && len(bs) < maxClientRequestID; i++ {
+		switch c := id[i]; {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			c == '.', c == '-', c == '_':
+			bs = append(bs, c)
+		}
+	}
+	return string(bs)
+}
+
+// record records an action taken on a target in the request in the audit
+// log, as taken by the request's Principal, or by actor if it has none, and
+// by the admin impersonating them, if any.
+func (g *Guard) record(r *http.Request, actor, action, target string, err error) {
+	if g.Audit == nil {
+		return
+	}
+
+	ids := requestID(r)
+	e := &audit.Entry{
+		Actor:           actor,
+		Action:          action,
+		Target:          target,
+		RequestID:       ids.id,
+		ClientRequestID: ids.client,
+	}
+	if p, ok := rbac.FromContext(r.Context()); ok {
+		e.Actor = p.String()
+	}
+	if imp, ok := rbac.ImpersonatorFrom(r.Context()); ok {
+		e.Impersonator = imp.String()
+	}
+
+	if _, aerr := g.Audit.Append(e, err); aerr != nil {
+		log.Printf("error auditing %s of %q by %s: %s", action, target, e.Actor, aerr.Error())
+	}
+}
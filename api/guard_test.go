@@ -0,0 +1,180 @@
+package api_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	htr "github.com/julienschmidt/httprouter"
+	"github.com/synapse-garden/mf-proto/api"
+	"github.com/synapse-garden/mf-proto/audit"
+	"github.com/synapse-garden/mf-proto/user"
+	"github.com/synapse-garden/mf-proto/util"
+
+	gc "gopkg.in/check.v1"
+)
+
+func (s *APISuite) TestGuard(c *gc.C) {
+	bob := s.users["bob"]
+	key := s.login("bob", c)
+	tok, err := s.us.CreateAccessToken(bob.Email, "ci", time.Hour, user.ScopeObjectRead)
+	c.Assert(err, jc.ErrorIsNil)
+	valid := "/user/valid?email=" + url.QueryEscape(bob.Email)
+
+	for i, t := range []struct {
+		should       string
+		method, path string
+		body         string
+		key          util.Key
+		status       int
+		code         string
+	}{{
+		should: "refuse a request with no key",
+		method: "GET", path: "/admin/valid",
+		status: http.StatusUnauthorized, code: "unauthorized",
+	}, {
+		should: "refuse a request with a bad key",
+		method: "GET", path: "/admin/valid",
+		key:    "nope",
+		status: http.StatusUnauthorized, code: "unauthorized",
+	}, {
+		should: "refuse a bad login key for a user",
+		method: "GET", path: valid,
+		key:    "nope",
+		status: http.StatusUnauthorized, code: "unauthorized",
+	}, {
+		should: "forbid users from admin routes",
+		method: "GET", path: "/admin/valid?email=" + url.QueryEscape(bob.Email),
+		key:    key,
+		status: http.StatusForbidden, code: "forbidden",
+	}, {
+		should: "forbid admins from user routes",
+		method: "GET", path: valid,
+		key:    s.adminKey,
+		status: http.StatusForbidden, code: "forbidden",
+	}, {
+		should: "forbid access tokens without the route's scope",
+		method: "POST", path: "/user/totp",
+		key:    tok.Key,
+		status: http.StatusForbidden, code: "forbidden",
+	}, {
+		should: "allow an admin",
+		method: "GET", path: "/admin/valid",
+		key:    s.adminKey,
+		status: http.StatusOK,
+	}, {
+		should: "allow a user",
+		method: "GET", path: valid,
+		key:    key,
+		status: http.StatusOK,
+	}, {
+		should: "allow an access token by itself",
+		method: "GET", path: "/user/valid",
+		key:    tok.Key,
+		status: http.StatusOK,
+	}} {
+		c.Logf("test %d: should %s", i, t.should)
+		w := s.request(t.method, t.path, t.body, t.key)
+		if t.status == http.StatusOK {
+			checkOK(w, c)
+		} else {
+			checkError(w, t.status, t.code, c)
+		}
+	}
+}
+
+func (s *APISuite) TestGuardResolvesOnce(c *gc.C) {
+	var got []string
+	twice := func(r *htr.Router) error {
+		inner := s.g.Admin(func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+			p, err := s.g.Principal(r)
+			c.Check(err, jc.ErrorIsNil)
+			got = append(got, p.String())
+			api.WriteResponse(w, "ok")
+		})
+		r.POST("/twice", s.g.Admin(func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+			// Once the request's key has been checked, revoking it
+			// doesn't change who the request is from.
+			c.Assert(s.as.Delete(s.adminKey), jc.ErrorIsNil)
+			inner(w, r, ps)
+		}))
+		return nil
+	}
+	h, err := s.g.Routes(twice)
+	c.Assert(err, jc.ErrorIsNil)
+	s.h = h
+
+	checkOK(s.request("POST", "/twice", "", s.adminKey), c)
+	c.Check(got, jc.DeepEquals, []string{"admin:admin@tomato.com"})
+	checkError(s.request("POST", "/twice", "", s.adminKey), http.StatusUnauthorized, "unauthorized", c)
+}
+
+func (s *APISuite) TestGuardPrincipalReachesService(c *gc.C) {
+	bob := s.users["bob"]
+	id, err := s.us.ID(bob.Email)
+	c.Assert(err, jc.ErrorIsNil)
+	imp, err := s.as.Impersonate("admin@tomato.com", id, bob.Email, time.Hour)
+	c.Assert(err, jc.ErrorIsNil)
+
+	// An impersonation key is not bob's login, but the Guard lets it
+	// act as bob, so the service acts for the user the Guard found.
+	w := s.request("POST", "/user/totp", "", imp.Key)
+	checkOK(w, c)
+	u, err := s.us.Get(bob.Email)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(u.TOTP, gc.NotNil)
+
+	larry := s.users["larry"]
+	key := s.login("larry", c)
+	w = s.request("POST", "/user/password", fmt.Sprintf(
+		`{"email":%q,"pwhash":%q,"newpwhash":"new-password"}`, larry.Email, larry.Pwhash,
+	), key)
+	checkOK(w, c)
+	var changed user.User
+	value(w, &changed, c)
+	c.Check(s.us.ValidLogin(larry.Email, changed.Key), jc.ErrorIsNil)
+	c.Check(s.us.ValidLogin(larry.Email, key), gc.NotNil)
+	c.Check(s.us.CheckUser(larry.Email, "new-password"), jc.ErrorIsNil)
+}
+
+func (s *APISuite) TestGuardRequestID(c *gc.C) {
+	for i, t := range []struct {
+		given, client string
+	}{{
+		given: "", client: "",
+	}, {
+		given: "trace-1.a_b", client: "trace-1.a_b",
+	}, {
+		given: "evil\x1b[2J\"id\" <x>", client: "evil2Jidx",
+	}, {
+		given: strings.Repeat("a", 100), client: strings.Repeat("a", 64),
+	}} {
+		c.Logf("test %d: %q", i, t.given)
+		r := httptest.NewRequest("POST", "/admin/keys", strings.NewReader(`{"name":"ci"}`))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("Authorization", "Bearer "+string(s.adminKey))
+		r.Header.Set(api.RequestIDHeader, t.given)
+		w := httptest.NewRecorder()
+		s.h.ServeHTTP(w, r)
+		checkOK(w, c)
+
+		// The server always makes the request's ID.
+		id := w.Header().Get(api.RequestIDHeader)
+		c.Check(id, gc.Matches, `[0-9a-f]{16}`)
+		c.Check(id, gc.Not(gc.Equals), t.given)
+
+		es, err := s.au.Query(audit.Filter{Action: "admin.key.create"})
+		c.Assert(err, jc.ErrorIsNil)
+		c.Assert(es, gc.HasLen, i+1)
+		c.Check(es[i].RequestID, gc.Equals, id)
+		c.Check(es[i].ClientRequestID, gc.Equals, t.client)
+	}
+
+	// Requests which don't reach a handler still get an ID.
+	w := s.request("GET", "/nowhere", "", "")
+	c.Check(w.Header().Get(api.RequestIDHeader), gc.Not(gc.Equals), "")
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	htr "github.com/julienschmidt/httprouter"
+	"github.com/synapse-garden/mf-proto/admin"
+	"github.com/synapse-garden/mf-proto/rbac"
+	"github.com/synapse-garden/mf-proto/user"
+	"github.com/synapse-garden/mf-proto/util"
+
+	"github.com/juju/errors"
+)
+
+// Impersonate binds the admin impersonation API for the given Services to a
+// Router, guarded by the given Guard.  Admins with user:impersonate may act
+// as a user, but not one who is an admin or may manage admins, by using
+// the key they are given until it expires or they end it.
+func Impersonate(as *admin.Service, us *user.Service, g *Guard) API {
+	return func(r *htr.Router) error {
+		g.handle(r, "POST", "/admin/impersonations", "/admin/impersonate", g.Require(rbac.UserImpersonate, handleImpersonate(as, us, g)))
+		g.handle(r, "DELETE", "/admin/impersonations/:id", "/admin/impersonate/end", g.Admin(handleImpersonateEnd(as, g)))
+		return nil
+	}
+}
+
+// handleImpersonate starts an impersonation of the user given as user, for
+// ttl, or admin.DefaultImpersonation.
+func handleImpersonate(as *admin.Service, us *user.Service, g *Guard) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		p, email := principal(r), targetEmail(r)
+		target := userTarget(us, email)
+
+		imp, err := impersonate(as, us, g, p, email, r.Form.Get("ttl"))
+		g.record(r, "", "user.impersonate", target, err)
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("error impersonating %q by %s: %s", email, p, err.Error())
+			return
+		}
+
+		log.Printf("%s impersonating %s until %s", p, target, imp.Expires.Format(time.RFC3339))
+		WriteResponse(w, imp)
+	}
+}
+
+// impersonate starts an impersonation by the admin p of the user with the
+// given email, for the given duration if any.
+func impersonate(as *admin.Service, us *user.Service, g *Guard, p rbac.Principal, email, ttl string) (*admin.Impersonation, error) {
+	if p.Kind != rbac.KindAdmin {
+		return nil, util.Forbiddenf("%s is not an admin", p)
+	}
+
+	d := admin.DefaultImpersonation
+	if ttl != "" {
+		var err error
+		if d, err = time.ParseDuration(ttl); err != nil {
+			return nil, errors.NotValidf("ttl %q", ttl)
+		}
+	}
+
+	id, err := us.ID(email)
+	if err != nil {
+		return nil, err
+	}
+
+	if g.RBAC.Can(rbac.User(id), rbac.AdminManage) == nil {
+		return nil, util.Forbiddenf("%s may not impersonate %q, who may manage admins", p, email)
+	}
+
+	return as.Impersonate(p.ID, id, email, d)
+}
+
+func handleImpersonateEnd(as *admin.Service, g *Guard) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		p, id := principal(r), r.Form.Get("id")
+		err := as.EndImpersonation(p.ID, id)
+		g.record(r, "", "user.impersonate.end", "impersonation "+id, err)
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("error ending impersonation %q by %s: %s", id, p, err.Error())
+			return
+		}
+
+		log.Printf("%s ended impersonation %q", p, id)
+		WriteResponse(w, "ok")
+	}
+}
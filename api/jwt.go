@@ -0,0 +1,55 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	htr "github.com/julienschmidt/httprouter"
+	"github.com/synapse-garden/mf-proto/rbac"
+	"github.com/synapse-garden/mf-proto/user"
+)
+
+// JWT binds the JWT login key API for the given Service to a Router,
+// guarded by the given Guard.  The public keys are published as a JWKS so
+// that other services can check JWT logins themselves.
+func JWT(us *user.Service, g *Guard) API {
+	return func(r *htr.Router) error {
+		r.GET("/.well-known/jwks.json", handleJWKS(us))
+		g.handle(r, "POST", "/admin/jwt/rotate", "/admin/jwt/rotate", g.Require(rbac.AdminManage, handleAdminJWTRotate(us, g)))
+		return nil
+	}
+}
+
+// handleJWKS writes the JWKS bare, as JWKS clients expect.
+func handleJWKS(us *user.Service) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		ks, err := us.JWKS()
+		if err != nil {
+			http.Error(w, "failed to get keys", http.StatusInternalServerError)
+			log.Printf("error getting JWKS: %s", err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "max-age=300")
+		if err := json.NewEncoder(w).Encode(ks); err != nil {
+			log.Printf("failed to write JWKS: %s", err.Error())
+		}
+	}
+}
+
+func handleAdminJWTRotate(us *user.Service, g *Guard) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		kid, err := us.RotateJWTKey()
+		g.record(r, "", "jwt.rotate", "jwt key "+kid, err)
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("error rotating JWT key: %s", err.Error())
+			return
+		}
+
+		log.Printf("%s rotated the JWT signing key to %q", principal(r), kid)
+		WriteResponse(w, kid)
+	}
+}
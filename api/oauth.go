@@ -0,0 +1,373 @@
+package api
+
+import (
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	htr "github.com/julienschmidt/httprouter"
+	"github.com/synapse-garden/mf-proto/db"
+	"github.com/synapse-garden/mf-proto/oauth"
+	"github.com/synapse-garden/mf-proto/rbac"
+	"github.com/synapse-garden/mf-proto/user"
+	"github.com/synapse-garden/mf-proto/util"
+)
+
+// OAuth binds the OAuth 2.0 authorization server for the given Services to
+// a Router, guarded by the given Guard.  The authorization endpoint shows a
+// consent page where the user signs in to allow a client access; the token
+// and revocation endpoints are for clients.  Clients are managed by admins.
+func OAuth(oas *oauth.Service, us *user.Service, g *Guard) API {
+	return func(r *htr.Router) error {
+		if err := db.SetupBuckets(oas.DB, oauth.Buckets()); err != nil {
+			return err
+		}
+
+		g.handle(r, "GET", "/oauth/authorize", "", g.Anonymous(handleOAuthAuthorize(oas)))
+		g.handle(r, "POST", "/oauth/authorize", "", g.Anonymous(handleOAuthConsent(oas, us, g)))
+		g.handle(r, "POST", "/oauth/token", "", g.Anonymous(handleOAuthToken(oas)))
+		g.handle(r, "POST", "/oauth/revoke", "", g.Anonymous(handleOAuthRevoke(oas)))
+
+		r.GET("/admin/oauth/clients", g.Require(rbac.OAuthManage, handleOAuthClients(oas)))
+		g.handle(r, "POST", "/admin/oauth/clients", "/admin/oauth/client/create", g.Require(rbac.OAuthManage, handleOAuthClientCreate(oas, g)))
+		g.handle(r, "DELETE", "/admin/oauth/clients/:id", "/admin/oauth/client/delete", g.Require(rbac.OAuthManage, handleOAuthClientDelete(oas, g)))
+		return nil
+	}
+}
+
+var consentPage = template.Must(template.New("consent").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Allow {{.Client.Name}}?</title></head>
+<body>
+<h1>Allow {{.Client.Name}} to access your account?</h1>
+<p>{{.Client.Name}} is asking to:</p>
+<ul>{{range .Scopes}}<li>{{.}}</li>{{end}}</ul>
+{{if .Error}}<p><strong>{{.Error}}</strong></p>{{end}}
+<form method="post" action="/oauth/authorize">
+{{with .Request}}<input type="hidden" name="response_type" value="{{.ResponseType}}">
+<input type="hidden" name="client_id" value="{{.ClientID}}">
+<input type="hidden" name="redirect_uri" value="{{.RedirectURI}}">
+<input type="hidden" name="scope" value="{{.Scope}}">
+<input type="hidden" name="state" value="{{.State}}">
+<input type="hidden" name="code_challenge" value="{{.Challenge}}">
+<input type="hidden" name="code_challenge_method" value="{{.ChallengeMethod}}">{{end}}
+<p><label>Email <input type="email" name="email" value="{{.Email}}" required></label></p>
+<p><label>Password hash <input type="password" name="pwhash" required></label></p>
+<p><label>Two-factor code, if enabled <input type="text" name="code" autocomplete="one-time-code"></label></p>
+<p><button type="submit" name="allow" value="true">Allow</button>
+<button type="submit" name="deny" value="true" formnovalidate>Deny</button></p>
+</form>
+</body>
+</html>
+`))
+
+// scopeDescriptions are shown on the consent page for well-known Scopes.
+var scopeDescriptions = map[user.Scope]string{
+	user.ScopeAll:          "do anything you can, except manage your login",
+	user.ScopeObjectRead:   "read your objects",
+	user.ScopeObjectWrite:  "read, write and delete your objects",
+	user.ScopeProfileRead:  "read your account and profile",
+	user.ScopeProfileWrite: "read and update your profile",
+}
+
+type consent struct {
+	Client  *oauth.Client
+	Request *oauth.Request
+	Scopes  []string
+	Email   string
+	Error   string
+}
+
+// oauthRequest reads an authorization Request from the request's form.
+func oauthRequest(r *http.Request) *oauth.Request {
+	return &oauth.Request{
+		ResponseType:    r.Form.Get("response_type"),
+		ClientID:        r.Form.Get("client_id"),
+		RedirectURI:     r.Form.Get("redirect_uri"),
+		Scope:           r.Form.Get("scope"),
+		State:           r.Form.Get("state"),
+		Challenge:       r.Form.Get("code_challenge"),
+		ChallengeMethod: r.Form.Get("code_challenge_method"),
+	}
+}
+
+// checkOAuthRequest checks the authorization Request, and responds to the
+// user if it isn't valid: with an error page if the client or redirect URI
+// can't be trusted, or else by redirecting to the client with the error.
+func checkOAuthRequest(oas *oauth.Service, w http.ResponseWriter, r *http.Request, req *oauth.Request) (*oauth.Client, bool) {
+	c, err := oas.Check(req)
+	if err == nil {
+		return c, true
+	}
+
+	if e, ok := err.(*oauth.Error); ok {
+		redirectOAuth(w, r, req, url.Values{
+			"error":             {e.Code},
+			"error_description": {e.Description},
+		})
+	} else {
+		http.Error(w, "bad authorization request: "+err.Error(), http.StatusBadRequest)
+	}
+	log.Printf("bad OAuth authorization request: %s", err.Error())
+	return nil, false
+}
+
+// redirectOAuth redirects the user back to the Request's redirect URI with
+// the given values and the Request's state.
+func redirectOAuth(w http.ResponseWriter, r *http.Request, req *oauth.Request, vs url.Values) {
+	u, err := url.Parse(req.RedirectURI)
+	if err != nil {
+		http.Error(w, "bad redirect URI", http.StatusBadRequest)
+		return
+	}
+
+	q := u.Query()
+	for k, v := range vs {
+		q[k] = v
+	}
+	if req.State != "" {
+		q.Set("state", req.State)
+	}
+	u.RawQuery = q.Encode()
+
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+func renderConsent(w http.ResponseWriter, status int, cs *consent) {
+	for _, sc := range cs.Request.Scopes() {
+		desc, ok := scopeDescriptions[sc]
+		if !ok {
+			desc = string(sc)
+		}
+		cs.Scopes = append(cs.Scopes, desc)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.WriteHeader(status)
+	if err := consentPage.Execute(w, cs); err != nil {
+		log.Printf("failed to render consent page: %s", err.Error())
+	}
+}
+
+// handleOAuthAuthorize shows the consent page for a valid authorization
+// request.
+func handleOAuthAuthorize(oas *oauth.Service) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		req := oauthRequest(r)
+		c, ok := checkOAuthRequest(oas, w, r, req)
+		if !ok {
+			return
+		}
+
+		renderConsent(w, http.StatusOK, &consent{Client: c, Request: req})
+	}
+}
+
+// handleOAuthConsent handles the consent page's form.  If the user allows
+// the request and signs in, they are redirected to the client with an
+// authorization code.  The user's credentials are only read from the posted
+// form, never the URL, even for Legacy Guards.
+func handleOAuthConsent(oas *oauth.Service, us *user.Service, g *Guard) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		if cs := queryCredentials(r); len(cs) > 0 {
+			http.Error(w, "bad request: "+cs[0]+" may not be given in the URL", http.StatusBadRequest)
+			log.Printf("OAuth consent with %s in URL query refused", cs[0])
+			return
+		}
+
+		req := oauthRequest(r)
+		c, ok := checkOAuthRequest(oas, w, r, req)
+		if !ok {
+			return
+		}
+
+		f := r.PostForm
+		if f.Get("allow") != "true" {
+			redirectOAuth(w, r, req, url.Values{"error": {oauth.AccessDenied}})
+			return
+		}
+
+		email := f.Get("email")
+		u, err := us.Authenticate(remoteAddr(r), email, f.Get("pwhash"), f.Get("code"))
+		if err != nil {
+			g.record(r, "consent@"+remoteAddr(r), "oauth.authorize", clientTarget(c), err)
+			renderConsent(w, http.StatusUnauthorized, &consent{
+				Client:  c,
+				Request: req,
+				Email:   email,
+				Error:   err.Error(),
+			})
+			log.Printf("OAuth consent for %q failed: %s", email, err.Error())
+			return
+		}
+
+		k, err := oas.Authorize(req, u.ID)
+		g.record(r, rbac.User(u.ID).String(), "oauth.authorize", clientTarget(c), err)
+		if err != nil {
+			http.Error(w, "authorization failed", http.StatusInternalServerError)
+			log.Printf("error authorizing client %q for %q: %s", c.ID, email, err.Error())
+			return
+		}
+
+		log.Printf("user %q authorized OAuth client %q", email, c.ID)
+		redirectOAuth(w, r, req, url.Values{"code": {string(k)}})
+	}
+}
+
+// writeOAuth writes v as a bare JSON response, as OAuth clients expect.
+func writeOAuth(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("failed to write OAuth response: %s", err.Error())
+	}
+}
+
+// writeOAuthError writes err as an OAuth Error if it is one.
+func writeOAuthError(w http.ResponseWriter, err error) {
+	e, ok := err.(*oauth.Error)
+	switch {
+	case !ok:
+		writeOAuth(w, http.StatusInternalServerError, &oauth.Error{Code: "server_error"})
+	case e.Code == oauth.InvalidClient:
+		w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+		writeOAuth(w, http.StatusUnauthorized, e)
+	default:
+		writeOAuth(w, http.StatusBadRequest, e)
+	}
+}
+
+// clientCredentials returns the client ID and secret of a request to the
+// token or revocation endpoint, from HTTP Basic authentication or else
+// the client_id and client_secret values.
+func clientCredentials(r *http.Request) (string, util.Key) {
+	if id, secret, ok := r.BasicAuth(); ok {
+		if uid, err := url.QueryUnescape(id); err == nil {
+			id = uid
+		}
+		if usecret, err := url.QueryUnescape(secret); err == nil {
+			secret = usecret
+		}
+		return id, util.Key(secret)
+	}
+	return r.PostForm.Get("client_id"), util.Key(r.PostForm.Get("client_secret"))
+}
+
+// handleOAuthToken exchanges an authorization code or refresh token for a
+// new Token.
+func handleOAuthToken(oas *oauth.Service) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		id, secret := clientCredentials(r)
+		f := r.PostForm
+
+		var (
+			t   *oauth.Token
+			err error
+		)
+		switch gt := f.Get("grant_type"); gt {
+		case "authorization_code":
+			t, err = oas.Exchange(id, secret, util.Key(f.Get("code")), f.Get("redirect_uri"), f.Get("code_verifier"))
+		case "refresh_token":
+			t, err = oas.Refresh(id, secret, util.Key(f.Get("refresh_token")), f.Get("scope"))
+		default:
+			err = &oauth.Error{Code: oauth.UnsupportedGrantType, Description: gt}
+		}
+		if err != nil {
+			writeOAuthError(w, err)
+			log.Printf("OAuth token request from %q failed: %s", id, err.Error())
+			return
+		}
+
+		writeOAuth(w, http.StatusOK, t)
+	}
+}
+
+// handleOAuthRevoke revokes the access or refresh token given as the
+// token value.
+func handleOAuthRevoke(oas *oauth.Service) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		id, secret := clientCredentials(r)
+		if err := oas.Revoke(id, secret, util.Key(r.PostForm.Get("token"))); err != nil {
+			writeOAuthError(w, err)
+			log.Printf("OAuth revocation from %q failed: %s", id, err.Error())
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func handleOAuthClients(oas *oauth.Service) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		cs, err := oas.AllClients()
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("error listing OAuth clients: %s", err.Error())
+			return
+		}
+
+		WriteResponse(w, cs)
+	}
+}
+
+// clientTarget names the Client, which may be nil, in the audit log.
+func clientTarget(c *oauth.Client) string {
+	if c == nil {
+		return "oauth client"
+	}
+	return "oauth client " + c.ID
+}
+
+// handleOAuthClientCreate registers a client using the name, redirect_uris,
+// scopes and confidential values of the request.  Redirect URIs and Scopes
+// are separated by commas.  A confidential client's secret is only shown
+// in this response.
+func handleOAuthClientCreate(oas *oauth.Service, g *Guard) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		var redirects []string
+		for _, u := range strings.Split(r.Form.Get("redirect_uris"), ",") {
+			if u = strings.TrimSpace(u); u != "" {
+				redirects = append(redirects, u)
+			}
+		}
+
+		c, err := oas.RegisterClient(
+			r.Form.Get("name"),
+			redirects,
+			parseScopes(r.Form.Get("scopes")),
+			r.Form.Get("confidential") == "true",
+		)
+		g.record(r, "", "oauth.client.create", clientTarget(c), err)
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("error registering OAuth client: %s", err.Error())
+			return
+		}
+
+		log.Printf("%s registered OAuth client %q (%s)", principal(r), c.Name, c.ID)
+		WriteResponse(w, c)
+	}
+}
+
+func handleOAuthClientDelete(oas *oauth.Service, g *Guard) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		id := r.Form.Get("id")
+		err := oas.DeleteClient(id)
+		g.record(r, "", "oauth.client.delete", "oauth client "+id, err)
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("error deleting OAuth client %q: %s", id, err.Error())
+			return
+		}
+
+		log.Printf("%s deleted OAuth client %q", principal(r), id)
+		WriteResponse(w, "ok")
+	}
+}
@@ -0,0 +1,103 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/synapse-garden/mf-proto/audit"
+	"github.com/synapse-garden/mf-proto/cli"
+	"github.com/synapse-garden/mf-proto/db"
+	"github.com/synapse-garden/mf-proto/oauth"
+
+	"github.com/juju/errors"
+)
+
+// OAuthCLI binds the OAuth client admin console commands for the given
+// Service to a CLI.  Changes made with them are recorded in the audit log.
+func OAuthCLI(oas *oauth.Service, au *audit.Service) cli.Binding {
+	return func(c *cli.CLI) error {
+		if err := db.SetupBuckets(oas.DB, oauth.Buckets()); err != nil {
+			return err
+		}
+
+		return c.AddCommands(&cli.Command{
+			Name:        "oauth-clients",
+			Description: "list registered OAuth clients",
+			Fn:          cliOAuthClients(oas),
+		}, &cli.Command{
+			Name:        "oauth-client-create",
+			Description: "register an OAuth client, e.g. oauth-client-create confidential https://notes.example/cb object:read,profile:read Notes App",
+			Fn:          cliOAuthClientCreate(oas, au),
+		}, &cli.Command{
+			Name:        "oauth-client-delete",
+			Description: "delete an OAuth client by ID, revoking its tokens",
+			Fn:          cliOAuthClientDelete(oas, au),
+		})
+	}
+}
+
+func cliOAuthClients(oas *oauth.Service) cli.CommandFunc {
+	return func(args ...string) (cli.Response, error) {
+		cs, err := oas.AllClients()
+		if err != nil {
+			return "", err
+		}
+
+		lines := make([]string, len(cs))
+		for i, c := range cs {
+			kind := "public"
+			if c.Confidential() {
+				kind = "confidential"
+			}
+			scs := make([]string, len(c.Scopes))
+			for j, sc := range c.Scopes {
+				scs[j] = string(sc)
+			}
+			lines[i] = fmt.Sprintf("%s  %-24s %-12s %s  %s",
+				c.ID, c.Name, kind, strings.Join(scs, ","), strings.Join(c.RedirectURIs, ","),
+			)
+		}
+
+		return cli.Response(strings.Join(lines, "\n")), nil
+	}
+}
+
+func cliOAuthClientCreate(oas *oauth.Service, au *audit.Service) cli.CommandFunc {
+	return func(args ...string) (cli.Response, error) {
+		if len(args) < 4 || (args[0] != "public" && args[0] != "confidential") {
+			return "", errors.New("oauth-client-create takes public or confidential, comma-separated redirect URIs, comma-separated scopes and a name as its args")
+		}
+
+		c, err := oas.RegisterClient(
+			strings.Join(args[3:], " "),
+			strings.Split(args[1], ","),
+			parseScopes(args[2]),
+			args[0] == "confidential",
+		)
+		consoleRecord(au, "oauth.client.create", clientTarget(c), err)
+		if err != nil {
+			return "", err
+		}
+
+		if c.Confidential() {
+			return cli.Response(fmt.Sprintf("client %s registered ok, secret %s", c.ID, c.Secret)), nil
+		}
+		return cli.Response(fmt.Sprintf("client %s registered ok", c.ID)), nil
+	}
+}
+
+func cliOAuthClientDelete(oas *oauth.Service, au *audit.Service) cli.CommandFunc {
+	return func(args ...string) (cli.Response, error) {
+		if len(args) != 1 {
+			return "", errors.New("oauth-client-delete takes a client ID as its arg")
+		}
+
+		err := oas.DeleteClient(args[0])
+		consoleRecord(au, "oauth.client.delete", "oauth client "+args[0], err)
+		if err != nil {
+			return "", err
+		}
+
+		return cli.Response(fmt.Sprintf("client %s deleted ok", args[0])), nil
+	}
+}
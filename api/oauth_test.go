@@ -0,0 +1,46 @@
+package api_test
+
+import (
+	"net/http"
+	"net/url"
+
+	jc "github.com/juju/testing/checkers"
+	"github.com/synapse-garden/mf-proto/audit"
+	"github.com/synapse-garden/mf-proto/oauth"
+	"github.com/synapse-garden/mf-proto/user"
+
+	gc "gopkg.in/check.v1"
+)
+
+func (s *APISuite) TestOAuthConsentAudited(c *gc.C) {
+	cl, err := s.oas.RegisterClient("ci", []string{"https://ci.test/cb"}, user.Scopes{user.ScopeObjectRead}, false)
+	c.Assert(err, jc.ErrorIsNil)
+	bob := s.users["bob"]
+	form := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {cl.ID},
+		"scope":                 {string(user.ScopeObjectRead)},
+		"code_challenge":        {"E9Melhoa2OwvFrEMTJguCQaoeJ8LqyIFTk8d9ROXclY"},
+		"code_challenge_method": {oauth.MethodS256},
+		"allow":                 {"true"},
+		"email":                 {bob.Email},
+		"pwhash":                {"wrong"},
+	}
+
+	w := s.requestForm("POST", "/oauth/authorize", form)
+	c.Check(w.Code, gc.Equals, http.StatusUnauthorized)
+
+	form.Set("pwhash", bob.Pwhash)
+	w = s.requestForm("POST", "/oauth/authorize", form)
+	c.Assert(w.Code, gc.Equals, http.StatusFound, gc.Commentf("body %q", w.Body.String()))
+	c.Check(w.Header().Get("Location"), gc.Matches, `https://ci\.test/cb\?code=.+`)
+
+	es, err := s.au.Query(audit.Filter{Action: "oauth.authorize"})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(es, gc.HasLen, 2)
+	c.Check(es[0].Actor, gc.Matches, `consent@.*`)
+	c.Check(es[0].Outcome, gc.Equals, audit.Failed)
+	c.Check(es[1].Actor, gc.Equals, "user:"+s.mustID(bob.Email, c))
+	c.Check(es[1].Target, gc.Equals, "oauth client "+cl.ID)
+	c.Check(es[1].Outcome, gc.Equals, audit.OK)
+}
@@ -4,52 +4,83 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
 
 	"github.com/juju/errors"
 	htr "github.com/julienschmidt/httprouter"
 	"github.com/synapse-garden/mf-proto/db"
 	"github.com/synapse-garden/mf-proto/object"
+	"github.com/synapse-garden/mf-proto/rbac"
 	"github.com/synapse-garden/mf-proto/user"
 	"github.com/synapse-garden/mf-proto/util"
 )
 
-// Object binds the Object database package for the given DB to a Router.
-func Object(d db.DB) API {
+// Object binds the Object database package for the given Service to a
+// Router, guarded by the given Guard.  Users may use their own Objects and
+// those shared with them, and anyone with object:read:any or
+// object:write:any may read or delete any.  Owners share an Object by
+// putting it with readers and writers values, each a comma-separated list
+// of principals such as user:<id> or group:<id>.  Access tokens need an
+// object Scope covering the object's collection.
+func Object(objs *object.Service, g *Guard) API {
 	return func(r *htr.Router) error {
-		if err := db.SetupBuckets(d, object.Buckets()); err != nil {
+		if err := db.SetupBuckets(objs.DB, object.Buckets()); err != nil {
 			return err
 		}
 
-		r.PUT("/object/:id", handleObjectPut(d))
-		r.DELETE("/object/:id", handleObjectDelete(d))
-		r.GET("/object/:id", handleObjectGet(d))
+		r.PUT("/object/:id", g.UserScoped(objectScope(true), handleObjectPut(objs, g)))
+		r.DELETE("/object/:id", g.AuthenticatedScoped(objectScope(true), handleObjectDelete(objs, g)))
+		r.GET("/object/:id", g.AuthenticatedScoped(objectScope(false), handleObjectGet(objs, g)))
 		return nil
 	}
 }
 
-func handleObjectPut(d db.DB) htr.Handle {
-	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
-		if err := r.ParseForm(); err != nil {
-			WriteResponse(w, newApiError(err.Error(), err))
-			log.Printf("bad object request: %#v", r)
-			return
-		}
+// objectScope returns a ScopeFunc for reading, or writing if write is true,
+// the object with the request's id.
+func objectScope(write bool) ScopeFunc {
+	return func(r *http.Request, ps htr.Params) user.Scope {
+		return user.ObjectScope(write, util.Key(ps.ByName("id")))
+	}
+}
 
-		email, key := r.Form.Get("email"), util.Key(r.Form.Get("key"))
-		if err := user.ValidLogin(d, email, key); err != nil {
-			WriteResponse(w, newApiError(err.Error(), err))
-			log.Printf("bad login: %#v", r)
-			return
+// principalList splits a comma-separated list of principals.
+func principalList(s string) []string {
+	var ps []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			ps = append(ps, p)
 		}
+	}
+	return ps
+}
+
+// impersonated records the write of an object in the audit log if an
+// admin made it as a user.
+func impersonated(g *Guard, r *http.Request, action string, id util.Key, err error) {
+	if _, ok := rbac.ImpersonatorFrom(r.Context()); ok {
+		g.record(r, "", action, "object "+string(id), err)
+	}
+}
+
+func handleObjectPut(objs *object.Service, g *Guard) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		p := principal(r)
 
 		id := util.Key(ps.ByName("id"))
-		obj := object.New(r.Form.Get("json"), email)
+		obj := object.New(r.Form.Get("json"), p.ID)
+		obj.Perms.Readers = principalList(r.Form.Get("readers"))
+		obj.Perms.Writers = principalList(r.Form.Get("writers"))
+		if imp, ok := rbac.ImpersonatorFrom(r.Context()); ok {
+			obj.Impersonation = &object.Impersonation{User: p.ID, Admin: imp.String()}
+		}
 
-		if err := object.Put(d, email, id, obj); err != nil {
+		err := objs.Put(p.ID, id, obj)
+		impersonated(g, r, "object.put", id, err)
+		if err != nil {
 			if errors.IsNotValid(err) {
 				WriteResponse(w, newApiError(
 					fmt.Sprintf("bad JSON for object %s", id),
-					fmt.Errorf("bad JSON for object %s"),
+					fmt.Errorf("bad JSON for object %s", id),
 				))
 			} else {
 				WriteResponse(w, newApiError(err.Error(), err))
@@ -62,29 +93,21 @@ func handleObjectPut(d db.DB) htr.Handle {
 			return
 		}
 
-		log.Printf("object %s stored with id %s", obj, id)
+		log.Printf("object %s stored with id %s", obj.JSON, id)
 		WriteResponse(w, obj)
 	}
 }
 
-func handleObjectGet(d db.DB) htr.Handle {
+func handleObjectGet(objs *object.Service, g *Guard) htr.Handle {
 	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
-		if err := r.ParseForm(); err != nil {
-			WriteResponse(w, newApiError(err.Error(), err))
-			log.Printf("bad object request: %#v", r)
-			return
-		}
-
-		email, key := r.Form.Get("email"), util.Key(r.Form.Get("key"))
-		if err := user.ValidLogin(d, email, key); err != nil {
-			WriteResponse(w, newApiError(err.Error(), err))
-			log.Printf("bad login: %#v", r)
-			return
-		}
+		p := principal(r)
 
 		id := util.Key(ps.ByName("id"))
 
-		obj, err := object.Get(d, email, id)
+		obj, err := objs.Get(p.ID, id)
+		if errors.IsUnauthorized(err) && g.RBAC.Can(p, rbac.ObjectReadAny) == nil {
+			obj, err = objs.GetAny(id)
+		}
 		if err != nil {
 			if errors.IsNotValid(err) {
 				WriteResponse(w, newApiError(
@@ -98,29 +121,23 @@ func handleObjectGet(d db.DB) htr.Handle {
 			return
 		}
 
-		log.Printf("fetched object %s:\n  %s", id, obj)
+		log.Printf("fetched object %s:\n  %s", id, obj.JSON)
 		WriteResponse(w, obj)
 	}
 }
 
-func handleObjectDelete(d db.DB) htr.Handle {
+func handleObjectDelete(objs *object.Service, g *Guard) htr.Handle {
 	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
-		if err := r.ParseForm(); err != nil {
-			WriteResponse(w, newApiError(err.Error(), err))
-			log.Printf("bad request: %#v", r)
-			return
-		}
-
-		email, key := r.Form.Get("email"), util.Key(r.Form.Get("key"))
-		if err := user.ValidLogin(d, email, key); err != nil {
-			WriteResponse(w, newApiError(err.Error(), err))
-			log.Printf("bad login: %#v", r)
-			return
-		}
+		p := principal(r)
 
 		id := ps.ByName("id")
 
-		if err := object.Delete(d, email, util.Key(id)); err != nil {
+		err := objs.Delete(p.ID, util.Key(id))
+		if errors.IsUnauthorized(err) && g.RBAC.Can(p, rbac.ObjectWriteAny) == nil {
+			err = objs.DeleteAny(p.ID, util.Key(id))
+		}
+		impersonated(g, r, "object.delete", util.Key(id), err)
+		if err != nil {
 			if errors.IsNotValid(err) {
 				WriteResponse(w, newApiError(
 					fmt.Sprintf("bad JSON for object %s", id),
@@ -0,0 +1,92 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/juju/errors"
+	htr "github.com/julienschmidt/httprouter"
+	"github.com/synapse-garden/mf-proto/db"
+	"github.com/synapse-garden/mf-proto/oidc"
+	"github.com/synapse-garden/mf-proto/user"
+)
+
+// OIDC binds OpenID Connect login with the given Service's Providers to a
+// Router, guarded by the given Guard.  Users are sent to a Provider to sign
+// in, and come back to its callback, which logs them in as /user/login does.
+func OIDC(ois *oidc.Service, g *Guard) API {
+	return func(r *htr.Router) error {
+		if err := db.SetupBuckets(ois.DB, oidc.Buckets()); err != nil {
+			return err
+		}
+
+		g.handle(r, "GET", "/user/oidc", "", g.Anonymous(handleOIDCProviders(ois)))
+		g.handle(r, "GET", "/user/oidc/:provider/login", "", g.Anonymous(handleOIDCLogin(ois)))
+		g.handle(r, "GET", "/user/oidc/:provider/callback", "", g.Linked(handleOIDCCallback(ois)))
+		return nil
+	}
+}
+
+func handleOIDCProviders(ois *oidc.Service) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		names := make([]string, 0, len(ois.Providers))
+		for name := range ois.Providers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		WriteResponse(w, names)
+	}
+}
+
+func handleOIDCLogin(ois *oidc.Service) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		provider := ps.ByName("provider")
+		u, err := ois.AuthURL(provider)
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("error starting sign-in with provider %q: %s", provider, err.Error())
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		http.Redirect(w, r, u, http.StatusFound)
+	}
+}
+
+func handleOIDCCallback(ois *oidc.Service) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		provider := ps.ByName("provider")
+		q := r.URL.Query()
+		if e := q.Get("error"); e != "" {
+			err := errors.Unauthorizedf("provider %q refused sign-in: %s", provider, e)
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("sign-in with provider %q failed: %s", provider, e)
+			return
+		}
+
+		email, login, err := ois.Callback(provider, q.Get("state"), q.Get("code"))
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("error signing in with provider %q from %s: %s", provider, r.RemoteAddr, err.Error())
+			return
+		}
+
+		if login.Pending {
+			log.Printf("user %q challenged for second factor", email)
+			WriteResponse(w, &challenge{
+				Email:   email,
+				Key:     login.Key,
+				Pending: true,
+				Expires: login.Timeout,
+			})
+			return
+		}
+
+		log.Printf("user %q logged in with provider %q", email, provider)
+		WriteResponse(w, &user.User{
+			Email: email,
+			Key:   login.Key,
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	htr "github.com/julienschmidt/httprouter"
+	"github.com/synapse-garden/mf-proto/object"
+	"github.com/synapse-garden/mf-proto/user"
+)
+
+// Profile binds the user profile API for the given Services to a Router,
+// guarded by the given Guard.  Avatars must be objects the user can read.
+func Profile(us *user.Service, objs *object.Service, g *Guard) API {
+	return func(r *htr.Router) error {
+		r.GET("/user/me", g.UserScoped(Scope(user.ScopeProfileRead), handleUserMe(us)))
+		r.PATCH("/user/me", g.UserScoped(Scope(user.ScopeProfileWrite), handleUserMePatch(us, objs)))
+		return nil
+	}
+}
+
+func handleUserMe(us *user.Service) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		email := r.Form.Get("email")
+		a, err := us.Account(email)
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("error getting account %q: %s", email, err.Error())
+			return
+		}
+
+		WriteResponse(w, a)
+	}
+}
+
+// handleUserMePatch updates the user's profile from a JSON ProfileUpdate in
+// the request body.
+func handleUserMePatch(us *user.Service, objs *object.Service) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		email, id := r.Form.Get("email"), principal(r).ID
+
+		up := new(user.ProfileUpdate)
+		if err := json.NewDecoder(r.Body).Decode(up); err != nil {
+			WriteResponse(w, newApiError("bad profile update: "+err.Error(), badRequest(err)))
+			log.Printf("bad profile update for %q: %s", email, err.Error())
+			return
+		}
+
+		if up.Avatar != nil && *up.Avatar != "" {
+			if _, err := objs.Get(id, *up.Avatar); err != nil {
+				WriteResponse(w, newApiError(err.Error(), err))
+				log.Printf("bad avatar for %q: %s", email, err.Error())
+				return
+			}
+		}
+
+		a, err := us.UpdateProfile(email, up)
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("error updating profile for %q: %s", email, err.Error())
+			return
+		}
+
+		log.Printf("user %q updated profile", email)
+		WriteResponse(w, a)
+	}
+}
@@ -0,0 +1,160 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	htr "github.com/julienschmidt/httprouter"
+	"github.com/synapse-garden/mf-proto/db"
+	"github.com/synapse-garden/mf-proto/rbac"
+	"github.com/synapse-garden/mf-proto/user"
+)
+
+// Roles binds the role management API for the given Services to a Router,
+// guarded by the given Guard.
+func Roles(rs *rbac.Service, us *user.Service, g *Guard) API {
+	return func(r *htr.Router) error {
+		if err := db.SetupBuckets(rs.DB, rbac.Buckets()); err != nil {
+			return err
+		}
+
+		r.GET("/admin/roles", g.Require(rbac.AdminManage, handleRoles(rs)))
+		g.handle(r, "PUT", "/admin/roles/:name", "/admin/role/set", g.Require(rbac.AdminManage, handleRoleSet(rs, g)))
+		g.handle(r, "DELETE", "/admin/roles/:name", "/admin/role/delete", g.Require(rbac.AdminManage, handleRoleDelete(rs, g)))
+		r.GET("/admin/role/assigned", g.Require(rbac.AdminManage, handleRoleAssigned(rs, us)))
+		g.handle(r, "POST", "/admin/role/assigned", "/admin/role/assign", g.Require(rbac.AdminManage, handleRoleAssign(rs, us, g, true)))
+		g.handle(r, "DELETE", "/admin/role/assigned", "/admin/role/unassign", g.Require(rbac.AdminManage, handleRoleAssign(rs, us, g, false)))
+		return nil
+	}
+}
+
+// resolvePrincipal parses a Principal of the form "kind:id", where a user
+// may be given by email instead of ID.
+func resolvePrincipal(us *user.Service, s string) (rbac.Principal, error) {
+	p, err := rbac.ParsePrincipal(s)
+	if err != nil {
+		return p, err
+	}
+
+	if p.Kind == rbac.KindUser && strings.Contains(p.ID, "@") {
+		id, err := us.ID(p.ID)
+		if err != nil {
+			return p, err
+		}
+		p.ID = id
+	}
+
+	return p, nil
+}
+
+// parsePermissions splits a comma-separated list of Permissions.
+func parsePermissions(s string) []rbac.Permission {
+	var perms []rbac.Permission
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			perms = append(perms, rbac.Permission(p))
+		}
+	}
+	return perms
+}
+
+func handleRoles(rs *rbac.Service) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		roles, err := rs.AllRoles()
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("error listing roles: %s", err.Error())
+			return
+		}
+
+		WriteResponse(w, roles)
+	}
+}
+
+func handleRoleSet(rs *rbac.Service, g *Guard) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		name := r.Form.Get("name")
+		perms := parsePermissions(r.Form.Get("permissions"))
+
+		err := rs.PutRole(name, perms...)
+		g.record(r, "", "role.set", "role:"+name, err)
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("error setting role %q: %s", name, err.Error())
+			return
+		}
+
+		log.Printf("%s set role %q to %v", principal(r), name, perms)
+		WriteResponse(w, &rbac.Role{
+			Name:        name,
+			Permissions: perms,
+		})
+	}
+}
+
+func handleRoleDelete(rs *rbac.Service, g *Guard) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		name := r.Form.Get("name")
+
+		err := rs.DeleteRole(name)
+		g.record(r, "", "role.delete", "role:"+name, err)
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("error deleting role %q: %s", name, err.Error())
+			return
+		}
+
+		log.Printf("%s deleted role %q", principal(r), name)
+		WriteResponse(w, "ok")
+	}
+}
+
+func handleRoleAssigned(rs *rbac.Service, us *user.Service) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		p, err := resolvePrincipal(us, r.Form.Get("principal"))
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("bad principal: %s", err.Error())
+			return
+		}
+
+		roles, err := rs.RolesOf(p)
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("error getting roles of %s: %s", p, err.Error())
+			return
+		}
+
+		WriteResponse(w, roles)
+	}
+}
+
+// handleRoleAssign assigns a role to a principal, or unassigns it if assign
+// is false.
+func handleRoleAssign(rs *rbac.Service, us *user.Service, g *Guard, assign bool) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		p, err := resolvePrincipal(us, r.Form.Get("principal"))
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("bad principal: %s", err.Error())
+			return
+		}
+
+		role, change, did, action := r.Form.Get("role"), rs.Assign, "assigned", "role.assign"
+		if !assign {
+			change, did, action = rs.Unassign, "unassigned", "role.unassign"
+		}
+
+		err = change(p, role)
+		g.record(r, "", action, p.String()+" role:"+role, err)
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("error changing role %q of %s: %s", role, p, err.Error())
+			return
+		}
+
+		log.Printf("%s %s role %q to %s", principal(r), did, role, p)
+		WriteResponse(w, "ok")
+	}
+}
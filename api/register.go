@@ -0,0 +1,175 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	htr "github.com/julienschmidt/httprouter"
+	"github.com/synapse-garden/mf-proto/user"
+	"github.com/synapse-garden/mf-proto/util"
+
+	"github.com/juju/errors"
+)
+
+// DefaultInviteTTL is how long an invite lasts if no ttl is given.
+const DefaultInviteTTL = 7 * 24 * time.Hour
+
+// updatePolicy changes p using any of the mode, domains, minlength and
+// mixed values in form.  Domains are separated by commas.
+func updatePolicy(p *user.Policy, form url.Values) error {
+	if mode := form.Get("mode"); mode != "" {
+		p.Mode = user.Mode(mode)
+	}
+
+	if domains, ok := form["domains"]; ok {
+		p.Domains = nil
+		for _, d := range strings.Split(strings.Join(domains, ","), ",") {
+			if d = strings.TrimSpace(d); d != "" {
+				p.Domains = append(p.Domains, d)
+			}
+		}
+	}
+
+	if min := form.Get("minlength"); min != "" {
+		n, err := strconv.Atoi(min)
+		if err != nil {
+			return errors.NotValidf("minlength %q", min)
+		}
+		p.Password.MinLength = n
+	}
+
+	if mixed := form.Get("mixed"); mixed != "" {
+		b, err := strconv.ParseBool(mixed)
+		if err != nil {
+			return errors.NotValidf("mixed %q", mixed)
+		}
+		p.Password.Mixed = b
+	}
+
+	return nil
+}
+
+// newInvite mints an invite using the uses and ttl values in form.
+func newInvite(us *user.Service, form url.Values) (*user.Invite, error) {
+	uses, ttl := 1, DefaultInviteTTL
+
+	if u := form.Get("uses"); u != "" {
+		n, err := strconv.Atoi(u)
+		if err != nil {
+			return nil, errors.NotValidf("uses %q", u)
+		}
+		uses = n
+	}
+
+	if t := form.Get("ttl"); t != "" {
+		d, err := time.ParseDuration(t)
+		if err != nil {
+			return nil, errors.NotValidf("ttl %q", t)
+		}
+		ttl = d
+	}
+
+	return us.CreateInvite(uses, ttl)
+}
+
+func handleUserRegister(us *user.Service, g *Guard) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		email := r.Form.Get("email")
+		pwhash := r.Form.Get("pwhash")
+		invite := util.Key(r.Form.Get("invite"))
+
+		err := us.Register(email, pwhash, invite)
+		g.record(r, "anonymous@"+remoteAddr(r), "user.register", userTarget(us, email), err)
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("registration of %q from %s failed: %s", email, r.RemoteAddr, err.Error())
+			return
+		}
+
+		log.Printf("user %q registered", email)
+		WriteResponse(w, &user.User{
+			Email: email,
+		})
+	}
+}
+
+func handleAdminRegistration(us *user.Service) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		p, err := us.GetPolicy()
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("error getting registration policy: %s", err.Error())
+			return
+		}
+
+		WriteResponse(w, p)
+	}
+}
+
+func handleAdminRegistrationSet(us *user.Service, g *Guard) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		p, err := us.GetPolicy()
+		if err == nil {
+			if err = updatePolicy(p, r.Form); err == nil {
+				err = us.SetPolicy(*p)
+			}
+		}
+		g.record(r, "", "registration.set", "registration", err)
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("error setting registration policy: %s", err.Error())
+			return
+		}
+
+		log.Printf("registration policy set to %q", p.Mode)
+		WriteResponse(w, p)
+	}
+}
+
+func handleAdminInviteCreate(us *user.Service, g *Guard) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		inv, err := newInvite(us, r.Form)
+		g.record(r, "", "invite.create", "invite", err)
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("error creating invite: %s", err.Error())
+			return
+		}
+
+		log.Printf("invite for %d users created", inv.MaxUses)
+		WriteResponse(w, inv)
+	}
+}
+
+func handleAdminInviteRevoke(us *user.Service, g *Guard) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		code := util.Key(r.Form.Get("code"))
+		err := us.RevokeInvite(code)
+		g.record(r, "", "invite.revoke", "invite", err)
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("error revoking invite %q: %s", code, err.Error())
+			return
+		}
+
+		log.Printf("invite %q revoked", code)
+		WriteResponse(w, "ok")
+	}
+}
+
+func handleAdminInvites(us *user.Service) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		invs, err := us.Invites()
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("error listing invites: %s", err.Error())
+			return
+		}
+
+		WriteResponse(w, invs)
+	}
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"log"
+	"net/http"
+
+	htr "github.com/julienschmidt/httprouter"
+	"github.com/synapse-garden/mf-proto/admin"
+	"github.com/synapse-garden/mf-proto/user"
+)
+
+type totpEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type totpRecovery struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+func handleUserTOTPEnroll(us *user.Service, g *Guard) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		email := r.Form.Get("email")
+
+		secret, uri, err := us.EnrollTOTP(principal(r).ID)
+		g.record(r, "", "user.totp.enroll", principal(r).String(), err)
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("TOTP enrollment for user %q failed: %s", email, err.Error())
+			return
+		}
+
+		log.Printf("user %q enrolling in TOTP", email)
+		WriteResponse(w, &totpEnrollment{
+			Secret: secret,
+			URI:    uri,
+		})
+	}
+}
+
+func handleUserTOTPConfirm(us *user.Service, g *Guard) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		email := r.Form.Get("email")
+
+		codes, err := us.ConfirmTOTP(principal(r).ID, r.Form.Get("code"))
+		g.record(r, "", "user.totp.confirm", principal(r).String(), err)
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("TOTP confirmation for user %q failed: %s", email, err.Error())
+			return
+		}
+
+		log.Printf("user %q enabled TOTP", email)
+		WriteResponse(w, &totpRecovery{
+			RecoveryCodes: codes,
+		})
+	}
+}
+
+func handleUserTOTPDisable(us *user.Service, g *Guard) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		email := r.Form.Get("email")
+
+		err := us.DisableTOTP(principal(r).ID, r.Form.Get("code"))
+		g.record(r, "", "user.totp.disable", principal(r).String(), err)
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("disabling TOTP for user %q failed: %s", email, err.Error())
+			return
+		}
+
+		log.Printf("user %q disabled TOTP", email)
+		WriteResponse(w, &user.User{
+			Email: email,
+		})
+	}
+}
+
+func handleAdminTOTPEnroll(as *admin.Service, g *Guard) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		email := principal(r).ID
+
+		secret, uri, err := as.EnrollTOTP(email)
+		g.record(r, "", "admin.totp.enroll", principal(r).String(), err)
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("TOTP enrollment for admin %s failed: %s", email, err.Error())
+			return
+		}
+
+		log.Printf("admin %s enrolling in TOTP", email)
+		WriteResponse(w, &totpEnrollment{
+			Secret: secret,
+			URI:    uri,
+		})
+	}
+}
+
+func handleAdminTOTPConfirm(as *admin.Service, g *Guard) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		email := principal(r).ID
+
+		codes, err := as.ConfirmTOTP(email, r.Form.Get("code"))
+		g.record(r, "", "admin.totp.confirm", principal(r).String(), err)
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("TOTP confirmation for admin %s failed: %s", email, err.Error())
+			return
+		}
+
+		log.Printf("admin %s enabled TOTP", email)
+		WriteResponse(w, &totpRecovery{
+			RecoveryCodes: codes,
+		})
+	}
+}
+
+func handleAdminTOTPDisable(as *admin.Service, g *Guard) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		email := principal(r).ID
+
+		err := as.DisableTOTP(email, r.Form.Get("code"))
+		g.record(r, "", "admin.totp.disable", principal(r).String(), err)
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("disabling TOTP for admin %s failed: %s", email, err.Error())
+			return
+		}
+
+		log.Printf("admin %s disabled TOTP", email)
+		WriteResponse(w, "ok")
+	}
+}
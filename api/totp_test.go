@@ -0,0 +1,96 @@
+package api_test
+
+import (
+	"fmt"
+	"net/http"
+
+	jc "github.com/juju/testing/checkers"
+	"github.com/synapse-garden/mf-proto/totp"
+	"github.com/synapse-garden/mf-proto/user"
+
+	gc "gopkg.in/check.v1"
+)
+
+// challenge is the wire form of a login awaiting a second factor.
+type challenge struct {
+	Key     string `json:"key"`
+	Pending bool   `json:"pending"`
+}
+
+// code returns the current code for secret.
+func (s *APISuite) code(secret string, c *gc.C) string {
+	code, err := totp.Code(secret, s.clock.Now())
+	c.Assert(err, jc.ErrorIsNil)
+	return code
+}
+
+func (s *APISuite) TestLoginCompleteUnauthorized(c *gc.C) {
+	bob := s.users["bob"]
+	id := s.mustID(bob.Email, c)
+	secret, _, err := s.us.EnrollTOTP(id)
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = s.us.ConfirmTOTP(id, s.code(secret, c))
+	c.Assert(err, jc.ErrorIsNil)
+
+	const admin = "admin@tomato.com"
+	adminSecret, _, err := s.as.EnrollTOTP(admin)
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = s.as.ConfirmTOTP(admin, s.code(adminSecret, c))
+	c.Assert(err, jc.ErrorIsNil)
+	s.clock.Advance(totp.Period)
+
+	w := s.request("POST", "/user/login", fmt.Sprintf(`{"email":%q,"pwhash":%q}`, bob.Email, bob.Pwhash), "")
+	checkOK(w, c)
+	var uch challenge
+	value(w, &uch, c)
+	c.Assert(uch.Pending, jc.IsTrue)
+
+	w = s.request("POST", "/admin/login", fmt.Sprintf(`{"email":%q,"pwhash":"admin-pwhash"}`, admin), "")
+	checkOK(w, c)
+	var ach challenge
+	value(w, &ach, c)
+	c.Assert(ach.Pending, jc.IsTrue)
+
+	for i, t := range []struct {
+		should, path, body string
+	}{{
+		should: "refuse a user's bad code",
+		path:   "/user/login/complete",
+		body:   fmt.Sprintf(`{"email":%q,"key":%q,"code":"000000"}`, bob.Email, uch.Key),
+	}, {
+		should: "refuse a user's bad key",
+		path:   "/user/login/complete",
+		body:   fmt.Sprintf(`{"email":%q,"key":"nope","code":%q}`, bob.Email, s.code(secret, c)),
+	}, {
+		should: "refuse a user with no login",
+		path:   "/user/login/complete",
+		body:   fmt.Sprintf(`{"email":%q,"key":%q,"code":"000000"}`, s.users["larry"].Email, uch.Key),
+	}, {
+		should: "refuse an admin's bad code",
+		path:   "/admin/login/complete",
+		body:   fmt.Sprintf(`{"key":%q,"code":"000000"}`, ach.Key),
+	}, {
+		should: "refuse an admin's bad key",
+		path:   "/admin/login/complete",
+		body:   fmt.Sprintf(`{"key":"nope","code":%q}`, s.code(adminSecret, c)),
+	}} {
+		c.Logf("test %d: should %s", i, t.should)
+		checkError(s.request("POST", t.path, t.body, ""), http.StatusUnauthorized, "unauthorized", c)
+	}
+
+	w = s.request("POST", "/user/login/complete", fmt.Sprintf(
+		`{"email":%q,"key":%q,"code":%q}`, bob.Email, uch.Key, s.code(secret, c),
+	), "")
+	checkOK(w, c)
+	var u user.User
+	value(w, &u, c)
+	c.Check(s.us.ValidLogin(bob.Email, u.Key), jc.ErrorIsNil)
+
+	w = s.request("POST", "/admin/login/complete", fmt.Sprintf(
+		`{"key":%q,"code":%q}`, ach.Key, s.code(adminSecret, c),
+	), "")
+	checkOK(w, c)
+	var l user.Login
+	value(w, &l, c)
+	c.Check(s.as.IsAdmin(l.Key), jc.ErrorIsNil)
+}
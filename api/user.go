@@ -3,48 +3,84 @@ package api
 import (
 	"log"
 	"net/http"
+	"time"
 
 	htr "github.com/julienschmidt/httprouter"
-	"github.com/synapse-garden/mf-proto/admin"
 	"github.com/synapse-garden/mf-proto/db"
+	"github.com/synapse-garden/mf-proto/rbac"
 	"github.com/synapse-garden/mf-proto/user"
 	"github.com/synapse-garden/mf-proto/util"
+
+	"github.com/juju/errors"
 )
 
-func User(d db.DB) API {
+// User binds the user API for the given Service to a Router, guarded by the
+// given Guard.
+func User(us *user.Service, g *Guard) API {
 	return func(r *htr.Router) error {
-		if err := db.SetupBuckets(d, user.Buckets()); err != nil {
+		if err := db.SetupBuckets(us.DB, user.Buckets()); err != nil {
 			return err
 		}
 
-		r.GET("/user/create", handleUserCreate(d))
-		r.GET("/user/delete", handleUserDelete(d))
-		r.GET("/user/valid", handleUserValid(d))
-		r.GET("/user/login", handleUserLogin(d))
-		r.GET("/user/logout", handleUserLogout(d))
+		// Login keys, but not access tokens, may change a user's
+		// login, password, email and second factor.
+		login := Scope(user.ScopeLogin)
+
+		g.handle(r, "POST", "/admin/users", "/user/create", g.Require(rbac.UserCreate, handleUserCreate(us, g)))
+		g.handle(r, "DELETE", "/user", "/user/delete", g.Anonymous(handleUserDelete(us, g)))
+		r.GET("/user/valid", g.UserScoped(nil, handleUserValid()))
+		g.handle(r, "POST", "/user/login", "/user/login", g.Anonymous(handleUserLogin(us)))
+		g.handle(r, "POST", "/user/login/complete", "/user/login/complete", g.Anonymous(handleUserLoginComplete(us)))
+		g.handle(r, "DELETE", "/user/login", "/user/logout", g.UserScoped(login, handleUserLogout(us)))
+		g.handle(r, "POST", "/user/password", "/user/password", g.UserScoped(login, handleUserPassword(us, g)))
+		g.handle(r, "POST", "/user/password/forgot", "/user/password/forgot", g.Anonymous(handleUserPasswordForgot(us)))
+		g.handle(r, "POST", "/user/password/reset", "/user/password/reset", g.Anonymous(handleUserPasswordReset(us, g)))
+		g.handle(r, "POST", "/user/email", "/user/email", g.UserScoped(login, handleUserEmail(us, g)))
+		g.handle(r, "POST", "/user/totp", "/user/totp/enroll", g.UserScoped(login, handleUserTOTPEnroll(us, g)))
+		g.handle(r, "POST", "/user/totp/confirm", "/user/totp/confirm", g.UserScoped(login, handleUserTOTPConfirm(us, g)))
+		g.handle(r, "DELETE", "/user/totp", "/user/totp/disable", g.UserScoped(login, handleUserTOTPDisable(us, g)))
+		g.handle(r, "POST", "/user/register", "/user/register", g.Anonymous(handleUserRegister(us, g)))
+		r.GET("/admin/registration", g.Require(rbac.UserManage, handleAdminRegistration(us)))
+		g.handle(r, "PUT", "/admin/registration", "/admin/registration/set", g.Require(rbac.UserManage, handleAdminRegistrationSet(us, g)))
+		r.GET("/admin/invites", g.Require(rbac.UserManage, handleAdminInvites(us)))
+		g.handle(r, "POST", "/admin/invites", "/admin/invite/create", g.Require(rbac.UserManage, handleAdminInviteCreate(us, g)))
+		g.handle(r, "DELETE", "/admin/invites", "/admin/invite/revoke", g.Require(rbac.UserManage, handleAdminInviteRevoke(us, g)))
+
+		// These are followed from links sent by mail, so stay GET, with
+		// their single-use token in the query.
+		g.handle(r, "GET", "/user/verify", "", g.Linked(handleUserVerify(us, g)))
+		g.handle(r, "GET", "/user/email/confirm", "", g.Linked(handleUserEmailConfirm(us, g)))
 		return nil
 	}
 }
 
-func handleUserCreate(d db.DB) htr.Handle {
-	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
-		if err := r.ParseForm(); err != nil {
-			WriteResponse(w, newApiError(err.Error(), err))
-			log.Printf("bad admin request: %#v", r)
-			return
-		}
+// userTarget names the user with the given email in the audit log, by ID
+// if they exist.
+func userTarget(us *user.Service, email string) string {
+	id, err := us.ID(email)
+	if err != nil {
+		return "user:" + email
+	}
+	return rbac.User(id).String()
+}
 
-		key := util.Key(r.Form.Get("key"))
-		if err := admin.IsAdmin(d, key); err != nil {
-			WriteResponse(w, newApiError(err.Error(), err))
-			log.Printf("bad admin request: %#v", r)
-			return
-		}
+// linkTarget names the user a single-use link was for in the audit log,
+// or nothing if the link was no good.
+func linkTarget(us *user.Service, email string) string {
+	if email == "" {
+		return ""
+	}
+	return userTarget(us, email)
+}
 
+func handleUserCreate(us *user.Service, g *Guard) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
 		email := r.Form.Get("email")
 		pwhash := r.Form.Get("pwhash")
 
-		if err := user.Create(d, email, pwhash); err != nil {
+		err := us.Create(email, pwhash)
+		g.record(r, "", "user.create", userTarget(us, email), err)
+		if err != nil {
 			WriteResponse(w, newApiError(err.Error(), err))
 			log.Printf("error creating user %s: %s", email, err.Error())
 			return
@@ -58,41 +94,41 @@ func handleUserCreate(d db.DB) htr.Handle {
 	}
 }
 
-func handleUserDelete(d db.DB) htr.Handle {
+func handleUserDelete(us *user.Service, g *Guard) htr.Handle {
 	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
-		if err := r.ParseForm(); err != nil {
-			WriteResponse(w, newApiError(err.Error(), err))
-			log.Printf("bad admin request: %#v", r)
-			return
-		}
-
 		key := util.Key(r.Form.Get("key"))
 		email := r.Form.Get("email")
 		pwhash := r.Form.Get("pwhash")
 
+		target := userTarget(us, email)
 		switch {
 		case key != "":
-			// An admin can delete any user.
-			if err := admin.IsAdmin(d, key); err != nil {
+			// An admin, or a user with permission, can delete any user.
+			p, err := g.Authorize(r, rbac.UserDeleteAny)
+			if err != nil {
 				WriteResponse(w, newApiError(err.Error(), err))
-				log.Printf("bad admin request: %#v", r)
+				log.Printf("bad admin request to %s: %s", r.URL.Path, err.Error())
 				return
 			}
+			r = r.WithContext(rbac.NewContext(r.Context(), p))
 
 		case email != "", pwhash != "":
-			if err := user.CheckUser(d, email, pwhash); err != nil {
+			if err := us.CheckUserFrom(remoteAddr(r), email, pwhash); err != nil {
 				WriteResponse(w, newApiError(err.Error(), err))
 				log.Printf("invalid user %s: %s", email, err.Error())
 				return
 			}
 		default:
 			// No key, no email, no pwhash -- no delete.
-			WriteResponse(w, newApiError("must pass pwhash and email, or API key", nil))
+			err := badRequest(errors.New("must pass pwhash and email, or API key"))
+			WriteResponse(w, newApiError(err.Error(), err))
 			log.Printf("invalid user delete request: no values")
 			return
 		}
 
-		if err := user.Delete(d, email); err != nil {
+		err := us.Delete(email)
+		g.record(r, target, "user.delete", target, err)
+		if err != nil {
 			WriteResponse(w, newApiError(err.Error(), err))
 			log.Printf("error deleting user %q: %s", email, err.Error())
 			return
@@ -105,74 +141,212 @@ func handleUserDelete(d db.DB) htr.Handle {
 	}
 }
 
-func handleUserValid(d db.DB) htr.Handle {
+func handleUserValid() htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		email := r.Form.Get("email")
+		log.Printf("user %q validated", email)
+		WriteResponse(w, &user.User{
+			Email: email,
+		})
+	}
+}
+
+func handleUserLogin(us *user.Service) htr.Handle {
 	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
-		if err := r.ParseForm(); err != nil {
+		email := r.Form.Get("email")
+		pwhash := r.Form.Get("pwhash")
+		login, err := us.LoginUserFrom(remoteAddr(r), email, pwhash)
+		if err != nil {
 			WriteResponse(w, newApiError(err.Error(), err))
-			log.Printf("bad admin request: %#v", r)
+			log.Printf("error logging in user %q from %s: %s", email, r.RemoteAddr, err.Error())
+			return
+		}
+
+		if login.Pending {
+			log.Printf("user %q challenged for second factor", email)
+			WriteResponse(w, &challenge{
+				Email:   email,
+				Key:     login.Key,
+				Pending: true,
+				Expires: login.Timeout,
+			})
 			return
 		}
 
+		log.Printf("user %q logged in", email)
+		WriteResponse(w, &user.User{
+			Email: email,
+			Key:   login.Key,
+		})
+	}
+}
+
+// challenge is the response to a login which needs a second factor.  Its
+// Key must be sent to /user/login/complete, or /admin/login/complete for
+// an admin, with a code before it expires.
+type challenge struct {
+	Email   string    `json:"email"`
+	Key     util.Key  `json:"key"`
+	Pending bool      `json:"pending"`
+	Expires time.Time `json:"expires"`
+}
+
+func handleUserLoginComplete(us *user.Service) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
 		email := r.Form.Get("email")
 		key := util.Key(r.Form.Get("key"))
 
-		if err := user.ValidLogin(d, email, key); err != nil {
+		login, err := us.CompleteLogin(remoteAddr(r), email, key, r.Form.Get("code"))
+		if err = unauthenticated(err); err != nil {
 			WriteResponse(w, newApiError(err.Error(), err))
-			log.Printf("error authenticating user %q, key %q: %s", email, key, err.Error())
+			log.Printf("second factor for user %q failed: %s", email, err.Error())
+			return
+		}
+
+		log.Printf("user %q logged in", email)
+		WriteResponse(w, &user.User{
+			Email: email,
+			Key:   login.Key,
+		})
+	}
+}
+
+func handleUserLogout(us *user.Service) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		email := r.Form.Get("email")
+		key := util.Key(r.Form.Get("key"))
+
+		if err := us.LogoutUser(principal(r).ID, key); err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("user %q logout failed: %s", email, err.Error())
 			return
 		}
 
-		log.Printf("user %q validated", email)
 		WriteResponse(w, &user.User{
 			Email: email,
 		})
 	}
 }
 
-func handleUserLogin(d db.DB) htr.Handle {
+func handleUserVerify(us *user.Service, g *Guard) htr.Handle {
 	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
-		if err := r.ParseForm(); err != nil {
+		email, err := us.Verify(r.Form.Get("token"))
+		g.record(r, "anonymous@"+remoteAddr(r), "user.verify", linkTarget(us, email), err)
+		if err != nil {
 			WriteResponse(w, newApiError(err.Error(), err))
-			log.Printf("bad admin request: %#v", r)
+			log.Printf("user verification failed: %s", err.Error())
 			return
 		}
 
+		log.Printf("user %q verified", email)
+		WriteResponse(w, &user.User{
+			Email: email,
+		})
+	}
+}
+
+func handleUserPassword(us *user.Service, g *Guard) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
 		email := r.Form.Get("email")
 		pwhash := r.Form.Get("pwhash")
-		key, err := user.LoginUser(d, email, pwhash)
+		newPwhash := r.Form.Get("newpwhash")
+
+		newKey, err := us.ChangePassword(principal(r).ID, pwhash, newPwhash)
+		g.record(r, "", "user.password.change", principal(r).String(), err)
 		if err != nil {
 			WriteResponse(w, newApiError(err.Error(), err))
-			log.Printf("error logging in user %q, pwhash %q: %s", email, pwhash, err.Error())
+			log.Printf("user %q password change failed: %s", email, err.Error())
 			return
 		}
 
-		log.Printf("user %q logged in", email)
+		log.Printf("user %q changed password", email)
 		WriteResponse(w, &user.User{
 			Email: email,
-			Key:   key,
+			Key:   newKey,
 		})
 	}
 }
 
-func handleUserLogout(d db.DB) htr.Handle {
+func handleUserPasswordForgot(us *user.Service) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		email := r.Form.Get("email")
+
+		// Respond the same whether or not the user exists, so this
+		// can't be used to find out who has an account.
+		if err := us.RequestPasswordReset(email); err != nil {
+			log.Printf("password reset for %q failed: %s", email, err.Error())
+		} else {
+			log.Printf("password reset for %q sent", email)
+		}
+
+		WriteResponse(w, "ok")
+	}
+}
+
+func handleUserPasswordReset(us *user.Service, g *Guard) htr.Handle {
 	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
-		if err := r.ParseForm(); err != nil {
-			WriteResponse(w, newApiError("bad request: "+err.Error(), err))
-			log.Printf("bad request: %#v", r)
+		email, err := us.ResetPassword(r.Form.Get("token"), r.Form.Get("pwhash"))
+		g.record(r, "anonymous@"+remoteAddr(r), "user.password.reset", linkTarget(us, email), err)
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("password reset failed: %s", err.Error())
 			return
 		}
 
+		log.Printf("user %q reset password", email)
+		WriteResponse(w, &user.User{
+			Email: email,
+		})
+	}
+}
+
+func handleUserEmail(us *user.Service, g *Guard) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
 		email := r.Form.Get("email")
-		key := util.Key(r.Form.Get("key"))
+		pwhash := r.Form.Get("pwhash")
+		newEmail := r.Form.Get("newemail")
 
-		if err := user.LogoutUser(d, email, key); err != nil {
+		err := us.RequestEmailChange(principal(r).ID, pwhash, newEmail)
+		g.record(r, "", "user.email.request", principal(r).String(), err)
+		if err != nil {
 			WriteResponse(w, newApiError(err.Error(), err))
-			log.Printf("user %q logout for key %q failed: %s", email, key, err.Error())
+			log.Printf("user %q email change failed: %s", email, err.Error())
 			return
 		}
 
+		log.Printf("user %q asked to change email to %q", email, newEmail)
+		WriteResponse(w, "ok")
+	}
+}
+
+func handleUserEmailConfirm(us *user.Service, g *Guard) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		email, err := us.ChangeEmail(r.Form.Get("token"))
+		g.record(r, "anonymous@"+remoteAddr(r), "user.email.change", linkTarget(us, email), err)
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("email change failed: %s", err.Error())
+			return
+		}
+
+		log.Printf("user changed email to %q", email)
 		WriteResponse(w, &user.User{
 			Email: email,
 		})
 	}
 }
+
+// validUserID checks the user's login key or access token and returns their
+// ID and the Scopes the key allows.
+func validUserID(us *user.Service, email string, key util.Key) (string, user.Scopes, error) {
+	scs, err := us.ValidKey(email, key)
+	if err != nil {
+		return "", nil, err
+	}
+
+	id, err := us.ID(email)
+	if err != nil {
+		return "", nil, err
+	}
+	return id, scs, nil
+}
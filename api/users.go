@@ -0,0 +1,119 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	htr "github.com/julienschmidt/httprouter"
+	"github.com/synapse-garden/mf-proto/object"
+	"github.com/synapse-garden/mf-proto/rbac"
+	"github.com/synapse-garden/mf-proto/user"
+
+	"github.com/juju/errors"
+)
+
+// DefaultUserPage is how many users are listed when no limit is given.
+const DefaultUserPage = 50
+
+// Users binds the admin user-management API for the given Services to a
+// Router, guarded by the given Guard.
+func Users(us *user.Service, objs *object.Service, g *Guard) API {
+	return func(r *htr.Router) error {
+		r.GET("/admin/users", g.Require(rbac.UserReadAny, handleAdminUsers(us)))
+		r.GET("/admin/user", g.Require(rbac.UserReadAny, handleAdminUser(us, objs)))
+		g.handle(r, "POST", "/admin/users/:user/disable", "/admin/user/disable", g.Require(rbac.UserManage, handleAdminUserDisable(us, g, true)))
+		g.handle(r, "POST", "/admin/users/:user/enable", "/admin/user/enable", g.Require(rbac.UserManage, handleAdminUserDisable(us, g, false)))
+		return nil
+	}
+}
+
+// handleAdminUsers lists a page of users whose email begins with prefix,
+// from the email from on.
+func handleAdminUsers(us *user.Service) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		limit := DefaultUserPage
+		if l := r.Form.Get("limit"); l != "" {
+			n, err := strconv.Atoi(l)
+			if err != nil {
+				err = errors.NotValidf("limit %q", l)
+				WriteResponse(w, newApiError(err.Error(), err))
+				log.Printf("bad user list request: %s", err.Error())
+				return
+			}
+			limit = n
+		}
+
+		p, err := us.List(r.Form.Get("prefix"), r.Form.Get("from"), limit)
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("error listing users: %s", err.Error())
+			return
+		}
+
+		WriteResponse(w, p)
+	}
+}
+
+// targetEmail returns the email of the user a request is about.  It is
+// given as user, since a user's email is their own; admins may give it as
+// email.
+func targetEmail(r *http.Request) string {
+	if email := r.Form.Get("user"); email != "" {
+		return email
+	}
+	return r.Form.Get("email")
+}
+
+// userDetail is what an admin sees about a user, with how many objects
+// they own.
+type userDetail struct {
+	*user.Detail
+	Objects int `json:"objects"`
+}
+
+func handleAdminUser(us *user.Service, objs *object.Service) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		email := targetEmail(r)
+
+		d, err := us.Detail(email)
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("error getting account %q: %s", email, err.Error())
+			return
+		}
+
+		n, err := objs.CountOwned(d.ID)
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("error counting objects of %q: %s", email, err.Error())
+			return
+		}
+
+		WriteResponse(w, &userDetail{Detail: d, Objects: n})
+	}
+}
+
+// handleAdminUserDisable disables the user, or enables them if disable is
+// false.
+func handleAdminUserDisable(us *user.Service, g *Guard, disable bool) htr.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps htr.Params) {
+		email := targetEmail(r)
+
+		change, did, action := us.Disable, "disabled", "user.disable"
+		if !disable {
+			change, did, action = us.Enable, "enabled", "user.enable"
+		}
+
+		err := change(email)
+		g.record(r, "", action, userTarget(us, email), err)
+		if err != nil {
+			WriteResponse(w, newApiError(err.Error(), err))
+			log.Printf("error changing user %q: %s", email, err.Error())
+			return
+		}
+
+		log.Printf("%s %s user %q", principal(r), did, email)
+		WriteResponse(w, "ok")
+	}
+}
@@ -0,0 +1,241 @@
+// Package audit keeps an append-only log of privileged actions.  Each Entry
+// holds the hash of the one before it, so that changing or removing any
+// Entry but the last breaks the chain, which Verify finds.
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/juju/errors"
+	"github.com/synapse-garden/mf-proto/db"
+)
+
+// Entries holds the Entries by big-endian sequence number.
+const Entries db.Bucket = "audit-entries"
+
+// Buckets returns the Buckets for the audit database.
+func Buckets() []db.Bucket {
+	return []db.Bucket{Entries}
+}
+
+// Outcomes of an Entry's action.
+const (
+	OK     = "ok"
+	Failed = "failed"
+)
+
+// Entry records an action taken by an actor on a target.
+type Entry struct {
+	// Seq numbers the Entries from 1.
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+
+	// Actor is who acted, such as "admin:alice@tomato.com" or "console".
+	Actor string `json:"actor"`
+
+	// Impersonator is the admin who acted as the Actor, if any.
+	Impersonator string `json:"impersonator,omitempty"`
+
+	// Action is what they did, such as "user.delete".
+	Action string `json:"action"`
+
+	// Target is what they did it to.
+	Target string `json:"target,omitempty"`
+
+	// RequestID identifies the request the action was taken in, if any.
+	RequestID string `json:"request_id,omitempty"`
+
+	// ClientRequestID is the request ID its client sent, if any, with
+	// anything but letters, digits, dots, dashes and underscores removed.
+	ClientRequestID string `json:"client_request_id,omitempty"`
+
+	// Outcome is OK, or Failed.  Error says why it failed.
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+
+	// Prev is the Hash of the Entry before, or empty for the first.
+	Prev string `json:"prev,omitempty"`
+
+	// Hash is the hex SHA-256 of the Entry's JSON without its Hash.
+	Hash string `json:"hash"`
+}
+
+// sum returns what the Entry's Hash should be.
+func (e Entry) sum() (string, error) {
+	e.Hash = ""
+	bs, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256(bs)
+	return hex.EncodeToString(h[:]), nil
+}
+
+func seqKey(seq uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	return k
+}
+
+// Record appends an Entry for the given action, whose outcome is Failed if
+// err is not nil, and returns it.
+func (s *Service) Record(actor, action, target, requestID string, err error) (*Entry, error) {
+	return s.Append(&Entry{
+		Actor:     actor,
+		Action:    action,
+		Target:    target,
+		RequestID: requestID,
+	}, err)
+}
+
+// Append appends e, whose outcome is Failed if err is not nil, and returns
+// it.  Its Seq, Time, Outcome and chain are set.
+func (s *Service) Append(e *Entry, err error) (*Entry, error) {
+	e.Time, e.Outcome, e.Error = s.Clock.Now().UTC(), OK, ""
+	if err != nil {
+		e.Outcome, e.Error = Failed, err.Error()
+	}
+
+	err = s.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(Entries))
+		if b == nil {
+			return db.BucketNotFoundErr(Entries)
+		}
+
+		if _, v := b.Cursor().Last(); v != nil {
+			last := new(Entry)
+			if err := json.Unmarshal(v, last); err != nil {
+				return err
+			}
+			e.Prev = last.Hash
+		}
+
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		e.Seq = seq
+
+		if e.Hash, err = e.sum(); err != nil {
+			return err
+		}
+
+		bs, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		return b.Put(seqKey(seq), bs)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Filter selects Entries.  Empty fields select any.
+type Filter struct {
+	Actor        string
+	Impersonator string
+	Action       string
+	Target       string
+
+	// Since and Until bound the Entries' Time, from Since until before
+	// Until.
+	Since, Until time.Time
+
+	// After skips Entries up to and including the given Seq, for paging.
+	After uint64
+
+	// Limit is the most Entries to return, or all if 0.
+	Limit int
+}
+
+func (f *Filter) matches(e *Entry) bool {
+	switch {
+	case f.Actor != "" && e.Actor != f.Actor,
+		f.Impersonator != "" && e.Impersonator != f.Impersonator,
+		f.Action != "" && e.Action != f.Action,
+		f.Target != "" && e.Target != f.Target,
+		!f.Since.IsZero() && e.Time.Before(f.Since),
+		!f.Until.IsZero() && !e.Time.Before(f.Until):
+		return false
+	}
+	return true
+}
+
+// Query returns the Entries the Filter selects, oldest first.
+func (s *Service) Query(f Filter) ([]Entry, error) {
+	es := []Entry{}
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(Entries))
+		if b == nil {
+			return db.BucketNotFoundErr(Entries)
+		}
+
+		c := b.Cursor()
+		for k, v := c.Seek(seqKey(f.After + 1)); k != nil; k, v = c.Next() {
+			var e Entry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			if !f.matches(&e) {
+				continue
+			}
+
+			es = append(es, e)
+			if f.Limit > 0 && len(es) >= f.Limit {
+				return nil
+			}
+		}
+		return nil
+	})
+	return es, err
+}
+
+// Verify checks the whole chain of Entries, and returns how many there are.
+// If any Entry was changed, removed or inserted, it returns an error naming
+// the first Entry at which the chain breaks.
+func (s *Service) Verify() (int, error) {
+	n := 0
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(Entries))
+		if b == nil {
+			return db.BucketNotFoundErr(Entries)
+		}
+
+		prev := ""
+		return b.ForEach(func(k, v []byte) error {
+			n++
+			want := uint64(n)
+
+			var e Entry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return errors.NotValidf("audit entry %d", want)
+			}
+
+			sum, err := e.sum()
+			switch {
+			case err != nil:
+				return err
+			case len(k) != 8 || binary.BigEndian.Uint64(k) != want || e.Seq != want:
+				return errors.NotValidf("audit entry %d sequence", want)
+			case e.Prev != prev:
+				return errors.NotValidf("audit entry %d link", want)
+			case e.Hash != sum:
+				return errors.NotValidf("audit entry %d hash", want)
+			}
+
+			prev = e.Hash
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
@@ -0,0 +1,210 @@
+package audit_test
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	"github.com/synapse-garden/mf-proto/audit"
+	t "github.com/synapse-garden/mf-proto/testing"
+
+	gc "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { gc.TestingT(t) }
+
+type AuditSuite struct {
+	d     *t.DB
+	clock *t.Clock
+	svc   *audit.Service
+}
+
+var _ = gc.Suite(&AuditSuite{})
+
+func (s *AuditSuite) SetUpTest(c *gc.C) {
+	d, err := t.NewDB(
+		t.SetupBolt("test.db"),
+		t.SetupBuckets(audit.Buckets()),
+	)
+	c.Assert(err, jc.ErrorIsNil)
+	s.d = d
+	s.clock = t.NewClock(time.Date(2016, 1, 14, 0, 0, 0, 0, time.UTC))
+	s.svc = audit.NewService(d, audit.WithClock(s.clock))
+}
+
+func (s *AuditSuite) TearDownTest(c *gc.C) {
+	c.Assert(t.CleanupDB(s.d), jc.ErrorIsNil)
+}
+
+// record records some Entries a minute apart.
+func (s *AuditSuite) record(c *gc.C) {
+	for _, e := range []struct {
+		actor, action, target string
+		err                   error
+	}{
+		{"console", "admin.create", "admin:alice@tomato.com", nil},
+		{"admin:alice@tomato.com", "user.create", "bob@tomato.com", nil},
+		{"admin:alice@tomato.com", "user.delete", "larry@cucumber.net", errors.UserNotFoundf("larry")},
+		{"admin:alice@tomato.com", "role.assign", "user:bob@tomato.com", nil},
+	} {
+		_, err := s.svc.Record(e.actor, e.action, e.target, "req", e.err)
+		c.Assert(err, jc.ErrorIsNil)
+		s.clock.Advance(time.Minute)
+	}
+}
+
+// tamper changes the Entry with the given Seq in place.
+func (s *AuditSuite) tamper(seq uint64, change func(*audit.Entry), c *gc.C) {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	c.Assert(s.d.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(audit.Entries))
+		e := new(audit.Entry)
+		if err := json.Unmarshal(b.Get(k), e); err != nil {
+			return err
+		}
+		if change == nil {
+			return b.Delete(k)
+		}
+		change(e)
+		bs, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		return b.Put(k, bs)
+	}), jc.ErrorIsNil)
+}
+
+func (s *AuditSuite) TestRecord(c *gc.C) {
+	e1, err := s.svc.Record("console", "admin.create", "admin:alice@tomato.com", "", nil)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(e1.Seq, gc.Equals, uint64(1))
+	c.Check(e1.Prev, gc.Equals, "")
+	c.Check(e1.Outcome, gc.Equals, audit.OK)
+	c.Check(e1.Time.Equal(s.clock.Now()), jc.IsTrue)
+
+	e2, err := s.svc.Record("console", "admin.delete", "admin:bob@tomato.com", "", errors.UserNotFoundf("bob"))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(e2.Seq, gc.Equals, uint64(2))
+	c.Check(e2.Prev, gc.Equals, e1.Hash)
+	c.Check(e2.Outcome, gc.Equals, audit.Failed)
+	c.Check(e2.Error, gc.Equals, "bob user not found")
+
+	e3, err := s.svc.Append(&audit.Entry{
+		Actor:        "user:b0b",
+		Impersonator: "admin:alice@tomato.com",
+		Action:       "object.put",
+		Target:       "object 12345",
+	}, nil)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(e3.Seq, gc.Equals, uint64(3))
+	c.Check(e3.Prev, gc.Equals, e2.Hash)
+	c.Check(e3.Outcome, gc.Equals, audit.OK)
+
+	es, err := s.svc.Query(audit.Filter{Impersonator: "admin:alice@tomato.com"})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(es, jc.DeepEquals, []audit.Entry{*e3})
+
+	n, err := s.svc.Verify()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(n, gc.Equals, 3)
+}
+
+func (s *AuditSuite) TestQuery(c *gc.C) {
+	s.record(c)
+	start := time.Date(2016, 1, 14, 0, 0, 0, 0, time.UTC)
+
+	for i, t := range []struct {
+		should string
+		filter audit.Filter
+		expect []uint64
+	}{{
+		should: "return every entry",
+		expect: []uint64{1, 2, 3, 4},
+	}, {
+		should: "select by actor",
+		filter: audit.Filter{Actor: "admin:alice@tomato.com"},
+		expect: []uint64{2, 3, 4},
+	}, {
+		should: "select by action and target",
+		filter: audit.Filter{Action: "user.delete", Target: "larry@cucumber.net"},
+		expect: []uint64{3},
+	}, {
+		should: "select by time",
+		filter: audit.Filter{Since: start.Add(time.Minute), Until: start.Add(3 * time.Minute)},
+		expect: []uint64{2, 3},
+	}, {
+		should: "page",
+		filter: audit.Filter{After: 1, Limit: 2},
+		expect: []uint64{2, 3},
+	}, {
+		should: "return nothing past the end",
+		filter: audit.Filter{After: 4},
+		expect: []uint64{},
+	}} {
+		c.Logf("test %d: should %s", i, t.should)
+
+		es, err := s.svc.Query(t.filter)
+		c.Assert(err, jc.ErrorIsNil)
+		seqs := []uint64{}
+		for _, e := range es {
+			seqs = append(seqs, e.Seq)
+		}
+		c.Check(seqs, jc.DeepEquals, t.expect)
+	}
+}
+
+func (s *AuditSuite) TestVerify(c *gc.C) {
+	n, err := s.svc.Verify()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(n, gc.Equals, 0)
+
+	s.record(c)
+	n, err = s.svc.Verify()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(n, gc.Equals, 4)
+
+	for i, t := range []struct {
+		should      string
+		seq         uint64
+		change      func(*audit.Entry)
+		expectError string
+	}{{
+		should:      "find a changed entry",
+		seq:         2,
+		change:      func(e *audit.Entry) { e.Target = "carol@pepper.org" },
+		expectError: `audit entry 2 hash not valid`,
+	}, {
+		should: "find a rehashed entry",
+		seq:    2,
+		change: func(e *audit.Entry) {
+			e.Target = "carol@pepper.org"
+			e.Hash = ""
+			bs, _ := json.Marshal(e)
+			h := sha256.Sum256(bs)
+			e.Hash = hex.EncodeToString(h[:])
+		},
+		expectError: `audit entry 3 link not valid`,
+	}, {
+		should:      "find a removed entry",
+		seq:         3,
+		expectError: `audit entry 3 sequence not valid`,
+	}} {
+		c.Logf("test %d: should %s", i, t.should)
+
+		s.TearDownTest(c)
+		s.SetUpTest(c)
+		s.record(c)
+
+		s.tamper(t.seq, t.change, c)
+		_, err := s.svc.Verify()
+		c.Check(err, gc.ErrorMatches, t.expectError)
+	}
+}
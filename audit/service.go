@@ -0,0 +1,34 @@
+package audit
+
+import (
+	"github.com/synapse-garden/mf-proto/db"
+	"github.com/synapse-garden/mf-proto/util"
+)
+
+// Service records and queries audit Entries in its own DB, timed by its
+// own Clock.
+type Service struct {
+	DB    db.DB
+	Clock util.Clock
+}
+
+// Option configures a Service.
+type Option func(*Service)
+
+// WithClock sets the Clock a Service uses.
+func WithClock(c util.Clock) Option {
+	return func(s *Service) { s.Clock = c }
+}
+
+// NewService makes a new Service for the given DB using the system clock,
+// unless otherwise configured by the given Options.
+func NewService(d db.DB, opts ...Option) *Service {
+	s := &Service{
+		DB:    d,
+		Clock: util.SystemClock{},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/synapse-garden/mf-proto/admin"
+	"github.com/synapse-garden/mf-proto/db"
+	"github.com/synapse-garden/mf-proto/jwt"
+	"github.com/synapse-garden/mf-proto/mail"
+	"github.com/synapse-garden/mf-proto/oidc"
+	"github.com/synapse-garden/mf-proto/user"
+	"github.com/synapse-garden/mf-proto/util"
+)
+
+var (
+	smtpAddr = flag.String("smtp", "", "host:port of an SMTP server to send mail through")
+	smtpUser = flag.String("smtp-user", "", "SMTP username; the password is read from $MF_SMTP_PASSWORD")
+	mailFrom = flag.String("mail-from", "mindfork@localhost", "sender address of outgoing mail")
+	mailDir  = flag.String("mail-dir", "outbox", "directory to write outgoing mail into if -smtp is not set")
+
+	verifyURL = flag.String("verify-url", "https://localhost:25001/user/verify", "email verification link sent to new users")
+	resetURL  = flag.String("reset-url", "https://localhost:25001/user/password/reset", "password reset link sent to users who forgot their password")
+	emailURL  = flag.String("email-url", "https://localhost:25001/user/email/confirm", "email change link sent to users' new addresses")
+
+	jwtAlg = flag.String("jwt", "", "issue logins as JWTs signed with HS256 or EdDSA instead of keeping them in the DB")
+	jwtTTL = flag.Duration("jwt-ttl", user.DefaultJWTTTL, "how long JWT logins last")
+
+	setupTokenFile = flag.String("setup-token-file", "", "file holding the token to create the first admin with at /admin/setup; $MF_SETUP_TOKEN may hold it instead")
+
+	oidcProviders = flag.String("oidc", "", "JSON file of OpenID Connect providers users may sign in with")
+
+	legacyGET = flag.Bool("legacy-get", false, "also serve the old GET routes which change things, and accept credentials in URL queries, with Deprecation headers")
+)
+
+// mailer makes the Mailer configured by the command-line flags.
+func mailer() (mail.Mailer, error) {
+	if *smtpAddr == "" {
+		if err := os.MkdirAll(*mailDir, 0700); err != nil {
+			return nil, err
+		}
+		return mail.Dir(*mailDir), nil
+	}
+
+	host, _, err := net.SplitHostPort(*smtpAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	return mail.NewSMTP(
+		*smtpAddr, host,
+		*smtpUser, os.Getenv("MF_SMTP_PASSWORD"),
+		*mailFrom,
+	), nil
+}
+
+// userOptions returns the user.Options configured by the command-line flags.
+func userOptions(m mail.Mailer) ([]user.Option, error) {
+	opts := []user.Option{
+		user.WithMailer(m, *mailFrom),
+		user.WithVerifyURL(*verifyURL),
+		user.WithResetURL(*resetURL),
+		user.WithEmailURL(*emailURL),
+	}
+
+	if *jwtAlg != "" {
+		if err := jwt.ValidAlg(*jwtAlg); err != nil {
+			return nil, err
+		}
+		opts = append(opts, user.WithJWT(*jwtAlg, *jwtTTL))
+	}
+
+	return opts, nil
+}
+
+// oidcOptions returns the oidc.Options configured by the command-line flags.
+func oidcOptions() ([]oidc.Option, error) {
+	if *oidcProviders == "" {
+		return nil, nil
+	}
+
+	ps, err := oidc.LoadProviders(*oidcProviders)
+	if err != nil {
+		return nil, err
+	}
+	return []oidc.Option{oidc.WithProviders(ps...)}, nil
+}
+
+// openSetup opens admin setup if there is no admin yet, with the token from
+// $MF_SETUP_TOKEN or -setup-token-file, or else a random one which is
+// logged.
+func openSetup(as *admin.Service) error {
+	if err := db.SetupBuckets(as.DB, admin.Buckets()); err != nil {
+		return err
+	}
+
+	switch found, err := as.Any(); {
+	case err != nil:
+		return err
+	case found:
+		return nil
+	}
+
+	token := os.Getenv("MF_SETUP_TOKEN")
+	if token == "" && *setupTokenFile != "" {
+		bs, err := os.ReadFile(*setupTokenFile)
+		if err != nil {
+			return err
+		}
+		token = strings.TrimSpace(string(bs))
+	}
+
+	t, err := as.OpenSetup(util.Key(token))
+	if err != nil {
+		return err
+	}
+
+	if token == "" {
+		log.Printf("no admin exists; create one at /admin/setup with setup token %s", t)
+	} else {
+		log.Printf("no admin exists; create one at /admin/setup with the given setup token")
+	}
+	return nil
+}
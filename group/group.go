@@ -0,0 +1,433 @@
+// Package group implements groups of users who share Objects.  Each member
+// of a Group has a Role: owners manage the Group and its membership, and
+// members may use whatever is shared with the Group.
+package group
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/boltdb/bolt"
+	"github.com/juju/errors"
+	"github.com/synapse-garden/mf-proto/db"
+	"github.com/synapse-garden/mf-proto/util"
+)
+
+const (
+	// Groups is the bucket that contains all Groups, by ID.
+	Groups db.Bucket = "group-groups"
+
+	// UserGroups indexes the IDs of each user's Groups by user ID.
+	UserGroups db.Bucket = "group-user-groups"
+
+	// Invites holds pending Invites, by code.
+	Invites db.Bucket = "group-invites"
+)
+
+// MaxName is the longest a Group's name may be, in characters.
+const MaxName = 64
+
+// Buckets returns the Buckets for the group database.
+func Buckets() []db.Bucket {
+	return []db.Bucket{
+		Groups,
+		UserGroups,
+		Invites,
+	}
+}
+
+// Role is what a member may do in a Group.
+type Role string
+
+const (
+	// RoleOwner members manage the Group.
+	RoleOwner Role = "owner"
+
+	// RoleMember members use what is shared with the Group.
+	RoleMember Role = "member"
+)
+
+// ValidRole returns an error if r is not a known Role.
+func ValidRole(r Role) error {
+	switch r {
+	case RoleOwner, RoleMember:
+		return nil
+	}
+	return errors.NotValidf("group role %q", r)
+}
+
+// Grants returns true if the Role may do anything the wanted Role may.
+func (r Role) Grants(want Role) bool {
+	return r == RoleOwner || r == want
+}
+
+// ValidName returns an error if name is not a valid Group name.
+func ValidName(name string) error {
+	if n := utf8.RuneCountInString(name); n == 0 || n > MaxName ||
+		strings.TrimSpace(name) != name {
+		return errors.NotValidf("group name %q", name)
+	}
+	return nil
+}
+
+// Member is a user in a Group.
+type Member struct {
+	User   string    `json:"user"`
+	Role   Role      `json:"role"`
+	Joined time.Time `json:"joined"`
+}
+
+// Group is a named set of users.
+type Group struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	Members []Member  `json:"members"`
+}
+
+// Principal returns the principal naming the Group's members in object
+// Permissions.
+func (g *Group) Principal() string { return util.GroupPrincipal(g.ID) }
+
+// RoleOf returns the Role of the user with the given ID, and false if they
+// are not a member.
+func (g *Group) RoleOf(user string) (Role, bool) {
+	for _, m := range g.Members {
+		if m.User == user {
+			return m.Role, true
+		}
+	}
+	return "", false
+}
+
+// owners returns how many owners the Group has.
+func (g *Group) owners() int {
+	n := 0
+	for _, m := range g.Members {
+		if m.Role == RoleOwner {
+			n++
+		}
+	}
+	return n
+}
+
+func newID() (string, error) {
+	k, err := util.NewKey()
+	if err != nil {
+		return "", err
+	}
+	return string(k[:16]), nil
+}
+
+// Create makes a new Group with the given name, owned by the user with the
+// given ID.
+func (s *Service) Create(owner, name string) (*Group, error) {
+	if err := ValidName(name); err != nil {
+		return nil, err
+	}
+
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.Clock.Now()
+	g := &Group{
+		ID:      id,
+		Name:    name,
+		Created: now,
+		Members: []Member{{User: owner, Role: RoleOwner, Joined: now}},
+	}
+
+	err = s.DB.Update(func(tx *bolt.Tx) error {
+		if err := putGroup(tx, g); err != nil {
+			return err
+		}
+		return index(tx, owner, id, true)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return g, nil
+}
+
+// Get returns the Group with the given ID.
+func (s *Service) Get(id string) (*Group, error) {
+	var g *Group
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		g, err = getGroup(tx, id)
+		return err
+	})
+	return g, err
+}
+
+// All returns every Group.
+func (s *Service) All() ([]*Group, error) {
+	var gs []*Group
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(Groups))
+		if b == nil {
+			return db.BucketNotFoundErr(Groups)
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			g := new(Group)
+			if err := json.Unmarshal(v, g); err != nil {
+				return err
+			}
+			gs = append(gs, g)
+			return nil
+		})
+	})
+	return gs, err
+}
+
+// IDsOf returns the IDs of the Groups the user with the given ID is a
+// member of.
+func (s *Service) IDsOf(user string) ([]string, error) {
+	var ids []string
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		ids, err = indexed(tx, user)
+		return err
+	})
+	return ids, err
+}
+
+// Of returns the Groups the user with the given ID is a member of.
+func (s *Service) Of(user string) ([]*Group, error) {
+	var gs []*Group
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		ids, err := indexed(tx, user)
+		if err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			g, err := getGroup(tx, id)
+			if err != nil {
+				return err
+			}
+			gs = append(gs, g)
+		}
+		return nil
+	})
+	return gs, err
+}
+
+// Authorize returns the Group with the given ID if the user with the given
+// ID has a Role in it granting the wanted Role.
+func (s *Service) Authorize(user, id string, want Role) (*Group, error) {
+	g, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if r, ok := g.RoleOf(user); !ok || !r.Grants(want) {
+		return nil, util.Forbiddenf("user %q not %s of group %q", user, want, id)
+	}
+
+	return g, nil
+}
+
+// Rename renames the Group with the given ID.
+func (s *Service) Rename(id, name string) error {
+	if err := ValidName(name); err != nil {
+		return err
+	}
+
+	return s.update(id, func(tx *bolt.Tx, g *Group) error {
+		g.Name = name
+		return nil
+	})
+}
+
+// Delete deletes the Group with the given ID and its pending Invites.
+func (s *Service) Delete(id string) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		g, err := getGroup(tx, id)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range g.Members {
+			if err := index(tx, m.User, id, false); err != nil {
+				return err
+			}
+		}
+
+		if err := deleteInvites(tx, id); err != nil {
+			return err
+		}
+
+		return tx.Bucket([]byte(Groups)).Delete([]byte(id))
+	})
+}
+
+// AddMember adds the user with the given ID to the Group with the given ID.
+func (s *Service) AddMember(id, user string, role Role) error {
+	if err := ValidRole(role); err != nil {
+		return err
+	}
+
+	return s.update(id, func(tx *bolt.Tx, g *Group) error {
+		return addMember(tx, g, user, role, s.Clock.Now())
+	})
+}
+
+// SetRole changes the Role of a member of the Group with the given ID.  The
+// Group's last owner cannot be made a member.
+func (s *Service) SetRole(id, user string, role Role) error {
+	if err := ValidRole(role); err != nil {
+		return err
+	}
+
+	return s.update(id, func(tx *bolt.Tx, g *Group) error {
+		i, err := memberIndex(g, user)
+		if err != nil {
+			return err
+		}
+
+		if g.Members[i].Role == RoleOwner && role != RoleOwner && g.owners() == 1 {
+			return errors.NotValidf("demoting last owner of group %q", id)
+		}
+
+		g.Members[i].Role = role
+		return nil
+	})
+}
+
+// RemoveMember removes the user with the given ID from the Group with the
+// given ID.  The Group's last owner cannot be removed; delete the Group
+// instead.
+func (s *Service) RemoveMember(id, user string) error {
+	return s.update(id, func(tx *bolt.Tx, g *Group) error {
+		i, err := memberIndex(g, user)
+		if err != nil {
+			return err
+		}
+
+		if g.Members[i].Role == RoleOwner && g.owners() == 1 {
+			return errors.NotValidf("removing last owner of group %q", id)
+		}
+
+		g.Members = append(g.Members[:i], g.Members[i+1:]...)
+		return index(tx, user, id, false)
+	})
+}
+
+// update calls fn on the Group with the given ID and stores the result, in
+// one transaction.
+func (s *Service) update(id string, fn func(*bolt.Tx, *Group) error) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		g, err := getGroup(tx, id)
+		if err != nil {
+			return err
+		}
+
+		if err := fn(tx, g); err != nil {
+			return err
+		}
+
+		return putGroup(tx, g)
+	})
+}
+
+func addMember(tx *bolt.Tx, g *Group, user string, role Role, now time.Time) error {
+	if _, ok := g.RoleOf(user); ok {
+		return errors.AlreadyExistsf("member %q of group %q", user, g.ID)
+	}
+
+	g.Members = append(g.Members, Member{User: user, Role: role, Joined: now})
+	return index(tx, user, g.ID, true)
+}
+
+func memberIndex(g *Group, user string) (int, error) {
+	for i, m := range g.Members {
+		if m.User == user {
+			return i, nil
+		}
+	}
+	return 0, errors.NotFoundf("member %q of group %q", user, g.ID)
+}
+
+func getGroup(tx *bolt.Tx, id string) (*Group, error) {
+	b := tx.Bucket([]byte(Groups))
+	if b == nil {
+		return nil, db.BucketNotFoundErr(Groups)
+	}
+
+	bs := b.Get([]byte(id))
+	if len(bs) == 0 {
+		return nil, errors.NotFoundf("group %q", id)
+	}
+
+	g := new(Group)
+	if err := json.Unmarshal(bs, g); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func putGroup(tx *bolt.Tx, g *Group) error {
+	b := tx.Bucket([]byte(Groups))
+	if b == nil {
+		return db.BucketNotFoundErr(Groups)
+	}
+
+	bs, err := json.Marshal(g)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(g.ID), bs)
+}
+
+// indexed returns the IDs of the user's Groups.
+func indexed(tx *bolt.Tx, user string) ([]string, error) {
+	b := tx.Bucket([]byte(UserGroups))
+	if b == nil {
+		return nil, db.BucketNotFoundErr(UserGroups)
+	}
+
+	var ids []string
+	if bs := b.Get([]byte(user)); len(bs) > 0 {
+		if err := json.Unmarshal(bs, &ids); err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
+
+// index adds the Group with the given ID to the user's Groups, or removes
+// it if add is false.
+func index(tx *bolt.Tx, user, id string, add bool) error {
+	ids, err := indexed(tx, user)
+	if err != nil {
+		return err
+	}
+
+	kept := ids[:0]
+	for _, i := range ids {
+		if i != id {
+			kept = append(kept, i)
+		}
+	}
+	if add {
+		kept = append(kept, id)
+	}
+
+	b := tx.Bucket([]byte(UserGroups))
+	if len(kept) == 0 {
+		return b.Delete([]byte(user))
+	}
+
+	bs, err := json.Marshal(kept)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(user), bs)
+}
@@ -0,0 +1,159 @@
+package group_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	"github.com/synapse-garden/mf-proto/group"
+	t "github.com/synapse-garden/mf-proto/testing"
+	"github.com/synapse-garden/mf-proto/util"
+
+	gc "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { gc.TestingT(t) }
+
+type GroupSuite struct {
+	d     *t.DB
+	clock *t.Clock
+	svc   *group.Service
+}
+
+var _ = gc.Suite(&GroupSuite{})
+
+func (s *GroupSuite) SetUpTest(c *gc.C) {
+	d, err := t.NewDB(
+		t.SetupBolt("test.db"),
+		t.SetupBuckets(group.Buckets()),
+	)
+	c.Assert(err, jc.ErrorIsNil)
+	s.d = d
+	s.clock = t.NewClock(time.Date(2016, 1, 14, 0, 0, 0, 0, time.UTC))
+	s.svc = group.NewService(d, group.WithClock(s.clock))
+}
+
+func (s *GroupSuite) TearDownTest(c *gc.C) {
+	c.Assert(t.CleanupDB(s.d), jc.ErrorIsNil)
+}
+
+func (s *GroupSuite) TestCreate(c *gc.C) {
+	for i, t := range []struct {
+		should      string
+		name        string
+		expectError string
+	}{{
+		should: "make a group",
+		name:   "Tomato Growers",
+	}, {
+		should:      "not make a group without a name",
+		expectError: `group name "" not valid`,
+	}, {
+		should:      "not make a group with padded name",
+		name:        " padded ",
+		expectError: `group name " padded " not valid`,
+	}} {
+		c.Logf("test %d: should %s", i, t.should)
+		g, err := s.svc.Create("b0b", t.name)
+		if t.expectError != "" {
+			c.Check(err, gc.ErrorMatches, t.expectError)
+			continue
+		}
+		c.Assert(err, jc.ErrorIsNil)
+
+		got, err := s.svc.Get(g.ID)
+		c.Assert(err, jc.ErrorIsNil)
+		c.Check(got, jc.DeepEquals, g)
+		c.Check(got.Name, gc.Equals, t.name)
+		c.Check(got.Created, gc.Equals, s.clock.Now())
+		c.Check(got.Members, jc.DeepEquals, []group.Member{{
+			User:   "b0b",
+			Role:   group.RoleOwner,
+			Joined: s.clock.Now(),
+		}})
+
+		ids, err := s.svc.IDsOf("b0b")
+		c.Assert(err, jc.ErrorIsNil)
+		c.Check(ids, jc.DeepEquals, []string{g.ID})
+	}
+
+	_, err := s.svc.Get("nope")
+	c.Check(err, gc.ErrorMatches, `group "nope" not found`)
+	c.Check(errors.IsNotFound(err), jc.IsTrue)
+}
+
+func (s *GroupSuite) TestMembership(c *gc.C) {
+	g, err := s.svc.Create("b0b", "growers")
+	c.Assert(err, jc.ErrorIsNil)
+
+	c.Assert(s.svc.AddMember(g.ID, "l4rry", group.RoleMember), jc.ErrorIsNil)
+	c.Check(s.svc.AddMember(g.ID, "l4rry", group.RoleOwner), gc.ErrorMatches,
+		`member "l4rry" of group ".*" already exists`)
+	c.Check(s.svc.AddMember(g.ID, "sue", "boss"), gc.ErrorMatches,
+		`group role "boss" not valid`)
+
+	_, err = s.svc.Authorize("l4rry", g.ID, group.RoleMember)
+	c.Check(err, jc.ErrorIsNil)
+	_, err = s.svc.Authorize("l4rry", g.ID, group.RoleOwner)
+	c.Check(err, gc.ErrorMatches, `user "l4rry" not owner of group ".*"`)
+	c.Check(errors.IsUnauthorized(err), jc.IsTrue)
+	c.Check(err, jc.Satisfies, util.IsForbidden)
+	_, err = s.svc.Authorize("sue", g.ID, group.RoleMember)
+	c.Check(err, gc.ErrorMatches, `user "sue" not member of group ".*"`)
+
+	// The last owner can be neither demoted nor removed.
+	c.Check(s.svc.SetRole(g.ID, "b0b", group.RoleMember), gc.ErrorMatches,
+		`demoting last owner of group ".*" not valid`)
+	c.Check(s.svc.RemoveMember(g.ID, "b0b"), gc.ErrorMatches,
+		`removing last owner of group ".*" not valid`)
+
+	c.Assert(s.svc.SetRole(g.ID, "l4rry", group.RoleOwner), jc.ErrorIsNil)
+	c.Assert(s.svc.RemoveMember(g.ID, "b0b"), jc.ErrorIsNil)
+	c.Check(s.svc.RemoveMember(g.ID, "b0b"), gc.ErrorMatches,
+		`member "b0b" of group ".*" not found`)
+
+	gs, err := s.svc.Of("b0b")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(gs, gc.HasLen, 0)
+	gs, err = s.svc.Of("l4rry")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(gs, gc.HasLen, 1)
+	c.Check(gs[0].Members, jc.DeepEquals, []group.Member{{
+		User:   "l4rry",
+		Role:   group.RoleOwner,
+		Joined: s.clock.Now(),
+	}})
+}
+
+func (s *GroupSuite) TestRenameDelete(c *gc.C) {
+	g, err := s.svc.Create("b0b", "growers")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(s.svc.AddMember(g.ID, "l4rry", group.RoleMember), jc.ErrorIsNil)
+	_, err = s.svc.Invite(g.ID, "b0b", "sue", group.RoleMember)
+	c.Assert(err, jc.ErrorIsNil)
+
+	c.Check(s.svc.Rename(g.ID, ""), gc.ErrorMatches, `group name "" not valid`)
+	c.Assert(s.svc.Rename(g.ID, "eaters"), jc.ErrorIsNil)
+	got, err := s.svc.Get(g.ID)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(got.Name, gc.Equals, "eaters")
+
+	c.Assert(s.svc.Delete(g.ID), jc.ErrorIsNil)
+	c.Check(s.svc.Delete(g.ID), gc.ErrorMatches, `group ".*" not found`)
+
+	for _, u := range []string{"b0b", "l4rry"} {
+		ids, err := s.svc.IDsOf(u)
+		c.Assert(err, jc.ErrorIsNil)
+		c.Check(ids, gc.HasLen, 0)
+	}
+
+	invs, err := s.svc.Invites("sue")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(invs, gc.HasLen, 0)
+
+	gs, err := s.svc.All()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(gs, gc.HasLen, 0)
+}
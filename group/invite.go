@@ -0,0 +1,208 @@
+package group
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/juju/errors"
+	"github.com/synapse-garden/mf-proto/db"
+	"github.com/synapse-garden/mf-proto/util"
+)
+
+// Invite is an invitation for a user to join a Group with a Role.
+type Invite struct {
+	Code    util.Key  `json:"code"`
+	Group   string    `json:"group"`
+	User    string    `json:"user"`
+	Role    Role      `json:"role"`
+	By      string    `json:"by"`
+	Expires time.Time `json:"expires"`
+}
+
+// Invite invites the user with the given ID to join the Group with the
+// given ID with the given Role, on behalf of the member by.
+func (s *Service) Invite(id, by, user string, role Role) (*Invite, error) {
+	if err := ValidRole(role); err != nil {
+		return nil, err
+	}
+
+	g, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := g.RoleOf(user); ok {
+		return nil, errors.AlreadyExistsf("member %q of group %q", user, id)
+	}
+
+	code, err := util.NewKey()
+	if err != nil {
+		return nil, err
+	}
+
+	inv := &Invite{
+		Code:    code[:16],
+		Group:   id,
+		User:    user,
+		Role:    role,
+		By:      by,
+		Expires: s.Clock.Now().Add(s.InviteTTL),
+	}
+
+	return inv, db.StoreKeyValue(s.DB, Invites, []byte(inv.Code), inv)
+}
+
+// Invites returns the unexpired Invites for the user with the given ID.
+func (s *Service) Invites(user string) ([]*Invite, error) {
+	now := s.Clock.Now()
+	return s.invites(func(inv *Invite) bool {
+		return inv.User == user && now.Before(inv.Expires)
+	})
+}
+
+// GroupInvites returns the Invites to the Group with the given ID.
+func (s *Service) GroupInvites(id string) ([]*Invite, error) {
+	return s.invites(func(inv *Invite) bool { return inv.Group == id })
+}
+
+// Accept makes the user with the given ID a member of the Group they were
+// invited to with the given code, and returns the Group.
+func (s *Service) Accept(user string, code util.Key) (*Group, error) {
+	var g *Group
+	err := s.DB.Update(func(tx *bolt.Tx) error {
+		inv, err := s.useInvite(tx, user, code)
+		if err != nil {
+			return err
+		}
+
+		if g, err = getGroup(tx, inv.Group); err != nil {
+			return err
+		}
+
+		if err := addMember(tx, g, user, inv.Role, s.Clock.Now()); err != nil {
+			return err
+		}
+		return putGroup(tx, g)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return g, nil
+}
+
+// Decline deletes the Invite with the given code for the user with the
+// given ID.
+func (s *Service) Decline(user string, code util.Key) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		_, err := s.useInvite(tx, user, code)
+		return err
+	})
+}
+
+// RevokeInvite deletes the Invite with the given code to the Group with the
+// given ID.
+func (s *Service) RevokeInvite(id string, code util.Key) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(Invites))
+		if b == nil {
+			return db.BucketNotFoundErr(Invites)
+		}
+
+		inv, err := getInvite(b, code)
+		switch {
+		case err != nil:
+			return err
+		case inv == nil || inv.Group != id:
+			return errors.NotFoundf("invite %q to group %q", code, id)
+		}
+
+		return b.Delete([]byte(code))
+	})
+}
+
+// useInvite deletes and returns the Invite with the given code, or returns
+// an error if it is not an unexpired Invite for the user.
+func (s *Service) useInvite(tx *bolt.Tx, user string, code util.Key) (*Invite, error) {
+	b := tx.Bucket([]byte(Invites))
+	if b == nil {
+		return nil, db.BucketNotFoundErr(Invites)
+	}
+
+	inv, err := getInvite(b, code)
+	switch {
+	case err != nil:
+		return nil, err
+	case inv == nil, inv.User != user, !s.Clock.Now().Before(inv.Expires):
+		return nil, errors.Unauthorizedf("invite %q not valid", code)
+	}
+
+	return inv, b.Delete([]byte(code))
+}
+
+func (s *Service) invites(keep func(*Invite) bool) ([]*Invite, error) {
+	var invs []*Invite
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(Invites))
+		if b == nil {
+			return db.BucketNotFoundErr(Invites)
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			inv := new(Invite)
+			if err := json.Unmarshal(v, inv); err != nil {
+				return err
+			}
+			if keep(inv) {
+				invs = append(invs, inv)
+			}
+			return nil
+		})
+	})
+	return invs, err
+}
+
+// getInvite returns the Invite with the given code, or nil if there is none.
+func getInvite(b *bolt.Bucket, code util.Key) (*Invite, error) {
+	bs := b.Get([]byte(code))
+	if len(bs) == 0 {
+		return nil, nil
+	}
+
+	inv := new(Invite)
+	if err := json.Unmarshal(bs, inv); err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// deleteInvites deletes every Invite to the Group with the given ID.
+func deleteInvites(tx *bolt.Tx, id string) error {
+	b := tx.Bucket([]byte(Invites))
+	if b == nil {
+		return db.BucketNotFoundErr(Invites)
+	}
+
+	var codes [][]byte
+	err := b.ForEach(func(k, v []byte) error {
+		inv := new(Invite)
+		if err := json.Unmarshal(v, inv); err != nil {
+			return err
+		}
+		if inv.Group == id {
+			codes = append(codes, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, k := range codes {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package group_test
+
+import (
+	jc "github.com/juju/testing/checkers"
+	"github.com/synapse-garden/mf-proto/group"
+
+	gc "gopkg.in/check.v1"
+)
+
+func (s *GroupSuite) TestInvite(c *gc.C) {
+	g, err := s.svc.Create("b0b", "growers")
+	c.Assert(err, jc.ErrorIsNil)
+
+	_, err = s.svc.Invite(g.ID, "b0b", "b0b", group.RoleMember)
+	c.Check(err, gc.ErrorMatches, `member "b0b" of group ".*" already exists`)
+	_, err = s.svc.Invite("nope", "b0b", "l4rry", group.RoleMember)
+	c.Check(err, gc.ErrorMatches, `group "nope" not found`)
+
+	inv, err := s.svc.Invite(g.ID, "b0b", "l4rry", group.RoleOwner)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(inv.Expires, gc.Equals, s.clock.Now().Add(group.DefaultInviteTTL))
+
+	invs, err := s.svc.Invites("l4rry")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(invs, jc.DeepEquals, []*group.Invite{inv})
+	invs, err = s.svc.GroupInvites(g.ID)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(invs, jc.DeepEquals, []*group.Invite{inv})
+
+	// Only the invited user may accept.
+	_, err = s.svc.Accept("sue", inv.Code)
+	c.Check(err, gc.ErrorMatches, `invite ".*" not valid`)
+
+	got, err := s.svc.Accept("l4rry", inv.Code)
+	c.Assert(err, jc.ErrorIsNil)
+	r, ok := got.RoleOf("l4rry")
+	c.Check(ok, jc.IsTrue)
+	c.Check(r, gc.Equals, group.RoleOwner)
+
+	// Invites are single-use.
+	_, err = s.svc.Accept("l4rry", inv.Code)
+	c.Check(err, gc.ErrorMatches, `invite ".*" not valid`)
+}
+
+func (s *GroupSuite) TestInviteExpiry(c *gc.C) {
+	g, err := s.svc.Create("b0b", "growers")
+	c.Assert(err, jc.ErrorIsNil)
+
+	inv, err := s.svc.Invite(g.ID, "b0b", "l4rry", group.RoleMember)
+	c.Assert(err, jc.ErrorIsNil)
+
+	s.clock.Advance(group.DefaultInviteTTL)
+
+	invs, err := s.svc.Invites("l4rry")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(invs, gc.HasLen, 0)
+	_, err = s.svc.Accept("l4rry", inv.Code)
+	c.Check(err, gc.ErrorMatches, `invite ".*" not valid`)
+}
+
+func (s *GroupSuite) TestDeclineRevoke(c *gc.C) {
+	g, err := s.svc.Create("b0b", "growers")
+	c.Assert(err, jc.ErrorIsNil)
+
+	inv, err := s.svc.Invite(g.ID, "b0b", "l4rry", group.RoleMember)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(s.svc.Decline("sue", inv.Code), gc.ErrorMatches, `invite ".*" not valid`)
+	c.Assert(s.svc.Decline("l4rry", inv.Code), jc.ErrorIsNil)
+	_, err = s.svc.Accept("l4rry", inv.Code)
+	c.Check(err, gc.ErrorMatches, `invite ".*" not valid`)
+
+	inv, err = s.svc.Invite(g.ID, "b0b", "l4rry", group.RoleMember)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(s.svc.RevokeInvite("other", inv.Code), gc.ErrorMatches,
+		`invite ".*" to group "other" not found`)
+	c.Assert(s.svc.RevokeInvite(g.ID, inv.Code), jc.ErrorIsNil)
+
+	invs, err := s.svc.GroupInvites(g.ID)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(invs, gc.HasLen, 0)
+}
@@ -0,0 +1,48 @@
+package group
+
+import (
+	"time"
+
+	"github.com/synapse-garden/mf-proto/db"
+	"github.com/synapse-garden/mf-proto/util"
+)
+
+// DefaultInviteTTL is how long an Invite to a group lasts.
+const DefaultInviteTTL = 7 * 24 * time.Hour
+
+// Service performs group operations against its own DB, using its own
+// Clock.
+type Service struct {
+	DB    db.DB
+	Clock util.Clock
+
+	// InviteTTL is how long an Invite lasts before it expires.
+	InviteTTL time.Duration
+}
+
+// Option configures a Service.
+type Option func(*Service)
+
+// WithClock sets the Service's Clock.
+func WithClock(c util.Clock) Option {
+	return func(s *Service) { s.Clock = c }
+}
+
+// WithInviteTTL sets how long the Service's Invites last.
+func WithInviteTTL(t time.Duration) Option {
+	return func(s *Service) { s.InviteTTL = t }
+}
+
+// NewService makes a new Service for the given DB, using the system clock
+// and DefaultInviteTTL unless configured otherwise by the given Options.
+func NewService(d db.DB, opts ...Option) *Service {
+	s := &Service{
+		DB:        d,
+		Clock:     util.SystemClock{},
+		InviteTTL: DefaultInviteTTL,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
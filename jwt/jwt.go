@@ -0,0 +1,295 @@
+// Package jwt implements signed JSON Web Tokens (RFC 7519) using HS256 or
+// EdDSA with Ed25519 keys (RFC 8037), and JSON Web Key Sets (RFC 7517) for
+// publishing the public keys.  Tokens signed by others with RS256 can be
+// verified, but not made.
+package jwt
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/synapse-garden/mf-proto/util"
+)
+
+// Signing algorithms.  Only HS256 and EdDSA Keys can sign.
+const (
+	HS256 = "HS256"
+	EdDSA = "EdDSA"
+	RS256 = "RS256"
+)
+
+// MinRSABits is the smallest RSA modulus accepted.
+const MinRSABits = 2048
+
+var b64 = base64.RawURLEncoding
+
+// ValidAlg returns an error unless alg is an algorithm which can sign.
+func ValidAlg(alg string) error {
+	switch alg {
+	case HS256, EdDSA:
+		return nil
+	}
+	return errors.NotValidf("JWT algorithm %q", alg)
+}
+
+// Key is a signing Key.  Its Secret is the HMAC secret of an HS256 Key, or
+// the private key seed of an EdDSA Key, and must be kept private.  Keys
+// made from a JWK have no Secret, and can only verify.
+type Key struct {
+	ID      string    `json:"kid"`
+	Alg     string    `json:"alg"`
+	Created time.Time `json:"created"`
+	Secret  []byte    `json:"secret"`
+
+	public crypto.PublicKey
+}
+
+// NewKey makes a new random Key for the given algorithm.
+func NewKey(alg string, created time.Time) (*Key, error) {
+	if err := ValidAlg(alg); err != nil {
+		return nil, err
+	}
+
+	id, err := util.NewKey()
+	if err != nil {
+		return nil, err
+	}
+
+	size := 32
+	if alg == EdDSA {
+		size = ed25519.SeedSize
+	}
+	secret, err := util.RandomBytes(size)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Key{
+		ID:      string(id[:16]),
+		Alg:     alg,
+		Created: created,
+		Secret:  secret,
+	}, nil
+}
+
+func (k *Key) sign(data []byte) []byte {
+	if k.Alg == EdDSA {
+		return ed25519.Sign(ed25519.NewKeyFromSeed(k.Secret), data)
+	}
+
+	mac := hmac.New(sha256.New, k.Secret)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func (k *Key) verify(data, sig []byte) bool {
+	switch pub := k.public.(type) {
+	case ed25519.PublicKey:
+		return k.Alg == EdDSA && ed25519.Verify(pub, data, sig)
+	case *rsa.PublicKey:
+		sum := sha256.Sum256(data)
+		return k.Alg == RS256 && rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig) == nil
+	}
+
+	switch {
+	case k.Alg == EdDSA && len(k.Secret) == ed25519.SeedSize:
+		pub := ed25519.NewKeyFromSeed(k.Secret).Public().(ed25519.PublicKey)
+		return ed25519.Verify(pub, data, sig)
+	case k.Alg == HS256 && len(k.Secret) > 0:
+		return hmac.Equal(k.sign(data), sig)
+	}
+	return false
+}
+
+// JWK is a public JSON Web Key: an Ed25519 key with an X coordinate, or an
+// RSA key with a modulus N and exponent E.
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Kid string `json:"kid"`
+	X   string `json:"x,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+// Key returns a Key which verifies tokens signed by the JWK's private key.
+func (j JWK) Key() (*Key, error) {
+	switch {
+	case j.Use != "" && j.Use != "sig":
+		return nil, errors.NotValidf("JWK %q for %q", j.Kid, j.Use)
+	case j.Kty == "OKP" && j.Crv == "Ed25519" && (j.Alg == "" || j.Alg == EdDSA):
+		x, err := b64.DecodeString(j.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.NotValidf("JWK %q", j.Kid)
+		}
+		return &Key{ID: j.Kid, Alg: EdDSA, public: ed25519.PublicKey(x)}, nil
+	case j.Kty == "RSA" && (j.Alg == "" || j.Alg == RS256):
+		n, nerr := b64.DecodeString(j.N)
+		e, eerr := b64.DecodeString(j.E)
+		if nerr != nil || eerr != nil || len(e) == 0 || len(e) > 4 {
+			return nil, errors.NotValidf("JWK %q", j.Kid)
+		}
+		pub := &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+		if pub.N.BitLen() < MinRSABits {
+			return nil, errors.NotValidf("JWK %q with a %d-bit modulus", j.Kid, pub.N.BitLen())
+		}
+		return &Key{ID: j.Kid, Alg: RS256, public: pub}, nil
+	}
+	return nil, errors.NotSupportedf("JWK %q of type %q", j.Kid, j.Kty)
+}
+
+// JWKS is a JSON Web Key Set.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWK returns the public JWK of an EdDSA Key.  HS256 Keys have none, since
+// they are symmetric.
+func (k *Key) JWK() (JWK, bool) {
+	if k.Alg != EdDSA {
+		return JWK{}, false
+	}
+
+	pub := ed25519.NewKeyFromSeed(k.Secret).Public().(ed25519.PublicKey)
+	return JWK{
+		Kty: "OKP",
+		Crv: "Ed25519",
+		Use: "sig",
+		Alg: EdDSA,
+		Kid: k.ID,
+		X:   b64.EncodeToString(pub),
+	}, true
+}
+
+// Claims are the registered claims used by this package.  Times are in
+// seconds since the Unix epoch.
+type Claims struct {
+	Issuer    string `json:"iss,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	ID        string `json:"jti,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	NotBefore int64  `json:"nbf,omitempty"`
+	Expires   int64  `json:"exp"`
+}
+
+// NewClaims makes Claims issued at now which expire after ttl, with a
+// random ID.
+func NewClaims(issuer, subject string, now time.Time, ttl time.Duration) (Claims, error) {
+	id, err := util.NewKey()
+	if err != nil {
+		return Claims{}, err
+	}
+
+	return Claims{
+		Issuer:   issuer,
+		Subject:  subject,
+		ID:       string(id),
+		IssuedAt: now.Unix(),
+		Expires:  now.Add(ttl).Unix(),
+	}, nil
+}
+
+// ExpiresAt returns when the Claims expire.
+func (c *Claims) ExpiresAt() time.Time { return time.Unix(c.Expires, 0) }
+
+// Valid returns an error if the Claims are expired or not yet valid at now.
+func (c *Claims) Valid(now time.Time) error {
+	switch t := now.Unix(); {
+	case t >= c.Expires:
+		return errors.NotValidf("expired token")
+	case c.NotBefore != 0 && t < c.NotBefore:
+		return errors.NotValidf("premature token")
+	}
+	return nil
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+// Sign signs the given claims with the Key, which are usually a struct
+// embedding Claims.
+func Sign(k *Key, claims interface{}) (string, error) {
+	if err := ValidAlg(k.Alg); err != nil || len(k.Secret) == 0 {
+		return "", errors.NotValidf("signing key %q", k.ID)
+	}
+
+	h, err := json.Marshal(header{Alg: k.Alg, Typ: "JWT", Kid: k.ID})
+	if err != nil {
+		return "", err
+	}
+
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	data := b64.EncodeToString(h) + "." + b64.EncodeToString(c)
+	return data + "." + b64.EncodeToString(k.sign([]byte(data))), nil
+}
+
+// Is returns true if tok looks like a JWT, rather than some other kind of
+// key.
+func Is(tok string) bool {
+	return strings.Count(tok, ".") == 2
+}
+
+// KeyFunc returns the Key with the given ID.
+type KeyFunc func(kid string) (*Key, error)
+
+// Parse verifies the token's signature using the Key it names, and decodes
+// its claims into the given value.  The token's algorithm must be its
+// Key's.  The caller must check whether the claims are Valid.
+func Parse(tok string, keys KeyFunc, claims interface{}) error {
+	parts := strings.Split(tok, ".")
+	if len(parts) != 3 {
+		return errors.NotValidf("token")
+	}
+
+	hs, err := b64.DecodeString(parts[0])
+	if err != nil {
+		return errors.NotValidf("token header")
+	}
+	h := new(header)
+	if err := json.Unmarshal(hs, h); err != nil {
+		return errors.NotValidf("token header")
+	}
+
+	k, err := keys(h.Kid)
+	switch {
+	case err != nil:
+		return errors.NotValidf("token key %q", h.Kid)
+	case h.Alg != k.Alg:
+		return errors.NotValidf("token algorithm %q", h.Alg)
+	}
+
+	sig, err := b64.DecodeString(parts[2])
+	if err != nil || !k.verify([]byte(parts[0]+"."+parts[1]), sig) {
+		return errors.NotValidf("token signature")
+	}
+
+	cs, err := b64.DecodeString(parts[1])
+	if err != nil {
+		return errors.NotValidf("token claims")
+	}
+	if err := json.Unmarshal(cs, claims); err != nil {
+		return errors.NotValidf("token claims")
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package jwt_test
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/synapse-garden/mf-proto/jwt"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { gc.TestingT(t) }
+
+type JWTSuite struct{}
+
+var _ = gc.Suite(&JWTSuite{})
+
+var now = time.Date(2016, 1, 14, 0, 0, 0, 0, time.UTC)
+
+type claims struct {
+	jwt.Claims
+	Email string `json:"email"`
+}
+
+func keyFunc(ks ...*jwt.Key) jwt.KeyFunc {
+	return func(kid string) (*jwt.Key, error) {
+		for _, k := range ks {
+			if k.ID == kid {
+				return k, nil
+			}
+		}
+		return nil, errors.NotFoundf("key %q", kid)
+	}
+}
+
+func (s *JWTSuite) TestJWK(c *gc.C) {
+	// The Ed25519 key from RFC 8037 appendix A.1.
+	seed, err := base64.RawURLEncoding.DecodeString("nWGxne_9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A")
+	c.Assert(err, jc.ErrorIsNil)
+
+	k := &jwt.Key{ID: "rfc", Alg: jwt.EdDSA, Secret: seed}
+	got, ok := k.JWK()
+	c.Assert(ok, jc.IsTrue)
+	c.Check(got, jc.DeepEquals, jwt.JWK{
+		Kty: "OKP",
+		Crv: "Ed25519",
+		Use: "sig",
+		Alg: jwt.EdDSA,
+		Kid: "rfc",
+		X:   "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo",
+	})
+
+	hk, err := jwt.NewKey(jwt.HS256, now)
+	c.Assert(err, jc.ErrorIsNil)
+	_, ok = hk.JWK()
+	c.Check(ok, jc.IsFalse)
+
+	_, err = jwt.NewKey("none", now)
+	c.Check(err, gc.ErrorMatches, `JWT algorithm "none" not valid`)
+}
+
+func (s *JWTSuite) TestSignParse(c *gc.C) {
+	for i, alg := range []string{jwt.HS256, jwt.EdDSA} {
+		c.Logf("test %d: %s", i, alg)
+		k, err := jwt.NewKey(alg, now)
+		c.Assert(err, jc.ErrorIsNil)
+		other, err := jwt.NewKey(alg, now)
+		c.Assert(err, jc.ErrorIsNil)
+
+		cl, err := jwt.NewClaims("mf", "b0b", now, time.Hour)
+		c.Assert(err, jc.ErrorIsNil)
+		given := claims{Claims: cl, Email: "bob@tomato.com"}
+
+		tok, err := jwt.Sign(k, given)
+		c.Assert(err, jc.ErrorIsNil)
+		c.Check(jwt.Is(tok), jc.IsTrue)
+
+		got := new(claims)
+		c.Assert(jwt.Parse(tok, keyFunc(k, other), got), jc.ErrorIsNil)
+		c.Check(*got, jc.DeepEquals, given)
+		c.Check(got.ExpiresAt(), gc.Equals, time.Unix(now.Add(time.Hour).Unix(), 0))
+
+		err = jwt.Parse(tok, keyFunc(other), new(claims))
+		c.Check(err, gc.ErrorMatches, `token key ".*" not valid`)
+
+		// A token signed by one key but naming another is rejected.
+		forged := &jwt.Key{ID: k.ID, Alg: alg, Secret: other.Secret}
+		err = jwt.Parse(tok, keyFunc(forged), new(claims))
+		c.Check(err, gc.ErrorMatches, `token signature not valid`)
+
+		parts := strings.Split(tok, ".")
+		tampered := parts[0] + "." + base64.RawURLEncoding.EncodeToString(
+			[]byte(`{"sub":"larry","exp":9999999999}`),
+		) + "." + parts[2]
+		err = jwt.Parse(tampered, keyFunc(k), new(claims))
+		c.Check(err, gc.ErrorMatches, `token signature not valid`)
+	}
+}
+
+func (s *JWTSuite) TestAlgMismatch(c *gc.C) {
+	k, err := jwt.NewKey(jwt.EdDSA, now)
+	c.Assert(err, jc.ErrorIsNil)
+
+	// A token can't choose to be checked as HS256 with an EdDSA key.
+	hk := &jwt.Key{ID: k.ID, Alg: jwt.HS256, Secret: k.Secret}
+	tok, err := jwt.Sign(hk, jwt.Claims{Expires: now.Unix()})
+	c.Assert(err, jc.ErrorIsNil)
+
+	err = jwt.Parse(tok, keyFunc(k), new(jwt.Claims))
+	c.Check(err, gc.ErrorMatches, `token algorithm "HS256" not valid`)
+
+	c.Check(jwt.Parse("a.b", keyFunc(k), new(jwt.Claims)), gc.ErrorMatches, `token not valid`)
+	c.Check(jwt.Is("0123abcd"), jc.IsFalse)
+}
+
+func (s *JWTSuite) TestValid(c *gc.C) {
+	for i, t := range []struct {
+		should      string
+		claims      jwt.Claims
+		expectError string
+	}{{
+		should: "accept unexpired claims",
+		claims: jwt.Claims{Expires: now.Unix() + 1},
+	}, {
+		should:      "reject expired claims",
+		claims:      jwt.Claims{Expires: now.Unix()},
+		expectError: `expired token not valid`,
+	}, {
+		should:      "reject claims not yet valid",
+		claims:      jwt.Claims{NotBefore: now.Unix() + 1, Expires: now.Unix() + 2},
+		expectError: `premature token not valid`,
+	}} {
+		c.Logf("test %d: should %s", i, t.should)
+		err := t.claims.Valid(now)
+		if t.expectError != "" {
+			c.Check(err, gc.ErrorMatches, t.expectError)
+			continue
+		}
+		c.Check(err, jc.ErrorIsNil)
+	}
+}
+
+func (s *JWTSuite) TestJWKKey(c *gc.C) {
+	k, err := jwt.NewKey(jwt.EdDSA, now)
+	c.Assert(err, jc.ErrorIsNil)
+	tok, err := jwt.Sign(k, jwt.Claims{Expires: now.Unix()})
+	c.Assert(err, jc.ErrorIsNil)
+
+	j, _ := k.JWK()
+	pub, err := j.Key()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(jwt.Parse(tok, keyFunc(pub), new(jwt.Claims)), jc.ErrorIsNil)
+
+	// A Key made from a JWK can't sign.
+	_, err = jwt.Sign(pub, jwt.Claims{})
+	c.Check(err, gc.ErrorMatches, `signing key ".*" not valid`)
+
+	j.Use = "enc"
+	_, err = j.Key()
+	c.Check(err, gc.ErrorMatches, `JWK ".*" for "enc" not valid`)
+
+	_, err = jwt.JWK{Kty: "EC", Kid: "p256"}.Key()
+	c.Check(err, gc.ErrorMatches, `JWK "p256" of type "EC" not supported`)
+}
+
+// rsaJWK returns the JWK of an RSA key.
+func rsaJWK(kid string, k *rsa.PrivateKey) jwt.JWK {
+	return jwt.JWK{
+		Kty: "RSA",
+		Kid: kid,
+		N:   base64.RawURLEncoding.EncodeToString(k.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes()),
+	}
+}
+
+func (s *JWTSuite) TestRS256(c *gc.C) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, jc.ErrorIsNil)
+
+	enc := base64.RawURLEncoding.EncodeToString
+	data := enc([]byte(`{"alg":"RS256","kid":"rsa"}`)) + "." + enc([]byte(`{"sub":"b0b","exp":1452729600}`))
+	sum := sha256.Sum256([]byte(data))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, sum[:])
+	c.Assert(err, jc.ErrorIsNil)
+	tok := data + "." + enc(sig)
+
+	pub, err := rsaJWK("rsa", priv).Key()
+	c.Assert(err, jc.ErrorIsNil)
+
+	got := new(jwt.Claims)
+	c.Assert(jwt.Parse(tok, keyFunc(pub), got), jc.ErrorIsNil)
+	c.Check(got.Subject, gc.Equals, "b0b")
+
+	c.Check(jwt.Parse(data+"."+enc(sig[1:]), keyFunc(pub), got), gc.ErrorMatches, `token signature not valid`)
+
+	small, err := rsa.GenerateKey(rand.Reader, 1024)
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = rsaJWK("small", small).Key()
+	c.Check(err, gc.ErrorMatches, `JWK "small" with a 1024-bit modulus not valid`)
+}
@@ -0,0 +1,81 @@
+// Package mail defines how mf-proto sends email, with Mailers for SMTP,
+// for local development, and for tests.
+package mail
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Message is an email to be sent by a Mailer.
+type Message struct {
+	From    string `json:"from,omitempty"`
+	To      string `json:"to,omitempty"`
+	Subject string `json:"subject,omitempty"`
+	Body    string `json:"body,omitempty"`
+}
+
+// Bytes renders the Message as a plain text RFC 5322 email.
+func (m Message) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "From: %s\r\n", m.From)
+	fmt.Fprintf(buf, "To: %s\r\n", m.To)
+	fmt.Fprintf(buf, "Subject: %s\r\n", m.Subject)
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=\"utf-8\"\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(m.Body)
+	return buf.Bytes()
+}
+
+// Mailer sends Messages.
+type Mailer interface {
+	Send(Message) error
+}
+
+// Memory is a Mailer which keeps every Message it is sent, for tests.
+type Memory struct {
+	messages []Message
+	sync.Mutex
+}
+
+// Send implements Mailer.Send by keeping the Message.
+func (m *Memory) Send(msg Message) error {
+	m.Lock()
+	defer m.Unlock()
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+// Sent returns the Messages sent so far, oldest first.
+func (m *Memory) Sent() []Message {
+	m.Lock()
+	defer m.Unlock()
+	return append([]Message(nil), m.messages...)
+}
+
+// Last returns the most recent Message sent to the given address.
+func (m *Memory) Last(to string) (Message, bool) {
+	m.Lock()
+	defer m.Unlock()
+	for i := len(m.messages) - 1; i >= 0; i-- {
+		if m.messages[i].To == to {
+			return m.messages[i], true
+		}
+	}
+	return Message{}, false
+}
+
+// Dir is a Mailer which writes each Message it is sent into a file in the
+// named directory, for local development.
+type Dir string
+
+// Send implements Mailer.Send by writing the Message to a new .eml file.
+func (d Dir) Send(msg Message) error {
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), msg.To)
+	return ioutil.WriteFile(filepath.Join(string(d), name), msg.Bytes(), 0600)
+}
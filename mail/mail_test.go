@@ -0,0 +1,62 @@
+package mail_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/synapse-garden/mf-proto/mail"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { gc.TestingT(t) }
+
+type MailSuite struct{}
+
+var _ = gc.Suite(&MailSuite{})
+
+func (s *MailSuite) TestMemory(c *gc.C) {
+	m := new(mail.Memory)
+	_, ok := m.Last("bob@tomato.com")
+	c.Check(ok, gc.Equals, false)
+
+	for _, msg := range []mail.Message{
+		{To: "bob@tomato.com", Subject: "one"},
+		{To: "larry@cucumber.net", Subject: "two"},
+		{To: "bob@tomato.com", Subject: "three"},
+	} {
+		c.Assert(m.Send(msg), jc.ErrorIsNil)
+	}
+
+	c.Check(m.Sent(), gc.HasLen, 3)
+	msg, ok := m.Last("bob@tomato.com")
+	c.Check(ok, gc.Equals, true)
+	c.Check(msg.Subject, gc.Equals, "three")
+}
+
+func (s *MailSuite) TestDir(c *gc.C) {
+	dir, err := ioutil.TempDir("", "mf-mail")
+	c.Assert(err, jc.ErrorIsNil)
+	defer os.RemoveAll(dir)
+
+	err = mail.Dir(dir).Send(mail.Message{
+		From:    "mf@synapsegarden.net",
+		To:      "bob@tomato.com",
+		Subject: "hello",
+		Body:    "hi bob",
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	names, err := filepath.Glob(filepath.Join(dir, "*-bob@tomato.com.eml"))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(names, gc.HasLen, 1)
+
+	bs, err := ioutil.ReadFile(names[0])
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(strings.Contains(string(bs), "Subject: hello\r\n"), gc.Equals, true)
+	c.Check(strings.HasSuffix(string(bs), "\r\n\r\nhi bob"), gc.Equals, true)
+}
@@ -0,0 +1,33 @@
+package mail
+
+import "net/smtp"
+
+// SMTP is a Mailer which sends Messages through an SMTP server.
+type SMTP struct {
+	// Addr is the host:port of the SMTP server.
+	Addr string
+
+	// Auth is used to authenticate to the server, if it is not nil.
+	Auth smtp.Auth
+
+	// From is used as the sender of any Message which has none.
+	From string
+}
+
+// NewSMTP makes an SMTP Mailer for the given server which authenticates with
+// PLAIN auth if a username is given.
+func NewSMTP(addr, host, username, password, from string) *SMTP {
+	m := &SMTP{Addr: addr, From: from}
+	if username != "" {
+		m.Auth = smtp.PlainAuth("", username, password, host)
+	}
+	return m
+}
+
+// Send implements Mailer.Send.
+func (m *SMTP) Send(msg Message) error {
+	if msg.From == "" {
+		msg.From = m.From
+	}
+	return smtp.SendMail(m.Addr, m.Auth, msg.From, []string{msg.To}, msg.Bytes())
+}
@@ -1,24 +1,81 @@
 package main
 
 import (
+	"flag"
 	"log"
 
 	"github.com/boltdb/bolt"
+	"github.com/synapse-garden/mf-proto/admin"
 	"github.com/synapse-garden/mf-proto/api"
+	"github.com/synapse-garden/mf-proto/audit"
 	"github.com/synapse-garden/mf-proto/cli"
+	"github.com/synapse-garden/mf-proto/group"
+	"github.com/synapse-garden/mf-proto/oauth"
+	"github.com/synapse-garden/mf-proto/object"
+	"github.com/synapse-garden/mf-proto/oidc"
+	"github.com/synapse-garden/mf-proto/rbac"
+	"github.com/synapse-garden/mf-proto/user"
 )
 
 func main() {
+	flag.Parse()
+
+	m, err := mailer()
+	if err != nil {
+		log.Fatalf("setting up mailer failed: %s", err.Error())
+	}
+
 	d, err := bolt.Open("my.db", 0600, nil)
 	if err != nil {
 		log.Fatalf("setting up db failed: %s", err.Error())
 	}
 	defer d.Close()
 
+	rs := rbac.NewService(d)
+	uopts, err := userOptions(m)
+	if err != nil {
+		log.Fatalf("bad user flags: %s", err.Error())
+	}
+	us := user.NewService(d, uopts...)
+	as := admin.NewService(d,
+		admin.WithThrottler(us),
+		admin.OnDeleted(func(email string) error {
+			return rs.Clear(rbac.Admin(email))
+		}),
+	)
+	gs := group.NewService(d)
+	objs := object.NewService(d, object.WithGroups(gs.IDsOf))
+	oas := oauth.NewService(d, us)
+	oiopts, err := oidcOptions()
+	if err != nil {
+		log.Fatalf("bad oidc flags: %s", err.Error())
+	}
+	au := audit.NewService(d)
+	ois := oidc.NewService(d, us, append(oiopts,
+		oidc.OnCreated(func(provider, email string) error {
+			id, err := us.ID(email)
+			if err != nil {
+				return err
+			}
+			_, err = au.Record("oidc:"+provider, "user.create", rbac.User(id).String(), "", nil)
+			return err
+		}),
+	)...)
+
+	if err := migrate(as, us, objs); err != nil {
+		log.Fatalf("migrating db failed: %s", err.Error())
+	}
+	if err := openSetup(as); err != nil {
+		log.Fatalf("opening admin setup failed: %s", err.Error())
+	}
+
 	c, err := cli.NewCLI(
-		api.AdminCLI(d),
+		api.AdminCLI(as, us, rs, au),
+		api.GroupCLI(gs, us, au),
+		api.OAuthCLI(oas, au),
+		api.AuditCLI(au),
 	)
 
-	runHTTPListeners(d)
+	runHTTPListeners(d, as, us, objs, rs, gs, oas, ois, au)
 	c.Admin()
 }
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"log"
+
+	"github.com/synapse-garden/mf-proto/admin"
+	"github.com/synapse-garden/mf-proto/object"
+	"github.com/synapse-garden/mf-proto/user"
+)
+
+// migrate brings records kept in an older layout up to date.
+func migrate(as *admin.Service, us *user.Service, objs *object.Service) error {
+	n, err := as.Migrate()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		log.Printf("gave IDs and separate keys to %d admins", n)
+	}
+
+	n, err = us.Migrate()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		log.Printf("gave IDs to %d users", n)
+	}
+
+	if n, err = objs.MigrateOwners(us.IDIn); err != nil {
+		return err
+	}
+	if n > 0 {
+		log.Printf("moved %d objects from owner emails to IDs", n)
+	}
+
+	return nil
+}
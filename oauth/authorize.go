@@ -0,0 +1,174 @@
+package oauth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/juju/errors"
+	"github.com/synapse-garden/mf-proto/db"
+	"github.com/synapse-garden/mf-proto/user"
+	"github.com/synapse-garden/mf-proto/util"
+)
+
+// MethodS256 is the only PKCE code challenge method accepted.
+const MethodS256 = "S256"
+
+// Request is an authorization request, as a client sends it to the
+// authorization endpoint.
+type Request struct {
+	ResponseType    string
+	ClientID        string
+	RedirectURI     string
+	Scope           string
+	State           string
+	Challenge       string
+	ChallengeMethod string
+}
+
+// Scopes returns the Request's space-separated Scopes.
+func (r *Request) Scopes() user.Scopes {
+	var scs user.Scopes
+	for _, sc := range strings.Fields(r.Scope) {
+		scs = append(scs, user.Scope(sc))
+	}
+	return scs
+}
+
+// code is an authorization code's grant, kept until it is exchanged.
+type code struct {
+	Client      string      `json:"client"`
+	User        string      `json:"user"`
+	RedirectURI string      `json:"redirect_uri"`
+	Scopes      user.Scopes `json:"scopes"`
+	Challenge   string      `json:"challenge"`
+	Expires     time.Time   `json:"expires"`
+}
+
+// Check checks an authorization Request, filling in its RedirectURI if the
+// Client has only one, and returns its Client.  If the Client or redirect
+// URI is not valid, the error is not an Error, and the user must not be
+// redirected; otherwise an Error is returned to send to the redirect URI.
+func (s *Service) Check(r *Request) (*Client, error) {
+	c, err := s.GetClient(r.ClientID)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case r.RedirectURI == "" && len(c.RedirectURIs) == 1:
+		r.RedirectURI = c.RedirectURIs[0]
+	case !includes(c.RedirectURIs, r.RedirectURI):
+		return nil, errors.NotValidf("redirect URI %q for client %q", r.RedirectURI, c.ID)
+	}
+
+	switch {
+	case r.ResponseType != "code":
+		return nil, newError(UnsupportedResponseType, "only code is supported")
+	case r.Challenge == "":
+		return nil, newError(InvalidRequest, "code_challenge is required")
+	case r.ChallengeMethod != MethodS256:
+		return nil, newError(InvalidRequest, "code_challenge_method must be S256")
+	}
+
+	scs := r.Scopes()
+	if len(scs) == 0 {
+		return nil, newError(InvalidScope, "scope is required")
+	}
+	for _, sc := range scs {
+		if sc.Valid() != nil || !c.Scopes.Grants(sc) {
+			return nil, newError(InvalidScope, "scope "+string(sc)+" not allowed")
+		}
+	}
+
+	return c, nil
+}
+
+// Authorize grants the checked Request on behalf of the user with the
+// given ID, who consented to it, and returns the authorization code to
+// send to the Request's redirect URI.
+func (s *Service) Authorize(r *Request, uid string) (util.Key, error) {
+	if _, err := s.Check(r); err != nil {
+		return "", err
+	}
+
+	k, err := util.NewKey()
+	if err != nil {
+		return "", err
+	}
+
+	cd := &code{
+		Client:      r.ClientID,
+		User:        uid,
+		RedirectURI: r.RedirectURI,
+		Scopes:      r.Scopes(),
+		Challenge:   r.Challenge,
+		Expires:     s.Clock.Now().Add(s.CodeTTL),
+	}
+
+	if err := db.StoreKeyValue(s.DB, Codes, []byte(util.HashKey(k)), cd); err != nil {
+		return "", err
+	}
+	return k, nil
+}
+
+// Challenge returns the S256 PKCE code challenge for a code verifier.
+func Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// takeCode deletes and returns the unexpired grant of the given code.
+func (s *Service) takeCode(k util.Key) (*code, error) {
+	var cd *code
+	err := s.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(Codes))
+		if b == nil {
+			return db.BucketNotFoundErr(Codes)
+		}
+
+		hash := []byte(util.HashKey(k))
+		bs := b.Get(hash)
+		if len(bs) == 0 {
+			return newError(InvalidGrant, "unknown code")
+		}
+
+		cd = new(code)
+		if err := json.Unmarshal(bs, cd); err != nil {
+			return err
+		}
+		return b.Delete(hash)
+	})
+	switch {
+	case err != nil:
+		return nil, err
+	case !s.Clock.Now().Before(cd.Expires):
+		return nil, newError(InvalidGrant, "expired code")
+	}
+	return cd, nil
+}
+
+// verify returns an error unless verifier matches the code's challenge.
+func (cd *code) verify(verifier string) error {
+	if n := len(verifier); n < 43 || n > 128 {
+		return newError(InvalidGrant, "code_verifier must be 43 to 128 characters")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(Challenge(verifier)), []byte(cd.Challenge)) != 1 {
+		return newError(InvalidGrant, "code_verifier does not match code_challenge")
+	}
+	return nil
+}
+
+func includes(ss []string, s string) bool {
+	for _, t := range ss {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
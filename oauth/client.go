@@ -0,0 +1,252 @@
+// Package oauth implements an OAuth 2.0 authorization server (RFC 6749) for
+// third-party apps acting on behalf of users.  Only the authorization code
+// grant with PKCE (RFC 7636) is supported, along with refresh tokens and
+// token revocation (RFC 7009).
+package oauth
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/url"
+	"time"
+	"unicode/utf8"
+
+	"github.com/boltdb/bolt"
+	"github.com/juju/errors"
+	"github.com/synapse-garden/mf-proto/db"
+	"github.com/synapse-garden/mf-proto/user"
+	"github.com/synapse-garden/mf-proto/util"
+)
+
+const (
+	// Clients holds registered Clients by ID.
+	Clients db.Bucket = "oauth-clients"
+
+	// Codes holds unused authorization codes by their hash.
+	Codes db.Bucket = "oauth-codes"
+
+	// RefreshTokens holds refresh tokens by their hash.
+	RefreshTokens db.Bucket = "oauth-refresh-tokens"
+
+	// MaxClientName is the longest a Client's name may be.
+	MaxClientName = 48
+)
+
+// Buckets returns the Buckets for the oauth database.
+func Buckets() []db.Bucket {
+	return []db.Bucket{
+		Clients,
+		Codes,
+		RefreshTokens,
+	}
+}
+
+// Client is a third-party app registered by an admin.  Confidential
+// Clients have a secret; public ones, such as native apps, rely on PKCE
+// alone.
+type Client struct {
+	ID           string      `json:"id"`
+	Name         string      `json:"name"`
+	RedirectURIs []string    `json:"redirect_uris"`
+	Scopes       user.Scopes `json:"scopes"`
+	Created      time.Time   `json:"created"`
+	SecretHash   util.Hash   `json:"secret_hash,omitempty"`
+
+	// Secret is only set when a confidential Client is registered.
+	Secret util.Key `json:"secret,omitempty"`
+}
+
+// Confidential returns true if the Client has a secret.
+func (c *Client) Confidential() bool { return c.SecretHash != "" }
+
+// validRedirectURI returns an error if u cannot be a redirect URI: it must
+// be absolute, without a fragment, and https unless it is on loopback.
+func validRedirectURI(u string) error {
+	p, err := url.Parse(u)
+	switch {
+	case err != nil, !p.IsAbs(), p.Fragment != "", p.Host == "":
+		return errors.NotValidf("redirect URI %q", u)
+	case p.Scheme == "https":
+		return nil
+	case p.Scheme == "http":
+		switch p.Hostname() {
+		case "localhost", "127.0.0.1", "::1":
+			return nil
+		}
+	}
+	return errors.NotValidf("redirect URI %q without https", u)
+}
+
+// RegisterClient registers a new Client which may redirect to the given
+// URIs and ask for the given Scopes.  If confidential is true, the returned
+// Client has a Secret, which cannot be recovered later.
+func (s *Service) RegisterClient(name string, redirects []string, scopes user.Scopes, confidential bool) (*Client, error) {
+	if n := utf8.RuneCountInString(name); n == 0 || n > MaxClientName {
+		return nil, errors.NotValidf("client name %q", name)
+	}
+
+	if len(redirects) == 0 {
+		return nil, errors.NotValidf("client without redirect URIs")
+	}
+	for _, u := range redirects {
+		if err := validRedirectURI(u); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(scopes) == 0 {
+		return nil, errors.NotValidf("client without scopes")
+	}
+	for _, sc := range scopes {
+		if err := sc.Valid(); err != nil {
+			return nil, err
+		}
+	}
+
+	id, err := util.NewKey()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		ID:           string(id[:20]),
+		Name:         name,
+		RedirectURIs: redirects,
+		Scopes:       scopes,
+		Created:      s.Clock.Now(),
+	}
+
+	var secret util.Key
+	if confidential {
+		if secret, err = util.NewKey(); err != nil {
+			return nil, err
+		}
+		c.SecretHash = util.HashKey(secret)
+	}
+
+	if err := db.StoreKeyValue(s.DB, Clients, []byte(c.ID), c); err != nil {
+		return nil, err
+	}
+
+	c.Secret = secret
+	return c, nil
+}
+
+// GetClient returns the Client with the given ID.
+func (s *Service) GetClient(id string) (*Client, error) {
+	bs, err := db.GetByKey(s.DB, Clients, []byte(id))
+	switch {
+	case err != nil:
+		return nil, err
+	case len(bs) == 0:
+		return nil, errors.NotFoundf("client %q", id)
+	}
+
+	c := new(Client)
+	if err := json.Unmarshal(bs, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// AllClients returns every registered Client.
+func (s *Service) AllClients() ([]*Client, error) {
+	var cs []*Client
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(Clients))
+		if b == nil {
+			return db.BucketNotFoundErr(Clients)
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			c := new(Client)
+			if err := json.Unmarshal(v, c); err != nil {
+				return err
+			}
+			cs = append(cs, c)
+			return nil
+		})
+	})
+	return cs, err
+}
+
+// DeleteClient deletes the Client with the given ID, and revokes every
+// code and token issued to it.
+func (s *Service) DeleteClient(id string) error {
+	if _, err := s.GetClient(id); err != nil {
+		return err
+	}
+
+	err := s.DB.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket([]byte(Clients)).Delete([]byte(id)); err != nil {
+			return err
+		}
+
+		if err := deleteWhere(tx, Codes, func(bs []byte) (bool, error) {
+			cd := new(code)
+			err := json.Unmarshal(bs, cd)
+			return cd.Client == id, err
+		}); err != nil {
+			return err
+		}
+
+		return deleteWhere(tx, RefreshTokens, func(bs []byte) (bool, error) {
+			rt := new(refresh)
+			err := json.Unmarshal(bs, rt)
+			return rt.Client == id, err
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.Users.RevokeClientTokens(id)
+}
+
+// authenticateClient returns the Client with the given ID if the secret
+// is its own, or if it is public and no secret is given.
+func (s *Service) authenticateClient(id string, secret util.Key) (*Client, error) {
+	c, err := s.GetClient(id)
+	switch {
+	case errors.IsNotFound(err):
+		return nil, newError(InvalidClient, "unknown client")
+	case err != nil:
+		return nil, err
+	case !c.Confidential() && secret == "":
+		return c, nil
+	case !c.Confidential():
+		return nil, newError(InvalidClient, "public client with a secret")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(util.HashKey(secret)), []byte(c.SecretHash)) != 1 {
+		return nil, newError(InvalidClient, "bad client secret")
+	}
+	return c, nil
+}
+
+// deleteWhere deletes every value in the Bucket for which match is true.
+func deleteWhere(tx *bolt.Tx, bucket db.Bucket, match func([]byte) (bool, error)) error {
+	b := tx.Bucket([]byte(bucket))
+	if b == nil {
+		return db.BucketNotFoundErr(bucket)
+	}
+
+	var ks [][]byte
+	err := b.ForEach(func(k, v []byte) error {
+		ok, err := match(v)
+		if ok {
+			ks = append(ks, append([]byte(nil), k...))
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, k := range ks {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
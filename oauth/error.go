@@ -0,0 +1,36 @@
+package oauth
+
+// Error codes from RFC 6749 sections 4.1.2.1 and 5.2.
+const (
+	InvalidRequest          = "invalid_request"
+	InvalidClient           = "invalid_client"
+	InvalidGrant            = "invalid_grant"
+	InvalidScope            = "invalid_scope"
+	AccessDenied            = "access_denied"
+	UnsupportedGrantType    = "unsupported_grant_type"
+	UnsupportedResponseType = "unsupported_response_type"
+)
+
+// Error is an OAuth 2.0 error, which is returned to the client as its
+// error and error_description.
+type Error struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *Error) Error() string {
+	if e.Description == "" {
+		return e.Code
+	}
+	return e.Code + ": " + e.Description
+}
+
+func newError(code, desc string) *Error {
+	return &Error{Code: code, Description: desc}
+}
+
+// IsError returns true if err is an OAuth Error with the given code.
+func IsError(err error, code string) bool {
+	e, ok := err.(*Error)
+	return ok && e.Code == code
+}
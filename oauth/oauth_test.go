@@ -0,0 +1,451 @@
+package oauth_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	"github.com/synapse-garden/mf-proto/oauth"
+	t "github.com/synapse-garden/mf-proto/testing"
+	"github.com/synapse-garden/mf-proto/user"
+	"github.com/synapse-garden/mf-proto/util"
+
+	gc "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { gc.TestingT(t) }
+
+const verifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+
+type OAuthSuite struct {
+	d     *t.DB
+	clock *t.Clock
+	users *user.Service
+	svc   *oauth.Service
+	uid   string
+}
+
+var _ = gc.Suite(&OAuthSuite{})
+
+func (s *OAuthSuite) SetUpTest(c *gc.C) {
+	d, err := t.NewDB(
+		t.SetupBolt("test.db"),
+		t.SetupBuckets(append(user.Buckets(), oauth.Buckets()...)),
+	)
+	c.Assert(err, jc.ErrorIsNil)
+	s.d = d
+	s.clock = t.NewClock(time.Date(2016, 1, 14, 0, 0, 0, 0, time.UTC))
+	s.users = user.NewService(d, user.WithClock(s.clock))
+	s.svc = oauth.NewService(d, s.users, oauth.WithClock(s.clock))
+
+	c.Assert(s.users.Create("bob@tomato.com", "12345"), jc.ErrorIsNil)
+	s.uid, err = s.users.ID("bob@tomato.com")
+	c.Assert(err, jc.ErrorIsNil)
+}
+
+func (s *OAuthSuite) TearDownTest(c *gc.C) {
+	c.Assert(t.CleanupDB(s.d), jc.ErrorIsNil)
+}
+
+func (s *OAuthSuite) register(confidential bool, c *gc.C) *oauth.Client {
+	cl, err := s.svc.RegisterClient(
+		"Notes App",
+		[]string{"https://notes.example/cb", "http://localhost:8080/cb"},
+		user.Scopes{user.ScopeObjectWrite, user.ScopeProfileRead},
+		confidential,
+	)
+	c.Assert(err, jc.ErrorIsNil)
+	return cl
+}
+
+func (s *OAuthSuite) request(cl *oauth.Client) *oauth.Request {
+	return &oauth.Request{
+		ResponseType:    "code",
+		ClientID:        cl.ID,
+		RedirectURI:     "https://notes.example/cb",
+		Scope:           "object:read:notes profile:read",
+		State:           "xyz",
+		Challenge:       oauth.Challenge(verifier),
+		ChallengeMethod: oauth.MethodS256,
+	}
+}
+
+func (s *OAuthSuite) TestChallenge(c *gc.C) {
+	// From RFC 7636 appendix B.
+	c.Check(oauth.Challenge(verifier), gc.Equals, "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM")
+}
+
+func (s *OAuthSuite) TestRegisterClient(c *gc.C) {
+	for i, t := range []struct {
+		should       string
+		name         string
+		redirects    []string
+		scopes       user.Scopes
+		confidential bool
+		expectError  string
+	}{{
+		should:       "register a confidential client",
+		name:         "Notes App",
+		redirects:    []string{"https://notes.example/cb"},
+		scopes:       user.Scopes{user.ScopeObjectRead},
+		confidential: true,
+	}, {
+		should:    "register a public client on loopback",
+		name:      "Notes CLI",
+		redirects: []string{"http://127.0.0.1:9000/cb"},
+		scopes:    user.Scopes{user.ScopeAll},
+	}, {
+		should:      "not register a client without a name",
+		redirects:   []string{"https://notes.example/cb"},
+		scopes:      user.Scopes{user.ScopeObjectRead},
+		expectError: `client name "" not valid`,
+	}, {
+		should:      "not register a client without redirect URIs",
+		name:        "Notes App",
+		scopes:      user.Scopes{user.ScopeObjectRead},
+		expectError: `client without redirect URIs not valid`,
+	}, {
+		should:      "not register a plain http redirect URI",
+		name:        "Notes App",
+		redirects:   []string{"http://notes.example/cb"},
+		scopes:      user.Scopes{user.ScopeObjectRead},
+		expectError: `redirect URI "http://notes.example/cb" without https not valid`,
+	}, {
+		should:      "not register a redirect URI with a fragment",
+		name:        "Notes App",
+		redirects:   []string{"https://notes.example/cb#x"},
+		scopes:      user.Scopes{user.ScopeObjectRead},
+		expectError: `redirect URI "https://notes.example/cb#x" not valid`,
+	}, {
+		should:      "not register a client which may log in",
+		name:        "Notes App",
+		redirects:   []string{"https://notes.example/cb"},
+		scopes:      user.Scopes{user.ScopeLogin},
+		expectError: `.*not valid`,
+	}} {
+		c.Logf("test %d: should %s", i, t.should)
+		cl, err := s.svc.RegisterClient(t.name, t.redirects, t.scopes, t.confidential)
+		if t.expectError != "" {
+			c.Check(err, gc.ErrorMatches, t.expectError)
+			continue
+		}
+		c.Assert(err, jc.ErrorIsNil)
+		c.Check(cl.Confidential(), gc.Equals, t.confidential)
+		c.Check(cl.Secret != "", gc.Equals, t.confidential)
+
+		got, err := s.svc.GetClient(cl.ID)
+		c.Assert(err, jc.ErrorIsNil)
+		c.Check(got.Secret, gc.Equals, util.Key(""))
+		c.Check(got.Name, gc.Equals, t.name)
+		c.Check(got.RedirectURIs, jc.DeepEquals, t.redirects)
+		c.Check(got.Scopes, jc.DeepEquals, t.scopes)
+		c.Check(got.Created, gc.Equals, s.clock.Now())
+	}
+
+	cs, err := s.svc.AllClients()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(cs, gc.HasLen, 2)
+}
+
+func (s *OAuthSuite) TestCheck(c *gc.C) {
+	cl := s.register(false, c)
+
+	for i, t := range []struct {
+		should      string
+		change      func(*oauth.Request)
+		expectError string
+		expectCode  string
+	}{{
+		should: "accept a good request",
+		change: func(*oauth.Request) {},
+	}, {
+		should:      "not redirect for an unknown client",
+		change:      func(r *oauth.Request) { r.ClientID = "nope" },
+		expectError: `client "nope" not found`,
+	}, {
+		should:      "not redirect for an unregistered redirect URI",
+		change:      func(r *oauth.Request) { r.RedirectURI = "https://evil.example/cb" },
+		expectError: `redirect URI "https://evil.example/cb" for client .* not valid`,
+	}, {
+		should:      "not default the redirect URI when there are several",
+		change:      func(r *oauth.Request) { r.RedirectURI = "" },
+		expectError: `redirect URI "" for client .* not valid`,
+	}, {
+		should:     "only support code",
+		change:     func(r *oauth.Request) { r.ResponseType = "token" },
+		expectCode: oauth.UnsupportedResponseType,
+	}, {
+		should:     "require PKCE",
+		change:     func(r *oauth.Request) { r.Challenge = "" },
+		expectCode: oauth.InvalidRequest,
+	}, {
+		should:     "require S256",
+		change:     func(r *oauth.Request) { r.ChallengeMethod = "plain" },
+		expectCode: oauth.InvalidRequest,
+	}, {
+		should:     "require a scope",
+		change:     func(r *oauth.Request) { r.Scope = " " },
+		expectCode: oauth.InvalidScope,
+	}, {
+		should:     "not allow scopes the client lacks",
+		change:     func(r *oauth.Request) { r.Scope = "profile:write" },
+		expectCode: oauth.InvalidScope,
+	}, {
+		should:     "not allow login",
+		change:     func(r *oauth.Request) { r.Scope = "login" },
+		expectCode: oauth.InvalidScope,
+	}} {
+		c.Logf("test %d: should %s", i, t.should)
+		r := s.request(cl)
+		t.change(r)
+		got, err := s.svc.Check(r)
+		switch {
+		case t.expectError != "":
+			c.Check(err, gc.ErrorMatches, t.expectError)
+			_, isOAuth := err.(*oauth.Error)
+			c.Check(isOAuth, jc.IsFalse)
+		case t.expectCode != "":
+			c.Check(oauth.IsError(err, t.expectCode), jc.IsTrue, gc.Commentf("%v", err))
+		default:
+			c.Assert(err, jc.ErrorIsNil)
+			c.Check(got.ID, gc.Equals, cl.ID)
+		}
+	}
+}
+
+func (s *OAuthSuite) TestExchange(c *gc.C) {
+	cl := s.register(true, c)
+	other := s.register(false, c)
+
+	k, err := s.svc.Authorize(s.request(cl), s.uid)
+	c.Assert(err, jc.ErrorIsNil)
+
+	for i, t := range []struct {
+		should   string
+		client   string
+		secret   util.Key
+		redirect string
+		verifier string
+		expect   string
+	}{{
+		should:   "not exchange for another client",
+		client:   other.ID,
+		redirect: "https://notes.example/cb",
+		verifier: verifier,
+		expect:   oauth.InvalidGrant,
+	}, {
+		should:   "not exchange with a bad secret",
+		client:   cl.ID,
+		secret:   "bad",
+		redirect: "https://notes.example/cb",
+		verifier: verifier,
+		expect:   oauth.InvalidClient,
+	}} {
+		c.Logf("test %d: should %s", i, t.should)
+		_, err := s.svc.Exchange(t.client, t.secret, k, t.redirect, t.verifier)
+		c.Check(oauth.IsError(err, t.expect), jc.IsTrue, gc.Commentf("%v", err))
+	}
+
+	// A code is used up by any attempt by its client to exchange it.
+	_, err = s.svc.Exchange(cl.ID, cl.Secret, k, "https://notes.example/cb", verifier)
+	c.Check(oauth.IsError(err, oauth.InvalidGrant), jc.IsTrue)
+
+	for i, t := range []struct {
+		should   string
+		redirect string
+		verifier string
+		advance  time.Duration
+		expect   string
+	}{{
+		should:   "not exchange with the wrong redirect URI",
+		redirect: "http://localhost:8080/cb",
+		verifier: verifier,
+		expect:   oauth.InvalidGrant,
+	}, {
+		should:   "not exchange with the wrong verifier",
+		redirect: "https://notes.example/cb",
+		verifier: strings.Repeat("a", 43),
+		expect:   oauth.InvalidGrant,
+	}, {
+		should:   "not exchange an expired code",
+		redirect: "https://notes.example/cb",
+		verifier: verifier,
+		advance:  oauth.DefaultCodeTTL,
+		expect:   oauth.InvalidGrant,
+	}, {
+		should:   "exchange a good code",
+		redirect: "https://notes.example/cb",
+		verifier: verifier,
+	}} {
+		c.Logf("test %d: should %s", i, t.should)
+		k, err := s.svc.Authorize(s.request(cl), s.uid)
+		c.Assert(err, jc.ErrorIsNil)
+		s.clock.Advance(t.advance)
+
+		tok, err := s.svc.Exchange(cl.ID, cl.Secret, k, t.redirect, t.verifier)
+		if t.expect != "" {
+			c.Check(oauth.IsError(err, t.expect), jc.IsTrue, gc.Commentf("%v", err))
+			continue
+		}
+		c.Assert(err, jc.ErrorIsNil)
+		c.Check(tok.TokenType, gc.Equals, "Bearer")
+		c.Check(tok.ExpiresIn, gc.Equals, 3600)
+		c.Check(tok.Scope, gc.Equals, "object:read:notes profile:read")
+
+		at, err := s.users.ValidAccessToken("bob@tomato.com", tok.AccessToken)
+		c.Assert(err, jc.ErrorIsNil)
+		c.Check(at.Client, gc.Equals, cl.ID)
+		c.Check(at.Name, gc.Equals, "oauth: Notes App")
+		c.Check(at.Scopes, jc.DeepEquals, user.Scopes{"object:read:notes", user.ScopeProfileRead})
+
+		_, err = s.svc.Exchange(cl.ID, cl.Secret, k, t.redirect, t.verifier)
+		c.Check(oauth.IsError(err, oauth.InvalidGrant), jc.IsTrue)
+	}
+}
+
+func (s *OAuthSuite) exchange(cl *oauth.Client, c *gc.C) *oauth.Token {
+	k, err := s.svc.Authorize(s.request(cl), s.uid)
+	c.Assert(err, jc.ErrorIsNil)
+	tok, err := s.svc.Exchange(cl.ID, cl.Secret, k, "https://notes.example/cb", verifier)
+	c.Assert(err, jc.ErrorIsNil)
+	return tok
+}
+
+func (s *OAuthSuite) TestRefresh(c *gc.C) {
+	cl := s.register(false, c)
+	tok := s.exchange(cl, c)
+
+	_, err := s.svc.Refresh(cl.ID, "", tok.RefreshToken, "object:write")
+	c.Check(oauth.IsError(err, oauth.InvalidScope), jc.IsTrue, gc.Commentf("%v", err))
+
+	// The failed attempt used up the refresh token.
+	_, err = s.svc.Refresh(cl.ID, "", tok.RefreshToken, "")
+	c.Check(oauth.IsError(err, oauth.InvalidGrant), jc.IsTrue)
+
+	tok = s.exchange(cl, c)
+	got, err := s.svc.Refresh(cl.ID, "", tok.RefreshToken, "profile:read")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(got.Scope, gc.Equals, "profile:read")
+	c.Check(got.RefreshToken, gc.Not(gc.Equals), tok.RefreshToken)
+
+	s.clock.Advance(oauth.DefaultRefreshTTL)
+	_, err = s.svc.Refresh(cl.ID, "", got.RefreshToken, "")
+	c.Check(oauth.IsError(err, oauth.InvalidGrant), jc.IsTrue)
+
+	s.clock.Set(time.Date(2016, 1, 14, 0, 0, 0, 0, time.UTC))
+	tok = s.exchange(cl, c)
+	c.Assert(s.users.Delete("bob@tomato.com"), jc.ErrorIsNil)
+	_, err = s.svc.Refresh(cl.ID, "", tok.RefreshToken, "")
+	c.Check(oauth.IsError(err, oauth.InvalidGrant), jc.IsTrue)
+}
+
+func (s *OAuthSuite) TestDisabledUser(c *gc.C) {
+	cl := s.register(false, c)
+	tok := s.exchange(cl, c)
+	code, err := s.svc.Authorize(s.request(cl), s.uid)
+	c.Assert(err, jc.ErrorIsNil)
+
+	// Disable bob without the Service's hooks, so that his grants are
+	// left to be refused on their own.
+	other := user.NewService(s.d, user.WithClock(s.clock))
+	c.Assert(other.Disable("bob@tomato.com"), jc.ErrorIsNil)
+
+	_, err = s.svc.Refresh(cl.ID, "", tok.RefreshToken, "")
+	c.Check(err, gc.ErrorMatches, "invalid_grant: user is disabled")
+	_, err = s.svc.Exchange(cl.ID, "", code, "https://notes.example/cb", verifier)
+	c.Check(err, gc.ErrorMatches, "invalid_grant: user is disabled")
+
+	c.Assert(other.Enable("bob@tomato.com"), jc.ErrorIsNil)
+	tok = s.exchange(cl, c)
+	_, err = s.svc.Refresh(cl.ID, "", tok.RefreshToken, "")
+	c.Check(err, jc.ErrorIsNil)
+}
+
+func (s *OAuthSuite) TestRevoke(c *gc.C) {
+	cl := s.register(false, c)
+	other := s.register(false, c)
+	tok := s.exchange(cl, c)
+
+	// Another client can't revoke the tokens, but doesn't learn that.
+	c.Assert(s.svc.Revoke(other.ID, "", tok.AccessToken), jc.ErrorIsNil)
+	c.Assert(s.svc.Revoke(other.ID, "", tok.RefreshToken), jc.ErrorIsNil)
+	_, err := s.users.ValidAccessKey(tok.AccessToken)
+	c.Check(err, jc.ErrorIsNil)
+
+	c.Assert(s.svc.Revoke(cl.ID, "", tok.AccessToken), jc.ErrorIsNil)
+	_, err = s.users.ValidAccessKey(tok.AccessToken)
+	c.Check(err, jc.Satisfies, errors.IsNotValid)
+
+	c.Assert(s.svc.Revoke(cl.ID, "", tok.RefreshToken), jc.ErrorIsNil)
+	_, err = s.svc.Refresh(cl.ID, "", tok.RefreshToken, "")
+	c.Check(oauth.IsError(err, oauth.InvalidGrant), jc.IsTrue)
+
+	c.Check(s.svc.Revoke(cl.ID, "", "mfp_unknown"), jc.ErrorIsNil)
+	err = s.svc.Revoke("nope", "", tok.AccessToken)
+	c.Check(oauth.IsError(err, oauth.InvalidClient), jc.IsTrue)
+}
+
+func (s *OAuthSuite) TestDeleteClient(c *gc.C) {
+	cl := s.register(false, c)
+	tok := s.exchange(cl, c)
+
+	c.Assert(s.svc.DeleteClient(cl.ID), jc.ErrorIsNil)
+	_, err := s.svc.GetClient(cl.ID)
+	c.Check(err, jc.Satisfies, errors.IsNotFound)
+	_, err = s.users.ValidAccessKey(tok.AccessToken)
+	c.Check(err, jc.Satisfies, errors.IsNotValid)
+
+	c.Check(s.svc.DeleteClient(cl.ID), jc.Satisfies, errors.IsNotFound)
+}
+
+func (s *OAuthSuite) TestRevokeUser(c *gc.C) {
+	cl := s.register(false, c)
+	c.Assert(s.users.Create("larry@cucumber.net", "54321"), jc.ErrorIsNil)
+	lid, err := s.users.ID("larry@cucumber.net")
+	c.Assert(err, jc.ErrorIsNil)
+
+	for i, t := range []struct {
+		should string
+		revoke func() error
+	}{{
+		should: "revoke refresh tokens when the password is changed",
+		revoke: func() error {
+			_, err := s.users.ChangePassword(s.uid, "12345", "new-password")
+			return err
+		},
+	}, {
+		should: "revoke refresh tokens when the user is disabled",
+		revoke: func() error {
+			if err := s.users.Disable("bob@tomato.com"); err != nil {
+				return err
+			}
+			return s.users.Enable("bob@tomato.com")
+		},
+	}, {
+		should: "revoke refresh tokens when the user is deleted",
+		revoke: func() error { return s.users.Delete("bob@tomato.com") },
+	}} {
+		c.Logf("test %d: should %s", i, t.should)
+		tok := s.exchange(cl, c)
+		code, err := s.svc.Authorize(s.request(cl), s.uid)
+		c.Assert(err, jc.ErrorIsNil)
+		other, err := s.svc.Authorize(s.request(cl), lid)
+		c.Assert(err, jc.ErrorIsNil)
+		otherTok, err := s.svc.Exchange(cl.ID, "", other, "https://notes.example/cb", verifier)
+		c.Assert(err, jc.ErrorIsNil)
+
+		c.Assert(t.revoke(), jc.ErrorIsNil)
+
+		_, err = s.svc.Refresh(cl.ID, "", tok.RefreshToken, "")
+		c.Check(err, gc.ErrorMatches, `invalid_grant: unknown refresh token`)
+		_, err = s.svc.Exchange(cl.ID, "", code, "https://notes.example/cb", verifier)
+		c.Check(oauth.IsError(err, oauth.InvalidGrant), jc.IsTrue)
+
+		// Other users' grants are kept.
+		_, err = s.svc.Refresh(cl.ID, "", otherTok.RefreshToken, "")
+		c.Check(err, jc.ErrorIsNil)
+	}
+}
@@ -0,0 +1,71 @@
+package oauth
+
+import (
+	"time"
+
+	"github.com/synapse-garden/mf-proto/db"
+	"github.com/synapse-garden/mf-proto/user"
+	"github.com/synapse-garden/mf-proto/util"
+)
+
+const (
+	// DefaultCodeTTL is how long an authorization code lasts.
+	DefaultCodeTTL = 10 * time.Minute
+
+	// DefaultAccessTTL is how long an issued access token lasts.
+	DefaultAccessTTL = time.Hour
+
+	// DefaultRefreshTTL is how long an issued refresh token lasts.
+	DefaultRefreshTTL = 30 * 24 * time.Hour
+)
+
+// Service is an OAuth 2.0 authorization server which keeps its clients,
+// codes and refresh tokens in its own DB, and issues access tokens as
+// user.AccessTokens of its Users.
+type Service struct {
+	DB    db.DB
+	Clock util.Clock
+	Users *user.Service
+
+	CodeTTL    time.Duration
+	AccessTTL  time.Duration
+	RefreshTTL time.Duration
+}
+
+// Option configures a Service.
+type Option func(*Service)
+
+// WithClock sets the Service's Clock.
+func WithClock(c util.Clock) Option {
+	return func(s *Service) { s.Clock = c }
+}
+
+// WithAccessTTL sets how long the access tokens the Service issues last.
+func WithAccessTTL(t time.Duration) Option {
+	return func(s *Service) { s.AccessTTL = t }
+}
+
+// WithRefreshTTL sets how long the refresh tokens the Service issues last.
+func WithRefreshTTL(t time.Duration) Option {
+	return func(s *Service) { s.RefreshTTL = t }
+}
+
+// NewService makes a new Service for the given DB and users, using the
+// system clock and default lifetimes unless configured otherwise by the
+// given Options.  A user's refresh tokens are revoked whenever the users
+// Service revokes their credentials.
+func NewService(d db.DB, us *user.Service, opts ...Option) *Service {
+	s := &Service{
+		DB:         d,
+		Clock:      util.SystemClock{},
+		Users:      us,
+		CodeTTL:    DefaultCodeTTL,
+		AccessTTL:  DefaultAccessTTL,
+		RefreshTTL: DefaultRefreshTTL,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	us.Hooks.Revoked = append(us.Hooks.Revoked, s.RevokeUser)
+	return s
+}
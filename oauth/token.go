@@ -0,0 +1,230 @@
+package oauth
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/juju/errors"
+	"github.com/synapse-garden/mf-proto/db"
+	"github.com/synapse-garden/mf-proto/user"
+	"github.com/synapse-garden/mf-proto/util"
+)
+
+// RefreshTokenPrefix begins every refresh token.
+const RefreshTokenPrefix = "mfr_"
+
+// Token is a token endpoint response.  Its AccessToken is a user.AccessToken
+// Key, and may be used wherever one is accepted.
+type Token struct {
+	AccessToken  util.Key `json:"access_token"`
+	TokenType    string   `json:"token_type"`
+	ExpiresIn    int      `json:"expires_in"`
+	RefreshToken util.Key `json:"refresh_token,omitempty"`
+	Scope        string   `json:"scope"`
+}
+
+// refresh is a refresh token's grant.
+type refresh struct {
+	Client  string      `json:"client"`
+	User    string      `json:"user"`
+	Scopes  user.Scopes `json:"scopes"`
+	Expires time.Time   `json:"expires"`
+}
+
+// Exchange authenticates a Client and exchanges the authorization code
+// it was given, with its PKCE code verifier, for a Token.  Each code may
+// only be exchanged once.
+func (s *Service) Exchange(clientID string, secret, k util.Key, redirectURI, verifier string) (*Token, error) {
+	c, err := s.authenticateClient(clientID, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	cd, err := s.takeCode(k)
+	switch {
+	case err != nil:
+		return nil, err
+	case cd.Client != c.ID:
+		return nil, newError(InvalidGrant, "code issued to another client")
+	case cd.RedirectURI != redirectURI:
+		return nil, newError(InvalidGrant, "redirect_uri does not match")
+	}
+
+	if err := cd.verify(verifier); err != nil {
+		return nil, err
+	}
+
+	return s.issue(c, cd.User, cd.Scopes)
+}
+
+// Refresh authenticates a Client and exchanges a refresh token for a new
+// Token, optionally with fewer Scopes than were first granted.  The old
+// refresh token cannot be used again.
+func (s *Service) Refresh(clientID string, secret, k util.Key, scope string) (*Token, error) {
+	c, err := s.authenticateClient(clientID, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	rt, err := s.takeRefresh(k)
+	switch {
+	case err != nil:
+		return nil, err
+	case rt.Client != c.ID:
+		return nil, newError(InvalidGrant, "refresh token issued to another client")
+	}
+
+	scs := rt.Scopes
+	if scope != "" {
+		scs = (&Request{Scope: scope}).Scopes()
+		for _, sc := range scs {
+			if !rt.Scopes.Grants(sc) {
+				return nil, newError(InvalidScope, "scope "+string(sc)+" not granted")
+			}
+		}
+	}
+
+	return s.issue(c, rt.User, scs)
+}
+
+// Revoke revokes an access or refresh token issued to the authenticated
+// Client.  As RFC 7009 requires, it is not an error if the token is not
+// known.  Access tokens issued with a refresh token are not revoked with
+// it, but they do not last long.
+func (s *Service) Revoke(clientID string, secret, k util.Key) error {
+	c, err := s.authenticateClient(clientID, secret)
+	if err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(string(k), user.AccessTokenPrefix) {
+		return s.Users.RevokeClientKey(c.ID, k)
+	}
+
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(RefreshTokens))
+		if b == nil {
+			return db.BucketNotFoundErr(RefreshTokens)
+		}
+
+		hash := []byte(util.HashKey(k))
+		bs := b.Get(hash)
+		if len(bs) == 0 {
+			return nil
+		}
+
+		rt := new(refresh)
+		if err := json.Unmarshal(bs, rt); err != nil {
+			return err
+		}
+		if rt.Client != c.ID {
+			return nil
+		}
+		return b.Delete(hash)
+	})
+}
+
+// RevokeUser revokes the refresh tokens and unused authorization codes
+// of the user with the given email, so that no client can get new access
+// tokens for them.
+func (s *Service) RevokeUser(email string) error {
+	uid, err := s.Users.ID(email)
+	if err != nil {
+		return err
+	}
+
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		if err := deleteWhere(tx, Codes, func(bs []byte) (bool, error) {
+			cd := new(code)
+			err := json.Unmarshal(bs, cd)
+			return cd.User == uid, err
+		}); err != nil {
+			return err
+		}
+
+		return deleteWhere(tx, RefreshTokens, func(bs []byte) (bool, error) {
+			rt := new(refresh)
+			err := json.Unmarshal(bs, rt)
+			return rt.User == uid, err
+		})
+	})
+}
+
+// issue issues a new access and refresh token to the Client on behalf of
+// the user with the given ID, unless they have since been deleted or
+// disabled.
+func (s *Service) issue(c *Client, uid string, scs user.Scopes) (*Token, error) {
+	u, err := s.Users.GetByID(uid)
+	switch {
+	case err != nil:
+		return nil, newError(InvalidGrant, "user no longer exists")
+	case u.Disabled:
+		return nil, newError(InvalidGrant, "user is disabled")
+	}
+
+	at, err := s.Users.IssueAccessToken(uid, c.ID, "oauth: "+c.Name, s.AccessTTL, scs...)
+	if err != nil {
+		return nil, err
+	}
+
+	k, err := util.NewKey()
+	if err != nil {
+		return nil, err
+	}
+	k = RefreshTokenPrefix + k
+
+	rt := &refresh{
+		Client:  c.ID,
+		User:    uid,
+		Scopes:  scs,
+		Expires: s.Clock.Now().Add(s.RefreshTTL),
+	}
+	if err := db.StoreKeyValue(s.DB, RefreshTokens, []byte(util.HashKey(k)), rt); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(scs))
+	for i, sc := range scs {
+		names[i] = string(sc)
+	}
+
+	return &Token{
+		AccessToken:  at.Key,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(s.AccessTTL / time.Second),
+		RefreshToken: k,
+		Scope:        strings.Join(names, " "),
+	}, nil
+}
+
+// takeRefresh deletes and returns the unexpired grant of a refresh token.
+func (s *Service) takeRefresh(k util.Key) (*refresh, error) {
+	var rt *refresh
+	err := s.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(RefreshTokens))
+		if b == nil {
+			return db.BucketNotFoundErr(RefreshTokens)
+		}
+
+		hash := []byte(util.HashKey(k))
+		bs := b.Get(hash)
+		if len(bs) == 0 {
+			return newError(InvalidGrant, "unknown refresh token")
+		}
+
+		rt = new(refresh)
+		if err := json.Unmarshal(bs, rt); err != nil {
+			return errors.Trace(err)
+		}
+		return b.Delete(hash)
+	})
+	switch {
+	case err != nil:
+		return nil, err
+	case !s.Clock.Now().Before(rt.Expires):
+		return nil, newError(InvalidGrant, "expired refresh token")
+	}
+	return rt, nil
+}
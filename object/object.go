@@ -3,7 +3,9 @@ package object
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
 
+	"github.com/boltdb/bolt"
 	"github.com/synapse-garden/mf-proto/db"
 	"github.com/synapse-garden/mf-proto/util"
 
@@ -29,54 +31,115 @@ type Object struct {
 
 	// Perms defines the permissions for the object.
 	Perms util.Permissions `json:"perms,omitempty"`
+
+	// Impersonation is set if the object was last written by an admin
+	// impersonating a user.
+	Impersonation *Impersonation `json:"impersonation,omitempty"`
+}
+
+// Impersonation records who wrote an Object, and the admin who did it as
+// them.
+type Impersonation struct {
+	// User is the ID of the user the Object was written as.
+	User string `json:"user"`
+
+	// Admin names the admin who wrote it, such as "admin:alice@tomato.com".
+	Admin string `json:"admin"`
 }
 
 // New makes an object with the given json and default (owner only)
-// permissions.
+// permissions for the user with the given ID.
 func New(json, user string) *Object {
 	return &Object{
 		JSON:  json,
-		Perms: util.Permissions{user},
+		Perms: util.Permissions{Owner: user},
 	}
 }
 
-// ReadAuthorized determines if a user is authorized to use an object.
-func (o *Object) ReadAuthorized(email string) error {
-	return o.Perms.ReadAuthorized(email)
+// ReadAuthorized determines if a user, who is a member of the given groups,
+// is authorized to use an object.
+func (o *Object) ReadAuthorized(user string, groups ...string) error {
+	return o.Perms.ReadAuthorized(user, groups...)
 }
 
-// WriteAuthorized determines if a user is authorized to write an object.
-func (o *Object) WriteAuthorized(email string) error {
-	return o.Perms.WriteAuthorized(email)
+// WriteAuthorized determines if a user, who is a member of the given
+// groups, is authorized to write an object.
+func (o *Object) WriteAuthorized(user string, groups ...string) error {
+	return o.Perms.WriteAuthorized(user, groups...)
 }
 
 // Put stores an object by id for the given user, if the user is authorized.
-func Put(d db.DB, email string, id util.Key, obj *Object) error {
-	o, err := Get(d, email, id)
+// Only the owner of an existing object may change its permissions; when
+// anyone else writes it, its permissions are kept.
+func (s *Service) Put(user string, id util.Key, obj *Object) error {
+	if err := obj.Perms.Validate(); err != nil {
+		return err
+	}
+
+	groups, err := s.groupsOf(user)
+	if err != nil {
+		return err
+	}
+
+	o, err := s.Get(user, id)
 
 	switch {
 	case err != nil && errors.IsNotFound(err):
-		return db.StoreKeyValue(d, Objects, []byte(id), obj)
+		return s.store(user, id, obj)
 	case err != nil && errors.IsUnauthorized(err):
 		return errors.Annotatef(err,
 			"user %q does not have read permissions for %s",
-			email, id,
+			user, id,
 		)
+	case err != nil:
+		return err
 	}
 
-	if err = o.WriteAuthorized(email); err != nil {
+	if err = o.WriteAuthorized(user, groups...); err != nil {
 		return errors.Annotatef(err,
 			"user %q does not have write permissions for %s",
-			email, id,
+			user, id,
 		)
 	}
 
-	return db.StoreKeyValue(d, Objects, []byte(id), obj)
+	if o.Perms.Owner != user {
+		obj.Perms = o.Perms
+	}
+
+	return s.store(user, id, obj)
+}
+
+func (s *Service) store(user string, id util.Key, obj *Object) error {
+	if err := db.StoreKeyValue(s.DB, Objects, []byte(id), obj); err != nil {
+		return err
+	}
+
+	return runHooks(s.Hooks.Stored, user, id)
 }
 
 // Get fetches an object by ID, if the user has permission to view it.
-func Get(d db.DB, email string, id util.Key) (*Object, error) {
-	objBytes, err := db.GetByKey(d, Objects, []byte(id))
+func (s *Service) Get(user string, id util.Key) (*Object, error) {
+	obj, err := s.GetAny(id)
+	if err != nil {
+		return nil, err
+	}
+
+	groups, err := s.groupsOf(user)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = obj.ReadAuthorized(user, groups...); err != nil {
+		return nil, err
+	}
+
+	return obj, nil
+}
+
+// GetAny fetches an object by ID whoever owns it.  Callers must check the
+// user may do so.
+func (s *Service) GetAny(id util.Key) (*Object, error) {
+	objBytes, err := db.GetByKey(s.DB, Objects, []byte(id))
 	if err != nil {
 		return nil, err
 	}
@@ -92,44 +155,129 @@ func Get(d db.DB, email string, id util.Key) (*Object, error) {
 		)
 	}
 
-	if err = obj.ReadAuthorized(email); err != nil {
-		return nil, err
-	}
-
 	return obj, nil
 }
 
 // Delete deletes an object given a user and an Object id.
-func Delete(d db.DB, email string, id util.Key) error {
-	objBytes, err := db.GetByKey(d, Objects, []byte(id))
-	if err != nil {
+func (s *Service) Delete(user string, id util.Key) error {
+	obj, err := s.GetAny(id)
+	switch {
+	case errors.IsNotFound(err):
+		// Was already deleted, no problem
+		return nil
+	case err != nil:
 		return err
 	}
 
-	if len(objBytes) == 0 {
-		// Was already deleted, no problem
-		return nil
+	groups, err := s.groupsOf(user)
+	if err != nil {
+		return err
 	}
 
-	obj := new(Object)
-	if err := json.Unmarshal(objBytes, obj); err != nil {
-		return errors.Annotatef(
-			err, "unmarshaling %#q failed", objBytes,
-		)
+	if err = obj.ReadAuthorized(user, groups...); err != nil {
+		return err
 	}
 
-	if err = obj.ReadAuthorized(email); err != nil {
+	if err = obj.WriteAuthorized(user, groups...); err != nil {
 		return err
 	}
 
-	if err = obj.WriteAuthorized(email); err != nil {
+	return s.DeleteAny(user, id)
+}
+
+// DeleteAny deletes an object by ID on behalf of the given user, whoever
+// owns it.  Callers must check the user may do so.
+func (s *Service) DeleteAny(user string, id util.Key) error {
+	if err := db.DeleteByKey(s.DB, Objects, []byte(id)); err != nil {
 		return err
 	}
 
-	return db.DeleteByKey(d, Objects, []byte(id))
+	return runHooks(s.Hooks.Deleted, user, id)
+}
+
+// CountOwned returns how many Objects the given user owns.
+func (s *Service) CountOwned(user string) (int, error) {
+	n := 0
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(Objects))
+		if b == nil {
+			return db.BucketNotFoundErr(Objects)
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			obj := new(Object)
+			if err := json.Unmarshal(v, obj); err != nil {
+				return err
+			}
+			if obj.Perms.Owner == user {
+				n++
+			}
+			return nil
+		})
+	})
+	return n, err
 }
 
 // DeleteAll deletes all Objects owned by the given user.
-func DeleteAll(d db.DB, email string) error {
+func (s *Service) DeleteAll(user string) error {
 	return fmt.Errorf("implement me")
 }
+
+// MigrateOwners changes the owner of each Object owned by an email from
+// before users had IDs to the ID lookup returns for it.  Objects whose
+// owner lookup fails are left alone.  It returns how many Objects were
+// migrated, and may safely be run again.  lookup is called in the
+// migration's transaction, which it must use for any lookups of its own.
+func (s *Service) MigrateOwners(lookup func(tx *bolt.Tx, email string) (string, error)) (int, error) {
+	if err := db.SetupBuckets(s.DB, Buckets()); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	err := s.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(Objects))
+
+		moved := make(map[string]*Object)
+		err := b.ForEach(func(k, v []byte) error {
+			obj := new(Object)
+			if err := json.Unmarshal(v, obj); err != nil {
+				return errors.Annotatef(err, "unmarshaling %#q failed", v)
+			}
+
+			// IDs never contain an @.
+			if !strings.Contains(obj.Perms.Owner, "@") {
+				return nil
+			}
+
+			id, err := lookup(tx, obj.Perms.Owner)
+			if err != nil {
+				return nil
+			}
+
+			obj.Perms.Owner = id
+			moved[string(k)] = obj
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for k, obj := range moved {
+			bs, err := json.Marshal(obj)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(k), bs); err != nil {
+				return err
+			}
+			n++
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
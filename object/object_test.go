@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"testing"
 
+	"github.com/boltdb/bolt"
 	"github.com/synapse-garden/mf-proto/db"
 	"github.com/synapse-garden/mf-proto/object"
 	mft "github.com/synapse-garden/mf-proto/testing"
@@ -18,6 +19,7 @@ func Test(t *testing.T) { gc.TestingT(t) }
 
 type ObjectSuite struct {
 	d       *mft.DB
+	svc     *object.Service
 	objects map[util.Key]object.Object
 }
 
@@ -30,6 +32,7 @@ func (s *ObjectSuite) SetUpTest(c *gc.C) {
 	)
 	c.Assert(err, jc.ErrorIsNil)
 	s.d = d
+	s.svc = object.NewService(d)
 }
 
 func (s *ObjectSuite) TearDownTest(c *gc.C) {
@@ -48,14 +51,14 @@ func (s *ObjectSuite) TestReadAuthorized(c *gc.C) {
 	}{{
 		should: "reject an unauthorized user",
 		given: &object.Object{
-			Perms: util.Permissions{"joe"},
+			Perms: util.Permissions{Owner: "joe"},
 		},
 		givenEmail:         "not-joe",
 		expectError:        `user "not-joe" not read authorized`,
 		expectUnauthorized: true,
 	}, {
 		should:     "accept an authorized user",
-		given:      &object.Object{Perms: util.Permissions{"joe"}},
+		given:      &object.Object{Perms: util.Permissions{Owner: "joe"}},
 		givenEmail: "joe",
 	}} {
 		c.Logf("test %d: should %s", i, t.should)
@@ -79,14 +82,14 @@ func (s *ObjectSuite) TestWriteAuthorized(c *gc.C) {
 	}{{
 		should: "reject an unauthorized user",
 		given: &object.Object{
-			Perms: util.Permissions{"joe"},
+			Perms: util.Permissions{Owner: "joe"},
 		},
 		givenEmail:         "not-joe",
 		expectError:        `user "not-joe" not write authorized`,
 		expectUnauthorized: true,
 	}, {
 		should:     "accept an authorized user",
-		given:      &object.Object{Perms: util.Permissions{"joe"}},
+		given:      &object.Object{Perms: util.Permissions{Owner: "joe"}},
 		givenEmail: "joe",
 	}} {
 		c.Logf("test %d: should %s", i, t.should)
@@ -144,7 +147,7 @@ func (s *ObjectSuite) TestPut(c *gc.C) {
 
 		mft.CreateObjects(s.d, t.givenExistingObjects)
 
-		err := object.Put(s.d, t.givenUser, util.Key(t.givenID), t.givenNewObject)
+		err := s.svc.Put(t.givenUser, util.Key(t.givenID), t.givenNewObject)
 
 		if t.expectError != "" {
 			c.Check(err, gc.ErrorMatches, t.expectError)
@@ -158,7 +161,7 @@ func (s *ObjectSuite) TestPut(c *gc.C) {
 
 		c.Assert(err, jc.ErrorIsNil)
 
-		obj, err := object.Get(s.d, t.givenUser, util.Key(t.givenID))
+		obj, err := s.svc.Get(t.givenUser, util.Key(t.givenID))
 		c.Assert(err, jc.ErrorIsNil)
 		c.Check(obj, jc.DeepEquals, t.givenNewObject)
 	}
@@ -203,7 +206,7 @@ func (s *ObjectSuite) TestGet(c *gc.C) {
 
 		mft.CreateObjects(s.d, t.givenExistingObjects)
 
-		obj, err := object.Get(s.d, t.givenUser, util.Key(t.givenID))
+		obj, err := s.svc.Get(t.givenUser, util.Key(t.givenID))
 
 		if t.expectError != "" {
 			c.Check(err, gc.ErrorMatches, t.expectError)
@@ -251,7 +254,7 @@ func (s *ObjectSuite) TestDelete(c *gc.C) {
 
 		mft.CreateObjects(s.d, t.givenExistingObjects)
 
-		err := object.Delete(s.d, t.givenUser, util.Key(t.givenID))
+		err := s.svc.Delete(t.givenUser, util.Key(t.givenID))
 
 		if t.expectError != "" {
 			c.Check(err, gc.ErrorMatches, t.expectError)
@@ -292,3 +295,134 @@ func (s *ObjectSuite) TestDelete(c *gc.C) {
 		}
 	}
 }
+
+func (s *ObjectSuite) TestShared(c *gc.C) {
+	groups := map[string][]string{"fred": {"g1"}}
+	svc := object.NewService(s.d, object.WithGroups(func(user string) ([]string, error) {
+		return groups[user], nil
+	}))
+
+	obj := object.New("foo", "joe")
+	obj.Perms.Writers = []string{util.GroupPrincipal("g1")}
+	c.Assert(svc.Put("joe", "12345", obj), jc.ErrorIsNil)
+
+	got, err := svc.Get("fred", "12345")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(got, jc.DeepEquals, obj)
+	_, err = svc.Get("sue", "12345")
+	c.Check(err, gc.ErrorMatches, `user "sue" not read authorized`)
+
+	// A writer who is not the owner keeps the object's permissions.
+	c.Assert(svc.Put("fred", "12345", object.New("bar", "fred")), jc.ErrorIsNil)
+	got, err = svc.Get("joe", "12345")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(got.JSON, gc.Equals, "bar")
+	c.Check(got.Perms, jc.DeepEquals, obj.Perms)
+
+	bad := object.New("baz", "joe")
+	bad.Perms.Readers = []string{"g1"}
+	c.Check(svc.Put("joe", "12345", bad), gc.ErrorMatches, `principal "g1" not valid`)
+
+	c.Assert(svc.Delete("fred", "12345"), jc.ErrorIsNil)
+}
+
+func (s *ObjectSuite) TestPutUnreadable(c *gc.C) {
+	err := db.StoreKeyValue(s.d, object.Objects, []byte("12345"), "not an object")
+	c.Assert(err, jc.ErrorIsNil)
+
+	// An error getting the existing Object is returned, not written over.
+	err = s.svc.Put("joe", "12345", object.New("foo", "joe"))
+	c.Check(err, gc.ErrorMatches, `unmarshaling .* failed: .*`)
+	bs, err := db.GetByKey(s.d, object.Objects, []byte("12345"))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(string(bs), gc.Equals, `"not an object"`)
+}
+
+func (s *ObjectSuite) TestMigrateOwners(c *gc.C) {
+	ids := map[string]string{"bob@tomato.com": "b0b"}
+	lookup := func(tx *bolt.Tx, email string) (string, error) {
+		// Lookups use the migration's transaction, not one of their own.
+		c.Check(tx.Writable(), jc.IsTrue)
+		id, ok := ids[email]
+		if !ok {
+			return "", errors.UserNotFoundf("%q", email)
+		}
+		return id, nil
+	}
+
+	for id, owner := range map[util.Key]string{
+		"1": "bob@tomato.com",
+		"2": "b0b",
+		"3": "jove@olympus.mons",
+	} {
+		err := db.StoreKeyValue(s.d, object.Objects, []byte(id), object.New("{}", owner))
+		c.Assert(err, jc.ErrorIsNil)
+	}
+
+	n, err := s.svc.MigrateOwners(lookup)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(n, gc.Equals, 1)
+
+	for id, owner := range map[util.Key]string{
+		"1": "b0b",
+		"2": "b0b",
+		"3": "jove@olympus.mons",
+	} {
+		obj, err := s.svc.Get(owner, id)
+		c.Assert(err, jc.ErrorIsNil)
+		c.Check(obj.Perms.Owner, gc.Equals, owner)
+	}
+
+	// Running it again changes nothing.
+	n, err = s.svc.MigrateOwners(lookup)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(n, gc.Equals, 0)
+}
+
+func (s *ObjectSuite) TestCountOwned(c *gc.C) {
+	for id, owner := range map[util.Key]string{
+		"1": "joe",
+		"2": "joe",
+		"3": "fred",
+	} {
+		c.Assert(s.svc.Put(owner, id, object.New("{}", owner)), jc.ErrorIsNil)
+	}
+
+	for i, t := range []struct {
+		should string
+		given  string
+		expect int
+	}{{
+		should: "count a user's objects",
+		given:  "joe",
+		expect: 2,
+	}, {
+		should: "count only objects the user owns",
+		given:  "fred",
+		expect: 1,
+	}, {
+		should: "count none for a user without objects",
+		given:  "sue",
+	}} {
+		c.Logf("test %d: should %s", i, t.should)
+		n, err := s.svc.CountOwned(t.given)
+		c.Assert(err, jc.ErrorIsNil)
+		c.Check(n, gc.Equals, t.expect)
+	}
+}
+
+func (s *ObjectSuite) TestPutImpersonated(c *gc.C) {
+	obj := object.New("foo", "joe")
+	obj.Impersonation = &object.Impersonation{User: "joe", Admin: "admin:alice@tomato.com"}
+	c.Assert(s.svc.Put("joe", "12345", obj), jc.ErrorIsNil)
+
+	got, err := s.svc.Get("joe", "12345")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(got.Impersonation, jc.DeepEquals, obj.Impersonation)
+
+	// Writing it again without impersonation clears the record.
+	c.Assert(s.svc.Put("joe", "12345", object.New("bar", "joe")), jc.ErrorIsNil)
+	got, err = s.svc.Get("joe", "12345")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(got.Impersonation, gc.IsNil)
+}
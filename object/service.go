@@ -0,0 +1,76 @@
+package object
+
+import (
+	"github.com/synapse-garden/mf-proto/db"
+	"github.com/synapse-garden/mf-proto/util"
+)
+
+// Hook is called with the acting user's ID and an Object's ID after some
+// event has happened to the Object.  If it returns an error, the error is
+// returned to the caller.
+type Hook func(user string, id util.Key) error
+
+// Hooks are the Hooks a Service calls after each kind of event.
+type Hooks struct {
+	Stored  []Hook
+	Deleted []Hook
+}
+
+func runHooks(hs []Hook, user string, id util.Key) error {
+	for _, h := range hs {
+		if err := h(user, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GroupsFunc returns the IDs of the groups the user with the given ID is a
+// member of.
+type GroupsFunc func(user string) ([]string, error)
+
+// Service performs Object operations against its own DB.
+type Service struct {
+	DB    db.DB
+	Hooks Hooks
+
+	// Groups finds users' groups, so that Objects may be shared with
+	// them.  If it is nil, no user is in any group.
+	Groups GroupsFunc
+}
+
+// Option configures a Service.
+type Option func(*Service)
+
+// OnStored adds Hooks to be called after an Object is stored.
+func OnStored(hs ...Hook) Option {
+	return func(s *Service) { s.Hooks.Stored = append(s.Hooks.Stored, hs...) }
+}
+
+// OnDeleted adds Hooks to be called after an Object is deleted.
+func OnDeleted(hs ...Hook) Option {
+	return func(s *Service) { s.Hooks.Deleted = append(s.Hooks.Deleted, hs...) }
+}
+
+// WithGroups sets how the Service finds users' groups.
+func WithGroups(f GroupsFunc) Option {
+	return func(s *Service) { s.Groups = f }
+}
+
+// NewService makes a new Service for the given DB, configured by the given
+// Options.
+func NewService(d db.DB, opts ...Option) *Service {
+	s := &Service{DB: d}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// groupsOf returns the IDs of the user's groups.
+func (s *Service) groupsOf(user string) ([]string, error) {
+	if s.Groups == nil {
+		return nil, nil
+	}
+	return s.Groups(user)
+}
@@ -0,0 +1,358 @@
+package oidc
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/juju/errors"
+	"github.com/synapse-garden/mf-proto/db"
+	"github.com/synapse-garden/mf-proto/jwt"
+	"github.com/synapse-garden/mf-proto/user"
+	"github.com/synapse-garden/mf-proto/util"
+)
+
+const (
+	// States holds the outstanding sign-ins by state.
+	States db.Bucket = "oidc-states"
+
+	// Links holds the IDs of the users linked to external identities, by
+	// Provider name and subject.
+	Links db.Bucket = "oidc-links"
+
+	// MaxClockSkew is how far a Provider's clock may be ahead of ours.
+	MaxClockSkew = time.Minute
+)
+
+// Buckets returns the Buckets for the oidc database.
+func Buckets() []db.Bucket {
+	return []db.Bucket{
+		States,
+		Links,
+	}
+}
+
+// state is an outstanding sign-in with a Provider.
+type state struct {
+	Provider string    `json:"provider"`
+	Nonce    string    `json:"nonce"`
+	Verifier string    `json:"verifier"`
+	Expires  time.Time `json:"expires"`
+}
+
+// idToken is an ID token's claims.  The Audience may be a string or an
+// array of strings.
+type idToken struct {
+	jwt.Claims
+	Audience      audience `json:"aud"`
+	AZP           string   `json:"azp,omitempty"`
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+}
+
+type audience []string
+
+func (a *audience) UnmarshalJSON(bs []byte) error {
+	var one string
+	if err := json.Unmarshal(bs, &one); err == nil {
+		*a = audience{one}
+		return nil
+	}
+	return json.Unmarshal(bs, (*[]string)(a))
+}
+
+func (a audience) includes(s string) bool {
+	for _, t := range a {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
+
+func linkKey(provider, subject string) []byte {
+	return []byte(provider + "\x00" + subject)
+}
+
+// AuthURL starts a sign-in with the named Provider, and returns the URL
+// to send the user to.
+func (s *Service) AuthURL(provider string) (string, error) {
+	p, m, err := s.provider(provider)
+	if err != nil {
+		return "", err
+	}
+
+	var ks [3]util.Key
+	for i := range ks {
+		if ks[i], err = util.NewKey(); err != nil {
+			return "", err
+		}
+	}
+	st, nonce, verifier := ks[0], string(ks[1]), string(ks[2])+string(ks[0])
+
+	if err := db.StoreKeyValue(s.DB, States, []byte(util.HashKey(st)), &state{
+		Provider: p.Name,
+		Nonce:    nonce,
+		Verifier: verifier,
+		Expires:  s.Clock.Now().Add(s.StateTTL),
+	}); err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256([]byte(verifier))
+	v := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {p.RedirectURL},
+		"scope":                 {strings.Join(append([]string{"openid", "email"}, p.Scopes...), " ")},
+		"state":                 {string(st)},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	sep := "?"
+	if strings.Contains(m.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return m.AuthorizationEndpoint + sep + v.Encode(), nil
+}
+
+// Callback completes a sign-in with the named Provider by exchanging the
+// code it sent back with the state for an ID token.  The identity in the
+// token is linked to a user, who is logged in.  It returns the user's
+// email and Login, which is Pending if they use two-factor authentication.
+func (s *Service) Callback(provider, st, code string) (string, *user.Login, error) {
+	p, m, err := s.provider(provider)
+	if err != nil {
+		return "", nil, err
+	}
+
+	sn, err := s.takeState(st)
+	switch {
+	case err != nil:
+		return "", nil, err
+	case sn.Provider != p.Name:
+		return "", nil, errors.NotValidf("state for provider %q", sn.Provider)
+	}
+
+	raw, err := s.exchange(p, m, code, sn.Verifier)
+	if err != nil {
+		return "", nil, err
+	}
+
+	tok, err := s.verify(p, m, raw, sn.Nonce)
+	if err != nil {
+		return "", nil, err
+	}
+
+	u, err := s.link(p, tok)
+	if err != nil {
+		return "", nil, err
+	}
+
+	l, err := s.Users.LoginExternal(u.Email)
+	if err != nil {
+		return "", nil, err
+	}
+	return u.Email, l, nil
+}
+
+// takeState deletes and returns an unexpired outstanding sign-in.
+func (s *Service) takeState(st string) (*state, error) {
+	sn := new(state)
+	err := s.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(States))
+		if b == nil {
+			return db.BucketNotFoundErr(States)
+		}
+
+		k := []byte(util.HashKey(util.Key(st)))
+		bs := b.Get(k)
+		if len(bs) == 0 {
+			return errors.NotValidf("sign-in state")
+		}
+		if err := json.Unmarshal(bs, sn); err != nil {
+			return err
+		}
+		return b.Delete(k)
+	})
+	switch {
+	case err != nil:
+		return nil, err
+	case !s.Clock.Now().Before(sn.Expires):
+		return nil, errors.NotValidf("expired sign-in state")
+	}
+	return sn, nil
+}
+
+// exchange exchanges a code at the Provider's token endpoint for an ID
+// token.
+func (s *Service) exchange(p *Provider, m *metadata, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	if p.ClientSecret == "" {
+		form.Set("client_id", p.ClientID)
+	}
+
+	req, err := http.NewRequest("POST", m.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	resp, err := s.HTTP.Do(req)
+	if err != nil {
+		return "", errors.Annotatef(err, "provider %q token request failed", p.Name)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken     string `json:"id_token"`
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return "", errors.Annotatef(err, "provider %q token response", p.Name)
+	}
+
+	switch {
+	case body.Error != "":
+		return "", errors.Unauthorizedf("provider %q refused code: %s %s", p.Name, body.Error, body.Description)
+	case resp.StatusCode != http.StatusOK:
+		return "", errors.Errorf("provider %q token request failed: %s", p.Name, resp.Status)
+	case body.IDToken == "":
+		return "", errors.NotValidf("provider %q token response without id_token", p.Name)
+	}
+	return body.IDToken, nil
+}
+
+// verify checks an ID token as OpenID Connect Core section 3.1.3.7 says.
+func (s *Service) verify(p *Provider, m *metadata, raw, nonce string) (*idToken, error) {
+	tok := new(idToken)
+	err := jwt.Parse(raw, func(kid string) (*jwt.Key, error) {
+		return s.key(p.Name, m, kid)
+	}, tok)
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.Clock.Now()
+	switch {
+	case tok.Issuer != m.Issuer:
+		return nil, errors.NotValidf("ID token issuer %q", tok.Issuer)
+	case !tok.Audience.includes(p.ClientID):
+		return nil, errors.NotValidf("ID token audience %q", tok.Audience)
+	case len(tok.Audience) > 1 && tok.AZP != p.ClientID:
+		return nil, errors.NotValidf("ID token authorized party %q", tok.AZP)
+	case tok.Subject == "":
+		return nil, errors.NotValidf("ID token without subject")
+	case tok.IssuedAt > now.Add(MaxClockSkew).Unix():
+		return nil, errors.NotValidf("ID token issued in the future")
+	case subtle.ConstantTimeCompare([]byte(tok.Nonce), []byte(nonce)) != 1:
+		return nil, errors.NotValidf("ID token nonce")
+	}
+
+	if err := tok.Valid(now); err != nil {
+		return nil, err
+	}
+	return tok, nil
+}
+
+// link returns the user linked to the ID token's identity.  If there is
+// none, the identity is linked to the user with its email if the Provider
+// has verified it, or else to a new user if the Provider allows it.
+func (s *Service) link(p *Provider, tok *idToken) (*user.User, error) {
+	key := linkKey(p.Name, tok.Subject)
+	bs, err := db.GetByKey(s.DB, Links, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(bs) > 0 {
+		var id string
+		if err := json.Unmarshal(bs, &id); err != nil {
+			return nil, err
+		}
+		u, err := s.Users.GetByID(id)
+		if err == nil {
+			return u, nil
+		}
+		if !errors.IsUserNotFound(err) && !errors.IsNotFound(err) {
+			return nil, err
+		}
+		// The user was deleted, so link the identity afresh.
+	}
+
+	if tok.Email == "" || !tok.EmailVerified {
+		return nil, errors.Unauthorizedf("provider %q has not verified the email of %q", p.Name, tok.Subject)
+	}
+
+	u, err := s.Users.Get(tok.Email)
+	created := false
+	switch {
+	case errors.IsUserNotFound(err) && p.CreateUsers:
+		if u, err = s.Users.CreateExternal(tok.Email); err != nil {
+			return nil, err
+		}
+		created = true
+	case errors.IsUserNotFound(err):
+		return nil, errors.Unauthorizedf("no user for %q, and provider %q may not create one", tok.Email, p.Name)
+	case err != nil:
+		return nil, err
+	}
+
+	if err := db.StoreKeyValue(s.DB, Links, key, u.ID); err != nil {
+		return nil, err
+	}
+
+	if created {
+		for _, h := range s.Created {
+			if err := h(p.Name, u.Email); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return u, nil
+}
+
+// Linked returns the Provider names and subjects linked to the user with
+// the given ID.
+func (s *Service) Linked(uid string) (map[string][]string, error) {
+	ls := map[string][]string{}
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(Links))
+		if b == nil {
+			return db.BucketNotFoundErr(Links)
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			var id string
+			if err := json.Unmarshal(v, &id); err != nil {
+				return err
+			}
+			if id == uid {
+				parts := strings.SplitN(string(k), "\x00", 2)
+				ls[parts[0]] = append(ls[parts[0]], parts[1])
+			}
+			return nil
+		})
+	})
+	return ls, err
+}
@@ -0,0 +1,403 @@
+package oidc_test
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	"github.com/synapse-garden/mf-proto/jwt"
+	"github.com/synapse-garden/mf-proto/oidc"
+	t "github.com/synapse-garden/mf-proto/testing"
+	"github.com/synapse-garden/mf-proto/totp"
+	"github.com/synapse-garden/mf-proto/user"
+
+	gc "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { gc.TestingT(t) }
+
+// issuer is a stub OpenID Connect Provider.  Its token endpoint accepts
+// the code "good-code" with the verifier for the last challenge it was
+// sent, and returns an ID token with its claims.
+type issuer struct {
+	*httptest.Server
+	key       *jwt.Key
+	challenge string
+	claims    map[string]interface{}
+	jwksHits  int
+}
+
+func newIssuer(c *gc.C) *issuer {
+	i := new(issuer)
+	k, err := jwt.NewKey(jwt.EdDSA, time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC))
+	c.Assert(err, jc.ErrorIsNil)
+	i.key = k
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&oidc.Discovery{
+			Issuer:                i.URL,
+			AuthorizationEndpoint: i.URL + "/authorize",
+			TokenEndpoint:         i.URL + "/token",
+			JWKSURI:               i.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		i.jwksHits++
+		j, _ := i.key.JWK()
+		json.NewEncoder(w).Encode(&jwt.JWKS{Keys: []jwt.JWK{j}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		switch {
+		case id != "mf" || secret != "shh":
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+			return
+		case r.PostFormValue("code") != "good-code",
+			base64.RawURLEncoding.EncodeToString(sum[:]) != i.challenge:
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		tok, err := jwt.Sign(i.key, i.claims)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "at",
+			"token_type":   "Bearer",
+			"id_token":     tok,
+		})
+	})
+	i.Server = httptest.NewServer(mux)
+	return i
+}
+
+type OIDCSuite struct {
+	d      *t.DB
+	clock  *t.Clock
+	users  *user.Service
+	svc    *oidc.Service
+	issuer *issuer
+}
+
+var _ = gc.Suite(&OIDCSuite{})
+
+func (s *OIDCSuite) SetUpTest(c *gc.C) {
+	d, err := t.NewDB(
+		t.SetupBolt("test.db"),
+		t.SetupBuckets(append(user.Buckets(), oidc.Buckets()...)),
+	)
+	c.Assert(err, jc.ErrorIsNil)
+	s.d = d
+	s.clock = t.NewClock(time.Date(2016, 1, 14, 0, 0, 0, 0, time.UTC))
+	s.users = user.NewService(d, user.WithClock(s.clock))
+	s.issuer = newIssuer(c)
+
+	s.svc = oidc.NewService(d, s.users,
+		oidc.WithClock(s.clock),
+		oidc.WithProviders(oidc.Provider{
+			Name:         "corp",
+			Issuer:       s.issuer.URL,
+			ClientID:     "mf",
+			ClientSecret: "shh",
+			RedirectURL:  "https://mf.example/user/oidc/corp/callback",
+		}, oidc.Provider{
+			Name:         "open",
+			Issuer:       s.issuer.URL,
+			ClientID:     "mf",
+			ClientSecret: "shh",
+			RedirectURL:  "https://mf.example/user/oidc/open/callback",
+			CreateUsers:  true,
+		}),
+	)
+
+	c.Assert(s.users.Create("bob@tomato.com", "12345"), jc.ErrorIsNil)
+}
+
+func (s *OIDCSuite) TearDownTest(c *gc.C) {
+	s.issuer.Close()
+	c.Assert(t.CleanupDB(s.d), jc.ErrorIsNil)
+}
+
+// claims returns valid ID token claims for the given subject and email,
+// with the given nonce.
+func (s *OIDCSuite) claims(sub, email, nonce string) map[string]interface{} {
+	now := s.clock.Now()
+	return map[string]interface{}{
+		"iss":            s.issuer.URL,
+		"sub":            sub,
+		"aud":            "mf",
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+		"nonce":          nonce,
+		"email":          email,
+		"email_verified": true,
+	}
+}
+
+// start starts a sign-in with the provider and returns its state and
+// nonce, as the stub issuer would see them.
+func (s *OIDCSuite) start(provider string, c *gc.C) (string, string) {
+	u, err := s.svc.AuthURL(provider)
+	c.Assert(err, jc.ErrorIsNil)
+
+	pu, err := url.Parse(u)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(pu.Path, gc.Equals, "/authorize")
+
+	q := pu.Query()
+	c.Check(q.Get("response_type"), gc.Equals, "code")
+	c.Check(q.Get("client_id"), gc.Equals, "mf")
+	c.Check(q.Get("scope"), gc.Equals, "openid email")
+	c.Check(q.Get("code_challenge_method"), gc.Equals, "S256")
+	s.issuer.challenge = q.Get("code_challenge")
+	return q.Get("state"), q.Get("nonce")
+}
+
+// login signs in with the provider, where the issuer returns the claims
+// made by the given func from the nonce.
+func (s *OIDCSuite) login(provider string, claims func(nonce string) map[string]interface{}, c *gc.C) (string, *user.Login, error) {
+	st, nonce := s.start(provider, c)
+	s.issuer.claims = claims(nonce)
+	return s.svc.Callback(provider, st, "good-code")
+}
+
+func (s *OIDCSuite) TestLoadProviders(c *gc.C) {
+	p := oidc.Provider{
+		Name:        "corp",
+		Issuer:      "https://id.corp.example",
+		ClientID:    "mf",
+		RedirectURL: "https://mf.example/cb",
+	}
+	c.Check(p.Validate(), jc.ErrorIsNil)
+
+	p.Issuer = "id.corp.example"
+	c.Check(p.Validate(), gc.ErrorMatches, `provider "corp" URL "id.corp.example" not valid`)
+
+	p.Name = "a/b"
+	c.Check(p.Validate(), gc.ErrorMatches, `provider name "a/b" not valid`)
+}
+
+func (s *OIDCSuite) TestAuthURL(c *gc.C) {
+	_, err := s.svc.AuthURL("nope")
+	c.Check(err, jc.Satisfies, errors.IsNotFound)
+
+	st1, n1 := s.start("corp", c)
+	st2, n2 := s.start("corp", c)
+	c.Check(st1, gc.Not(gc.Equals), st2)
+	c.Check(n1, gc.Not(gc.Equals), n2)
+	c.Check(st1, gc.Not(gc.Equals), n1)
+}
+
+func (s *OIDCSuite) TestCallback(c *gc.C) {
+	// An existing user is linked by the email the provider verified.
+	email, l, err := s.login("corp", func(n string) map[string]interface{} {
+		return s.claims("sub-1", "bob@tomato.com", n)
+	}, c)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(email, gc.Equals, "bob@tomato.com")
+	c.Check(l.Pending, jc.IsFalse)
+	c.Check(s.users.ValidLogin(email, l.Key), jc.ErrorIsNil)
+
+	bob, err := s.users.Get("bob@tomato.com")
+	c.Assert(err, jc.ErrorIsNil)
+	ls, err := s.svc.Linked(bob.ID)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(ls, jc.DeepEquals, map[string][]string{"corp": {"sub-1"}})
+
+	// Once linked, the subject signs in as the user, whatever its email
+	// is now.
+	email, _, err = s.login("corp", func(n string) map[string]interface{} {
+		cs := s.claims("sub-1", "robert@tomato.com", n)
+		cs["email_verified"] = false
+		return cs
+	}, c)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(email, gc.Equals, "bob@tomato.com")
+
+	// A provider which may not create users refuses unknown emails.
+	_, _, err = s.login("corp", func(n string) map[string]interface{} {
+		return s.claims("sub-2", "carol@pepper.org", n)
+	}, c)
+	c.Check(err, gc.ErrorMatches, `no user for "carol@pepper.org", and provider "corp" may not create one`)
+	c.Check(err, jc.Satisfies, errors.IsUnauthorized)
+
+	// One which may, creates a verified user just in time.
+	email, l, err = s.login("open", func(n string) map[string]interface{} {
+		return s.claims("sub-2", "carol@pepper.org", n)
+	}, c)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(email, gc.Equals, "carol@pepper.org")
+	c.Check(s.users.ValidLogin(email, l.Key), jc.ErrorIsNil)
+	carol, err := s.users.Get(email)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(carol.Unverified, jc.IsFalse)
+
+	// Unverified emails are never linked.
+	_, _, err = s.login("open", func(n string) map[string]interface{} {
+		cs := s.claims("sub-3", "dave@radish.net", n)
+		cs["email_verified"] = false
+		return cs
+	}, c)
+	c.Check(err, gc.ErrorMatches, `provider "open" has not verified the email of "sub-3"`)
+	_, err = s.users.Get("dave@radish.net")
+	c.Check(err, jc.Satisfies, errors.IsUserNotFound)
+}
+
+func (s *OIDCSuite) TestCallbackCreatedHooks(c *gc.C) {
+	var created []string
+	s.svc.Created = append(s.svc.Created, func(provider, email string) error {
+		created = append(created, provider+" "+email)
+		return nil
+	})
+
+	// Linking an existing user creates no one.
+	_, _, err := s.login("open", func(n string) map[string]interface{} {
+		return s.claims("sub-1", "bob@tomato.com", n)
+	}, c)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(created, gc.HasLen, 0)
+
+	_, _, err = s.login("open", func(n string) map[string]interface{} {
+		return s.claims("sub-2", "carol@pepper.org", n)
+	}, c)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(created, jc.DeepEquals, []string{"open carol@pepper.org"})
+
+	// Signing in again once linked creates no one either.
+	_, _, err = s.login("open", func(n string) map[string]interface{} {
+		return s.claims("sub-2", "carol@pepper.org", n)
+	}, c)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(created, gc.HasLen, 1)
+}
+
+func (s *OIDCSuite) TestCallbackTOTP(c *gc.C) {
+	id, err := s.users.ID("bob@tomato.com")
+	c.Assert(err, jc.ErrorIsNil)
+	secret, _, err := s.users.EnrollTOTP(id)
+	c.Assert(err, jc.ErrorIsNil)
+	code, err := totp.Code(secret, s.clock.Now())
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = s.users.ConfirmTOTP(id, code)
+	c.Assert(err, jc.ErrorIsNil)
+
+	_, l, err := s.login("corp", func(n string) map[string]interface{} {
+		return s.claims("sub-1", "bob@tomato.com", n)
+	}, c)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(l.Pending, jc.IsTrue)
+}
+
+func (s *OIDCSuite) TestCallbackInvalid(c *gc.C) {
+	for i, t := range []struct {
+		should      string
+		claims      func(cs map[string]interface{})
+		expectError string
+	}{{
+		should:      "reject the wrong nonce",
+		claims:      func(cs map[string]interface{}) { cs["nonce"] = "other" },
+		expectError: `ID token nonce not valid`,
+	}, {
+		should:      "reject the wrong audience",
+		claims:      func(cs map[string]interface{}) { cs["aud"] = []string{"other"} },
+		expectError: `ID token audience \["other"\] not valid`,
+	}, {
+		should: "reject another authorized party",
+		claims: func(cs map[string]interface{}) {
+			cs["aud"] = []string{"mf", "other"}
+			cs["azp"] = "other"
+		},
+		expectError: `ID token authorized party "other" not valid`,
+	}, {
+		should:      "reject the wrong issuer",
+		claims:      func(cs map[string]interface{}) { cs["iss"] = "https://evil.example" },
+		expectError: `ID token issuer "https://evil.example" not valid`,
+	}, {
+		should:      "reject an expired token",
+		claims:      func(cs map[string]interface{}) { cs["exp"] = s.clock.Now().Unix() },
+		expectError: `expired token not valid`,
+	}, {
+		should:      "reject a token without a subject",
+		claims:      func(cs map[string]interface{}) { delete(cs, "sub") },
+		expectError: `ID token without subject not valid`,
+	}} {
+		c.Logf("test %d: should %s", i, t.should)
+
+		_, _, err := s.login("corp", func(n string) map[string]interface{} {
+			cs := s.claims("sub-1", "bob@tomato.com", n)
+			t.claims(cs)
+			return cs
+		}, c)
+		c.Check(err, gc.ErrorMatches, t.expectError)
+	}
+}
+
+func (s *OIDCSuite) TestCallbackState(c *gc.C) {
+	claims := func(n string) map[string]interface{} {
+		return s.claims("sub-1", "bob@tomato.com", n)
+	}
+
+	// States may only be used once.
+	st, n := s.start("corp", c)
+	s.issuer.claims = claims(n)
+	_, _, err := s.svc.Callback("corp", st, "good-code")
+	c.Assert(err, jc.ErrorIsNil)
+	_, _, err = s.svc.Callback("corp", st, "good-code")
+	c.Check(err, gc.ErrorMatches, `sign-in state not valid`)
+
+	// Nor with another provider.
+	st, n = s.start("corp", c)
+	s.issuer.claims = claims(n)
+	_, _, err = s.svc.Callback("open", st, "good-code")
+	c.Check(err, gc.ErrorMatches, `state for provider "corp" not valid`)
+
+	// Nor once they have expired.
+	st, n = s.start("corp", c)
+	s.issuer.claims = claims(n)
+	s.clock.Advance(oidc.DefaultStateTTL)
+	_, _, err = s.svc.Callback("corp", st, "good-code")
+	c.Check(err, gc.ErrorMatches, `expired sign-in state not valid`)
+
+	// A code the provider refuses is an error.
+	st, n = s.start("corp", c)
+	s.issuer.claims = claims(n)
+	_, _, err = s.svc.Callback("corp", st, "bad-code")
+	c.Check(err, gc.ErrorMatches, `provider "corp" refused code: invalid_grant `)
+	c.Check(err, jc.Satisfies, errors.IsUnauthorized)
+}
+
+func (s *OIDCSuite) TestKeyRotation(c *gc.C) {
+	claims := func(n string) map[string]interface{} {
+		return s.claims("sub-1", "bob@tomato.com", n)
+	}
+	_, _, err := s.login("corp", claims, c)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(s.issuer.jwksHits, gc.Equals, 1)
+
+	// A new key is fetched, but not too often.
+	k, err := jwt.NewKey(jwt.EdDSA, s.clock.Now())
+	c.Assert(err, jc.ErrorIsNil)
+	s.issuer.key = k
+	_, _, err = s.login("corp", claims, c)
+	c.Check(err, gc.ErrorMatches, `token key ".*" not valid`)
+	c.Check(s.issuer.jwksHits, gc.Equals, 1)
+
+	s.clock.Advance(oidc.KeyRefresh)
+	_, _, err = s.login("corp", claims, c)
+	c.Check(err, jc.ErrorIsNil)
+	c.Check(s.issuer.jwksHits, gc.Equals, 2)
+}
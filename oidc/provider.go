@@ -0,0 +1,191 @@
+// Package oidc implements OpenID Connect relying-party login: users sign in
+// with an external identity Provider using the authorization code flow
+// with PKCE, and the ID token it issues is verified and linked to a user.
+package oidc
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/synapse-garden/mf-proto/jwt"
+)
+
+// Provider is an OpenID Connect identity provider users may sign in with.
+type Provider struct {
+	// Name identifies the Provider in URLs, such as "corp".
+	Name string `json:"name"`
+
+	// Issuer is the Provider's issuer URL, where its discovery document
+	// is found under /.well-known/openid-configuration.
+	Issuer string `json:"issuer"`
+
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret,omitempty"`
+
+	// RedirectURL is this server's callback URL for the Provider, which
+	// must be registered with it.
+	RedirectURL string `json:"redirect_url"`
+
+	// Scopes are requested as well as openid and email.
+	Scopes []string `json:"scopes,omitempty"`
+
+	// CreateUsers allows users to be made for new identities whose email
+	// the Provider has verified.  Otherwise only existing users may sign
+	// in with it.
+	CreateUsers bool `json:"create_users,omitempty"`
+}
+
+// Validate returns an error if the Provider can't be used.
+func (p *Provider) Validate() error {
+	switch {
+	case p.Name == "" || strings.ContainsAny(p.Name, "/?#% "):
+		return errors.NotValidf("provider name %q", p.Name)
+	case p.ClientID == "":
+		return errors.NotValidf("provider %q without client_id", p.Name)
+	}
+
+	for _, u := range []string{p.Issuer, p.RedirectURL} {
+		pu, err := url.Parse(u)
+		if err != nil || !pu.IsAbs() || pu.Host == "" {
+			return errors.NotValidf("provider %q URL %q", p.Name, u)
+		}
+	}
+	return nil
+}
+
+// LoadProviders reads a JSON array of Providers from the given file.
+func LoadProviders(path string) ([]Provider, error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var ps []Provider
+	if err := json.Unmarshal(bs, &ps); err != nil {
+		return nil, errors.Annotatef(err, "reading providers from %q failed", path)
+	}
+
+	seen := map[string]bool{}
+	for i := range ps {
+		if err := ps[i].Validate(); err != nil {
+			return nil, err
+		}
+		if seen[ps[i].Name] {
+			return nil, errors.AlreadyExistsf("provider %q", ps[i].Name)
+		}
+		seen[ps[i].Name] = true
+	}
+	return ps, nil
+}
+
+// Discovery is the part of a Provider's discovery document which is used.
+type Discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// metadata is what has been fetched from a Provider.
+type metadata struct {
+	Discovery
+	keys    []*jwt.Key
+	fetched time.Time
+}
+
+// getJSON gets a JSON document from a Provider.
+func (s *Service) getJSON(u string, v interface{}) error {
+	resp, err := s.HTTP.Get(u)
+	if err != nil {
+		return errors.Annotatef(err, "fetching %q failed", u)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("fetching %q failed: %s", u, resp.Status)
+	}
+
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v); err != nil {
+		return errors.Annotatef(err, "decoding %q failed", u)
+	}
+	return nil
+}
+
+// provider returns the named Provider and its metadata, fetching its
+// discovery document if it hasn't been yet.
+func (s *Service) provider(name string) (*Provider, *metadata, error) {
+	p, ok := s.Providers[name]
+	if !ok {
+		return nil, nil, errors.NotFoundf("provider %q", name)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m, ok := s.meta[name]; ok {
+		return p, m, nil
+	}
+
+	m := new(metadata)
+	u := strings.TrimSuffix(p.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := s.getJSON(u, &m.Discovery); err != nil {
+		return nil, nil, err
+	}
+
+	switch {
+	case m.Issuer != p.Issuer:
+		return nil, nil, errors.NotValidf("provider %q issuer %q", name, m.Issuer)
+	case m.AuthorizationEndpoint == "", m.TokenEndpoint == "", m.JWKSURI == "":
+		return nil, nil, errors.NotValidf("provider %q discovery document", name)
+	}
+
+	s.meta[name] = m
+	return p, m, nil
+}
+
+// key returns the Provider's signing Key with the given ID, refetching its
+// keys if it is not known and they weren't fetched too recently.
+func (s *Service) key(name string, m *metadata, kid string) (*jwt.Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	find := func() *jwt.Key {
+		for _, k := range m.keys {
+			if k.ID == kid {
+				return k
+			}
+		}
+		return nil
+	}
+	if k := find(); k != nil {
+		return k, nil
+	}
+
+	now := s.Clock.Now()
+	if !m.fetched.IsZero() && now.Before(m.fetched.Add(KeyRefresh)) {
+		return nil, errors.NotFoundf("provider %q key %q", name, kid)
+	}
+
+	ks := new(jwt.JWKS)
+	if err := s.getJSON(m.JWKSURI, ks); err != nil {
+		return nil, err
+	}
+
+	m.keys, m.fetched = nil, now
+	for _, j := range ks.Keys {
+		// Skip keys of other kinds, which the Provider may also publish.
+		if k, err := j.Key(); err == nil {
+			m.keys = append(m.keys, k)
+		}
+	}
+
+	if k := find(); k != nil {
+		return k, nil
+	}
+	return nil, errors.NotFoundf("provider %q key %q", name, kid)
+}
@@ -0,0 +1,95 @@
+package oidc
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/synapse-garden/mf-proto/db"
+	"github.com/synapse-garden/mf-proto/user"
+	"github.com/synapse-garden/mf-proto/util"
+)
+
+const (
+	// DefaultStateTTL is how long a user has to sign in with a Provider.
+	DefaultStateTTL = 10 * time.Minute
+
+	// DefaultTimeout is how long requests to a Provider may take.
+	DefaultTimeout = 10 * time.Second
+
+	// KeyRefresh is how often a Provider's keys may be refetched when a
+	// token is signed by an unknown key.
+	KeyRefresh = time.Minute
+)
+
+// Hook is called with the name of a Provider and the email of a user it
+// signed in, after some event has happened to the user.  If it returns an
+// error, the error is returned to the caller.
+type Hook func(provider, email string) error
+
+// Service signs users in with the OpenID Connect Providers it is given,
+// linking each external identity to a user of its Users.  Providers'
+// discovery documents and keys are fetched when first needed.
+type Service struct {
+	DB       db.DB
+	Clock    util.Clock
+	Users    *user.Service
+	HTTP     *http.Client
+	StateTTL time.Duration
+
+	// Providers are the configured Providers by Name.
+	Providers map[string]*Provider
+
+	// Created are called when a Provider creates a user just in time.
+	Created []Hook
+
+	mu   sync.Mutex
+	meta map[string]*metadata
+}
+
+// Option configures a Service.
+type Option func(*Service)
+
+// WithClock sets the Service's Clock.
+func WithClock(c util.Clock) Option {
+	return func(s *Service) { s.Clock = c }
+}
+
+// WithHTTPClient sets the client the Service talks to Providers with.
+func WithHTTPClient(c *http.Client) Option {
+	return func(s *Service) { s.HTTP = c }
+}
+
+// WithProviders adds Providers to the Service.
+func WithProviders(ps ...Provider) Option {
+	return func(s *Service) {
+		for i := range ps {
+			p := ps[i]
+			s.Providers[p.Name] = &p
+		}
+	}
+}
+
+// OnCreated adds Hooks called when a Provider creates a user.
+func OnCreated(hs ...Hook) Option {
+	return func(s *Service) { s.Created = append(s.Created, hs...) }
+}
+
+// NewService makes a new Service for the given DB and users, using the
+// system clock and default timeouts unless configured otherwise by the
+// given Options.
+func NewService(d db.DB, us *user.Service, opts ...Option) *Service {
+	s := &Service{
+		DB:        d,
+		Clock:     util.SystemClock{},
+		Users:     us,
+		HTTP:      &http.Client{Timeout: DefaultTimeout},
+		StateTTL:  DefaultStateTTL,
+		Providers: map[string]*Provider{},
+		meta:      map[string]*metadata{},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
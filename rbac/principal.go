@@ -0,0 +1,191 @@
+package rbac
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/juju/errors"
+	"github.com/synapse-garden/mf-proto/db"
+	"github.com/synapse-garden/mf-proto/util"
+)
+
+// Kind is a kind of Principal.
+type Kind string
+
+const (
+	// KindUser Principals are users, identified by user ID.
+	KindUser Kind = "user"
+
+	// KindAdmin Principals are admins, identified by email.
+	KindAdmin Kind = "admin"
+)
+
+// Principal is someone who may be granted Roles.
+type Principal struct {
+	Kind Kind   `json:"kind"`
+	ID   string `json:"id"`
+}
+
+// User returns the Principal for the user with the given ID.
+func User(id string) Principal { return Principal{Kind: KindUser, ID: id} }
+
+// Admin returns the Principal for the admin with the given email.
+func Admin(email string) Principal { return Principal{Kind: KindAdmin, ID: email} }
+
+func (p Principal) String() string { return string(p.Kind) + ":" + p.ID }
+
+// ParsePrincipal parses a Principal of the form "kind:id".
+func ParsePrincipal(s string) (Principal, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return Principal{}, errors.NotValidf("principal %q", s)
+	}
+
+	switch k := Kind(parts[0]); k {
+	case KindUser, KindAdmin:
+		return Principal{Kind: k, ID: parts[1]}, nil
+	default:
+		return Principal{}, errors.NotValidf("principal kind %q", k)
+	}
+}
+
+type principalKey struct{}
+
+// NewContext returns a Context carrying p.
+func NewContext(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// FromContext returns the Principal carried by ctx, if any.
+func FromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
+
+type impersonatorKey struct{}
+
+// WithImpersonator returns a Context marked as one in which the admin p is
+// acting as the Context's Principal.
+func WithImpersonator(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, impersonatorKey{}, p)
+}
+
+// ImpersonatorFrom returns the admin acting as the Principal of ctx, if
+// any.
+func ImpersonatorFrom(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(impersonatorKey{}).(Principal)
+	return p, ok
+}
+
+// Assigned returns the names of the Roles assigned to p, not counting its
+// default Role.
+func (s *Service) Assigned(p Principal) ([]string, error) {
+	bs, err := db.GetByKey(s.DB, Assignments, []byte(p.String()))
+	if err != nil || len(bs) == 0 {
+		return nil, err
+	}
+
+	var names []string
+	if err := json.Unmarshal(bs, &names); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// RolesOf returns p's Roles: those assigned to it, or else its default Role.
+func (s *Service) RolesOf(p Principal) ([]*Role, error) {
+	names, err := s.Assigned(p)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(names) == 0 {
+		if d, ok := s.Defaults[p.Kind]; ok {
+			names = []string{d}
+		}
+	}
+
+	rs := make([]*Role, 0, len(names))
+	for _, n := range names {
+		r, err := s.GetRole(n)
+		switch {
+		case errors.IsNotFound(err):
+			continue
+		case err != nil:
+			return nil, err
+		}
+		rs = append(rs, r)
+	}
+	return rs, nil
+}
+
+// Can returns nil if p has a Role granting the wanted Permission.
+func (s *Service) Can(p Principal, want Permission) error {
+	rs, err := s.RolesOf(p)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range rs {
+		if r.Grants(want) {
+			return nil
+		}
+	}
+
+	return util.Forbiddenf("%s lacks permission %q", p, want)
+}
+
+// Assign assigns the named Role to p.
+func (s *Service) Assign(p Principal, role string) error {
+	if _, err := s.GetRole(role); err != nil {
+		return err
+	}
+
+	return s.updateNames(p, func(names []string) []string {
+		if _, ok := without(names, role); ok {
+			return names
+		}
+		return append(names, role)
+	})
+}
+
+// Unassign takes the named Role away from p.
+func (s *Service) Unassign(p Principal, role string) error {
+	var found bool
+	err := s.updateNames(p, func(names []string) []string {
+		names, found = without(names, role)
+		return names
+	})
+	switch {
+	case err != nil:
+		return err
+	case !found:
+		return errors.NotFoundf("role %q for %s", role, p)
+	}
+	return nil
+}
+
+// Clear takes every assigned Role away from p.
+func (s *Service) Clear(p Principal) error {
+	return db.DeleteByKey(s.DB, Assignments, []byte(p.String()))
+}
+
+func (s *Service) updateNames(p Principal, update func([]string) []string) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(Assignments))
+		if b == nil {
+			return db.BucketNotFoundErr(Assignments)
+		}
+
+		var names []string
+		if bs := b.Get([]byte(p.String())); len(bs) > 0 {
+			if err := json.Unmarshal(bs, &names); err != nil {
+				return err
+			}
+		}
+
+		return putNames(b, []byte(p.String()), update(names))
+	})
+}
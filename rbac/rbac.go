@@ -0,0 +1,286 @@
+// Package rbac implements role-based access control.  Roles are named sets
+// of Permissions, which are assigned to Principals.  A Principal with no
+// assigned Roles has the default Role for its Kind.
+package rbac
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/juju/errors"
+	"github.com/synapse-garden/mf-proto/db"
+)
+
+const (
+	// Roles holds the Roles made by admins, by name.
+	Roles db.Bucket = "rbac-roles"
+
+	// Assignments holds the names of the Roles assigned to each Principal.
+	Assignments db.Bucket = "rbac-assignments"
+)
+
+// Buckets returns the Buckets for the rbac database.
+func Buckets() []db.Bucket {
+	return []db.Bucket{
+		Roles,
+		Assignments,
+	}
+}
+
+// Permission allows some action.  Permissions are of the form
+// "resource:action" or "resource:action:scope".  A Permission ending in
+// "*" grants every Permission it is a prefix of.
+type Permission string
+
+const (
+	// All grants every Permission.
+	All Permission = "*"
+
+	// UserCreate allows creating users.
+	UserCreate Permission = "user:create"
+
+	// UserReadAny allows reading any user's account.
+	UserReadAny Permission = "user:read:any"
+
+	// UserDeleteAny allows deleting any user.
+	UserDeleteAny Permission = "user:delete:any"
+
+	// UserImpersonate allows admins to act as users other than admins.
+	UserImpersonate Permission = "user:impersonate"
+
+	// UserManage allows setting the registration policy and minting
+	// invites.
+	UserManage Permission = "user:manage"
+
+	// ObjectReadAny allows reading any user's objects.
+	ObjectReadAny Permission = "object:read:any"
+
+	// ObjectWriteAny allows deleting any user's objects.
+	ObjectWriteAny Permission = "object:write:any"
+
+	// AdminManage allows creating and deleting admins, and managing Roles.
+	AdminManage Permission = "admin:manage"
+
+	// OAuthManage allows registering and deleting OAuth clients.
+	OAuthManage Permission = "oauth:manage"
+
+	// AuditRead allows reading and verifying the audit log.
+	AuditRead Permission = "audit:read"
+)
+
+// Known are the Permissions which are checked somewhere.
+var Known = []Permission{
+	UserCreate,
+	UserReadAny,
+	UserDeleteAny,
+	UserImpersonate,
+	UserManage,
+	ObjectReadAny,
+	ObjectWriteAny,
+	AdminManage,
+	OAuthManage,
+	AuditRead,
+}
+
+// Grants returns true if p grants the wanted Permission.
+func (p Permission) Grants(want Permission) bool {
+	if strings.HasSuffix(string(p), "*") {
+		return strings.HasPrefix(string(want), strings.TrimSuffix(string(p), "*"))
+	}
+	return p == want
+}
+
+// valid returns an error unless p is Known, or is a wildcard.
+func (p Permission) valid() error {
+	if strings.HasSuffix(string(p), "*") {
+		return nil
+	}
+	for _, k := range Known {
+		if p == k {
+			return nil
+		}
+	}
+	return errors.NotValidf("permission %q", p)
+}
+
+// Role is a named set of Permissions.
+type Role struct {
+	Name        string       `json:"name"`
+	Permissions []Permission `json:"permissions"`
+
+	// BuiltIn Roles can't be changed or deleted.
+	BuiltIn bool `json:"builtin,omitempty"`
+}
+
+// Grants returns true if any of the Role's Permissions grants want.
+func (r *Role) Grants(want Permission) bool {
+	for _, p := range r.Permissions {
+		if p.Grants(want) {
+			return true
+		}
+	}
+	return false
+}
+
+// Built-in Role names.
+const (
+	RoleAdmin   = "admin"
+	RoleUser    = "user"
+	RoleSupport = "support"
+)
+
+// BuiltIn are the Roles every Service has.
+var BuiltIn = []Role{{
+	Name:        RoleAdmin,
+	Permissions: []Permission{All},
+	BuiltIn:     true,
+}, {
+	Name:    RoleUser,
+	BuiltIn: true,
+}, {
+	Name:        RoleSupport,
+	Permissions: []Permission{UserReadAny, ObjectReadAny},
+	BuiltIn:     true,
+}}
+
+func builtIn(name string) (*Role, bool) {
+	for _, r := range BuiltIn {
+		if r.Name == name {
+			r := r
+			return &r, true
+		}
+	}
+	return nil, false
+}
+
+// GetRole returns the Role with the given name.
+func (s *Service) GetRole(name string) (*Role, error) {
+	if r, ok := builtIn(name); ok {
+		return r, nil
+	}
+
+	bs, err := db.GetByKey(s.DB, Roles, []byte(name))
+	switch {
+	case err != nil:
+		return nil, err
+	case len(bs) == 0:
+		return nil, errors.NotFoundf("role %q", name)
+	}
+
+	r := new(Role)
+	if err := json.Unmarshal(bs, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// AllRoles returns every Role, built-in ones first.
+func (s *Service) AllRoles() ([]Role, error) {
+	rs := append([]Role(nil), BuiltIn...)
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(Roles))
+		if b == nil {
+			return db.BucketNotFoundErr(Roles)
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			var r Role
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			rs = append(rs, r)
+			return nil
+		})
+	})
+	return rs, err
+}
+
+// PutRole creates or replaces the Role with the given name.
+func (s *Service) PutRole(name string, perms ...Permission) error {
+	if name == "" || strings.ContainsAny(name, ", ") {
+		return errors.NotValidf("role name %q", name)
+	}
+
+	if _, ok := builtIn(name); ok {
+		return errors.NotSupportedf("changing built-in role %q", name)
+	}
+
+	for _, p := range perms {
+		if err := p.valid(); err != nil {
+			return err
+		}
+	}
+
+	return db.StoreKeyValue(s.DB, Roles, []byte(name), &Role{
+		Name:        name,
+		Permissions: perms,
+	})
+}
+
+// DeleteRole deletes the Role with the given name, and unassigns it from
+// everyone.
+func (s *Service) DeleteRole(name string) error {
+	if _, ok := builtIn(name); ok {
+		return errors.NotSupportedf("deleting built-in role %q", name)
+	}
+
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		rb, ab := tx.Bucket([]byte(Roles)), tx.Bucket([]byte(Assignments))
+		switch {
+		case rb == nil:
+			return db.BucketNotFoundErr(Roles)
+		case ab == nil:
+			return db.BucketNotFoundErr(Assignments)
+		case len(rb.Get([]byte(name))) == 0:
+			return errors.NotFoundf("role %q", name)
+		}
+
+		changed := make(map[string][]string)
+		err := ab.ForEach(func(k, v []byte) error {
+			var names []string
+			if err := json.Unmarshal(v, &names); err != nil {
+				return err
+			}
+			if left, ok := without(names, name); ok {
+				changed[string(k)] = left
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for k, names := range changed {
+			if err := putNames(ab, []byte(k), names); err != nil {
+				return err
+			}
+		}
+
+		return rb.Delete([]byte(name))
+	})
+}
+
+// without returns names without name, and whether it was there.
+func without(names []string, name string) ([]string, bool) {
+	for i, n := range names {
+		if n == name {
+			return append(names[:i:i], names[i+1:]...), true
+		}
+	}
+	return names, false
+}
+
+func putNames(b *bolt.Bucket, k []byte, names []string) error {
+	if len(names) == 0 {
+		return b.Delete(k)
+	}
+
+	sort.Strings(names)
+	bs, err := json.Marshal(names)
+	if err != nil {
+		return err
+	}
+	return b.Put(k, bs)
+}
@@ -0,0 +1,201 @@
+package rbac_test
+
+import (
+	"context"
+	"testing"
+
+	jc "github.com/juju/testing/checkers"
+	"github.com/synapse-garden/mf-proto/rbac"
+	t "github.com/synapse-garden/mf-proto/testing"
+	"github.com/synapse-garden/mf-proto/util"
+
+	gc "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { gc.TestingT(t) }
+
+type RBACSuite struct {
+	d   *t.DB
+	svc *rbac.Service
+}
+
+var _ = gc.Suite(&RBACSuite{})
+
+var (
+	bob   = rbac.User("b0b")
+	alice = rbac.Admin("alice@tomato.com")
+)
+
+func (s *RBACSuite) SetUpTest(c *gc.C) {
+	d, err := t.NewDB(
+		t.SetupBolt("test.db"),
+		t.SetupBuckets(rbac.Buckets()),
+	)
+	c.Assert(err, jc.ErrorIsNil)
+	s.d = d
+	s.svc = rbac.NewService(d)
+}
+
+func (s *RBACSuite) TearDownTest(c *gc.C) {
+	c.Assert(t.CleanupDB(s.d), jc.ErrorIsNil)
+}
+
+func (s *RBACSuite) TestGrants(c *gc.C) {
+	for i, t := range []struct {
+		should string
+		given  rbac.Permission
+		want   rbac.Permission
+		expect bool
+	}{{
+		should: "grant the same permission",
+		given:  rbac.UserCreate,
+		want:   rbac.UserCreate,
+		expect: true,
+	}, {
+		should: "not grant a different permission",
+		given:  rbac.UserCreate,
+		want:   rbac.UserReadAny,
+	}, {
+		should: "grant everything with *",
+		given:  rbac.All,
+		want:   rbac.AdminManage,
+		expect: true,
+	}, {
+		should: "grant a resource's permissions with a wildcard",
+		given:  "object:*",
+		want:   rbac.ObjectWriteAny,
+		expect: true,
+	}, {
+		should: "not grant another resource's permissions with a wildcard",
+		given:  "object:*",
+		want:   rbac.UserReadAny,
+	}} {
+		c.Logf("test %d: should %s", i, t.should)
+		c.Check(t.given.Grants(t.want), gc.Equals, t.expect)
+	}
+}
+
+func (s *RBACSuite) TestDefaults(c *gc.C) {
+	c.Check(s.svc.Can(alice, rbac.AdminManage), jc.ErrorIsNil)
+	c.Check(s.svc.Can(bob, rbac.UserCreate), gc.ErrorMatches,
+		`user:b0b lacks permission "user:create"`)
+	c.Check(s.svc.Can(bob, rbac.UserCreate), jc.Satisfies, util.IsForbidden)
+
+	svc := rbac.NewService(s.d, rbac.WithDefault(rbac.KindAdmin, rbac.RoleSupport))
+	c.Check(svc.Can(alice, rbac.UserReadAny), jc.ErrorIsNil)
+	c.Check(svc.Can(alice, rbac.AdminManage), gc.ErrorMatches,
+		`admin:alice@tomato.com lacks permission "admin:manage"`)
+}
+
+func (s *RBACSuite) TestPutRole(c *gc.C) {
+	for i, t := range []struct {
+		should      string
+		name        string
+		perms       []rbac.Permission
+		expectError string
+	}{{
+		should: "make a role",
+		name:   "creator",
+		perms:  []rbac.Permission{rbac.UserCreate, "object:*"},
+	}, {
+		should:      "not make a role with an unknown permission",
+		name:        "wizard",
+		perms:       []rbac.Permission{"magic:cast"},
+		expectError: `permission "magic:cast" not valid`,
+	}, {
+		should:      "not make a role with a bad name",
+		name:        "two words",
+		expectError: `role name "two words" not valid`,
+	}, {
+		should:      "not change a built-in role",
+		name:        rbac.RoleAdmin,
+		expectError: `changing built-in role "admin" not supported`,
+	}} {
+		c.Logf("test %d: should %s", i, t.should)
+		err := s.svc.PutRole(t.name, t.perms...)
+		if t.expectError != "" {
+			c.Check(err, gc.ErrorMatches, t.expectError)
+			continue
+		}
+		c.Assert(err, jc.ErrorIsNil)
+
+		r, err := s.svc.GetRole(t.name)
+		c.Assert(err, jc.ErrorIsNil)
+		c.Check(r.Permissions, jc.DeepEquals, t.perms)
+	}
+
+	rs, err := s.svc.AllRoles()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(rs, gc.HasLen, len(rbac.BuiltIn)+1)
+}
+
+func (s *RBACSuite) TestAssign(c *gc.C) {
+	c.Assert(s.svc.PutRole("creator", rbac.UserCreate), jc.ErrorIsNil)
+
+	c.Check(s.svc.Assign(bob, "nope"), gc.ErrorMatches, `role "nope" not found`)
+	c.Assert(s.svc.Assign(bob, "creator"), jc.ErrorIsNil)
+	c.Assert(s.svc.Assign(bob, "creator"), jc.ErrorIsNil)
+	c.Assert(s.svc.Assign(bob, rbac.RoleSupport), jc.ErrorIsNil)
+
+	names, err := s.svc.Assigned(bob)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(names, jc.DeepEquals, []string{"creator", "support"})
+	c.Check(s.svc.Can(bob, rbac.UserCreate), jc.ErrorIsNil)
+	c.Check(s.svc.Can(bob, rbac.ObjectReadAny), jc.ErrorIsNil)
+
+	// Assigning a role to an admin replaces their default role.
+	c.Assert(s.svc.Assign(alice, rbac.RoleSupport), jc.ErrorIsNil)
+	c.Check(s.svc.Can(alice, rbac.AdminManage), gc.ErrorMatches, `.* lacks permission "admin:manage"`)
+
+	c.Assert(s.svc.Unassign(bob, rbac.RoleSupport), jc.ErrorIsNil)
+	c.Check(s.svc.Unassign(bob, rbac.RoleSupport), gc.ErrorMatches, `role "support" for user:b0b not found`)
+	c.Check(s.svc.Can(bob, rbac.ObjectReadAny), gc.ErrorMatches, `.* lacks permission "object:read:any"`)
+
+	// Deleting a role takes it from everyone.
+	c.Check(s.svc.DeleteRole(rbac.RoleUser), gc.ErrorMatches, `deleting built-in role "user" not supported`)
+	c.Assert(s.svc.DeleteRole("creator"), jc.ErrorIsNil)
+	c.Check(s.svc.DeleteRole("creator"), gc.ErrorMatches, `role "creator" not found`)
+	names, err = s.svc.Assigned(bob)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(names, gc.HasLen, 0)
+
+	c.Assert(s.svc.Clear(alice), jc.ErrorIsNil)
+	c.Check(s.svc.Can(alice, rbac.AdminManage), jc.ErrorIsNil)
+}
+
+func (s *RBACSuite) TestParsePrincipal(c *gc.C) {
+	p, err := rbac.ParsePrincipal("admin:alice@tomato.com")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(p, gc.Equals, alice)
+
+	_, err = rbac.ParsePrincipal("bob")
+	c.Check(err, gc.ErrorMatches, `principal "bob" not valid`)
+	_, err = rbac.ParsePrincipal("robot:r2d2")
+	c.Check(err, gc.ErrorMatches, `principal kind "robot" not valid`)
+}
+
+func (s *RBACSuite) TestContext(c *gc.C) {
+	_, ok := rbac.FromContext(context.Background())
+	c.Check(ok, jc.IsFalse)
+
+	p, ok := rbac.FromContext(rbac.NewContext(context.Background(), bob))
+	c.Check(ok, jc.IsTrue)
+	c.Check(p, gc.Equals, bob)
+}
+
+func (s *RBACSuite) TestImpersonatorContext(c *gc.C) {
+	ctx := rbac.NewContext(context.Background(), bob)
+	_, ok := rbac.ImpersonatorFrom(ctx)
+	c.Check(ok, jc.IsFalse)
+
+	ctx = rbac.WithImpersonator(ctx, alice)
+	p, ok := rbac.ImpersonatorFrom(ctx)
+	c.Check(ok, jc.IsTrue)
+	c.Check(p, gc.Equals, alice)
+
+	// The Principal is still who is being impersonated.
+	p, ok = rbac.FromContext(ctx)
+	c.Check(ok, jc.IsTrue)
+	c.Check(p, gc.Equals, bob)
+}
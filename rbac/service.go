@@ -0,0 +1,40 @@
+package rbac
+
+import (
+	"github.com/synapse-garden/mf-proto/db"
+)
+
+// Service performs rbac operations against its own DB.
+type Service struct {
+	DB db.DB
+
+	// Defaults are the Roles of Principals of each Kind with no
+	// assigned Roles.
+	Defaults map[Kind]string
+}
+
+// Option configures a Service.
+type Option func(*Service)
+
+// WithDefault sets the Role of Principals of the given Kind with no assigned
+// Roles.
+func WithDefault(k Kind, role string) Option {
+	return func(s *Service) { s.Defaults[k] = role }
+}
+
+// NewService makes a new Service for the given DB, in which admins have the
+// admin Role and users the user Role unless otherwise assigned or
+// configured by the given Options.
+func NewService(d db.DB, opts ...Option) *Service {
+	s := &Service{
+		DB: d,
+		Defaults: map[Kind]string{
+			KindAdmin: RoleAdmin,
+			KindUser:  RoleUser,
+		},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
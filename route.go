@@ -5,20 +5,51 @@ import (
 	"net/http"
 
 	"github.com/rs/cors"
+	"github.com/synapse-garden/mf-proto/admin"
 	"github.com/synapse-garden/mf-proto/api"
+	"github.com/synapse-garden/mf-proto/audit"
 	"github.com/synapse-garden/mf-proto/db"
+	"github.com/synapse-garden/mf-proto/group"
+	"github.com/synapse-garden/mf-proto/oauth"
+	"github.com/synapse-garden/mf-proto/object"
+	"github.com/synapse-garden/mf-proto/oidc"
+	"github.com/synapse-garden/mf-proto/rbac"
+	"github.com/synapse-garden/mf-proto/user"
 )
 
-func runHTTPListeners(d db.DB) {
+func runHTTPListeners(
+	d db.DB,
+	as *admin.Service,
+	us *user.Service,
+	objs *object.Service,
+	rs *rbac.Service,
+	gs *group.Service,
+	oas *oauth.Service,
+	ois *oidc.Service,
+	au *audit.Service,
+) {
+	g := api.NewGuard(as, us, rs, au)
+	g.Legacy = *legacyGET
+
 	httpMux, err := api.Routes(api.Source(d))
 	if err != nil {
 		log.Fatalf("router setup failed: %s\n", err.Error())
 	}
 
-	httpsMux, err := api.Routes(
-		api.Admin(d),
-		api.User(d),
-		api.Object(d),
+	httpsMux, err := g.Routes(
+		api.Admin(as, g),
+		api.User(us, g),
+		api.Profile(us, objs, g),
+		api.Users(us, objs, g),
+		api.Impersonate(as, us, g),
+		api.AccessTokens(us, g),
+		api.JWT(us, g),
+		api.Roles(rs, us, g),
+		api.Group(gs, us, g),
+		api.OAuth(oas, us, g),
+		api.OIDC(ois, g),
+		api.Audit(au, g),
+		api.Object(objs, g),
 		api.Task(d),
 		api.Source(d),
 	)
@@ -31,7 +62,7 @@ func runHTTPListeners(d db.DB) {
 
 	defaultCORSOptions := cors.Options{
 		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{"GET", "PUT", "POST", "DELETE"},
+		AllowedMethods:   []string{"GET", "PUT", "POST", "PATCH", "DELETE"},
 		AllowCredentials: true,
 	}
 
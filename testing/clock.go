@@ -0,0 +1,38 @@
+package testing
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is a util.Clock whose time only changes when it is told to.
+type Clock struct {
+	now time.Time
+	sync.RWMutex
+}
+
+// NewClock makes a new Clock stopped at the given time.
+func NewClock(t time.Time) *Clock {
+	return &Clock{now: t}
+}
+
+// Now returns the Clock's current time.
+func (c *Clock) Now() time.Time {
+	c.RLock()
+	defer c.RUnlock()
+	return c.now
+}
+
+// Advance moves the Clock forward by the given duration.
+func (c *Clock) Advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Set stops the Clock at the given time.
+func (c *Clock) Set(t time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	c.now = t
+}
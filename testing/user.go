@@ -1,8 +1,6 @@
 package testing
 
 import (
-	"time"
-
 	"github.com/synapse-garden/mf-proto/db"
 	"github.com/synapse-garden/mf-proto/user"
 	"github.com/synapse-garden/mf-proto/util"
@@ -21,18 +19,23 @@ type TestAdmin struct {
 	Key    util.Key
 }
 
-func LoginUsers(d db.DB, users ...TestUser) SetupFunc {
-	var err error
-	user.SetTimeout(5 * time.Second)
+// LoginUsers stores logins for the given existing users which expire after
+// the Service's Timeout, according to its Clock.
+func LoginUsers(s *user.Service, users ...TestUser) SetupFunc {
 	return func(t *DB) error {
 		for _, u := range users {
+			id, err := s.ID(u.Email)
+			if err != nil {
+				return err
+			}
+
 			err = db.StoreKeyValue(
 				t,
 				user.LoginKeys,
-				[]byte(u.Email),
+				[]byte(id),
 				user.Login{
-					util.Key(u.LoginKey),
-					time.Now().Add(user.GetTimeout()),
+					Key:     util.Key(u.LoginKey),
+					Timeout: s.Clock.Now().Add(s.Timeout),
 				},
 			)
 
@@ -41,6 +44,6 @@ func LoginUsers(d db.DB, users ...TestUser) SetupFunc {
 			}
 		}
 
-		return err
+		return nil
 	}
 }
@@ -0,0 +1,108 @@
+// Package totp implements RFC 6238 time-based one-time passwords, as used by
+// authenticator apps.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/synapse-garden/mf-proto/util"
+)
+
+const (
+	// Digits is the length of a code.
+	Digits = 6
+
+	// Period is how long each code lasts.
+	Period = 30 * time.Second
+
+	// Skew is how many periods before or after the current one a code
+	// may be from, to allow for clock drift.
+	Skew = 1
+)
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewSecret makes a new random base32-encoded secret.
+func NewSecret() (string, error) {
+	bs, err := util.RandomBytes(20)
+	if err != nil {
+		return "", err
+	}
+	return b32.EncodeToString(bs), nil
+}
+
+// Counter is the number of Periods since the Unix epoch at t.
+func Counter(t time.Time) int64 {
+	return t.Unix() / int64(Period/time.Second)
+}
+
+// CodeAt returns the code for the given secret and counter.
+func CodeAt(secret string, counter int64) (string, error) {
+	key, err := b32.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", errors.NotValidf("TOTP secret")
+	}
+
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	bin := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < Digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", Digits, bin%mod), nil
+}
+
+// Code returns the code for the given secret at t.
+func Code(secret string, t time.Time) (string, error) {
+	return CodeAt(secret, Counter(t))
+}
+
+// Check finds the counter within Skew periods of t for which code is valid,
+// and returns it.  Callers should reject codes whose counters are not greater
+// than the last one accepted, so that codes cannot be replayed.
+func Check(secret, code string, t time.Time) (int64, error) {
+	now := Counter(t)
+	for c := now - Skew; c <= now+Skew; c++ {
+		expect, err := CodeAt(secret, c)
+		if err != nil {
+			return 0, err
+		}
+		if subtle.ConstantTimeCompare([]byte(expect), []byte(code)) == 1 {
+			return c, nil
+		}
+	}
+	return 0, errors.NotValidf("code %q", code)
+}
+
+// URI returns the otpauth:// URI which authenticator apps use to enroll the
+// given account, usually shown as a QR code.
+func URI(issuer, account, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("digits", fmt.Sprint(Digits))
+	v.Set("period", fmt.Sprint(int(Period/time.Second)))
+	return (&url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: v.Encode(),
+	}).String()
+}
@@ -0,0 +1,68 @@
+package totp_test
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+
+	"github.com/synapse-garden/mf-proto/totp"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { gc.TestingT(t) }
+
+type TOTPSuite struct{}
+
+var _ = gc.Suite(&TOTPSuite{})
+
+// rfcSecret is the SHA1 seed from RFC 6238 appendix B.
+var rfcSecret = base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func (s *TOTPSuite) TestCode(c *gc.C) {
+	// The RFC's 8-digit test vectors, truncated to 6 digits.
+	for i, t := range []struct {
+		givenTime  int64
+		expectCode string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	} {
+		c.Logf("test %d: time %d", i, t.givenTime)
+		code, err := totp.Code(rfcSecret, time.Unix(t.givenTime, 0))
+		c.Assert(err, jc.ErrorIsNil)
+		c.Check(code, gc.Equals, t.expectCode)
+	}
+}
+
+func (s *TOTPSuite) TestCheck(c *gc.C) {
+	secret, err := totp.NewSecret()
+	c.Assert(err, jc.ErrorIsNil)
+
+	now := time.Unix(1452729600, 0)
+	code, err := totp.Code(secret, now)
+	c.Assert(err, jc.ErrorIsNil)
+
+	counter, err := totp.Check(secret, code, now.Add(totp.Period))
+	c.Check(err, jc.ErrorIsNil)
+	c.Check(counter, gc.Equals, totp.Counter(now))
+
+	_, err = totp.Check(secret, code, now.Add(3*totp.Period))
+	c.Check(err, gc.ErrorMatches, `code ".*" not valid`)
+
+	_, err = totp.Check("not base32!", code, now)
+	c.Check(err, gc.ErrorMatches, `TOTP secret not valid`)
+}
+
+func (s *TOTPSuite) TestURI(c *gc.C) {
+	c.Check(
+		totp.URI("Mindfork", "bob@tomato.com", "JBSWY3DPEHPK3PXP"),
+		gc.Equals,
+		"otpauth://totp/Mindfork:bob@tomato.com?digits=6&issuer=Mindfork&period=30&secret=JBSWY3DPEHPK3PXP",
+	)
+}
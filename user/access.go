@@ -0,0 +1,409 @@
+package user
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/boltdb/bolt"
+	"github.com/juju/errors"
+	"github.com/synapse-garden/mf-proto/db"
+	"github.com/synapse-garden/mf-proto/util"
+)
+
+const (
+	// AccessTokens holds personal AccessTokens by the hash of their Key.
+	AccessTokens db.Bucket = "user-access-tokens"
+
+	// AccessTokenPrefix begins every AccessToken Key, to tell them apart
+	// from login Keys.
+	AccessTokenPrefix = "mfp_"
+
+	// MaxAccessTokenTTL is the longest an AccessToken may last.
+	MaxAccessTokenTTL = 365 * 24 * time.Hour
+
+	// MaxAccessTokenName is the longest an AccessToken's name may be.
+	MaxAccessTokenName = 64
+)
+
+// Scope limits what an AccessToken may be used for.
+type Scope string
+
+const (
+	// ScopeLogin is held only by login Keys, and allows everything.
+	ScopeLogin Scope = "login"
+
+	// ScopeAll allows everything the user may do except what needs
+	// ScopeLogin, such as managing AccessTokens.
+	ScopeAll Scope = "*"
+
+	// ScopeObjectRead allows reading the user's objects.
+	ScopeObjectRead Scope = "object:read"
+
+	// ScopeObjectWrite allows reading and writing the user's objects.
+	ScopeObjectWrite Scope = "object:write"
+
+	// ScopeProfileRead allows reading the user's account and profile.
+	ScopeProfileRead Scope = "profile:read"
+
+	// ScopeProfileWrite allows reading and updating the user's profile.
+	ScopeProfileWrite Scope = "profile:write"
+)
+
+// ObjectScope returns the Scope needed to read, or write if write is true,
+// the object with the given ID.  An object's collection is the part of its
+// ID before the first ".", and a Scope such as "object:read:notes" allows
+// only the objects in that collection.
+func ObjectScope(write bool, id util.Key) Scope {
+	sc := ScopeObjectRead
+	if write {
+		sc = ScopeObjectWrite
+	}
+
+	if i := strings.Index(string(id), "."); i > 0 {
+		return sc + Scope(":"+id[:i])
+	}
+	return sc
+}
+
+// Valid returns an error if the Scope is not ScopeAll, a profile Scope or an
+// object Scope, which are the Scopes an AccessToken may have.
+func (sc Scope) Valid() error {
+	parts := strings.SplitN(string(sc), ":", 3)
+	switch {
+	case sc == ScopeAll, sc == ScopeProfileRead, sc == ScopeProfileWrite:
+		return nil
+	case len(parts) < 2 || parts[0] != "object",
+		parts[1] != "read" && parts[1] != "write",
+		len(parts) == 3 && (parts[2] == "" || strings.Contains(parts[2], ".")):
+		return errors.NotValidf("scope %q", sc)
+	}
+	return nil
+}
+
+// Grants returns true if the Scope allows the wanted Scope.  Write Scopes
+// allow reading, and Scopes without a collection allow every collection.
+func (sc Scope) Grants(want Scope) bool {
+	switch {
+	case sc == ScopeLogin, sc == want:
+		return true
+	case want == ScopeLogin:
+		return false
+	case sc == ScopeAll:
+		return true
+	}
+
+	have, wanted := strings.SplitN(string(sc), ":", 3), strings.SplitN(string(want), ":", 3)
+	switch {
+	case len(have) < 2 || len(wanted) < 2 || have[0] != wanted[0]:
+		return false
+	case have[1] != wanted[1] && !(have[1] == "write" && wanted[1] == "read"):
+		return false
+	}
+
+	return len(have) == 2 || (len(wanted) == 3 && have[2] == wanted[2])
+}
+
+// Scopes is a set of Scopes.
+type Scopes []Scope
+
+// Grants returns true if any of the Scopes allows the wanted Scope.
+func (scs Scopes) Grants(want Scope) bool {
+	for _, sc := range scs {
+		if sc.Grants(want) {
+			return true
+		}
+	}
+	return false
+}
+
+// AccessToken is a long-lived personal credential a user mints for scripts
+// and integrations, or one issued to an OAuth client on their behalf.  Only
+// the hash of its Key is stored.
+type AccessToken struct {
+	ID       string     `json:"id"`
+	User     string     `json:"user"`
+	Client   string     `json:"client,omitempty"`
+	Name     string     `json:"name"`
+	Scopes   Scopes     `json:"scopes"`
+	Created  time.Time  `json:"created"`
+	Expires  time.Time  `json:"expires"`
+	LastUsed *time.Time `json:"last_used,omitempty"`
+
+	// Key is only set when the AccessToken is created.
+	Key util.Key `json:"key,omitempty"`
+}
+
+// CreateAccessToken mints a named AccessToken for the given user which
+// lasts for ttl and allows the given Scopes.  The returned AccessToken's
+// Key cannot be recovered later.
+func (s *Service) CreateAccessToken(email, name string, ttl time.Duration, scopes ...Scope) (*AccessToken, error) {
+	uid, err := s.ID(email)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.IssueAccessToken(uid, "", name, ttl, scopes...)
+}
+
+// IssueAccessToken mints an AccessToken for the user with the given ID, on
+// behalf of the OAuth client with the given ID if it is not empty.
+func (s *Service) IssueAccessToken(uid, client, name string, ttl time.Duration, scopes ...Scope) (*AccessToken, error) {
+	if n := utf8.RuneCountInString(name); n == 0 || n > MaxAccessTokenName {
+		return nil, errors.NotValidf("access token name %q", name)
+	}
+
+	if ttl <= 0 || ttl > MaxAccessTokenTTL {
+		return nil, errors.NotValidf("access token lifetime %s", ttl)
+	}
+
+	if len(scopes) == 0 {
+		return nil, errors.NotValidf("access token without scopes")
+	}
+	for _, sc := range scopes {
+		if err := sc.Valid(); err != nil {
+			return nil, err
+		}
+	}
+
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := util.NewKey()
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.Clock.Now()
+	t := &AccessToken{
+		ID:      id,
+		User:    uid,
+		Client:  client,
+		Name:    name,
+		Scopes:  scopes,
+		Created: now,
+		Expires: now.Add(ttl),
+	}
+
+	if err := db.StoreKeyValue(
+		s.DB, AccessTokens, []byte(util.HashKey(AccessTokenPrefix+key)), t,
+	); err != nil {
+		return nil, err
+	}
+
+	t.Key = AccessTokenPrefix + key
+	return t, nil
+}
+
+// AccessTokens returns the given user's AccessTokens, including expired
+// ones, without their Keys.
+func (s *Service) AccessTokens(email string) ([]*AccessToken, error) {
+	uid, err := s.ID(email)
+	if err != nil {
+		return nil, err
+	}
+
+	var ts []*AccessToken
+	err = s.eachAccessToken(func(b *bolt.Bucket, k []byte, t *AccessToken) error {
+		if t.User == uid {
+			ts = append(ts, t)
+		}
+		return nil
+	})
+	return ts, err
+}
+
+// RevokeAccessToken deletes the given user's AccessToken with the given ID.
+func (s *Service) RevokeAccessToken(email, id string) error {
+	uid, err := s.ID(email)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	err = s.eachAccessToken(func(b *bolt.Bucket, k []byte, t *AccessToken) error {
+		if t.User != uid || t.ID != id {
+			return nil
+		}
+		found = true
+		return b.Delete(k)
+	})
+	switch {
+	case err != nil:
+		return err
+	case !found:
+		return errors.NotFoundf("access token %q", id)
+	}
+	return nil
+}
+
+// ValidAccessToken returns the given user's AccessToken with the given Key
+// if it has not expired, and records its use.
+func (s *Service) ValidAccessToken(email string, key util.Key) (*AccessToken, error) {
+	uid, err := s.ID(email)
+	if err != nil {
+		return nil, errors.NotValidf("bad key for user %q", email)
+	}
+
+	t, err := s.ValidAccessKey(key)
+	switch {
+	case errors.IsNotValid(err):
+		return nil, errors.NotValidf("bad key for user %q", email)
+	case err != nil:
+		return nil, err
+	case t.User != uid:
+		return nil, errors.NotValidf("bad key for user %q", email)
+	}
+	return t, nil
+}
+
+// ValidAccessKey returns the AccessToken with the given Key if it has not
+// expired and its user is not disabled, and records its use.
+func (s *Service) ValidAccessKey(key util.Key) (*AccessToken, error) {
+	var t *AccessToken
+	err := s.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(AccessTokens))
+		if b == nil {
+			return db.BucketNotFoundErr(AccessTokens)
+		}
+
+		hash := []byte(util.HashKey(key))
+		bs := b.Get(hash)
+		if len(bs) == 0 {
+			return errors.NotValidf("access token")
+		}
+
+		t = new(AccessToken)
+		if err := json.Unmarshal(bs, t); err != nil {
+			return err
+		}
+
+		now := s.Clock.Now()
+		if !now.Before(t.Expires) {
+			return errors.Unauthorizedf("access token %q expired", t.Name)
+		}
+
+		u := new(User)
+		if err := json.Unmarshal(tx.Bucket([]byte(Users)).Get([]byte(t.User)), u); err != nil {
+			return errors.NotValidf("access token")
+		}
+		if err := u.enabled(); err != nil {
+			return err
+		}
+
+		t.LastUsed = &now
+		bs, err := json.Marshal(t)
+		if err != nil {
+			return err
+		}
+		return b.Put(hash, bs)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// RevokeClientKey deletes the AccessToken with the given Key if it was
+// issued to the OAuth client with the given ID.  It is not an error if
+// there is none.
+func (s *Service) RevokeClientKey(client string, key util.Key) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(AccessTokens))
+		if b == nil {
+			return db.BucketNotFoundErr(AccessTokens)
+		}
+
+		hash := []byte(util.HashKey(key))
+		bs := b.Get(hash)
+		if len(bs) == 0 {
+			return nil
+		}
+
+		t := new(AccessToken)
+		if err := json.Unmarshal(bs, t); err != nil {
+			return err
+		}
+		if t.Client != client {
+			return nil
+		}
+		return b.Delete(hash)
+	})
+}
+
+// RevokeClientTokens deletes every AccessToken issued to the OAuth client
+// with the given ID.
+func (s *Service) RevokeClientTokens(client string) error {
+	return s.eachAccessToken(func(b *bolt.Bucket, k []byte, t *AccessToken) error {
+		if t.Client == client {
+			return b.Delete(k)
+		}
+		return nil
+	})
+}
+
+// ValidKey checks a login Key or AccessToken Key for the given user, and
+// returns the Scopes it allows.  Login Keys allow ScopeLogin.
+func (s *Service) ValidKey(email string, key util.Key) (Scopes, error) {
+	if !strings.HasPrefix(string(key), AccessTokenPrefix) {
+		if err := s.ValidLogin(email, key); err != nil {
+			return nil, err
+		}
+		return Scopes{ScopeLogin}, nil
+	}
+
+	t, err := s.ValidAccessToken(email, key)
+	if err != nil {
+		return nil, err
+	}
+	return t.Scopes, nil
+}
+
+// deleteAccessTokens deletes every AccessToken of the user with the given ID.
+func (s *Service) deleteAccessTokens(uid string) error {
+	return s.eachAccessToken(func(b *bolt.Bucket, k []byte, t *AccessToken) error {
+		if t.User == uid {
+			return b.Delete(k)
+		}
+		return nil
+	})
+}
+
+// eachAccessToken calls fn with each AccessToken in one transaction.  fn
+// may delete the AccessToken it is given.
+func (s *Service) eachAccessToken(fn func(*bolt.Bucket, []byte, *AccessToken) error) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(AccessTokens))
+		if b == nil {
+			return db.BucketNotFoundErr(AccessTokens)
+		}
+
+		type entry struct {
+			k []byte
+			t *AccessToken
+		}
+		var es []entry
+		err := b.ForEach(func(k, v []byte) error {
+			t := new(AccessToken)
+			if err := json.Unmarshal(v, t); err != nil {
+				return err
+			}
+			es = append(es, entry{append([]byte(nil), k...), t})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, e := range es {
+			if err := fn(b, e.k, e.t); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,190 @@
+package user_test
+
+import (
+	"strings"
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	"github.com/synapse-garden/mf-proto/user"
+	"github.com/synapse-garden/mf-proto/util"
+
+	gc "gopkg.in/check.v1"
+)
+
+func (s *UserSuite) TestScopeGrants(c *gc.C) {
+	for i, t := range []struct {
+		should string
+		given  user.Scope
+		want   user.Scope
+		expect bool
+	}{{
+		should: "grant everything but login with *",
+		given:  user.ScopeAll,
+		want:   user.ObjectScope(true, "notes.1"),
+		expect: true,
+	}, {
+		should: "not grant login with *",
+		given:  user.ScopeAll,
+		want:   user.ScopeLogin,
+	}, {
+		should: "grant everything with login",
+		given:  user.ScopeLogin,
+		want:   user.ScopeLogin,
+		expect: true,
+	}, {
+		should: "grant reading with write",
+		given:  user.ScopeObjectWrite,
+		want:   user.ObjectScope(false, "1"),
+		expect: true,
+	}, {
+		should: "not grant writing with read",
+		given:  user.ScopeObjectRead,
+		want:   user.ObjectScope(true, "1"),
+	}, {
+		should: "grant any collection without one",
+		given:  user.ScopeObjectRead,
+		want:   user.ObjectScope(false, "notes.1"),
+		expect: true,
+	}, {
+		should: "grant the scope's collection",
+		given:  "object:write:notes",
+		want:   user.ObjectScope(false, "notes.1"),
+		expect: true,
+	}, {
+		should: "not grant another collection",
+		given:  "object:write:notes",
+		want:   user.ObjectScope(false, "photos.1"),
+	}, {
+		should: "not grant objects outside any collection",
+		given:  "object:read:notes",
+		want:   user.ObjectScope(false, "notes"),
+	}, {
+		should: "grant profile reading with profile write",
+		given:  user.ScopeProfileWrite,
+		want:   user.ScopeProfileRead,
+		expect: true,
+	}, {
+		should: "not grant objects with profile write",
+		given:  user.ScopeProfileWrite,
+		want:   user.ObjectScope(false, "1"),
+	}} {
+		c.Logf("test %d: should %s", i, t.should)
+		c.Check(t.given.Grants(t.want), gc.Equals, t.expect)
+	}
+}
+
+func (s *UserSuite) TestCreateAccessToken(c *gc.C) {
+	s.createUsers(c)
+	email := s.users["bob"].Email
+
+	for i, t := range []struct {
+		should      string
+		name        string
+		ttl         time.Duration
+		scopes      []user.Scope
+		expectError string
+	}{{
+		should: "make a token",
+		name:   "backup script",
+		ttl:    24 * time.Hour,
+		scopes: []user.Scope{user.ScopeObjectRead, "object:write:notes"},
+	}, {
+		should:      "not make a token without a name",
+		ttl:         time.Hour,
+		scopes:      []user.Scope{user.ScopeAll},
+		expectError: `access token name "" not valid`,
+	}, {
+		should:      "not make a token which never expires",
+		name:        "forever",
+		scopes:      []user.Scope{user.ScopeAll},
+		expectError: `access token lifetime 0s not valid`,
+	}, {
+		should:      "not make a token without scopes",
+		name:        "useless",
+		ttl:         time.Hour,
+		expectError: `access token without scopes not valid`,
+	}, {
+		should:      "not make a token with login scope",
+		name:        "sneaky",
+		ttl:         time.Hour,
+		scopes:      []user.Scope{user.ScopeLogin},
+		expectError: `scope "login" not valid`,
+	}} {
+		c.Logf("test %d: should %s", i, t.should)
+		tok, err := s.svc.CreateAccessToken(email, t.name, t.ttl, t.scopes...)
+		if t.expectError != "" {
+			c.Check(err, gc.ErrorMatches, t.expectError)
+			continue
+		}
+		c.Assert(err, jc.ErrorIsNil)
+		c.Check(strings.HasPrefix(string(tok.Key), user.AccessTokenPrefix), jc.IsTrue)
+		c.Check(tok.Expires, gc.Equals, s.clock.Now().Add(t.ttl))
+
+		scs, err := s.svc.ValidKey(email, tok.Key)
+		c.Assert(err, jc.ErrorIsNil)
+		c.Check(scs, jc.DeepEquals, user.Scopes(t.scopes))
+	}
+}
+
+func (s *UserSuite) TestAccessTokens(c *gc.C) {
+	s.createUsers(c)
+	bob, larry := s.users["bob"].Email, s.users["larry"].Email
+
+	tok, err := s.svc.CreateAccessToken(bob, "ci", time.Hour, user.ScopeObjectRead)
+	c.Assert(err, jc.ErrorIsNil)
+
+	// Tokens outlast login timeouts, and only work for their own user.
+	s.clock.Advance(30 * time.Minute)
+	_, err = s.svc.ValidKey(bob, tok.Key)
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = s.svc.ValidKey(larry, tok.Key)
+	c.Check(err, gc.ErrorMatches, `bad key for user "larry@cucumber.net" not valid`)
+	_, err = s.svc.ValidKey(bob, tok.Key+"0")
+	c.Check(err, gc.ErrorMatches, `bad key for user "bob@tomato.com" not valid`)
+
+	ts, err := s.svc.AccessTokens(bob)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(ts, gc.HasLen, 1)
+	c.Check(ts[0].Key, gc.Equals, util.Key(""))
+	c.Check(ts[0].Name, gc.Equals, "ci")
+	c.Assert(ts[0].LastUsed, gc.NotNil)
+	c.Check(*ts[0].LastUsed, gc.Equals, s.clock.Now())
+
+	ts, err = s.svc.AccessTokens(larry)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(ts, gc.HasLen, 0)
+
+	s.clock.Advance(30 * time.Minute)
+	_, err = s.svc.ValidKey(bob, tok.Key)
+	c.Check(err, gc.ErrorMatches, `access token "ci" expired`)
+
+	c.Check(s.svc.RevokeAccessToken(larry, tok.ID), gc.ErrorMatches, `access token ".*" not found`)
+	c.Assert(s.svc.RevokeAccessToken(bob, tok.ID), jc.ErrorIsNil)
+	ts, err = s.svc.AccessTokens(bob)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(ts, gc.HasLen, 0)
+}
+
+func (s *UserSuite) TestValidKeyLogin(c *gc.C) {
+	s.createUsers(c)
+	email := s.users["bob"].Email
+	login, err := s.svc.LoginUser(email, s.users["bob"].Pwhash)
+	c.Assert(err, jc.ErrorIsNil)
+
+	scs, err := s.svc.ValidKey(email, login.Key)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(scs, jc.DeepEquals, user.Scopes{user.ScopeLogin})
+}
+
+func (s *UserSuite) TestDeleteUserAccessTokens(c *gc.C) {
+	s.createUsers(c)
+	email := s.users["bob"].Email
+
+	tok, err := s.svc.CreateAccessToken(email, "ci", time.Hour, user.ScopeAll)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(s.svc.Delete(email), jc.ErrorIsNil)
+	c.Assert(s.svc.Create(email, "new-password"), jc.ErrorIsNil)
+
+	_, err = s.svc.ValidKey(email, tok.Key)
+	c.Check(err, gc.ErrorMatches, `bad key for user "bob@tomato.com" not valid`)
+}
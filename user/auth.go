@@ -2,52 +2,55 @@ package user
 
 import (
 	"encoding/json"
-	"fmt"
-	"sync"
 	"time"
 
 	"github.com/juju/errors"
 	"github.com/synapse-garden/mf-proto/db"
+	"github.com/synapse-garden/mf-proto/jwt"
 	"github.com/synapse-garden/mf-proto/util"
 )
 
 const (
+	// LoginKeys holds each user's Login by their ID.
 	LoginKeys db.Bucket = "user-login-keys"
 )
 
-var timeout = struct {
-	t time.Duration
-	sync.RWMutex
-}{t: time.Duration(5) * time.Minute}
-
-func GetTimeout() time.Duration {
-	timeout.RLock()
-	defer timeout.RUnlock()
-	return timeout.t
-}
-
-func SetTimeout(t time.Duration) {
-	timeout.Lock()
-	defer timeout.Unlock()
-	timeout.t = t
-}
-
 type Login struct {
 	Key     util.Key  `json:"key,omitempty"`
 	Timeout time.Time `json:"timeout,omitempty"`
+
+	// Pending is set if the user has yet to give their second factor.
+	Pending bool `json:"pending,omitempty"`
 }
 
-func ValidLogin(d db.DB, email string, key util.Key) error {
-	login, err := GetLogin(d, email)
+// ValidLogin returns nil if key is the user's current login.  Stored logins
+// time out after going unused for the Service's Timeout; JWT logins are
+// checked without using the DB.  Disabled users have neither.
+func (s *Service) ValidLogin(email string, key util.Key) error {
+	if jwt.Is(string(key)) {
+		_, err := s.parseJWTLogin(email, key)
+		return err
+	}
+
+	login, err := s.GetLogin(email)
 	if err != nil {
 		return errors.NotValidf("could not get login for email %q", email)
 	}
 
 	if login.Key == key {
-		t := time.Now()
+		if login.Pending {
+			return errors.NotValidf("login for %q awaiting second factor", email)
+		}
+		if err := s.enabled(email); err != nil {
+			return err
+		}
+
+		t := s.Clock.Now()
 		if t.Before(login.Timeout) {
-			err = db.StoreKeyValue(d, LoginKeys, []byte(email), Login{key, t.Add(GetTimeout())})
-			return nil
+			return s.putLogin(email, &Login{
+				Key:     key,
+				Timeout: t.Add(s.Timeout),
+			})
 		}
 		return errors.NotValidf("user %q timed out", email)
 	}
@@ -55,51 +58,207 @@ func ValidLogin(d db.DB, email string, key util.Key) error {
 	return errors.NotValidf("bad key %q for user %q", key, email)
 }
 
-func LogoutUser(d db.DB, email string, key util.Key) error {
-	err := ValidLogin(d, email, key)
+// LogoutUser ends the login with the given key of the user with the given
+// ID, whose login the caller has checked.
+func (s *Service) LogoutUser(id string, key util.Key) error {
+	u, err := s.GetByID(id)
 	if err != nil {
 		return err
 	}
 
-	return ClearLogin(d, email)
-}
+	if jwt.Is(string(key)) {
+		l, err := s.parseJWTLogin(u.Email, key)
+		if err != nil {
+			return err
+		}
+		return s.revokeJWT(l)
+	}
 
-func LoginUser(d db.DB, email, pwhash string) (util.Key, error) {
-	if err := CheckUser(d, email, pwhash); err != nil {
-		return "", err
+	// Other keys with ScopeLogin, such as an admin's impersonation key,
+	// are not the user's login.
+	switch login, err := s.GetLogin(u.Email); {
+	case err != nil:
+		return err
+	case login.Key != key:
+		return errors.NotFoundf("login for key")
 	}
 
-	key := util.SaltedHash(pwhash, time.Now().String())
-	timeout := time.Now().Add(GetTimeout())
+	return s.ClearLogin(u.Email)
+}
+
+// LoginUser checks the user's password and logs them in.  If the user has
+// two-factor authentication enabled, the returned Login is Pending, and its
+// Key must be passed to CompleteLogin along with a code before it can be used.
+func (s *Service) LoginUser(email, pwhash string) (*Login, error) {
+	return s.LoginUserFrom("", email, pwhash)
+}
+
+// LoginUserFrom is LoginUser for a request from the given address, whose
+// failed logins are also throttled.  The account's failures are only
+// forgotten once the login is complete, so a Pending Login doesn't clear
+// them.
+func (s *Service) LoginUserFrom(addr, email, pwhash string) (*Login, error) {
+	if err := s.checkPassword(addr, email, pwhash); err != nil {
+		return nil, err
+	}
 
-	err := db.StoreKeyValue(
-		d,
-		LoginKeys,
-		[]byte(email),
-		Login{key, timeout},
-	)
+	u, err := s.Get(email)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	if u.Unverified {
+		return nil, errors.Unauthorizedf("user %q has not verified their email", email)
+	}
+
+	if err := u.enabled(); err != nil {
+		return nil, err
+	}
+
+	if u.TOTP.Active() {
+		return s.newLogin(email, true)
+	}
+
+	if err := s.touchLogin(u); err != nil {
+		return nil, err
 	}
 
-	return key, nil
+	if err := s.Succeed(email); err != nil {
+		return nil, err
+	}
+
+	return s.newLogin(email, false)
 }
 
-func CheckUser(d db.DB, email, pwhash string) error {
-	u, err := Get(d, email)
+// newLogin stores and returns a new Login for the given user, replacing any
+// existing Login.  If the Service uses JWT logins, a complete Login is a
+// JWT instead.
+func (s *Service) newLogin(email string, pending bool) (*Login, error) {
+	if !pending && s.JWTAlg != "" {
+		if _, err := s.GetLogin(email); err == nil {
+			if err := s.ClearLogin(email); err != nil {
+				return nil, err
+			}
+		}
+		return s.newJWTLogin(email)
+	}
+
+	key, err := util.NewKey()
 	if err != nil {
+		return nil, err
+	}
+
+	login := &Login{
+		Key:     key,
+		Timeout: s.Clock.Now().Add(s.Timeout),
+		Pending: pending,
+	}
+
+	if err := s.putLogin(email, login); err != nil {
+		return nil, err
+	}
+
+	return login, nil
+}
+
+// CheckUser returns nil if pwhash is the user's password.  Failures are
+// throttled, and the same error is returned whether the user does not exist
+// or the password is wrong.
+func (s *Service) CheckUser(email, pwhash string) error {
+	return s.CheckUserFrom("", email, pwhash)
+}
+
+// CheckUserFrom is CheckUser for a request from the given address, whose
+// failures are also throttled.  A good password forgets the account's
+// failed passwords, but not its failed second factors, which only a
+// complete login forgets.
+func (s *Service) CheckUserFrom(addr, email, pwhash string) error {
+	if err := s.checkPassword(addr, email, pwhash); err != nil {
+		return err
+	}
+	return db.DeleteByKey(s.DB, Attempts, accountKey(email))
+}
+
+// checkPassword checks the user's password, throttled as Check does.
+func (s *Service) checkPassword(addr, email, pwhash string) error {
+	return s.Check(addr, email, func() (bool, error) {
+		u, err := s.Get(email)
+		switch {
+		case errors.IsUserNotFound(err):
+			// Take as long as a real check would.
+			util.CheckHashedPw(pwhash, "", "")
+			return false, nil
+		case err != nil:
+			return false, err
+		}
+		return util.CheckHashedPw(pwhash, u.Salt, u.Hash), nil
+	})
+}
+
+// Check throttles a password login for the given account from the given
+// address, which check says is good or not.  Accounts other than users',
+// such as admins', may be checked with a prefix which can't begin an email,
+// and are unlocked in the same way.  A bad login is the same error however
+// it was bad.  The account's failures are not forgotten until Succeed is
+// called for it, once its login is complete.
+func (s *Service) Check(addr, account string, check func() (bool, error)) error {
+	return s.check(addr, account, check, s.fail)
+}
+
+// CheckFactor is Check for the second factor of a login whose password was
+// good.  Its failures are counted apart from failed passwords, and also
+// lock the account.
+func (s *Service) CheckFactor(addr, account string, check func() (bool, error)) error {
+	return s.check(addr, account, check, s.failFactor)
+}
+
+func (s *Service) check(
+	addr, account string,
+	check func() (bool, error),
+	fail func(account, addr string) error,
+) error {
+	if err := s.throttled(loginKeys(addr, account)...); err != nil {
+		return err
+	}
+
+	switch ok, err := check(); {
+	case err != nil:
 		return err
+	case ok:
+		return nil
 	}
 
-	if ok := util.CheckHashedPw(pwhash, u.Salt, u.Hash); !ok {
-		return fmt.Errorf("invalid password")
+	if err := fail(account, addr); err != nil {
+		return err
 	}
 
-	return nil
+	return errBadLogin()
+}
+
+// loginID returns the ID the given user's Login is kept by.
+func (s *Service) loginID(email string) ([]byte, error) {
+	id, err := s.ID(email)
+	if errors.IsUserNotFound(err) {
+		return nil, errors.UserNotFoundf("user %q not logged in: ", email)
+	}
+	return []byte(id), err
 }
 
-func GetLogin(d db.DB, email string) (*Login, error) {
-	loginBytes, err := db.GetByKey(d, LoginKeys, []byte(email))
+func (s *Service) putLogin(email string, login *Login) error {
+	id, err := s.loginID(email)
+	if err != nil {
+		return err
+	}
+	return db.StoreKeyValue(s.DB, LoginKeys, id, login)
+}
+
+func (s *Service) GetLogin(email string) (*Login, error) {
+	id, err := s.loginID(email)
+	if err != nil {
+		return nil, err
+	}
+
+	loginBytes, err := db.GetByKey(s.DB, LoginKeys, id)
 	if err != nil {
 		return nil, err
 	}
@@ -116,20 +275,20 @@ func GetLogin(d db.DB, email string) (*Login, error) {
 	return login, nil
 }
 
-func ClearLogin(d db.DB, email string) error {
-	loginBytes, err := db.GetByKey(d, LoginKeys, []byte(email))
+func (s *Service) ClearLogin(email string) error {
+	id, err := s.loginID(email)
 	if err != nil {
 		return err
 	}
 
-	if len(loginBytes) == 0 {
-		return errors.UserNotFoundf("user %q not logged in: ", email)
+	loginBytes, err := db.GetByKey(s.DB, LoginKeys, id)
+	if err != nil {
+		return err
 	}
 
-	login := &Login{}
-	if err = json.Unmarshal(loginBytes, &login); err != nil {
-		return err
+	if len(loginBytes) == 0 {
+		return errors.UserNotFoundf("user %q not logged in: ", email)
 	}
 
-	return db.DeleteByKey(d, LoginKeys, []byte(email))
+	return db.DeleteByKey(s.DB, LoginKeys, id)
 }
@@ -2,7 +2,6 @@ package user_test
 
 import (
 	"encoding/json"
-	"fmt"
 	"time"
 
 	jc "github.com/juju/testing/checkers"
@@ -25,7 +24,7 @@ func (s *UserSuite) TestLoginUser(c *gc.C) {
 	}, {
 		should:      "not log in a nonexistent user",
 		user:        t.TestUser{Email: "jove@olympus.mons", Pwhash: "1000"},
-		expectError: `"jove@olympus.mons" user not found`,
+		expectError: `invalid email or password`,
 	}} {
 		c.Logf("test %d: should %s", i, t.should)
 		if t.expectError == "" {
@@ -40,12 +39,17 @@ func (s *UserSuite) testLogins(u t.TestUser, c *gc.C) error {
 	s.createUsers(c)
 	defer s.deleteUsers(c)
 
-	key, err := user.LoginUser(s.d, u.Email, u.Pwhash)
+	l, err := s.svc.LoginUser(u.Email, u.Pwhash)
 	if err != nil {
 		return err
 	}
 
-	userBytes, err := db.GetByKey(s.d, user.LoginKeys, []byte(u.Email))
+	id, err := s.svc.ID(u.Email)
+	if err != nil {
+		return err
+	}
+
+	userBytes, err := db.GetByKey(s.d, user.LoginKeys, []byte(id))
 	if err != nil {
 		return err
 	}
@@ -58,15 +62,16 @@ func (s *UserSuite) testLogins(u t.TestUser, c *gc.C) error {
 		return err
 	}
 
-	c.Assert(login.Key, gc.Equals, key)
+	c.Assert(login.Key, gc.Equals, l.Key)
 	return nil
 }
 
 func (s *UserSuite) TestValidUser(c *gc.C) {
 	s.createUsers(c)
 	b := s.users["bob"]
-	key, err := user.LoginUser(s.d, b.Email, b.Pwhash)
+	login, err := s.svc.LoginUser(b.Email, b.Pwhash)
 	c.Assert(err, jc.ErrorIsNil)
+	key := login.Key
 	s.users["bob"] = t.TestUser{
 		Email:    b.Email,
 		LoginKey: string(key),
@@ -75,7 +80,7 @@ func (s *UserSuite) TestValidUser(c *gc.C) {
 	for i, t := range []struct {
 		should      string
 		user        t.TestUser
-		pause       int
+		advance     time.Duration
 		expectError string
 	}{{
 		should: "validate an existing login",
@@ -88,24 +93,32 @@ func (s *UserSuite) TestValidUser(c *gc.C) {
 		should:      "not validate a nonexistent user",
 		user:        t.TestUser{Email: "jove@olympus.mons", LoginKey: "foo"},
 		expectError: `could not get login for email "jove@olympus.mons" not valid`,
+	}, {
+		should:  "validate a login used before it times out",
+		advance: 40 * time.Millisecond,
+		user:    s.users["bob"],
+	}, {
+		should:  "slide the timeout of a login each time it is used",
+		advance: 40 * time.Millisecond,
+		user:    s.users["bob"],
 	}, {
 		should:      "not validate a timed-out user",
-		pause:       80,
+		advance:     80 * time.Millisecond,
 		user:        s.users["bob"],
 		expectError: `user "bob@tomato.com" timed out not valid`,
 	}} {
 		c.Logf("test %d: should %s", i, t.should)
 		if t.expectError == "" {
-			c.Check(s.testValidate(t.user, t.pause, c), jc.ErrorIsNil)
+			c.Check(s.testValidate(t.user, t.advance, c), jc.ErrorIsNil)
 		} else {
-			c.Check(s.testValidate(t.user, t.pause, c), gc.ErrorMatches, t.expectError)
+			c.Check(s.testValidate(t.user, t.advance, c), gc.ErrorMatches, t.expectError)
 		}
 	}
 }
 
-func (s *UserSuite) testValidate(u t.TestUser, pause int, c *gc.C) error {
-	<-time.NewTimer(timeout(pause)).C
-	err := user.ValidLogin(s.d, u.Email, util.Key(u.LoginKey))
+func (s *UserSuite) testValidate(u t.TestUser, advance time.Duration, c *gc.C) error {
+	s.clock.Advance(advance)
+	err := s.svc.ValidLogin(u.Email, util.Key(u.LoginKey))
 	if err != nil {
 		return err
 	}
@@ -115,59 +128,19 @@ func (s *UserSuite) testValidate(u t.TestUser, pause int, c *gc.C) error {
 
 func (s *UserSuite) TestLogoutUser(c *gc.C) {
 	s.createUsers(c)
+	b, l := s.users["bob"], s.users["larry"]
+	bobID, larryID := mustID(s.svc, b.Email, c), mustID(s.svc, l.Email, c)
 
-	for i, t := range []struct {
-		should      string
-		login       bool
-		user        t.TestUser
-		key         util.Key
-		expectError string
-	}{{
-		should: "log out a logged-in user",
-		login:  true,
-		user:   s.users["bob"],
-	}, {
-		should:      "not logout a logged-out user",
-		user:        s.users["larry"],
-		key:         "12345",
-		expectError: `could not get login for email "larry@cucumber.net" not valid`,
-	}, {
-		should:      "not logout a nonexistent user",
-		user:        t.TestUser{Email: "jove@olympus.mons"},
-		key:         "12345",
-		expectError: `could not get login for email "jove@olympus.mons" not valid`,
-	}} {
-		c.Logf("test %d: should %s", i, t.should)
+	key := mustLoginAs(s.svc, b, c)
+	c.Check(s.svc.LogoutUser("nobody", key), gc.ErrorMatches, `nobody user not found`)
 
-		if t.expectError == "" {
-			c.Check(s.logoutTests(t.user, t.key, t.login, c), jc.ErrorIsNil)
-		} else {
-			c.Check(s.logoutTests(t.user, t.key, t.login, c), gc.ErrorMatches, t.expectError)
-		}
-	}
-}
+	// Only the login's own key ends it.
+	c.Check(s.svc.LogoutUser(bobID, "12345"), gc.ErrorMatches, `login for key not found`)
+	c.Check(s.svc.ValidLogin(b.Email, key), jc.ErrorIsNil)
 
-func (s *UserSuite) logoutTests(u t.TestUser, key util.Key, login bool, c *gc.C) error {
-	if login {
-		key, err := user.LoginUser(s.d, u.Email, u.Pwhash)
-		c.Assert(err, jc.ErrorIsNil)
-		u = t.TestUser{
-			Email:    u.Email,
-			Pwhash:   u.Pwhash,
-			LoginKey: string(key),
-		}
-	}
+	c.Assert(s.svc.LogoutUser(bobID, key), jc.ErrorIsNil)
+	c.Check(s.svc.ValidLogin(b.Email, key), gc.NotNil)
+	c.Check(s.svc.LogoutUser(bobID, key), gc.ErrorMatches, `user "bob@tomato.com" not logged in: +user not found`)
 
-	if key != util.Key("") {
-		u.LoginKey = string(key)
-	}
-
-	err := user.LogoutUser(s.d, u.Email, util.Key(u.LoginKey))
-	if err != nil {
-		return err
-	}
-
-	err = user.LogoutUser(s.d, u.Email, util.Key(u.LoginKey))
-	c.Assert(err, gc.ErrorMatches, fmt.Sprintf("could not get login for email %q not valid", u.Email))
-	return nil
+	c.Check(s.svc.LogoutUser(larryID, "12345"), gc.ErrorMatches, `user "larry@cucumber.net" not logged in: +user not found`)
 }
@@ -7,6 +7,7 @@ import (
 	jc "github.com/juju/testing/checkers"
 	t "github.com/synapse-garden/mf-proto/testing"
 	"github.com/synapse-garden/mf-proto/user"
+	"github.com/synapse-garden/mf-proto/util"
 
 	gc "gopkg.in/check.v1"
 )
@@ -16,15 +17,13 @@ func Test(t *testing.T) { gc.TestingT(t) }
 
 type UserSuite struct {
 	d     *t.DB
+	clock *t.Clock
+	svc   *user.Service
 	users map[string]t.TestUser
 }
 
 var _ = gc.Suite(&UserSuite{})
 
-func timeout(t int) time.Duration {
-	return time.Duration(t) * time.Millisecond
-}
-
 func (s *UserSuite) SetUpTest(c *gc.C) {
 	d, err := t.NewDB(
 		t.SetupBolt("test.db"),
@@ -42,25 +41,43 @@ func (s *UserSuite) SetUpTest(c *gc.C) {
 			Pwhash: "54321",
 		},
 	}
-	user.SetTimeout(time.Duration(50) * time.Millisecond)
+	s.clock = t.NewClock(time.Date(2016, 1, 14, 0, 0, 0, 0, time.UTC))
+	s.svc = user.NewService(
+		s.d,
+		user.WithClock(s.clock),
+		user.WithTimeout(time.Duration(50)*time.Millisecond),
+	)
 }
 
 func (s *UserSuite) TearDownTest(c *gc.C) {
 	s.users = nil
 	c.Assert(t.CleanupDB(s.d), jc.ErrorIsNil)
-	user.SetTimeout(time.Duration(5) * time.Minute)
 }
 
 func (s *UserSuite) createUsers(c *gc.C) {
 	for _, u := range s.users {
-		err := user.Create(s.d, u.Email, u.Pwhash)
+		err := s.svc.Create(u.Email, u.Pwhash)
 		c.Assert(err, jc.ErrorIsNil)
 	}
 }
 
 func (s *UserSuite) deleteUsers(c *gc.C) {
 	for _, u := range s.users {
-		err := user.Delete(s.d, u.Email)
+		err := s.svc.Delete(u.Email)
 		c.Assert(err, jc.ErrorIsNil)
 	}
 }
+
+// mustLogin logs in the given user with "good password" and returns the key.
+func mustLogin(svc *user.Service, email string, c *gc.C) util.Key {
+	l, err := svc.LoginUser(email, "good password")
+	c.Assert(err, jc.ErrorIsNil)
+	return l.Key
+}
+
+// mustID returns the ID of the user with the given email.
+func mustID(svc *user.Service, email string, c *gc.C) string {
+	id, err := svc.ID(email)
+	c.Assert(err, jc.ErrorIsNil)
+	return id
+}
@@ -0,0 +1,136 @@
+package user
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+	"github.com/juju/errors"
+	"github.com/synapse-garden/mf-proto/db"
+	"github.com/synapse-garden/mf-proto/mail"
+)
+
+// RequestEmailChange mails the new address of the user with the given ID,
+// whose login the caller has checked, a link containing a single-use token
+// which changes their email to it, and tells their old address about the
+// change.  The user must give their password.
+func (s *Service) RequestEmailChange(id, pwhash, newEmail string) error {
+	if s.Mailer == nil {
+		return errors.NotProvisionedf("mailer")
+	}
+
+	u, err := s.GetByID(id)
+	if err != nil {
+		return err
+	}
+	email := u.Email
+
+	if err := s.CheckUser(email, pwhash); err != nil {
+		return err
+	}
+
+	if err := ValidEmail(newEmail); err != nil {
+		return err
+	}
+
+	switch _, err := s.ID(newEmail); {
+	case err == nil:
+		return errors.AlreadyExistsf("user for email %q", newEmail)
+	case !errors.IsUserNotFound(err):
+		return err
+	}
+
+	tok, err := s.issueToken(PurposeEmail, u.ID, newEmail, s.VerifyTTL)
+	if err != nil {
+		return err
+	}
+
+	err = s.Mailer.Send(mail.Message{
+		From:    s.MailFrom,
+		To:      newEmail,
+		Subject: "Confirm your new Mindfork email",
+		Body: fmt.Sprintf(
+			"Visit the following link to use this address for "+
+				"your account:\n\n%s\n\n"+
+				"This link expires in %s.  If you did not ask for "+
+				"this, you can ignore this email.\n",
+			linkTo(s.EmailURL, tok), s.VerifyTTL,
+		),
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.Mailer.Send(mail.Message{
+		From:    s.MailFrom,
+		To:      email,
+		Subject: "Your Mindfork email is changing",
+		Body: fmt.Sprintf(
+			"Someone asked to change the email for this account to "+
+				"%s.  It will change once they follow the link "+
+				"sent there.  If this wasn't you, change your "+
+				"password.\n",
+			newEmail,
+		),
+	})
+}
+
+// ChangeEmail redeems a token sent by RequestEmailChange and changes its
+// user's email to the one it was sent to, returning the new email.  The
+// user keeps their ID, login and objects.
+func (s *Service) ChangeEmail(tok string) (string, error) {
+	t, err := s.redeemToken(PurposeEmail, tok)
+	if err != nil {
+		return "", err
+	}
+
+	var old string
+	err = s.DB.Update(func(tx *bolt.Tx) error {
+		es, us := tx.Bucket([]byte(Emails)), tx.Bucket([]byte(Users))
+		switch {
+		case es == nil:
+			return db.BucketNotFoundErr(Emails)
+		case us == nil:
+			return db.BucketNotFoundErr(Users)
+		case len(es.Get([]byte(t.Email))) != 0:
+			return errors.AlreadyExistsf("user for email %q", t.Email)
+		}
+
+		bs := us.Get([]byte(t.ID))
+		if len(bs) == 0 {
+			return errors.UserNotFoundf("%s", t.ID)
+		}
+
+		u := new(User)
+		if err := json.Unmarshal(bs, u); err != nil {
+			return err
+		}
+
+		if err := es.Delete([]byte(u.Email)); err != nil {
+			return err
+		}
+		if err := es.Put([]byte(t.Email), []byte(u.ID)); err != nil {
+			return err
+		}
+
+		// Receiving the token proves the user owns the address.
+		old = u.Email
+		u.Email = t.Email
+		u.Unverified = false
+		if bs, err = json.Marshal(u); err != nil {
+			return err
+		}
+		return us.Put([]byte(u.ID), bs)
+	})
+	if err != nil {
+		return "", errors.Annotatef(err, "changing email to %q failed", t.Email)
+	}
+
+	// JWT logins name the old email, so they can't be used anyway, but
+	// whoever next has it must not be able to use them either.
+	if err := s.revokeJWTs(old); err != nil {
+		return "", err
+	}
+
+	return t.Email, nil
+}
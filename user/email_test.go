@@ -0,0 +1,121 @@
+package user_test
+
+import (
+	jc "github.com/juju/testing/checkers"
+	"github.com/synapse-garden/mf-proto/mail"
+	"github.com/synapse-garden/mf-proto/user"
+
+	gc "gopkg.in/check.v1"
+)
+
+func (s *UserSuite) TestChangeEmail(c *gc.C) {
+	m := new(mail.Memory)
+	svc := user.NewService(s.d,
+		user.WithClock(s.clock),
+		user.WithMailer(m, "mf@synapsegarden.net"),
+	)
+
+	b, l := s.users["bob"], s.users["larry"]
+	for _, u := range []string{b.Email, l.Email} {
+		c.Assert(svc.Create(u, "good password"), jc.ErrorIsNil)
+		_, err := svc.Verify(tokenFrom(m, u, c))
+		c.Assert(err, jc.ErrorIsNil)
+	}
+
+	login, err := svc.LoginUser(b.Email, "good password")
+	c.Assert(err, jc.ErrorIsNil)
+	id, err := svc.ID(b.Email)
+	c.Assert(err, jc.ErrorIsNil)
+
+	const newEmail = "bob@potato.org"
+	for i, t := range []struct {
+		should      string
+		pwhash      string
+		newEmail    string
+		expectError string
+	}{{
+		should:      "not change without the password",
+		pwhash:      "wrong",
+		newEmail:    newEmail,
+		expectError: `invalid email or password`,
+	}, {
+		should:      "not change to a bad email",
+		pwhash:      "good password",
+		newEmail:    "bob",
+		expectError: `email "bob" not valid`,
+	}, {
+		should:      "not change to another user's email",
+		pwhash:      "good password",
+		newEmail:    l.Email,
+		expectError: `user for email "larry@cucumber.net" already exists`,
+	}, {
+		should:   "mail the new address",
+		pwhash:   "good password",
+		newEmail: newEmail,
+	}} {
+		c.Logf("test %d: should %s", i, t.should)
+		err := svc.RequestEmailChange(id, t.pwhash, t.newEmail)
+		if t.expectError != "" {
+			c.Check(err, gc.ErrorMatches, t.expectError)
+		} else {
+			c.Check(err, jc.ErrorIsNil)
+		}
+	}
+
+	// The old address is told about the change.
+	notice, ok := m.Last(b.Email)
+	c.Assert(ok, jc.IsTrue)
+	c.Check(notice.Body, jc.Contains, newEmail)
+
+	tok := tokenFrom(m, newEmail, c)
+	got, err := svc.ChangeEmail(tok)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(got, gc.Equals, newEmail)
+
+	// The user keeps their ID, password and login under the new email.
+	newID, err := svc.ID(newEmail)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(newID, gc.Equals, id)
+	c.Check(svc.ValidLogin(newEmail, login.Key), jc.ErrorIsNil)
+	c.Check(svc.CheckUser(newEmail, "good password"), jc.ErrorIsNil)
+
+	_, err = svc.ID(b.Email)
+	c.Check(err, gc.ErrorMatches, `"bob@tomato.com" user not found`)
+
+	_, err = svc.ChangeEmail(tok)
+	c.Check(err, gc.ErrorMatches, `used email token not valid`)
+
+	// A token for an address taken since it was sent can't be used.
+	c.Assert(svc.RequestEmailChange(mustID(svc, l.Email, c), "good password", b.Email), jc.ErrorIsNil)
+	tok = tokenFrom(m, b.Email, c)
+	c.Assert(svc.Create(b.Email, "good password"), jc.ErrorIsNil)
+	_, err = svc.ChangeEmail(tok)
+	c.Check(err, gc.ErrorMatches, `changing email to "bob@tomato.com" failed: user for email "bob@tomato.com" already exists`)
+}
+
+func (s *UserSuite) TestResetTokenAfterEmailChange(c *gc.C) {
+	m := new(mail.Memory)
+	svc := user.NewService(s.d,
+		user.WithClock(s.clock),
+		user.WithMailer(m, "mf@synapsegarden.net"),
+	)
+
+	b := s.users["bob"]
+	c.Assert(svc.Create(b.Email, "good password"), jc.ErrorIsNil)
+	_, err := svc.Verify(tokenFrom(m, b.Email, c))
+	c.Assert(err, jc.ErrorIsNil)
+
+	c.Assert(svc.RequestPasswordReset(b.Email), jc.ErrorIsNil)
+	reset := tokenFrom(m, b.Email, c)
+
+	const newEmail = "bob@potato.org"
+	c.Assert(svc.RequestEmailChange(mustID(svc, b.Email, c), "good password", newEmail), jc.ErrorIsNil)
+	_, err = svc.ChangeEmail(tokenFrom(m, newEmail, c))
+	c.Assert(err, jc.ErrorIsNil)
+
+	// Someone else now has the old address, but the reset sent there
+	// before can't be used on their account.
+	c.Assert(svc.Create(b.Email, "other password"), jc.ErrorIsNil)
+	_, err = svc.ResetPassword(reset, "new password")
+	c.Check(err, gc.ErrorMatches, `reset token for "bob@tomato.com" not valid`)
+}
@@ -0,0 +1,45 @@
+package user
+
+import (
+	"github.com/juju/errors"
+	"github.com/synapse-garden/mf-proto/util"
+)
+
+// CreateExternal makes a new user with the given email, who signs in with
+// an external identity provider which has verified their email.  They have
+// a random password which nobody knows, until they reset it.
+func (s *Service) CreateExternal(email string) (*User, error) {
+	pw, err := util.NewKey()
+	if err != nil {
+		return nil, err
+	}
+	return s.create(email, string(pw), false)
+}
+
+// LoginExternal logs in a user who has proven who they are to an external
+// identity provider rather than by password.  As with LoginUser, a user
+// with two-factor authentication enabled gets a Pending Login.
+func (s *Service) LoginExternal(email string) (*Login, error) {
+	u, err := s.Get(email)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Unverified {
+		return nil, errors.Unauthorizedf("user %q has not verified their email", email)
+	}
+
+	if err := u.enabled(); err != nil {
+		return nil, err
+	}
+
+	if u.TOTP.Active() {
+		return s.newLogin(email, true)
+	}
+
+	if err := s.touchLogin(u); err != nil {
+		return nil, err
+	}
+
+	return s.newLogin(email, false)
+}
@@ -0,0 +1,59 @@
+package user_test
+
+import (
+	jc "github.com/juju/testing/checkers"
+	"github.com/synapse-garden/mf-proto/mail"
+	"github.com/synapse-garden/mf-proto/user"
+
+	gc "gopkg.in/check.v1"
+)
+
+func (s *UserSuite) TestCreateExternal(c *gc.C) {
+	m := new(mail.Memory)
+	svc := user.NewService(s.d, user.WithClock(s.clock), user.WithMailer(m, "mf@localhost"))
+
+	u, err := svc.CreateExternal("bob@tomato.com")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(u.Unverified, jc.IsFalse)
+	c.Check(*u.Created, gc.Equals, s.clock.Now())
+	_, sent := m.Last("bob@tomato.com")
+	c.Check(sent, jc.IsFalse)
+
+	got, err := svc.Get("bob@tomato.com")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(got.ID, gc.Equals, u.ID)
+
+	_, err = svc.CreateExternal("bob@tomato.com")
+	c.Check(err, gc.ErrorMatches, `user for email "bob@tomato.com" already exists`)
+	_, err = svc.CreateExternal("bob")
+	c.Check(err, gc.ErrorMatches, `email "bob" not valid`)
+}
+
+func (s *UserSuite) TestLoginExternal(c *gc.C) {
+	s.createUsers(c)
+	bob, larry := s.users["bob"], s.users["larry"]
+
+	l, err := s.svc.LoginExternal(bob.Email)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(l.Pending, jc.IsFalse)
+	c.Check(s.svc.ValidLogin(bob.Email, l.Key), jc.ErrorIsNil)
+
+	a, err := s.svc.Account(bob.Email)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(a.LastLogin, gc.NotNil)
+
+	// The second factor is still needed.
+	s.enableTOTP(larry.Email, c)
+	l, err = s.svc.LoginExternal(larry.Email)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(l.Pending, jc.IsTrue)
+
+	_, err = s.svc.LoginExternal("nobody@tomato.com")
+	c.Check(err, gc.ErrorMatches, `.*"nobody@tomato.com".*not found`)
+
+	m := new(mail.Memory)
+	svc := user.NewService(s.d, user.WithClock(s.clock), user.WithMailer(m, "mf@localhost"))
+	c.Assert(svc.Create("alice@tomato.com", "alice-password"), jc.ErrorIsNil)
+	_, err = svc.LoginExternal("alice@tomato.com")
+	c.Check(err, gc.ErrorMatches, `user "alice@tomato.com" has not verified their email`)
+}
@@ -0,0 +1,331 @@
+package user
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/juju/errors"
+	"github.com/synapse-garden/mf-proto/db"
+	"github.com/synapse-garden/mf-proto/jwt"
+	"github.com/synapse-garden/mf-proto/util"
+)
+
+const (
+	// JWTKeys holds the keys JWT logins are signed with, by ID.
+	JWTKeys db.Bucket = "user-jwt-keys"
+
+	// JWTRevoked holds the JWT logins revoked before they expire.
+	JWTRevoked db.Bucket = "user-jwt-revoked"
+
+	// DefaultJWTTTL is how long a JWT login lasts.
+	DefaultJWTTTL = time.Hour
+)
+
+// jwtLogin is the payload of a JWT login.  Its Subject is the user's ID.
+// Gen is the user's JWT generation when it was issued; revoking all of a
+// user's JWT logins starts a new generation.
+type jwtLogin struct {
+	jwt.Claims
+	Email string `json:"email"`
+	Gen   int64  `json:"gen,omitempty"`
+}
+
+// jwtGen is a user's current JWT generation, which must be kept Until every
+// JWT login of an older generation has expired.  Generations are numbered
+// by when they started, in nanoseconds, so that a new one is still newer
+// than any before it once those are forgotten.
+type jwtGen struct {
+	Gen   int64     `json:"gen"`
+	Until time.Time `json:"until"`
+}
+
+// jwtCache keeps the signing keys and revocations in memory, so that JWT
+// logins can be checked without touching the DB.
+type jwtCache struct {
+	sync.Mutex
+	loaded  bool
+	keys    []*jwt.Key
+	revoked map[string]time.Time
+	gens    map[string]jwtGen
+}
+
+// current returns the key new JWT logins are signed with.
+func (c *jwtCache) current() *jwt.Key { return c.keys[len(c.keys)-1] }
+
+func revokedKey(jti string) []byte { return []byte("jti:" + jti) }
+func genKey(email string) []byte   { return []byte("gen:" + email) }
+
+// loadJWT reads the keys and revocations from the DB, pruning those which are
+// no longer needed, and makes the first key if there is none.  The cache
+// must be locked.
+func (s *Service) loadJWT() error {
+	c := s.jwt
+	if c.loaded {
+		return nil
+	}
+
+	now := s.Clock.Now()
+	c.keys, c.revoked, c.gens = nil, map[string]time.Time{}, map[string]jwtGen{}
+	err := s.DB.Update(func(tx *bolt.Tx) error {
+		ks, rs := tx.Bucket([]byte(JWTKeys)), tx.Bucket([]byte(JWTRevoked))
+		switch {
+		case ks == nil:
+			return db.BucketNotFoundErr(JWTKeys)
+		case rs == nil:
+			return db.BucketNotFoundErr(JWTRevoked)
+		}
+
+		if err := ks.ForEach(func(k, v []byte) error {
+			key := new(jwt.Key)
+			if err := json.Unmarshal(v, key); err != nil {
+				return err
+			}
+			c.keys = append(c.keys, key)
+			return nil
+		}); err != nil {
+			return err
+		}
+		sort.Slice(c.keys, func(i, j int) bool {
+			return c.keys[i].Created.Before(c.keys[j].Created)
+		})
+
+		var stale [][]byte
+		if err := rs.ForEach(func(k, v []byte) error {
+			if email := string(k); strings.HasPrefix(email, "gen:") {
+				g := jwtGen{}
+				if err := json.Unmarshal(v, &g); err != nil {
+					return err
+				}
+				if now.Before(g.Until) {
+					c.gens[strings.TrimPrefix(email, "gen:")] = g
+					return nil
+				}
+			} else {
+				var until time.Time
+				if err := json.Unmarshal(v, &until); err != nil {
+					return err
+				}
+				if now.Before(until) {
+					c.revoked[strings.TrimPrefix(string(k), "jti:")] = until
+					return nil
+				}
+			}
+			stale = append(stale, append([]byte(nil), k...))
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, k := range stale {
+			if err := rs.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		if len(c.keys) == 0 || c.current().Alg != s.JWTAlg {
+			return s.addJWTKey(tx, now)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	c.loaded = true
+	return nil
+}
+
+// addJWTKey makes a new current key, and deletes those which were retired
+// long enough ago that no JWT login signed by them can still be valid.
+// The cache must be locked.
+func (s *Service) addJWTKey(tx *bolt.Tx, now time.Time) error {
+	c := s.jwt
+	k, err := jwt.NewKey(s.JWTAlg, now)
+	if err != nil {
+		return err
+	}
+
+	b := tx.Bucket([]byte(JWTKeys))
+	if b == nil {
+		return db.BucketNotFoundErr(JWTKeys)
+	}
+
+	bs, err := json.Marshal(k)
+	if err != nil {
+		return err
+	}
+	if err := b.Put([]byte(k.ID), bs); err != nil {
+		return err
+	}
+
+	// A key is retired when the next one is made.
+	keys := append(c.keys, k)
+	var kept []*jwt.Key
+	for i, old := range keys[:len(keys)-1] {
+		if now.Before(keys[i+1].Created.Add(s.JWTTTL)) {
+			kept = append(kept, old)
+			continue
+		}
+		if err := b.Delete([]byte(old.ID)); err != nil {
+			return err
+		}
+	}
+	c.keys = append(kept, k)
+	return nil
+}
+
+// RotateJWTKey makes a new key to sign JWT logins with, and returns its ID.
+// JWT logins signed by older keys stay valid until they expire.
+func (s *Service) RotateJWTKey() (string, error) {
+	if s.JWTAlg == "" {
+		return "", errors.NotSupportedf("JWT logins")
+	}
+
+	s.jwt.Lock()
+	defer s.jwt.Unlock()
+	if err := s.loadJWT(); err != nil {
+		return "", err
+	}
+
+	err := s.DB.Update(func(tx *bolt.Tx) error {
+		return s.addJWTKey(tx, s.Clock.Now())
+	})
+	if err != nil {
+		// Reload, since the cache may not match the DB.
+		s.jwt.loaded = false
+		return "", err
+	}
+	return s.jwt.current().ID, nil
+}
+
+// JWKS returns the public keys which JWT logins may be signed by.  It is
+// empty unless they are signed with EdDSA.
+func (s *Service) JWKS() (*jwt.JWKS, error) {
+	ks := &jwt.JWKS{Keys: []jwt.JWK{}}
+	if s.JWTAlg == "" {
+		return ks, nil
+	}
+
+	s.jwt.Lock()
+	defer s.jwt.Unlock()
+	if err := s.loadJWT(); err != nil {
+		return nil, err
+	}
+
+	for _, k := range s.jwt.keys {
+		if j, ok := k.JWK(); ok {
+			ks.Keys = append(ks.Keys, j)
+		}
+	}
+	return ks, nil
+}
+
+// newJWTLogin returns a Login whose Key is a JWT for the given user.  It is
+// not stored, and times out at a fixed time rather than after going unused.
+func (s *Service) newJWTLogin(email string) (*Login, error) {
+	id, err := s.ID(email)
+	if err != nil {
+		return nil, err
+	}
+
+	s.jwt.Lock()
+	defer s.jwt.Unlock()
+	if err := s.loadJWT(); err != nil {
+		return nil, err
+	}
+
+	claims, err := jwt.NewClaims(s.Issuer, id, s.Clock.Now(), s.JWTTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	tok, err := jwt.Sign(s.jwt.current(), &jwtLogin{
+		Claims: claims,
+		Email:  email,
+		Gen:    s.jwt.gens[email].Gen,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Login{
+		Key:     util.Key(tok),
+		Timeout: claims.ExpiresAt(),
+	}, nil
+}
+
+// parseJWTLogin checks that key is an unexpired, unrevoked JWT login for the
+// given user.  It only uses the cache.
+func (s *Service) parseJWTLogin(email string, key util.Key) (*jwtLogin, error) {
+	if s.JWTAlg == "" {
+		return nil, errors.NotValidf("bad key for user %q", email)
+	}
+
+	s.jwt.Lock()
+	defer s.jwt.Unlock()
+	if err := s.loadJWT(); err != nil {
+		return nil, err
+	}
+
+	l := new(jwtLogin)
+	err := jwt.Parse(string(key), func(kid string) (*jwt.Key, error) {
+		for _, k := range s.jwt.keys {
+			if k.ID == kid {
+				return k, nil
+			}
+		}
+		return nil, errors.NotFoundf("key %q", kid)
+	}, l)
+	switch {
+	case err != nil, l.Email != email:
+		return nil, errors.NotValidf("bad key for user %q", email)
+	case l.Valid(s.Clock.Now()) != nil:
+		return nil, errors.NotValidf("user %q timed out", email)
+	}
+
+	if _, ok := s.jwt.revoked[l.ID]; ok || l.Gen < s.jwt.gens[email].Gen {
+		return nil, errors.NotValidf("user %q logged out", email)
+	}
+	return l, nil
+}
+
+// revokeJWT revokes a JWT login until it expires.
+func (s *Service) revokeJWT(l *jwtLogin) error {
+	s.jwt.Lock()
+	defer s.jwt.Unlock()
+
+	until := l.ExpiresAt()
+	if err := db.StoreKeyValue(s.DB, JWTRevoked, revokedKey(l.ID), until); err != nil {
+		return err
+	}
+	s.jwt.revoked[l.ID] = until
+	return nil
+}
+
+// revokeJWTs revokes every JWT login of the given user, by starting a new
+// generation which lasts until they would have expired.
+func (s *Service) revokeJWTs(email string) error {
+	if s.JWTAlg == "" {
+		return nil
+	}
+
+	s.jwt.Lock()
+	defer s.jwt.Unlock()
+	if err := s.loadJWT(); err != nil {
+		return err
+	}
+
+	now := s.Clock.Now()
+	g := jwtGen{Gen: now.UnixNano(), Until: now.Add(s.JWTTTL)}
+	if last := s.jwt.gens[email].Gen; g.Gen <= last {
+		g.Gen = last + 1
+	}
+	if err := db.StoreKeyValue(s.DB, JWTRevoked, genKey(email), g); err != nil {
+		return err
+	}
+	s.jwt.gens[email] = g
+	return nil
+}
@@ -0,0 +1,140 @@
+package user_test
+
+import (
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	"github.com/synapse-garden/mf-proto/jwt"
+	"github.com/synapse-garden/mf-proto/user"
+	"github.com/synapse-garden/mf-proto/util"
+
+	gc "gopkg.in/check.v1"
+)
+
+// jwtService makes a Service on the suite's DB whose logins are JWTs.
+func (s *UserSuite) jwtService(alg string) *user.Service {
+	return user.NewService(
+		s.d,
+		user.WithClock(s.clock),
+		user.WithJWT(alg, time.Hour),
+	)
+}
+
+func (s *UserSuite) TestJWTLogin(c *gc.C) {
+	s.createUsers(c)
+	bob, larry := s.users["bob"], s.users["larry"]
+
+	for i, alg := range []string{jwt.HS256, jwt.EdDSA} {
+		c.Logf("test %d: %s", i, alg)
+		svc := s.jwtService(alg)
+
+		l, err := svc.LoginUser(bob.Email, bob.Pwhash)
+		c.Assert(err, jc.ErrorIsNil)
+		c.Check(jwt.Is(string(l.Key)), jc.IsTrue)
+		c.Check(l.Timeout.Equal(s.clock.Now().Add(time.Hour)), jc.IsTrue)
+
+		// Nothing is stored for the login.
+		_, err = svc.GetLogin(bob.Email)
+		c.Check(err, jc.Satisfies, errors.IsUserNotFound)
+
+		c.Check(svc.ValidLogin(bob.Email, l.Key), jc.ErrorIsNil)
+		c.Check(svc.ValidLogin(larry.Email, l.Key), gc.ErrorMatches,
+			`bad key for user "larry@cucumber.net" not valid`)
+
+		// A Service without JWT logins doesn't accept them.
+		c.Check(s.svc.ValidLogin(bob.Email, l.Key), gc.ErrorMatches,
+			`bad key for user "bob@tomato.com" not valid`)
+
+		// Nor is a JWT accepted with its signature removed.
+		parts := strings.Split(string(l.Key), ".")
+		c.Check(svc.ValidLogin(bob.Email, util.Key(parts[0]+"."+parts[1]+".")), gc.ErrorMatches,
+			`bad key for user "bob@tomato.com" not valid`)
+
+		// JWT logins don't slide.
+		s.clock.Advance(59 * time.Minute)
+		c.Check(svc.ValidLogin(bob.Email, l.Key), jc.ErrorIsNil)
+		s.clock.Advance(time.Minute)
+		c.Check(svc.ValidLogin(bob.Email, l.Key), gc.ErrorMatches,
+			`user "bob@tomato.com" timed out not valid`)
+	}
+}
+
+func (s *UserSuite) TestJWTRevoke(c *gc.C) {
+	s.createUsers(c)
+	bob := s.users["bob"]
+	svc := s.jwtService(jwt.EdDSA)
+
+	l1, err := svc.LoginUser(bob.Email, bob.Pwhash)
+	c.Assert(err, jc.ErrorIsNil)
+	l2, err := svc.LoginUser(bob.Email, bob.Pwhash)
+	c.Assert(err, jc.ErrorIsNil)
+
+	c.Assert(svc.LogoutUser(mustID(svc, bob.Email, c), l1.Key), jc.ErrorIsNil)
+	c.Check(svc.ValidLogin(bob.Email, l1.Key), gc.ErrorMatches,
+		`user "bob@tomato.com" logged out not valid`)
+	c.Check(svc.ValidLogin(bob.Email, l2.Key), jc.ErrorIsNil)
+
+	// Revocations are kept across restarts.
+	restarted := s.jwtService(jwt.EdDSA)
+	c.Check(restarted.ValidLogin(bob.Email, l1.Key), gc.ErrorMatches,
+		`user "bob@tomato.com" logged out not valid`)
+	c.Check(restarted.ValidLogin(bob.Email, l2.Key), jc.ErrorIsNil)
+
+	// Changing the password revokes every other login.
+	key, err := restarted.ChangePassword(mustID(restarted, bob.Email, c), bob.Pwhash, "new-password")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(restarted.ValidLogin(bob.Email, l2.Key), gc.ErrorMatches,
+		`user "bob@tomato.com" logged out not valid`)
+	c.Check(restarted.ValidLogin(bob.Email, key), jc.ErrorIsNil)
+
+	// Once they have all expired, the revocations are forgotten, but new
+	// revocations still apply.
+	s.clock.Advance(2 * time.Hour)
+	restarted = s.jwtService(jwt.EdDSA)
+	l3, err := restarted.LoginUser(bob.Email, "new-password")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(restarted.Delete(bob.Email), jc.ErrorIsNil)
+	c.Assert(restarted.Create(bob.Email, bob.Pwhash), jc.ErrorIsNil)
+	c.Check(restarted.ValidLogin(bob.Email, l3.Key), gc.ErrorMatches,
+		`user "bob@tomato.com" logged out not valid`)
+}
+
+func (s *UserSuite) TestJWTRotate(c *gc.C) {
+	s.createUsers(c)
+	bob := s.users["bob"]
+	svc := s.jwtService(jwt.EdDSA)
+
+	_, err := s.svc.RotateJWTKey()
+	c.Check(err, jc.Satisfies, errors.IsNotSupported)
+	ks, err := s.svc.JWKS()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(ks.Keys, gc.HasLen, 0)
+
+	old, err := svc.LoginUser(bob.Email, bob.Pwhash)
+	c.Assert(err, jc.ErrorIsNil)
+
+	s.clock.Advance(time.Minute)
+	kid, err := svc.RotateJWTKey()
+	c.Assert(err, jc.ErrorIsNil)
+
+	ks, err = svc.JWKS()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(ks.Keys, gc.HasLen, 2)
+	c.Check(ks.Keys[1].Kid, gc.Equals, kid)
+
+	l, err := svc.LoginUser(bob.Email, bob.Pwhash)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(svc.ValidLogin(bob.Email, old.Key), jc.ErrorIsNil)
+	c.Check(s.jwtService(jwt.EdDSA).ValidLogin(bob.Email, l.Key), jc.ErrorIsNil)
+
+	// Retired keys are dropped once their logins have expired.
+	s.clock.Advance(time.Hour)
+	_, err = svc.RotateJWTKey()
+	c.Assert(err, jc.ErrorIsNil)
+	ks, err = svc.JWKS()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(ks.Keys, gc.HasLen, 2)
+	c.Check(ks.Keys[0].Kid, gc.Equals, kid)
+}
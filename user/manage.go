@@ -0,0 +1,161 @@
+package user
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/juju/errors"
+	"github.com/synapse-garden/mf-proto/db"
+)
+
+// MaxPage is the most Accounts a Page may hold.
+const MaxPage = 1000
+
+// Page is a page of Accounts in email order.
+type Page struct {
+	Accounts []*Account `json:"accounts"`
+
+	// Next is the email to list from for the next Page, or empty if this
+	// is the last.
+	Next string `json:"next,omitempty"`
+}
+
+// List returns a Page of at most limit Accounts whose email begins with
+// prefix, from the email from on.  limit must be between 1 and MaxPage.
+func (s *Service) List(prefix, from string, limit int) (*Page, error) {
+	if limit < 1 || limit > MaxPage {
+		return nil, errors.NotValidf("limit %d", limit)
+	}
+	if from < prefix {
+		from = prefix
+	}
+
+	p := &Page{Accounts: []*Account{}}
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		es, us := tx.Bucket([]byte(Emails)), tx.Bucket([]byte(Users))
+		switch {
+		case es == nil:
+			return db.BucketNotFoundErr(Emails)
+		case us == nil:
+			return db.BucketNotFoundErr(Users)
+		}
+
+		c := es.Cursor()
+		for k, id := c.Seek([]byte(from)); k != nil; k, id = c.Next() {
+			if !bytes.HasPrefix(k, []byte(prefix)) {
+				return nil
+			}
+			if len(p.Accounts) == limit {
+				p.Next = string(k)
+				return nil
+			}
+
+			u := new(User)
+			if err := json.Unmarshal(us.Get(id), u); err != nil {
+				return errors.Annotatef(err, "reading user %q", k)
+			}
+			p.Accounts = append(p.Accounts, u.account())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Detail is what an admin may see about a user and their sessions.
+type Detail struct {
+	*Account
+
+	// LoggedIn is set if the user has a complete Login which has not
+	// timed out.  JWT logins are not kept, so are not counted.
+	LoggedIn     bool       `json:"logged_in"`
+	LoginTimeout *time.Time `json:"login_timeout,omitempty"`
+
+	// AccessTokens is how many unexpired AccessTokens the user has.
+	AccessTokens int `json:"access_tokens"`
+}
+
+// Detail returns the Detail of the given user.
+func (s *Service) Detail(email string) (*Detail, error) {
+	a, err := s.Account(email)
+	if err != nil {
+		return nil, err
+	}
+	d := &Detail{Account: a}
+
+	now := s.Clock.Now()
+	switch l, err := s.GetLogin(email); {
+	case errors.IsUserNotFound(err):
+	case err != nil:
+		return nil, err
+	case !l.Pending && now.Before(l.Timeout):
+		d.LoggedIn, d.LoginTimeout = true, &l.Timeout
+	}
+
+	ts, err := s.AccessTokens(email)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range ts {
+		if now.Before(t.Expires) {
+			d.AccessTokens++
+		}
+	}
+
+	return d, nil
+}
+
+// Disable stops the given user from logging in or using their keys until
+// they are enabled again.  Their Login and JWT logins are ended and the
+// Revoked Hooks are run, but their data and AccessTokens are kept.
+func (s *Service) Disable(email string) error {
+	if err := s.setDisabled(email, true); err != nil {
+		return err
+	}
+
+	if err := s.ClearLogin(email); err != nil && !errors.IsUserNotFound(err) {
+		return err
+	}
+
+	if err := s.revokeJWTs(email); err != nil {
+		return err
+	}
+
+	return runHooks(s.Hooks.Revoked, email)
+}
+
+// Enable lets a disabled user log in again.
+func (s *Service) Enable(email string) error {
+	return s.setDisabled(email, false)
+}
+
+func (s *Service) setDisabled(email string, disabled bool) error {
+	u, err := s.Get(email)
+	if err != nil {
+		return err
+	}
+
+	u.Disabled = disabled
+	return s.put(u)
+}
+
+// enabled returns an error if the given user is disabled.
+func (s *Service) enabled(email string) error {
+	u, err := s.Get(email)
+	if err != nil {
+		return err
+	}
+	return u.enabled()
+}
+
+func (u *User) enabled() error {
+	if u.Disabled {
+		return errors.Unauthorizedf("user %q is disabled", u.Email)
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package user_test
+
+import (
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	t "github.com/synapse-garden/mf-proto/testing"
+	"github.com/synapse-garden/mf-proto/user"
+	"github.com/synapse-garden/mf-proto/util"
+
+	gc "gopkg.in/check.v1"
+)
+
+func (s *UserSuite) TestList(c *gc.C) {
+	for _, email := range []string{
+		"al@tomato.com",
+		"bob@tomato.com",
+		"bob@zucchini.org",
+		"bobby@tomato.com",
+		"larry@cucumber.net",
+	} {
+		c.Assert(s.svc.Create(email, "12345"), jc.ErrorIsNil)
+	}
+
+	for i, t := range []struct {
+		should       string
+		prefix, from string
+		limit        int
+		expect       []string
+		expectNext   string
+		expectError  string
+	}{{
+		should: "list everyone in email order",
+		limit:  10,
+		expect: []string{
+			"al@tomato.com",
+			"bob@tomato.com",
+			"bob@zucchini.org",
+			"bobby@tomato.com",
+			"larry@cucumber.net",
+		},
+	}, {
+		should:     "list a page with the next email",
+		limit:      2,
+		expect:     []string{"al@tomato.com", "bob@tomato.com"},
+		expectNext: "bob@zucchini.org",
+	}, {
+		should: "list the next page",
+		from:   "bob@zucchini.org",
+		limit:  10,
+		expect: []string{
+			"bob@zucchini.org",
+			"bobby@tomato.com",
+			"larry@cucumber.net",
+		},
+	}, {
+		should: "list by prefix",
+		prefix: "bob",
+		limit:  10,
+		expect: []string{"bob@tomato.com", "bob@zucchini.org", "bobby@tomato.com"},
+	}, {
+		should:     "page through a prefix",
+		prefix:     "bob",
+		limit:      1,
+		expect:     []string{"bob@tomato.com"},
+		expectNext: "bob@zucchini.org",
+	}, {
+		should: "list a prefix from within it",
+		prefix: "bob",
+		from:   "bobby@tomato.com",
+		limit:  10,
+		expect: []string{"bobby@tomato.com"},
+	}, {
+		should: "list nobody for an unknown prefix",
+		prefix: "jove",
+		limit:  10,
+		expect: []string{},
+	}, {
+		should:      "not list with no limit",
+		expectError: `limit 0 not valid`,
+	}, {
+		should:      "not list too many",
+		limit:       user.MaxPage + 1,
+		expectError: `limit 1001 not valid`,
+	}} {
+		c.Logf("test %d: should %s", i, t.should)
+		p, err := s.svc.List(t.prefix, t.from, t.limit)
+		if t.expectError != "" {
+			c.Check(err, gc.ErrorMatches, t.expectError)
+			continue
+		}
+		c.Assert(err, jc.ErrorIsNil)
+
+		got := make([]string, len(p.Accounts))
+		for j, a := range p.Accounts {
+			got[j] = a.Email
+			c.Check(a.ID, gc.Not(gc.Equals), "")
+		}
+		c.Check(got, jc.DeepEquals, t.expect)
+		c.Check(p.Next, gc.Equals, t.expectNext)
+	}
+}
+
+func (s *UserSuite) TestDetail(c *gc.C) {
+	s.createUsers(c)
+	b := s.users["bob"]
+
+	d, err := s.svc.Detail(b.Email)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(d.Email, gc.Equals, b.Email)
+	c.Check(d.LoggedIn, jc.IsFalse)
+	c.Check(d.LoginTimeout, gc.IsNil)
+	c.Check(d.AccessTokens, gc.Equals, 0)
+
+	l, err := s.svc.LoginUser(b.Email, b.Pwhash)
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = s.svc.CreateAccessToken(b.Email, "laptop", time.Hour, user.ScopeAll)
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = s.svc.CreateAccessToken(b.Email, "phone", time.Minute, user.ScopeAll)
+	c.Assert(err, jc.ErrorIsNil)
+
+	d, err = s.svc.Detail(b.Email)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(d.LoggedIn, jc.IsTrue)
+	c.Check(*d.LoginTimeout, gc.Equals, l.Timeout)
+	c.Check(d.AccessTokens, gc.Equals, 2)
+	c.Check(*d.LastLogin, gc.Equals, s.clock.Now())
+
+	// Timed out logins and expired tokens are not counted.
+	s.clock.Advance(2 * time.Minute)
+	d, err = s.svc.Detail(b.Email)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(d.LoggedIn, jc.IsFalse)
+	c.Check(d.AccessTokens, gc.Equals, 1)
+
+	_, err = s.svc.Detail("jove@olympus.mons")
+	c.Check(err, gc.ErrorMatches, `"jove@olympus.mons" user not found`)
+}
+
+func (s *UserSuite) TestDisable(c *gc.C) {
+	s.createUsers(c)
+	b, l := s.users["bob"], s.users["larry"]
+
+	key := mustLoginAs(s.svc, b, c)
+	tok, err := s.svc.CreateAccessToken(b.Email, "laptop", time.Hour, user.ScopeAll)
+	c.Assert(err, jc.ErrorIsNil)
+	larryKey := mustLoginAs(s.svc, l, c)
+
+	c.Assert(s.svc.Disable(b.Email), jc.ErrorIsNil)
+
+	a, err := s.svc.Account(b.Email)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(a.Disabled, jc.IsTrue)
+
+	c.Check(s.svc.ValidLogin(b.Email, key), gc.NotNil)
+	_, err = s.svc.LoginUser(b.Email, b.Pwhash)
+	c.Check(err, gc.ErrorMatches, `user "bob@tomato.com" is disabled`)
+	_, err = s.svc.ValidAccessKey(tok.Key)
+	c.Check(err, gc.ErrorMatches, `user "bob@tomato.com" is disabled`)
+
+	// A bad password is still just a bad password.
+	_, err = s.svc.LoginUser(b.Email, "wrong")
+	c.Check(err, gc.ErrorMatches, `invalid email or password`)
+
+	// Nobody else is disabled.
+	c.Check(s.svc.ValidLogin(l.Email, larryKey), jc.ErrorIsNil)
+
+	// Their data and tokens are kept for when they are enabled.
+	c.Assert(s.svc.Enable(b.Email), jc.ErrorIsNil)
+	key = mustLoginAs(s.svc, b, c)
+	c.Check(s.svc.ValidLogin(b.Email, key), jc.ErrorIsNil)
+	_, err = s.svc.ValidAccessKey(tok.Key)
+	c.Check(err, jc.ErrorIsNil)
+
+	c.Check(s.svc.Disable("jove@olympus.mons"), gc.ErrorMatches, `"jove@olympus.mons" user not found`)
+}
+
+// mustLoginAs logs in the given user and returns their key.
+func mustLoginAs(svc *user.Service, u t.TestUser, c *gc.C) util.Key {
+	l, err := svc.LoginUser(u.Email, u.Pwhash)
+	c.Assert(err, jc.ErrorIsNil)
+	return l.Key
+}
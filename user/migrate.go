@@ -0,0 +1,82 @@
+package user
+
+import (
+	"encoding/json"
+
+	"github.com/boltdb/bolt"
+	"github.com/synapse-garden/mf-proto/db"
+)
+
+// Migrate gives an ID to each user kept by email from before users had IDs,
+// and moves their record and login to it.  It returns how many users were
+// migrated, and may safely be run again.
+func (s *Service) Migrate() (int, error) {
+	if err := db.SetupBuckets(s.DB, Buckets()); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	err := s.DB.Update(func(tx *bolt.Tx) error {
+		us := tx.Bucket([]byte(Users))
+		es := tx.Bucket([]byte(Emails))
+		ls := tx.Bucket([]byte(LoginKeys))
+
+		// Buckets can't be changed during ForEach, so find the old
+		// users first.
+		var old []*User
+		err := us.ForEach(func(k, v []byte) error {
+			u := new(User)
+			if err := json.Unmarshal(v, u); err != nil {
+				return err
+			}
+			if u.ID == "" {
+				old = append(old, u)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, u := range old {
+			id, err := newID()
+			if err != nil {
+				return err
+			}
+			u.ID = id
+
+			bs, err := json.Marshal(u)
+			if err != nil {
+				return err
+			}
+
+			if err := us.Delete([]byte(u.Email)); err != nil {
+				return err
+			}
+			if err := us.Put([]byte(id), bs); err != nil {
+				return err
+			}
+			if err := es.Put([]byte(u.Email), []byte(id)); err != nil {
+				return err
+			}
+
+			if login := ls.Get([]byte(u.Email)); len(login) > 0 {
+				login = append([]byte(nil), login...)
+				if err := ls.Delete([]byte(u.Email)); err != nil {
+					return err
+				}
+				if err := ls.Put([]byte(id), login); err != nil {
+					return err
+				}
+			}
+			n++
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
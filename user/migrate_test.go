@@ -0,0 +1,58 @@
+package user_test
+
+import (
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	"github.com/synapse-garden/mf-proto/db"
+	"github.com/synapse-garden/mf-proto/user"
+	"github.com/synapse-garden/mf-proto/util"
+
+	gc "gopkg.in/check.v1"
+)
+
+func (s *UserSuite) TestMigrate(c *gc.C) {
+	// Store bob the way users were kept before they had IDs.
+	b := s.users["bob"]
+	hash, salt := util.HashedAndSalt(b.Pwhash, "seed")
+	err := db.StoreKeyValue(s.d, user.Users, []byte(b.Email), &user.User{
+		Email: b.Email,
+		Salt:  salt,
+		Hash:  hash,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	err = db.StoreKeyValue(s.d, user.LoginKeys, []byte(b.Email), &user.Login{
+		Key:     "bobkey",
+		Timeout: s.clock.Now().Add(time.Minute),
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	// larry is new.
+	l := s.users["larry"]
+	c.Assert(s.svc.Create(l.Email, l.Pwhash), jc.ErrorIsNil)
+	larryID, err := s.svc.ID(l.Email)
+	c.Assert(err, jc.ErrorIsNil)
+
+	n, err := s.svc.Migrate()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(n, gc.Equals, 1)
+
+	u, err := s.svc.Get(b.Email)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(u.ID, gc.Not(gc.Equals), "")
+	c.Check(s.svc.CheckUser(b.Email, b.Pwhash), jc.ErrorIsNil)
+	c.Check(s.svc.ValidLogin(b.Email, "bobkey"), jc.ErrorIsNil)
+
+	old, err := db.GetByKey(s.d, user.Users, []byte(b.Email))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(old, gc.HasLen, 0)
+
+	id, err := s.svc.ID(l.Email)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(id, gc.Equals, larryID)
+
+	// Running it again changes nothing.
+	n, err = s.svc.Migrate()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(n, gc.Equals, 0)
+}
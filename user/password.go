@@ -0,0 +1,141 @@
+package user
+
+import (
+	"fmt"
+
+	"github.com/juju/errors"
+	"github.com/synapse-garden/mf-proto/mail"
+	"github.com/synapse-garden/mf-proto/util"
+)
+
+// setPassword stores a new salted hash of pwhash for the given user.
+func (s *Service) setPassword(u *User, pwhash string) error {
+	u.Hash, u.Salt = util.HashedAndSalt(pwhash, s.Clock.Now().String())
+	return s.put(u)
+}
+
+// ChangePassword changes the password of the user with the given ID, whose
+// login the caller has checked, if they know their current password.  The
+// user's login is replaced, so any other holder of the old key is logged
+// out, and the new key is returned.  Any reset tokens the user was sent can
+// no longer be used, and the Revoked Hooks are run.
+func (s *Service) ChangePassword(id, pwhash, newPwhash string) (util.Key, error) {
+	u, err := s.GetByID(id)
+	if err != nil {
+		return "", err
+	}
+	email := u.Email
+
+	if err := s.CheckUser(email, pwhash); err != nil {
+		return "", err
+	}
+
+	if err := s.CheckPwhash(email, newPwhash); err != nil {
+		return "", err
+	}
+
+	if err := s.setPassword(u, newPwhash); err != nil {
+		return "", errors.Annotatef(err, "changing password for %q failed", email)
+	}
+
+	if err := s.deleteTokens(PurposeReset, u.ID); err != nil {
+		return "", err
+	}
+
+	if err := s.revokeJWTs(email); err != nil {
+		return "", err
+	}
+
+	if err := runHooks(s.Hooks.Revoked, email); err != nil {
+		return "", err
+	}
+
+	login, err := s.newLogin(email, false)
+	if err != nil {
+		return "", err
+	}
+
+	return login.Key, nil
+}
+
+// RequestPasswordReset mails the given user a link containing a single-use
+// token which lets them choose a new password.
+func (s *Service) RequestPasswordReset(email string) error {
+	if s.Mailer == nil {
+		return errors.NotProvisionedf("mailer")
+	}
+
+	u, err := s.Get(email)
+	if err != nil {
+		return err
+	}
+
+	tok, err := s.issueToken(PurposeReset, u.ID, email, s.ResetTTL)
+	if err != nil {
+		return err
+	}
+
+	return s.Mailer.Send(mail.Message{
+		From:    s.MailFrom,
+		To:      email,
+		Subject: "Reset your Mindfork password",
+		Body: fmt.Sprintf(
+			"Someone asked to reset the password for this account.  "+
+				"If it was you, visit the following link to choose "+
+				"a new password:\n\n%s\n\n"+
+				"This link expires in %s.  If you did not ask for "+
+				"this, you can ignore this email.\n",
+			linkTo(s.ResetURL, tok), s.ResetTTL,
+		),
+	})
+}
+
+// ResetPassword redeems a token sent by RequestPasswordReset and sets the
+// user's password.  The user's other reset tokens are deleted, and since a
+// reset may follow a stolen password, their Login, JWT logins and
+// AccessTokens are all ended, and the Revoked Hooks are run.  It returns the
+// user's email.
+func (s *Service) ResetPassword(tok, newPwhash string) (string, error) {
+	// Check the pwhash first, so a bad one doesn't use up the token.
+	if err := s.CheckPwhash("", newPwhash); err != nil {
+		return "", err
+	}
+
+	t, err := s.redeemToken(PurposeReset, tok)
+	if err != nil {
+		return "", err
+	}
+
+	u, err := s.tokenUser(t)
+	if err != nil {
+		return "", err
+	}
+
+	// Receiving the token proves the user owns the address.
+	u.Unverified = false
+	if err := s.setPassword(u, newPwhash); err != nil {
+		return "", errors.Annotatef(err, "resetting password for %q failed", u.Email)
+	}
+
+	if err := s.deleteTokens(PurposeReset, u.ID); err != nil {
+		return "", err
+	}
+
+	if err := s.ClearLogin(u.Email); err != nil && !errors.IsUserNotFound(err) {
+		return "", err
+	}
+
+	if err := s.deleteAccessTokens(u.ID); err != nil {
+		return "", err
+	}
+
+	if err := s.revokeJWTs(u.Email); err != nil {
+		return "", err
+	}
+
+	if err := runHooks(s.Hooks.Revoked, u.Email); err != nil {
+		return "", err
+	}
+
+	return u.Email, nil
+}
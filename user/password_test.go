@@ -0,0 +1,126 @@
+package user_test
+
+import (
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	"github.com/synapse-garden/mf-proto/mail"
+	"github.com/synapse-garden/mf-proto/user"
+
+	gc "gopkg.in/check.v1"
+)
+
+func (s *UserSuite) TestChangePassword(c *gc.C) {
+	s.createUsers(c)
+	b := s.users["bob"]
+	login, err := s.svc.LoginUser(b.Email, b.Pwhash)
+	c.Assert(err, jc.ErrorIsNil)
+	key := login.Key
+	id := mustID(s.svc, b.Email, c)
+
+	for i, t := range []struct {
+		should      string
+		id          string
+		pwhash      string
+		newPwhash   string
+		expectError string
+	}{{
+		should:      "not change the password of a nonexistent user",
+		id:          "nobody",
+		pwhash:      b.Pwhash,
+		expectError: `nobody user not found`,
+	}, {
+		should:      "not change the password without the current password",
+		id:          id,
+		pwhash:      "wrong",
+		expectError: `invalid email or password`,
+	}, {
+		should:      "not change to a password which breaks the rules",
+		id:          id,
+		pwhash:      b.Pwhash,
+		newPwhash:   "short",
+		expectError: `pwhash shorter than 8 characters not valid`,
+	}, {
+		should: "change the password",
+		id:     id,
+		pwhash: b.Pwhash,
+	}} {
+		c.Logf("test %d: should %s", i, t.should)
+		if t.newPwhash == "" {
+			t.newPwhash = "new-password"
+		}
+		newKey, err := s.svc.ChangePassword(t.id, t.pwhash, t.newPwhash)
+		if t.expectError != "" {
+			c.Check(err, gc.ErrorMatches, t.expectError)
+			continue
+		}
+		c.Assert(err, jc.ErrorIsNil)
+
+		// The old login is replaced by the new one.
+		c.Check(newKey, gc.Not(gc.Equals), key)
+		c.Check(s.svc.ValidLogin(b.Email, key), gc.ErrorMatches, `bad key .* not valid`)
+		c.Check(s.svc.ValidLogin(b.Email, newKey), jc.ErrorIsNil)
+
+		c.Check(s.svc.CheckUser(b.Email, b.Pwhash), gc.ErrorMatches, `invalid email or password`)
+		c.Check(s.svc.CheckUser(b.Email, "new-password"), jc.ErrorIsNil)
+	}
+}
+
+func (s *UserSuite) TestResetPassword(c *gc.C) {
+	m := new(mail.Memory)
+	svc := user.NewService(s.d,
+		user.WithClock(s.clock),
+		user.WithMailer(m, "mf@synapsegarden.net"),
+	)
+
+	b := s.users["bob"]
+	c.Assert(svc.Create(b.Email, b.Pwhash), jc.ErrorIsNil)
+	_, err := svc.Verify(tokenFrom(m, b.Email, c))
+	c.Assert(err, jc.ErrorIsNil)
+	login, err := svc.LoginUser(b.Email, b.Pwhash)
+	c.Assert(err, jc.ErrorIsNil)
+	at, err := svc.CreateAccessToken(b.Email, "ci", time.Hour, user.ScopeObjectRead)
+	c.Assert(err, jc.ErrorIsNil)
+
+	c.Check(
+		svc.RequestPasswordReset("jove@olympus.mons"),
+		gc.ErrorMatches, `"jove@olympus.mons" user not found`,
+	)
+
+	c.Assert(svc.RequestPasswordReset(b.Email), jc.ErrorIsNil)
+	other := tokenFrom(m, b.Email, c)
+	c.Assert(svc.RequestPasswordReset(b.Email), jc.ErrorIsNil)
+	tok := tokenFrom(m, b.Email, c)
+
+	_, err = svc.Verify(tok)
+	c.Check(err, gc.ErrorMatches, `reset token for verify not valid`)
+
+	// A bad pwhash doesn't use up the token.
+	_, err = svc.ResetPassword(tok, "short")
+	c.Check(err, gc.ErrorMatches, `pwhash shorter than 8 characters not valid`)
+
+	email, err := svc.ResetPassword(tok, "new-password")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(email, gc.Equals, b.Email)
+
+	// Resetting the password logs the user out, ends their access
+	// tokens, and uses up their other reset tokens.
+	_, err = svc.GetLogin(b.Email)
+	c.Check(err, gc.ErrorMatches, `user "bob@tomato.com" not logged in: +user not found`)
+	c.Check(svc.ValidLogin(b.Email, login.Key), gc.NotNil)
+	_, err = svc.ValidKey(b.Email, at.Key)
+	c.Check(err, gc.ErrorMatches, `bad key for user "bob@tomato.com" not valid`)
+	_, err = svc.ResetPassword(other, "newer-password")
+	c.Check(err, gc.ErrorMatches, `used reset token not valid`)
+
+	_, err = svc.LoginUser(b.Email, "new-password")
+	c.Check(err, jc.ErrorIsNil)
+
+	_, err = svc.ResetPassword(tok, "newer-password")
+	c.Check(err, gc.ErrorMatches, `used reset token not valid`)
+
+	c.Assert(svc.RequestPasswordReset(b.Email), jc.ErrorIsNil)
+	s.clock.Advance(user.DefaultResetTTL)
+	_, err = svc.ResetPassword(tokenFrom(m, b.Email, c), "newer-password")
+	c.Check(err, gc.ErrorMatches, `expired reset token not valid`)
+}
@@ -0,0 +1,172 @@
+package user
+
+import (
+	"encoding/json"
+	"regexp"
+	"time"
+	"unicode/utf8"
+
+	"github.com/juju/errors"
+	"github.com/synapse-garden/mf-proto/util"
+)
+
+const (
+	// MaxDisplayName is the most characters a display name may have.
+	MaxDisplayName = 64
+
+	// MaxPreferences is the most bytes of preferences a user may keep.
+	MaxPreferences = 16 << 10
+)
+
+var localeRE = regexp.MustCompile(`^[a-zA-Z]{2,3}([-_][a-zA-Z0-9]{2,8})*$`)
+
+// Profile holds the settings a user may change about themselves.
+type Profile struct {
+	DisplayName string `json:"display_name,omitempty"`
+
+	// Timezone is an IANA time zone name, such as "Europe/Paris".
+	Timezone string `json:"timezone,omitempty"`
+
+	// Locale is a language tag, such as "en-US".
+	Locale string `json:"locale,omitempty"`
+
+	// Avatar is the ID of an object holding the user's picture.
+	Avatar util.Key `json:"avatar,omitempty"`
+
+	// Preferences is an arbitrary JSON object kept for clients.
+	Preferences json.RawMessage `json:"preferences,omitempty"`
+}
+
+// ProfileUpdate changes the Profile fields which are not nil.  Setting a
+// field to its zero value clears it.
+type ProfileUpdate struct {
+	DisplayName *string         `json:"display_name,omitempty"`
+	Timezone    *string         `json:"timezone,omitempty"`
+	Locale      *string         `json:"locale,omitempty"`
+	Avatar      *util.Key       `json:"avatar,omitempty"`
+	Preferences json.RawMessage `json:"preferences,omitempty"`
+}
+
+// Validate returns an error if any of the update's fields are not valid.
+func (up *ProfileUpdate) Validate() error {
+	if n := up.DisplayName; n != nil && utf8.RuneCountInString(*n) > MaxDisplayName {
+		return errors.NotValidf("display name longer than %d characters", MaxDisplayName)
+	}
+
+	if tz := up.Timezone; tz != nil && *tz != "" {
+		if _, err := time.LoadLocation(*tz); err != nil {
+			return errors.NotValidf("timezone %q", *tz)
+		}
+	}
+
+	if l := up.Locale; l != nil && *l != "" && !localeRE.MatchString(*l) {
+		return errors.NotValidf("locale %q", *l)
+	}
+
+	if ps := up.Preferences; len(ps) > 0 {
+		if len(ps) > MaxPreferences {
+			return errors.NotValidf("preferences larger than %d bytes", MaxPreferences)
+		}
+
+		var obj map[string]interface{}
+		if string(ps) != "null" && json.Unmarshal(ps, &obj) != nil {
+			return errors.NotValidf("preferences which are not a JSON object")
+		}
+	}
+
+	return nil
+}
+
+// apply changes p by the update.
+func (up *ProfileUpdate) apply(p *Profile) {
+	if up.DisplayName != nil {
+		p.DisplayName = *up.DisplayName
+	}
+	if up.Timezone != nil {
+		p.Timezone = *up.Timezone
+	}
+	if up.Locale != nil {
+		p.Locale = *up.Locale
+	}
+	if up.Avatar != nil {
+		p.Avatar = *up.Avatar
+	}
+
+	switch string(up.Preferences) {
+	case "":
+	case "null":
+		p.Preferences = nil
+	default:
+		p.Preferences = up.Preferences
+	}
+}
+
+// Account is what a user, or an admin, may see about a user.
+type Account struct {
+	ID        string     `json:"id"`
+	Email     string     `json:"email"`
+	Verified  bool       `json:"verified"`
+	TwoFactor bool       `json:"two_factor"`
+	Disabled  bool       `json:"disabled,omitempty"`
+	Created   *time.Time `json:"created,omitempty"`
+	LastLogin *time.Time `json:"last_login,omitempty"`
+	Profile   Profile    `json:"profile"`
+}
+
+// Account returns the Account of the given user.
+func (s *Service) Account(email string) (*Account, error) {
+	u, err := s.Get(email)
+	if err != nil {
+		return nil, err
+	}
+
+	return u.account(), nil
+}
+
+func (u *User) account() *Account {
+	a := &Account{
+		ID:        u.ID,
+		Email:     u.Email,
+		Verified:  !u.Unverified,
+		TwoFactor: u.TOTP.Active(),
+		Disabled:  u.Disabled,
+		Created:   u.Created,
+		LastLogin: u.LastLogin,
+	}
+	if u.Profile != nil {
+		a.Profile = *u.Profile
+	}
+
+	return a
+}
+
+// UpdateProfile applies the update to the given user's Profile and returns
+// their new Account.
+func (s *Service) UpdateProfile(email string, up *ProfileUpdate) (*Account, error) {
+	if err := up.Validate(); err != nil {
+		return nil, err
+	}
+
+	u, err := s.Get(email)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Profile == nil {
+		u.Profile = new(Profile)
+	}
+
+	up.apply(u.Profile)
+	if err := s.put(u); err != nil {
+		return nil, errors.Annotatef(err, "updating profile for %q failed", email)
+	}
+
+	return s.Account(email)
+}
+
+// touchLogin records that the user has just logged in.
+func (s *Service) touchLogin(u *User) error {
+	now := s.Clock.Now()
+	u.LastLogin = &now
+	return s.put(u)
+}
@@ -0,0 +1,115 @@
+package user_test
+
+import (
+	"encoding/json"
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	"github.com/synapse-garden/mf-proto/user"
+	"github.com/synapse-garden/mf-proto/util"
+
+	gc "gopkg.in/check.v1"
+)
+
+func str(s string) *string { return &s }
+
+func (s *UserSuite) TestAccountTimes(c *gc.C) {
+	created := s.clock.Now()
+	s.createUsers(c)
+	b := s.users["bob"]
+
+	a, err := s.svc.Account(b.Email)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(*a.Created, gc.Equals, created)
+	c.Check(a.LastLogin, gc.IsNil)
+	c.Check(a.Verified, jc.IsTrue)
+
+	// A failed login is not a login.
+	_, err = s.svc.LoginUser(b.Email, "wrong")
+	c.Check(err, gc.ErrorMatches, `invalid email or password`)
+	a, err = s.svc.Account(b.Email)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(a.LastLogin, gc.IsNil)
+
+	s.clock.Advance(time.Hour)
+	_, err = s.svc.LoginUser(b.Email, b.Pwhash)
+	c.Assert(err, jc.ErrorIsNil)
+	a, err = s.svc.Account(b.Email)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(*a.Created, gc.Equals, created)
+	c.Check(*a.LastLogin, gc.Equals, created.Add(time.Hour))
+
+	_, err = s.svc.Account("jove@olympus.mons")
+	c.Check(err, gc.ErrorMatches, `"jove@olympus.mons" user not found`)
+}
+
+func (s *UserSuite) TestUpdateProfile(c *gc.C) {
+	s.createUsers(c)
+	b := s.users["bob"]
+
+	for i, t := range []struct {
+		should      string
+		update      string
+		expect      user.Profile
+		expectError string
+	}{{
+		should: "set some fields",
+		update: `{"display_name": "Bob", "timezone": "UTC", "locale": "en-US"}`,
+		expect: user.Profile{DisplayName: "Bob", Timezone: "UTC", Locale: "en-US"},
+	}, {
+		should: "leave fields which are not given",
+		update: `{"avatar": "abc123", "preferences": {"theme": "dark"}}`,
+		expect: user.Profile{
+			DisplayName: "Bob",
+			Timezone:    "UTC",
+			Locale:      "en-US",
+			Avatar:      "abc123",
+			Preferences: json.RawMessage(`{"theme":"dark"}`),
+		},
+	}, {
+		should: "clear fields set to empty or null",
+		update: `{"timezone": "", "preferences": null}`,
+		expect: user.Profile{DisplayName: "Bob", Locale: "en-US", Avatar: "abc123"},
+	}, {
+		should:      "not set an unknown timezone",
+		update:      `{"timezone": "Mars/Olympus_Mons"}`,
+		expectError: `timezone "Mars/Olympus_Mons" not valid`,
+	}, {
+		should:      "not set a bad locale",
+		update:      `{"locale": "english please"}`,
+		expectError: `locale "english please" not valid`,
+	}, {
+		should:      "not set preferences which are not an object",
+		update:      `{"preferences": [1, 2, 3]}`,
+		expectError: `preferences which are not a JSON object not valid`,
+	}} {
+		c.Logf("test %d: should %s", i, t.should)
+		up := new(user.ProfileUpdate)
+		c.Assert(json.Unmarshal([]byte(t.update), up), jc.ErrorIsNil)
+
+		a, err := s.svc.UpdateProfile(b.Email, up)
+		if t.expectError != "" {
+			c.Check(err, gc.ErrorMatches, t.expectError)
+			continue
+		}
+		c.Assert(err, jc.ErrorIsNil)
+		c.Check(a.Profile, jc.DeepEquals, t.expect)
+	}
+
+	// A long display name is not allowed.
+	long := make([]rune, user.MaxDisplayName+1)
+	for i := range long {
+		long[i] = 'é'
+	}
+	_, err := s.svc.UpdateProfile(b.Email, &user.ProfileUpdate{
+		DisplayName: str(string(long)),
+	})
+	c.Check(err, gc.ErrorMatches, `display name longer than 64 characters not valid`)
+
+	// Updating the profile leaves the user's password alone.
+	c.Check(s.svc.CheckUser(b.Email, b.Pwhash), jc.ErrorIsNil)
+
+	avatar := util.Key("")
+	_, err = s.svc.UpdateProfile("jove@olympus.mons", &user.ProfileUpdate{Avatar: &avatar})
+	c.Check(err, gc.ErrorMatches, `"jove@olympus.mons" user not found`)
+}
@@ -0,0 +1,294 @@
+package user
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/boltdb/bolt"
+	"github.com/juju/errors"
+	"github.com/synapse-garden/mf-proto/db"
+	"github.com/synapse-garden/mf-proto/util"
+)
+
+const (
+	// Registration holds the registration Policy.
+	Registration db.Bucket = "user-registration"
+
+	// Invites holds the Invites minted by admins, by code.
+	Invites db.Bucket = "user-invites"
+)
+
+var policyKey = []byte("policy")
+
+// Mode is who may register themselves as a new user.
+type Mode string
+
+const (
+	// Closed means only admins can create users.
+	Closed Mode = "closed"
+
+	// Open means anyone can register.
+	Open Mode = "open"
+
+	// InviteOnly means only people with an Invite code can register.
+	InviteOnly Mode = "invite"
+
+	// DomainOnly means only emails at the Policy's Domains can register.
+	DomainOnly Mode = "domain"
+)
+
+// PasswordRules are the rules the pwhash of a new password must meet.
+// Clients send the server a hash of the user's password, never the password,
+// so these can only check the pwhash's format, such as that it isn't empty,
+// truncated or the user's email.  They cannot enforce a password's strength,
+// which clients must check before hashing it.
+type PasswordRules struct {
+	// MinLength is the least number of characters allowed.
+	MinLength int `json:"min_length,omitempty"`
+
+	// Mixed requires both letters and digits or symbols.
+	Mixed bool `json:"mixed,omitempty"`
+}
+
+// Policy is the admin-configured registration policy.
+type Policy struct {
+	Mode     Mode          `json:"mode"`
+	Domains  []string      `json:"domains,omitempty"`
+	Password PasswordRules `json:"password"`
+}
+
+// DefaultPolicy is used until an admin sets a Policy.
+var DefaultPolicy = Policy{
+	Mode:     Closed,
+	Password: PasswordRules{MinLength: 8},
+}
+
+// CheckFormat returns an error if pwhash does not meet the rules, or if it
+// is the same as the user's email.  It says nothing about the strength of
+// the password pwhash was made from.
+func (r PasswordRules) CheckFormat(email, pwhash string) error {
+	if len([]rune(pwhash)) < r.MinLength {
+		return errors.NotValidf("pwhash shorter than %d characters", r.MinLength)
+	}
+
+	if strings.EqualFold(pwhash, email) {
+		return errors.NotValidf("pwhash matching email")
+	}
+
+	if r.Mixed {
+		var letter, other bool
+		for _, c := range pwhash {
+			if unicode.IsLetter(c) {
+				letter = true
+			} else {
+				other = true
+			}
+		}
+		if !letter || !other {
+			return errors.NotValidf("pwhash without both letters and non-letters")
+		}
+	}
+
+	return nil
+}
+
+// allows returns an error if email is not at one of the Policy's Domains.
+func (p *Policy) allows(email string) error {
+	at := strings.LastIndex(email, "@")
+	domain := strings.ToLower(email[at+1:])
+	for _, d := range p.Domains {
+		if domain == strings.ToLower(d) {
+			return nil
+		}
+	}
+	return util.Forbiddenf("registration from %q not allowed", domain)
+}
+
+// Invite is a code an admin mints to let people register.
+type Invite struct {
+	Code    util.Key  `json:"code"`
+	Uses    int       `json:"uses"`
+	MaxUses int       `json:"max_uses"`
+	Expires time.Time `json:"expires"`
+}
+
+// GetPolicy returns the registration Policy, or DefaultPolicy if none is set.
+func (s *Service) GetPolicy() (*Policy, error) {
+	bs, err := db.GetByKey(s.DB, Registration, policyKey)
+	if err != nil {
+		return nil, err
+	}
+
+	p := DefaultPolicy
+	if len(bs) == 0 {
+		return &p, nil
+	}
+
+	if err := json.Unmarshal(bs, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// SetPolicy sets the registration Policy.
+func (s *Service) SetPolicy(p Policy) error {
+	switch p.Mode {
+	case Closed, Open, InviteOnly:
+	case DomainOnly:
+		if len(p.Domains) == 0 {
+			return errors.NotValidf("domain policy without domains")
+		}
+	default:
+		return errors.NotValidf("registration mode %q", p.Mode)
+	}
+
+	return db.StoreKeyValue(s.DB, Registration, policyKey, p)
+}
+
+// CheckPwhash returns an error if pwhash does not meet the format of the
+// registration Policy's PasswordRules.
+func (s *Service) CheckPwhash(email, pwhash string) error {
+	p, err := s.GetPolicy()
+	if err != nil {
+		return err
+	}
+	return p.Password.CheckFormat(email, pwhash)
+}
+
+// CreateInvite mints a new Invite which may be used maxUses times before
+// it expires after ttl.
+func (s *Service) CreateInvite(maxUses int, ttl time.Duration) (*Invite, error) {
+	if maxUses < 1 {
+		return nil, errors.NotValidf("invite with %d uses", maxUses)
+	}
+
+	code, err := util.NewKey()
+	if err != nil {
+		return nil, err
+	}
+
+	inv := &Invite{
+		Code:    code[:16],
+		MaxUses: maxUses,
+		Expires: s.Clock.Now().Add(ttl),
+	}
+
+	return inv, db.StoreKeyValue(s.DB, Invites, []byte(inv.Code), inv)
+}
+
+// Invites returns every Invite which has not been revoked.
+func (s *Service) Invites() ([]*Invite, error) {
+	var invs []*Invite
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(Invites))
+		if b == nil {
+			return db.BucketNotFoundErr(Invites)
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			inv := new(Invite)
+			if err := json.Unmarshal(v, inv); err != nil {
+				return err
+			}
+			invs = append(invs, inv)
+			return nil
+		})
+	})
+	return invs, err
+}
+
+// RevokeInvite deletes the Invite with the given code.
+func (s *Service) RevokeInvite(code util.Key) error {
+	bs, err := db.GetByKey(s.DB, Invites, []byte(code))
+	switch {
+	case err != nil:
+		return err
+	case len(bs) == 0:
+		return errors.NotFoundf("invite %q", code)
+	}
+
+	return db.DeleteByKey(s.DB, Invites, []byte(code))
+}
+
+// useInvite counts a use of the Invite with the given code, or returns an
+// error if it cannot be used.  If undo is true, a use is given back instead.
+func (s *Service) useInvite(code util.Key, undo bool) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(Invites))
+		if b == nil {
+			return db.BucketNotFoundErr(Invites)
+		}
+
+		bs := b.Get([]byte(code))
+		if len(bs) == 0 {
+			return errors.Unauthorizedf("invite %q not valid", code)
+		}
+
+		inv := new(Invite)
+		if err := json.Unmarshal(bs, inv); err != nil {
+			return err
+		}
+
+		switch {
+		case undo:
+			inv.Uses--
+		case inv.Uses >= inv.MaxUses, !s.Clock.Now().Before(inv.Expires):
+			return errors.Unauthorizedf("invite %q not valid", code)
+		default:
+			inv.Uses++
+		}
+
+		bs, err := json.Marshal(inv)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(code), bs)
+	})
+}
+
+// Register creates a new user for someone who is not an admin, if the
+// registration Policy allows it.  invite is only needed by InviteOnly
+// policies.
+func (s *Service) Register(email, pwhash string, invite util.Key) error {
+	p, err := s.GetPolicy()
+	if err != nil {
+		return err
+	}
+
+	if err := ValidEmail(email); err != nil {
+		return err
+	}
+
+	switch p.Mode {
+	case Open, InviteOnly:
+	case DomainOnly:
+		if err := p.allows(email); err != nil {
+			return err
+		}
+	default:
+		return util.Forbiddenf("registration closed")
+	}
+
+	if err := p.Password.CheckFormat(email, pwhash); err != nil {
+		return err
+	}
+
+	if p.Mode != InviteOnly {
+		return s.Create(email, pwhash)
+	}
+
+	if err := s.useInvite(invite, false); err != nil {
+		return err
+	}
+
+	if err := s.Create(email, pwhash); err != nil {
+		if uerr := s.useInvite(invite, true); uerr != nil {
+			return errors.Annotatef(err, "returning invite failed: %s", uerr)
+		}
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,191 @@
+package user_test
+
+import (
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	"github.com/synapse-garden/mf-proto/user"
+	"github.com/synapse-garden/mf-proto/util"
+
+	gc "gopkg.in/check.v1"
+)
+
+func (s *UserSuite) TestPasswordRulesCheckFormat(c *gc.C) {
+	for i, t := range []struct {
+		should      string
+		rules       user.PasswordRules
+		pwhash      string
+		expectError string
+	}{{
+		should: "allow a long enough pwhash",
+		rules:  user.PasswordRules{MinLength: 8},
+		pwhash: "long enough",
+	}, {
+		should:      "not allow a short pwhash",
+		rules:       user.PasswordRules{MinLength: 8},
+		pwhash:      "short",
+		expectError: `pwhash shorter than 8 characters not valid`,
+	}, {
+		should:      "not allow the email as the pwhash",
+		rules:       user.PasswordRules{MinLength: 8},
+		pwhash:      "BOB@tomato.com",
+		expectError: `pwhash matching email not valid`,
+	}, {
+		should:      "not allow only letters when mixed is required",
+		rules:       user.PasswordRules{Mixed: true},
+		pwhash:      "onlyletters",
+		expectError: `pwhash without both letters and non-letters not valid`,
+	}, {
+		should:      "not allow only digits when mixed is required",
+		rules:       user.PasswordRules{Mixed: true},
+		pwhash:      "12345678",
+		expectError: `pwhash without both letters and non-letters not valid`,
+	}, {
+		should: "allow letters and digits when mixed is required",
+		rules:  user.PasswordRules{Mixed: true},
+		pwhash: "letters123",
+	}} {
+		c.Logf("test %d: should %s", i, t.should)
+		err := t.rules.CheckFormat("bob@tomato.com", t.pwhash)
+		if t.expectError == "" {
+			c.Check(err, jc.ErrorIsNil)
+		} else {
+			c.Check(err, gc.ErrorMatches, t.expectError)
+		}
+	}
+}
+
+func (s *UserSuite) TestSetPolicy(c *gc.C) {
+	p, err := s.svc.GetPolicy()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(*p, jc.DeepEquals, user.DefaultPolicy)
+
+	c.Check(
+		s.svc.SetPolicy(user.Policy{Mode: "anarchy"}),
+		gc.ErrorMatches, `registration mode "anarchy" not valid`,
+	)
+	c.Check(
+		s.svc.SetPolicy(user.Policy{Mode: user.DomainOnly}),
+		gc.ErrorMatches, `domain policy without domains not valid`,
+	)
+
+	want := user.Policy{
+		Mode:     user.DomainOnly,
+		Domains:  []string{"tomato.com"},
+		Password: user.PasswordRules{MinLength: 10, Mixed: true},
+	}
+	c.Assert(s.svc.SetPolicy(want), jc.ErrorIsNil)
+	p, err = s.svc.GetPolicy()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(*p, jc.DeepEquals, want)
+}
+
+func (s *UserSuite) TestRegister(c *gc.C) {
+	for i, t := range []struct {
+		should      string
+		policy      user.Policy
+		email, pw   string
+		expectError string
+	}{{
+		should:      "not register anyone by default",
+		email:       "bob@tomato.com",
+		pw:          "good password",
+		expectError: `registration closed`,
+	}, {
+		should: "register anyone with an open policy",
+		policy: user.Policy{Mode: user.Open},
+		email:  "bob@tomato.com",
+		pw:     "good password",
+	}, {
+		should:      "not register a bad email",
+		policy:      user.Policy{Mode: user.Open},
+		email:       "bob",
+		pw:          "good password",
+		expectError: `email "bob" not valid`,
+	}, {
+		should:      "not register a weak password",
+		policy:      user.Policy{Mode: user.Open, Password: user.PasswordRules{MinLength: 8}},
+		email:       "bob@tomato.com",
+		pw:          "12345",
+		expectError: `pwhash shorter than 8 characters not valid`,
+	}, {
+		should: "register an allowed domain",
+		policy: user.Policy{Mode: user.DomainOnly, Domains: []string{"Tomato.com"}},
+		email:  "bob@TOMATO.com",
+		pw:     "good password",
+	}, {
+		should:      "not register another domain",
+		policy:      user.Policy{Mode: user.DomainOnly, Domains: []string{"tomato.com"}},
+		email:       "larry@cucumber.net",
+		pw:          "good password",
+		expectError: `registration from "cucumber.net" not allowed`,
+	}, {
+		should:      "not register without an invite",
+		policy:      user.Policy{Mode: user.InviteOnly},
+		email:       "bob@tomato.com",
+		pw:          "good password",
+		expectError: `invite "" not valid`,
+	}} {
+		c.Logf("test %d: should %s", i, t.should)
+		if t.policy.Mode != "" {
+			c.Assert(s.svc.SetPolicy(t.policy), jc.ErrorIsNil)
+		}
+
+		err := s.svc.Register(t.email, t.pw, "")
+		if t.expectError != "" {
+			c.Check(err, gc.ErrorMatches, t.expectError)
+			continue
+		}
+		c.Assert(err, jc.ErrorIsNil)
+		c.Check(s.svc.CheckUser(t.email, t.pw), jc.ErrorIsNil)
+		c.Assert(s.svc.Delete(t.email), jc.ErrorIsNil)
+	}
+}
+
+func (s *UserSuite) TestRegisterInvite(c *gc.C) {
+	c.Assert(s.svc.SetPolicy(user.Policy{Mode: user.InviteOnly}), jc.ErrorIsNil)
+
+	_, err := s.svc.CreateInvite(0, time.Hour)
+	c.Check(err, gc.ErrorMatches, `invite with 0 uses not valid`)
+
+	inv, err := s.svc.CreateInvite(2, time.Hour)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(inv.Expires, gc.Equals, s.clock.Now().Add(time.Hour))
+
+	c.Check(
+		s.svc.Register("bob@tomato.com", "good password", "nope"),
+		gc.ErrorMatches, `invite "nope" not valid`,
+	)
+	c.Assert(s.svc.Register("bob@tomato.com", "good password", inv.Code), jc.ErrorIsNil)
+
+	// A failed registration gives the use back.
+	c.Check(
+		s.svc.Register("bob@tomato.com", "good password", inv.Code),
+		gc.ErrorMatches, `user for email "bob@tomato.com" already exists`,
+	)
+	invs, err := s.svc.Invites()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(invs, gc.HasLen, 1)
+	c.Check(invs[0].Uses, gc.Equals, 1)
+
+	c.Assert(s.svc.Register("larry@cucumber.net", "good password", inv.Code), jc.ErrorIsNil)
+	c.Check(
+		s.svc.Register("jove@olympus.mons", "good password", inv.Code),
+		gc.ErrorMatches, `invite ".*" not valid`,
+	)
+
+	expiring, err := s.svc.CreateInvite(5, time.Hour)
+	c.Assert(err, jc.ErrorIsNil)
+	s.clock.Advance(time.Hour)
+	c.Check(
+		s.svc.Register("jove@olympus.mons", "good password", expiring.Code),
+		gc.ErrorMatches, `invite ".*" not valid`,
+	)
+
+	c.Assert(s.svc.RevokeInvite(expiring.Code), jc.ErrorIsNil)
+	c.Check(
+		s.svc.RevokeInvite(expiring.Code),
+		gc.ErrorMatches, `invite ".*" not found`,
+	)
+	c.Check(s.svc.RevokeInvite(util.Key("nope")), gc.ErrorMatches, `invite "nope" not found`)
+}
@@ -0,0 +1,190 @@
+package user
+
+import (
+	"time"
+
+	"github.com/synapse-garden/mf-proto/db"
+	"github.com/synapse-garden/mf-proto/mail"
+	"github.com/synapse-garden/mf-proto/util"
+)
+
+const (
+	// DefaultTimeout is how long a login lasts without being used.
+	DefaultTimeout = 5 * time.Minute
+
+	// DefaultVerifyTTL is how long an email verification link lasts.
+	DefaultVerifyTTL = 48 * time.Hour
+
+	// DefaultResetTTL is how long a password reset link lasts.
+	DefaultResetTTL = time.Hour
+)
+
+// Hook is called with a user's email after some event has happened to the
+// user.  If it returns an error, the error is returned to the caller.
+type Hook func(email string) error
+
+// Hooks are the Hooks a Service calls after each kind of event.
+type Hooks struct {
+	Created []Hook
+	Deleted []Hook
+
+	// Revoked are called when the user's password is changed or reset,
+	// when they are disabled, and before they are deleted, so that
+	// credentials kept elsewhere can be revoked along with their logins.
+	Revoked []Hook
+}
+
+func runHooks(hs []Hook, email string) error {
+	for _, h := range hs {
+		if err := h(email); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Service performs user operations against its own DB, using its own Clock
+// and login Timeout.  Several Services may be used in one process without
+// sharing any state.
+type Service struct {
+	DB      db.DB
+	Clock   util.Clock
+	Timeout time.Duration
+	Hooks   Hooks
+
+	// Secret signs the tokens the Service sends out.  If it is empty, a
+	// random secret is made and kept in the Secrets bucket.
+	Secret []byte
+
+	// Mailer sends mail to users.  If it is nil, new users are not asked
+	// to verify their email addresses.
+	Mailer   mail.Mailer
+	MailFrom string
+
+	// VerifyURL is the link to the /user/verify endpoint mailed to new
+	// users, and VerifyTTL is how long the link lasts.
+	VerifyURL string
+	VerifyTTL time.Duration
+
+	// ResetURL is the password reset page whose link is mailed to users
+	// who forgot their password, and ResetTTL is how long the link lasts.
+	ResetURL string
+	ResetTTL time.Duration
+
+	// EmailURL is the link to the /user/email/confirm endpoint mailed to
+	// a user's new address when they change it.  It lasts for VerifyTTL.
+	EmailURL string
+
+	// Issuer names the service in users' authenticator apps.
+	Issuer string
+
+	// Throttle limits failed logins.
+	Throttle Throttle
+
+	// JWTAlg is the algorithm logins are signed with as JWTs, which last
+	// for JWTTTL.  If it is empty, logins are kept in the DB instead.
+	JWTAlg string
+	JWTTTL time.Duration
+
+	jwt *jwtCache
+}
+
+// Option configures a Service.
+type Option func(*Service)
+
+// WithClock sets the Clock a Service uses.
+func WithClock(c util.Clock) Option {
+	return func(s *Service) { s.Clock = c }
+}
+
+// WithTimeout sets how long a Service's logins last.
+func WithTimeout(t time.Duration) Option {
+	return func(s *Service) { s.Timeout = t }
+}
+
+// WithSecret sets the secret a Service signs its tokens with.
+func WithSecret(secret []byte) Option {
+	return func(s *Service) { s.Secret = secret }
+}
+
+// WithMailer sets the Mailer a Service sends mail with, and the sender of
+// the mail.  New users of a Service with a Mailer must verify their email
+// addresses before logging in.
+func WithMailer(m mail.Mailer, from string) Option {
+	return func(s *Service) {
+		s.Mailer = m
+		s.MailFrom = from
+	}
+}
+
+// WithVerifyURL sets the verification link mailed to new users.
+func WithVerifyURL(u string) Option {
+	return func(s *Service) { s.VerifyURL = u }
+}
+
+// WithResetURL sets the password reset link mailed to users.
+func WithResetURL(u string) Option {
+	return func(s *Service) { s.ResetURL = u }
+}
+
+// WithEmailURL sets the email change link mailed to users' new addresses.
+func WithEmailURL(u string) Option {
+	return func(s *Service) { s.EmailURL = u }
+}
+
+// WithThrottle sets how a Service limits failed logins.
+func WithThrottle(t Throttle) Option {
+	return func(s *Service) { s.Throttle = t }
+}
+
+// WithJWT makes a Service's logins JWTs signed with the given algorithm,
+// which last for ttl.  They are checked without using the DB.
+func WithJWT(alg string, ttl time.Duration) Option {
+	return func(s *Service) {
+		s.JWTAlg = alg
+		s.JWTTTL = ttl
+	}
+}
+
+// OnCreated adds Hooks to be called after a user is created.
+func OnCreated(hs ...Hook) Option {
+	return func(s *Service) { s.Hooks.Created = append(s.Hooks.Created, hs...) }
+}
+
+// OnDeleted adds Hooks to be called after a user is deleted.
+func OnDeleted(hs ...Hook) Option {
+	return func(s *Service) { s.Hooks.Deleted = append(s.Hooks.Deleted, hs...) }
+}
+
+// OnRevoked adds Hooks to be called when a user's credentials are revoked.
+func OnRevoked(hs ...Hook) Option {
+	return func(s *Service) { s.Hooks.Revoked = append(s.Hooks.Revoked, hs...) }
+}
+
+// NewService makes a new Service for the given DB using the system clock and
+// DefaultTimeout, unless otherwise configured by the given Options.
+func NewService(d db.DB, opts ...Option) *Service {
+	s := &Service{
+		DB:      d,
+		Clock:   util.SystemClock{},
+		Timeout: DefaultTimeout,
+
+		VerifyURL: "https://localhost:25001/user/verify",
+		VerifyTTL: DefaultVerifyTTL,
+
+		ResetURL: "https://localhost:25001/user/password/reset",
+		ResetTTL: DefaultResetTTL,
+
+		EmailURL: "https://localhost:25001/user/email/confirm",
+
+		Issuer:   "Mindfork",
+		Throttle: DefaultThrottle,
+
+		JWTTTL: DefaultJWTTTL,
+		jwt:    new(jwtCache),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
@@ -0,0 +1,238 @@
+package user
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/juju/errors"
+	"github.com/synapse-garden/mf-proto/db"
+)
+
+// Attempts holds the failed login counters for accounts and addresses.
+const Attempts db.Bucket = "user-attempts"
+
+// Throttle configures how failed logins are slowed down.
+type Throttle struct {
+	// Free is how many failures are allowed before backoff starts.
+	Free int
+
+	// Base is the wait after the first failure past Free, which doubles
+	// with each further failure up to Max.
+	Base, Max time.Duration
+
+	// LockAfter is how many failures lock an account for LockFor, or
+	// until an admin unlocks it.  Addresses are never locked, only slowed.
+	LockAfter int
+	LockFor   time.Duration
+
+	// Window is how long failures are remembered after the last one.
+	Window time.Duration
+}
+
+// DefaultThrottle is the Throttle a new Service uses.
+var DefaultThrottle = Throttle{
+	Free:      3,
+	Base:      time.Second,
+	Max:       15 * time.Minute,
+	LockAfter: 10,
+	LockFor:   time.Hour,
+	Window:    24 * time.Hour,
+}
+
+// attempts counts the recent failed logins for an account or address.
+type attempts struct {
+	Failures int       `json:"failures,omitempty"`
+	Last     time.Time `json:"last,omitempty"`
+	Until    time.Time `json:"until,omitempty"`
+	Locked   bool      `json:"locked,omitempty"`
+}
+
+func accountKey(email string) []byte { return []byte("account:" + email) }
+func factorKey(email string) []byte  { return []byte("factor:" + email) }
+func addrKey(addr string) []byte     { return []byte("addr:" + addr) }
+
+// loginKeys returns the keys of the counters a login for the given account
+// from the given address is throttled by: its password and second factor
+// failures, and the address's failures if it is known.
+func loginKeys(addr, account string) [][]byte {
+	keys := [][]byte{accountKey(account), factorKey(account)}
+	if addr != "" {
+		keys = append(keys, addrKey(addr))
+	}
+	return keys
+}
+
+// errBadLogin is returned for any bad email, password or code, so that
+// callers can't tell which accounts exist.
+func errBadLogin() error {
+	return errors.Unauthorizedf("invalid email or password")
+}
+
+func (s *Service) getAttempts(key []byte) (*attempts, error) {
+	bs, err := db.GetByKey(s.DB, Attempts, key)
+	if err != nil {
+		return nil, err
+	}
+
+	a := new(attempts)
+	if len(bs) == 0 {
+		return a, nil
+	}
+
+	if err := json.Unmarshal(bs, a); err != nil {
+		return nil, err
+	}
+
+	if s.Clock.Now().Sub(a.Last) > s.Throttle.Window {
+		return new(attempts), nil
+	}
+
+	return a, nil
+}
+
+// throttled returns an error if logins for any of the given keys must wait.
+func (s *Service) throttled(keys ...[]byte) error {
+	now := s.Clock.Now()
+	for _, k := range keys {
+		a, err := s.getAttempts(k)
+		if err != nil {
+			return err
+		}
+
+		if now.Before(a.Until) {
+			return errors.Unauthorizedf(
+				"too many failed logins, try again after %s",
+				a.Until.Format(time.RFC3339),
+			)
+		}
+	}
+
+	return nil
+}
+
+// fail counts a failed password against the given account and address.
+func (s *Service) fail(email, addr string) error {
+	return s.failKey(accountKey(email), addr)
+}
+
+// failFactor counts a failed second factor against the given account and
+// address.  A good password doesn't clear these failures, so that someone
+// who knows it still can't keep guessing codes.
+func (s *Service) failFactor(email, addr string) error {
+	return s.failKey(factorKey(email), addr)
+}
+
+func (s *Service) failKey(key []byte, addr string) error {
+	if err := s.count(key, true); err != nil {
+		return err
+	}
+
+	if addr == "" {
+		return nil
+	}
+
+	return s.count(addrKey(addr), false)
+}
+
+func (s *Service) count(key []byte, lockable bool) error {
+	a, err := s.getAttempts(key)
+	if err != nil {
+		return err
+	}
+
+	t := s.Throttle
+	now := s.Clock.Now()
+	a.Failures++
+	a.Last = now
+
+	switch {
+	case lockable && t.LockAfter > 0 && a.Failures >= t.LockAfter:
+		a.Locked = true
+		a.Until = now.Add(t.LockFor)
+	case a.Failures > t.Free:
+		wait := t.Base
+		for i := t.Free + 1; i < a.Failures && wait < t.Max; i++ {
+			wait *= 2
+		}
+		if wait > t.Max {
+			wait = t.Max
+		}
+		a.Until = now.Add(wait)
+	}
+
+	return db.StoreKeyValue(s.DB, Attempts, key, a)
+}
+
+// Succeed forgets the failed passwords and second factors for the given
+// account.  It must only be called once a login is complete, including its
+// second factor.  Failures from an address are not forgotten, so an
+// attacker can't clear them by logging into their own account.
+func (s *Service) Succeed(account string) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(Attempts))
+		if b == nil {
+			return db.BucketNotFoundErr(Attempts)
+		}
+
+		if err := b.Delete(accountKey(account)); err != nil {
+			return err
+		}
+		return b.Delete(factorKey(account))
+	})
+}
+
+// LockedUntil returns when the given account's lockout ends, and whether it
+// is locked, for failed passwords or second factors.
+func (s *Service) LockedUntil(email string) (time.Time, bool, error) {
+	var until time.Time
+	for _, k := range [][]byte{accountKey(email), factorKey(email)} {
+		a, err := s.getAttempts(k)
+		if err != nil {
+			return time.Time{}, false, err
+		}
+
+		if a.Locked && s.Clock.Now().Before(a.Until) && a.Until.After(until) {
+			until = a.Until
+		}
+	}
+
+	return until, !until.IsZero(), nil
+}
+
+// Unlock clears the failed logins and any lockout for the given account.
+func (s *Service) Unlock(email string) error {
+	return s.unlock(accountKey(email), factorKey(email))
+}
+
+// UnlockAddr clears the failed logins for the given address.
+func (s *Service) UnlockAddr(addr string) error {
+	return s.unlock(addrKey(addr))
+}
+
+// unlock deletes the counters with the given keys, of which the first names
+// them in the error if there are none.
+func (s *Service) unlock(keys ...[]byte) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(Attempts))
+		if b == nil {
+			return db.BucketNotFoundErr(Attempts)
+		}
+
+		found := false
+		for _, k := range keys {
+			if len(b.Get(k)) == 0 {
+				continue
+			}
+			found = true
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		if !found {
+			return errors.NotFoundf("failed logins for %s", keys[0])
+		}
+		return nil
+	})
+}
@@ -0,0 +1,212 @@
+package user_test
+
+import (
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	"github.com/synapse-garden/mf-proto/totp"
+	"github.com/synapse-garden/mf-proto/user"
+
+	gc "gopkg.in/check.v1"
+)
+
+func (s *UserSuite) TestThrottle(c *gc.C) {
+	s.createUsers(c)
+	b := s.users["bob"]
+	svc := user.NewService(s.d,
+		user.WithClock(s.clock),
+		user.WithThrottle(user.Throttle{
+			Free:      2,
+			Base:      time.Second,
+			Max:       4 * time.Second,
+			LockAfter: 6,
+			LockFor:   time.Hour,
+			Window:    24 * time.Hour,
+		}),
+	)
+
+	for i, t := range []struct {
+		should      string
+		advance     time.Duration
+		email       string
+		pwhash      string
+		expectError string
+	}{{
+		should:      "reject a bad password",
+		email:       b.Email,
+		pwhash:      "wrong",
+		expectError: `invalid email or password`,
+	}, {
+		should:      "reject a nonexistent user the same way",
+		email:       "jove@olympus.mons",
+		pwhash:      "wrong",
+		expectError: `invalid email or password`,
+	}, {
+		should:      "allow free failures without waiting",
+		email:       b.Email,
+		pwhash:      "wrong",
+		expectError: `invalid email or password`,
+	}, {
+		should:      "start backing off after the free failures",
+		email:       b.Email,
+		pwhash:      "wrong",
+		expectError: `invalid email or password`,
+	}, {
+		should:      "reject even the right password while backing off",
+		email:       b.Email,
+		pwhash:      b.Pwhash,
+		expectError: `too many failed logins, try again after 2016-01-14T00:00:01Z`,
+	}, {
+		should:      "count another failure once the wait is over",
+		advance:     time.Second,
+		email:       b.Email,
+		pwhash:      "wrong",
+		expectError: `invalid email or password`,
+	}, {
+		should:      "double the wait",
+		advance:     time.Second,
+		email:       b.Email,
+		pwhash:      b.Pwhash,
+		expectError: `too many failed logins, try again after 2016-01-14T00:00:03Z`,
+	}, {
+		should:  "log in once the wait is over",
+		advance: time.Second,
+		email:   b.Email,
+		pwhash:  b.Pwhash,
+	}, {
+		should:      "forget failures after a successful login",
+		email:       b.Email,
+		pwhash:      "wrong",
+		expectError: `invalid email or password`,
+	}} {
+		c.Logf("test %d: should %s", i, t.should)
+		s.clock.Advance(t.advance)
+		_, err := svc.LoginUser(t.email, t.pwhash)
+		if t.expectError != "" {
+			c.Check(err, gc.ErrorMatches, t.expectError)
+		} else {
+			c.Check(err, jc.ErrorIsNil)
+		}
+	}
+}
+
+func (s *UserSuite) TestThrottleAddr(c *gc.C) {
+	s.createUsers(c)
+	svc := user.NewService(s.d,
+		user.WithClock(s.clock),
+		user.WithThrottle(user.Throttle{
+			Base:   time.Second,
+			Max:    time.Minute,
+			Window: time.Hour,
+		}),
+	)
+
+	_, err := svc.LoginUserFrom("10.0.0.1", "jove@olympus.mons", "wrong")
+	c.Check(err, gc.ErrorMatches, `invalid email or password`)
+
+	// Guessing at another account from the same address must wait.
+	l := s.users["larry"]
+	_, err = svc.LoginUserFrom("10.0.0.1", l.Email, l.Pwhash)
+	c.Check(err, gc.ErrorMatches, `too many failed logins, .*`)
+
+	_, err = svc.LoginUserFrom("10.0.0.2", l.Email, l.Pwhash)
+	c.Check(err, jc.ErrorIsNil)
+
+	c.Assert(svc.UnlockAddr("10.0.0.1"), jc.ErrorIsNil)
+	c.Check(svc.UnlockAddr("10.0.0.1"), gc.ErrorMatches, `failed logins for addr:10.0.0.1 not found`)
+	_, err = svc.LoginUserFrom("10.0.0.1", l.Email, l.Pwhash)
+	c.Check(err, jc.ErrorIsNil)
+}
+
+func (s *UserSuite) TestLockout(c *gc.C) {
+	s.createUsers(c)
+	b := s.users["bob"]
+	svc := user.NewService(s.d,
+		user.WithClock(s.clock),
+		user.WithThrottle(user.Throttle{
+			Free:      5,
+			LockAfter: 3,
+			LockFor:   time.Hour,
+			Window:    24 * time.Hour,
+		}),
+	)
+
+	for i := 0; i < 3; i++ {
+		_, err := svc.LoginUser(b.Email, "wrong")
+		c.Check(err, gc.ErrorMatches, `invalid email or password`)
+	}
+
+	until, locked, err := svc.LockedUntil(b.Email)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(locked, gc.Equals, true)
+	c.Check(until, gc.Equals, s.clock.Now().Add(time.Hour))
+
+	_, err = svc.LoginUser(b.Email, b.Pwhash)
+	c.Check(err, gc.ErrorMatches, `too many failed logins, .*`)
+
+	c.Assert(svc.Unlock(b.Email), jc.ErrorIsNil)
+	_, locked, err = svc.LockedUntil(b.Email)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(locked, gc.Equals, false)
+
+	_, err = svc.LoginUser(b.Email, b.Pwhash)
+	c.Check(err, jc.ErrorIsNil)
+}
+
+func (s *UserSuite) TestLockoutSecondFactor(c *gc.C) {
+	s.createUsers(c)
+	b := s.users["bob"]
+	secret, _ := s.enableTOTP(b.Email, c)
+	s.clock.Advance(totp.Period)
+	svc := user.NewService(s.d,
+		user.WithClock(s.clock),
+		user.WithThrottle(user.Throttle{
+			Free:      100,
+			LockAfter: 5,
+			LockFor:   time.Hour,
+			Window:    24 * time.Hour,
+		}),
+	)
+
+	// Logging in again with the right password doesn't forget bad codes.
+	for i := 0; i < 5; i++ {
+		l, err := svc.LoginUserFrom("10.0.0.1", b.Email, b.Pwhash)
+		c.Assert(err, jc.ErrorIsNil)
+		c.Assert(l.Pending, jc.IsTrue)
+		_, err = svc.CompleteLogin("10.0.0.1", b.Email, l.Key, "000000")
+		c.Check(err, gc.ErrorMatches, `code "000000" not valid`)
+	}
+
+	until, locked, err := svc.LockedUntil(b.Email)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(locked, jc.IsTrue)
+	c.Check(until, gc.Equals, s.clock.Now().Add(time.Hour))
+
+	_, err = svc.LoginUserFrom("10.0.0.2", b.Email, b.Pwhash)
+	c.Check(err, gc.ErrorMatches, `too many failed logins, .*`)
+	_, err = svc.Authenticate("10.0.0.2", b.Email, b.Pwhash, "000000")
+	c.Check(err, gc.ErrorMatches, `too many failed logins, .*`)
+
+	// Nor does consenting with the right password.
+	c.Assert(svc.Unlock(b.Email), jc.ErrorIsNil)
+	for i := 0; i < 5; i++ {
+		_, err := svc.Authenticate("10.0.0.2", b.Email, b.Pwhash, "000000")
+		c.Check(err, gc.ErrorMatches, `code "000000" not valid`)
+	}
+	_, locked, err = svc.LockedUntil(b.Email)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(locked, jc.IsTrue)
+
+	// A complete login forgets them.
+	c.Assert(svc.Unlock(b.Email), jc.ErrorIsNil)
+	c.Check(svc.Unlock(b.Email), gc.ErrorMatches, `failed logins for account:bob@tomato.com not found`)
+	l, err := svc.LoginUserFrom("10.0.0.2", b.Email, b.Pwhash)
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = svc.CompleteLogin("10.0.0.2", b.Email, l.Key, "000000")
+	c.Check(err, gc.ErrorMatches, `code "000000" not valid`)
+	code, err := totp.Code(secret, s.clock.Now())
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = svc.CompleteLogin("10.0.0.2", b.Email, l.Key, code)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(svc.Unlock(b.Email), gc.ErrorMatches, `failed logins for .* not found`)
+}
@@ -0,0 +1,199 @@
+package user
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/juju/errors"
+	"github.com/synapse-garden/mf-proto/db"
+	"github.com/synapse-garden/mf-proto/util"
+)
+
+const (
+	// Tokens holds the nonces of outstanding single-use tokens.
+	Tokens db.Bucket = "user-tokens"
+
+	// Secrets holds the secret used to sign tokens, if the Service was
+	// not given one.
+	Secrets db.Bucket = "user-secrets"
+)
+
+var tokenSecretKey = []byte("token")
+
+// Purpose is what a signed token may be used for.
+type Purpose string
+
+const (
+	// PurposeVerify tokens verify a new user's email address.
+	PurposeVerify Purpose = "verify"
+
+	// PurposeReset tokens reset a user's forgotten password.
+	PurposeReset Purpose = "reset"
+
+	// PurposeEmail tokens change a user's email to the one they were
+	// sent to.
+	PurposeEmail Purpose = "email"
+)
+
+// token is the signed payload of a single-use token.
+type token struct {
+	Purpose Purpose   `json:"purpose"`
+	ID      string    `json:"id,omitempty"`
+	Email   string    `json:"email"`
+	Nonce   util.Key  `json:"nonce"`
+	Expires time.Time `json:"expires"`
+}
+
+// tokenSecret gets the Service's Secret, or else the secret stored in the
+// Secrets bucket, creating it if it does not yet exist.
+func (s *Service) tokenSecret() ([]byte, error) {
+	if len(s.Secret) > 0 {
+		return s.Secret, nil
+	}
+
+	var secret []byte
+	err := s.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(Secrets))
+		if b == nil {
+			return db.BucketNotFoundErr(Secrets)
+		}
+
+		if stored := b.Get(tokenSecretKey); len(stored) > 0 {
+			secret = append([]byte(nil), stored...)
+			return nil
+		}
+
+		var err error
+		if secret, err = util.RandomBytes(32); err != nil {
+			return err
+		}
+		return b.Put(tokenSecretKey, secret)
+	})
+
+	return secret, err
+}
+
+// issueToken makes a new signed token for the given Purpose, user ID and
+// email, which expires after ttl and may be redeemed only once.
+func (s *Service) issueToken(p Purpose, id, email string, ttl time.Duration) (string, error) {
+	secret, err := s.tokenSecret()
+	if err != nil {
+		return "", err
+	}
+
+	nonce, err := util.NewKey()
+	if err != nil {
+		return "", err
+	}
+
+	t := token{
+		Purpose: p,
+		ID:      id,
+		Email:   email,
+		Nonce:   nonce,
+		Expires: s.Clock.Now().Add(ttl),
+	}
+
+	payload, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+
+	if err := db.StoreKeyValue(s.DB, Tokens, []byte(nonce), t); err != nil {
+		return "", err
+	}
+
+	return util.Sign(secret, payload), nil
+}
+
+// redeemToken checks that signed is a valid, unexpired token for the given
+// Purpose which has not yet been redeemed, and uses it up.
+func (s *Service) redeemToken(p Purpose, signed string) (*token, error) {
+	secret, err := s.tokenSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := util.Verify(secret, signed)
+	if err != nil {
+		return nil, err
+	}
+
+	t := new(token)
+	if err := json.Unmarshal(payload, t); err != nil {
+		return nil, errors.NotValidf("token payload %q", payload)
+	}
+
+	switch {
+	case t.Purpose != p:
+		return nil, errors.NotValidf("%s token for %s", t.Purpose, p)
+	case !s.Clock.Now().Before(t.Expires):
+		return nil, errors.NotValidf("expired %s token", p)
+	}
+
+	err = s.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(Tokens))
+		if b == nil {
+			return db.BucketNotFoundErr(Tokens)
+		}
+
+		if len(b.Get([]byte(t.Nonce))) == 0 {
+			return errors.NotValidf("used %s token", p)
+		}
+		return b.Delete([]byte(t.Nonce))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// deleteTokens deletes every outstanding token for the given Purpose which
+// was issued to the user with the given ID, so none of them can be redeemed.
+func (s *Service) deleteTokens(p Purpose, id string) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(Tokens))
+		if b == nil {
+			return db.BucketNotFoundErr(Tokens)
+		}
+
+		var stale [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			var t token
+			if err := json.Unmarshal(v, &t); err != nil {
+				return errors.Annotatef(err, "reading token %q", k)
+			}
+			if t.Purpose == p && t.ID == id {
+				stale = append(stale, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range stale {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// tokenUser returns the user a token was issued for, as long as they still
+// have the email it was sent to.
+func (s *Service) tokenUser(t *token) (*User, error) {
+	u, err := s.Get(t.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.ID != "" && u.ID != t.ID {
+		return nil, errors.NotValidf("%s token for %q", t.Purpose, t.Email)
+	}
+
+	return u, nil
+}
@@ -0,0 +1,278 @@
+package user
+
+import (
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/synapse-garden/mf-proto/totp"
+	"github.com/synapse-garden/mf-proto/util"
+)
+
+// RecoveryCodes is how many recovery codes a user gets when they enable
+// two-factor authentication.
+const RecoveryCodes = 10
+
+// TOTP is a user's two-factor authentication setup.
+type TOTP struct {
+	// Secret is shared with the user's authenticator app.
+	Secret string `json:"secret,omitempty"`
+
+	// Enabled is set once the user has confirmed their app works.
+	Enabled bool `json:"enabled,omitempty"`
+
+	// Last is the counter of the last code accepted, so that codes
+	// cannot be used twice.
+	Last int64 `json:"last,omitempty"`
+
+	// Recovery holds the salted hashes of unused recovery codes.
+	RecoverySalt util.Salt   `json:"recovery_salt,omitempty"`
+	Recovery     []util.Hash `json:"recovery,omitempty"`
+}
+
+// Active reports whether t is set up and enabled.
+func (t *TOTP) Active() bool {
+	return t != nil && t.Enabled
+}
+
+// Check consumes a TOTP or recovery code, returning an error if it is not
+// valid for t.
+func (t *TOTP) Check(code string, now time.Time) error {
+	if counter, err := totp.Check(t.Secret, code, now); err == nil {
+		if counter <= t.Last {
+			return errors.NotValidf("reused code %q", code)
+		}
+		t.Last = counter
+		return nil
+	}
+
+	for i, h := range t.Recovery {
+		if util.CheckHashedPw(code, t.RecoverySalt, h) {
+			t.Recovery = append(t.Recovery[:i], t.Recovery[i+1:]...)
+			return nil
+		}
+	}
+
+	return errors.NotValidf("code %q", code)
+}
+
+// Confirm enables t given a current code from its app, and returns its
+// recovery codes, which are only kept hashed.
+func (t *TOTP) Confirm(code string, now time.Time) ([]string, error) {
+	// Only the app's code is accepted here, since there are no recovery
+	// codes yet.
+	if err := t.Check(code, now); err != nil {
+		return nil, err
+	}
+
+	codes, salt, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	t.Enabled = true
+	t.RecoverySalt = salt
+	t.Recovery = hashes
+	return codes, nil
+}
+
+func newRecoveryCodes() ([]string, util.Salt, []util.Hash, error) {
+	seed, err := util.NewKey()
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	var (
+		codes  = make([]string, RecoveryCodes)
+		hashes = make([]util.Hash, RecoveryCodes)
+		salt   util.Salt
+	)
+	for i := range codes {
+		k, err := util.NewKey()
+		if err != nil {
+			return nil, "", nil, err
+		}
+		codes[i] = string(k[:10])
+		hashes[i], salt = util.HashedAndSalt(codes[i], string(seed))
+	}
+
+	return codes, salt, hashes, nil
+}
+
+// EnrollTOTP starts two-factor authentication setup for the user with the
+// given ID, whose login the caller has checked, returning the new secret and
+// its otpauth:// URI for their authenticator app.  It is not enabled until
+// the user calls ConfirmTOTP.
+func (s *Service) EnrollTOTP(id string) (secret, uri string, err error) {
+	u, err := s.GetByID(id)
+	if err != nil {
+		return "", "", err
+	}
+
+	if u.TOTP.Active() {
+		return "", "", errors.AlreadyExistsf("two-factor authentication for %q", u.Email)
+	}
+
+	if secret, err = totp.NewSecret(); err != nil {
+		return "", "", err
+	}
+
+	u.TOTP = &TOTP{Secret: secret}
+	if err := s.put(u); err != nil {
+		return "", "", err
+	}
+
+	return secret, totp.URI(s.Issuer, u.Email, secret), nil
+}
+
+// ConfirmTOTP enables two-factor authentication for the user with the given
+// ID who has enrolled, given a current code from their app.  It returns the
+// user's recovery codes, which are only stored hashed and cannot be shown
+// again.
+func (s *Service) ConfirmTOTP(id, code string) ([]string, error) {
+	u, err := s.GetByID(id)
+	switch {
+	case err != nil:
+		return nil, err
+	case u.TOTP == nil:
+		return nil, errors.NotFoundf("two-factor enrollment for %q", u.Email)
+	case u.TOTP.Enabled:
+		return nil, errors.AlreadyExistsf("two-factor authentication for %q", u.Email)
+	}
+
+	codes, err := u.TOTP.Confirm(code, s.Clock.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, s.put(u)
+}
+
+// DisableTOTP turns off two-factor authentication for the user with the
+// given ID, given a current code or recovery code.
+func (s *Service) DisableTOTP(id, code string) error {
+	u, err := s.GetByID(id)
+	if err != nil {
+		return err
+	}
+
+	if !u.TOTP.Active() {
+		return errors.NotFoundf("two-factor authentication for %q", u.Email)
+	}
+
+	if err := u.TOTP.Check(code, s.Clock.Now()); err != nil {
+		return err
+	}
+
+	u.TOTP = nil
+	return s.put(u)
+}
+
+// ResetTOTP removes a user's two-factor authentication, for when they have
+// lost both their app and their recovery codes.  It is for admins only.
+func (s *Service) ResetTOTP(email string) error {
+	u, err := s.Get(email)
+	if err != nil {
+		return err
+	}
+
+	if u.TOTP == nil {
+		return errors.NotFoundf("two-factor authentication for %q", email)
+	}
+
+	u.TOTP = nil
+	return s.put(u)
+}
+
+// CompleteLogin finishes the login of a user with two-factor authentication,
+// from the given address, given the Key of their Pending Login and a code or
+// recovery code.  The pending key is replaced by the returned Login.  A bad
+// key, login or code is Unauthorized, and bad codes are throttled apart from
+// bad passwords, so that logging in again doesn't clear them.
+func (s *Service) CompleteLogin(addr, email string, key util.Key, code string) (*Login, error) {
+	login, err := s.GetLogin(email)
+	switch {
+	case err != nil:
+		return nil, errors.Unauthorizedf("no login for email %q", email)
+	case login.Key != key:
+		return nil, errors.Unauthorizedf("bad key for user %q", email)
+	case !login.Pending:
+		return nil, errors.Unauthorizedf("login for %q not awaiting second factor", email)
+	case !s.Clock.Now().Before(login.Timeout):
+		return nil, errors.Unauthorizedf("user %q timed out", email)
+	}
+
+	u, err := s.Get(email)
+	if err != nil {
+		return nil, err
+	}
+
+	if !u.TOTP.Active() {
+		return nil, errors.NotFoundf("two-factor authentication for %q", email)
+	}
+
+	if err := u.enabled(); err != nil {
+		return nil, err
+	}
+
+	if err := s.throttled(loginKeys(addr, email)...); err != nil {
+		return nil, err
+	}
+
+	if err := u.TOTP.Check(code, s.Clock.Now()); err != nil {
+		if ferr := s.failFactor(email, addr); ferr != nil {
+			return nil, ferr
+		}
+		return nil, errors.NewUnauthorized(err, "")
+	}
+
+	if err := s.touchLogin(u); err != nil {
+		return nil, err
+	}
+
+	if err := s.Succeed(email); err != nil {
+		return nil, err
+	}
+
+	return s.newLogin(email, false)
+}
+
+// Authenticate checks the user's password, and their code or recovery code
+// if they have two-factor authentication enabled, without logging them in.
+// It is for flows such as OAuth consent where the user proves who they are
+// to a page rather than starting a session.  Failures are throttled like
+// logins from the given address.
+func (s *Service) Authenticate(addr, email, pwhash, code string) (*User, error) {
+	if err := s.checkPassword(addr, email, pwhash); err != nil {
+		return nil, err
+	}
+
+	u, err := s.Get(email)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Unverified {
+		return nil, errors.Unauthorizedf("user %q has not verified their email", email)
+	}
+
+	if err := u.enabled(); err != nil {
+		return nil, err
+	}
+
+	if !u.TOTP.Active() {
+		return u, s.Succeed(email)
+	}
+
+	if err := u.TOTP.Check(code, s.Clock.Now()); err != nil {
+		if ferr := s.failFactor(email, addr); ferr != nil {
+			return nil, ferr
+		}
+		return nil, err
+	}
+
+	// Keep the last used code, so that it cannot be used again.
+	if err := s.put(u); err != nil {
+		return nil, err
+	}
+	return u, s.Succeed(email)
+}
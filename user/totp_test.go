@@ -0,0 +1,158 @@
+package user_test
+
+import (
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	"github.com/synapse-garden/mf-proto/totp"
+	"github.com/synapse-garden/mf-proto/user"
+
+	gc "gopkg.in/check.v1"
+)
+
+// enableTOTP enables two-factor authentication for the given user,
+// returning its secret and recovery codes.
+func (s *UserSuite) enableTOTP(email string, c *gc.C) (string, []string) {
+	id := mustID(s.svc, email, c)
+
+	_, err := s.svc.ConfirmTOTP(id, "000000")
+	c.Check(err, gc.ErrorMatches, `two-factor enrollment for ".*" not found`)
+
+	secret, uri, err := s.svc.EnrollTOTP(id)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(uri, gc.Equals, totp.URI("Mindfork", email, secret))
+
+	code, err := totp.Code(secret, s.clock.Now())
+	c.Assert(err, jc.ErrorIsNil)
+
+	_, err = s.svc.ConfirmTOTP(id, "000000")
+	c.Check(err, gc.ErrorMatches, `code "000000" not valid`)
+
+	codes, err := s.svc.ConfirmTOTP(id, code)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(codes, gc.HasLen, user.RecoveryCodes)
+
+	_, _, err = s.svc.EnrollTOTP(id)
+	c.Check(err, gc.ErrorMatches, `two-factor authentication for ".*" already exists`)
+
+	return secret, codes
+}
+
+func (s *UserSuite) TestTOTPLogin(c *gc.C) {
+	s.createUsers(c)
+	b := s.users["bob"]
+	secret, _ := s.enableTOTP(b.Email, c)
+	used, err := totp.Code(secret, s.clock.Now())
+	c.Assert(err, jc.ErrorIsNil)
+
+	s.clock.Advance(totp.Period)
+	login, err := s.svc.LoginUser(b.Email, b.Pwhash)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(login.Pending, gc.Equals, true)
+
+	err = s.svc.ValidLogin(b.Email, login.Key)
+	c.Check(err, gc.ErrorMatches, `login for "bob@tomato.com" awaiting second factor not valid`)
+
+	// The code used to confirm enrollment can't be used again.
+	_, err = s.svc.CompleteLogin("", b.Email, login.Key, used)
+	c.Check(err, gc.ErrorMatches, `reused code ".*" not valid`)
+	c.Check(errors.IsUnauthorized(err), jc.IsTrue)
+
+	code, err := totp.Code(secret, s.clock.Now())
+	c.Assert(err, jc.ErrorIsNil)
+
+	_, err = s.svc.CompleteLogin("", b.Email, "foo", code)
+	c.Check(err, gc.ErrorMatches, `bad key for user "bob@tomato.com"`)
+	c.Check(errors.IsUnauthorized(err), jc.IsTrue)
+
+	done, err := s.svc.CompleteLogin("", b.Email, login.Key, code)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(done.Pending, gc.Equals, false)
+	c.Check(done.Key, gc.Not(gc.Equals), login.Key)
+	c.Check(s.svc.ValidLogin(b.Email, done.Key), jc.ErrorIsNil)
+
+	_, err = s.svc.CompleteLogin("", b.Email, done.Key, code)
+	c.Check(err, gc.ErrorMatches, `login for "bob@tomato.com" not awaiting second factor`)
+}
+
+func (s *UserSuite) TestTOTPRecoveryCodes(c *gc.C) {
+	s.createUsers(c)
+	b := s.users["bob"]
+	_, codes := s.enableTOTP(b.Email, c)
+
+	login, err := s.svc.LoginUser(b.Email, b.Pwhash)
+	c.Assert(err, jc.ErrorIsNil)
+
+	_, err = s.svc.CompleteLogin("", b.Email, login.Key, codes[3])
+	c.Assert(err, jc.ErrorIsNil)
+
+	// Recovery codes only work once.
+	login, err = s.svc.LoginUser(b.Email, b.Pwhash)
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = s.svc.CompleteLogin("", b.Email, login.Key, codes[3])
+	c.Check(err, gc.ErrorMatches, `code ".*" not valid`)
+
+	_, err = s.svc.CompleteLogin("", b.Email, login.Key, codes[4])
+	c.Assert(err, jc.ErrorIsNil)
+
+	id := mustID(s.svc, b.Email, c)
+	c.Check(s.svc.DisableTOTP(id, codes[3]), gc.ErrorMatches, `code ".*" not valid`)
+	c.Check(s.svc.DisableTOTP(id, codes[5]), jc.ErrorIsNil)
+	c.Check(s.svc.DisableTOTP(id, codes[6]), gc.ErrorMatches, `two-factor authentication for "bob@tomato.com" not found`)
+
+	login, err = s.svc.LoginUser(b.Email, b.Pwhash)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(login.Pending, gc.Equals, false)
+}
+
+func (s *UserSuite) TestResetTOTP(c *gc.C) {
+	s.createUsers(c)
+	b := s.users["bob"]
+
+	c.Check(s.svc.ResetTOTP(b.Email), gc.ErrorMatches, `two-factor authentication for "bob@tomato.com" not found`)
+
+	s.enableTOTP(b.Email, c)
+	c.Assert(s.svc.ResetTOTP(b.Email), jc.ErrorIsNil)
+
+	login, err := s.svc.LoginUser(b.Email, b.Pwhash)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(login.Pending, gc.Equals, false)
+	c.Check(s.svc.ValidLogin(b.Email, login.Key), jc.ErrorIsNil)
+}
+
+func (s *UserSuite) TestAuthenticate(c *gc.C) {
+	s.createUsers(c)
+	b, l := s.users["bob"], s.users["larry"]
+
+	u, err := s.svc.Authenticate("", l.Email, l.Pwhash, "")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(u.Email, gc.Equals, l.Email)
+	_, err = s.svc.Authenticate("", l.Email, "bad", "")
+	c.Check(err, gc.NotNil)
+
+	secret, _ := s.enableTOTP(b.Email, c)
+	s.clock.Advance(totp.Period)
+	mustLoginAs(s.svc, b, c)
+	login, err := s.svc.GetLogin(b.Email)
+	c.Assert(err, jc.ErrorIsNil)
+
+	_, err = s.svc.Authenticate("", b.Email, b.Pwhash, "")
+	c.Check(err, gc.ErrorMatches, `code "" not valid`)
+
+	code, err := totp.Code(secret, s.clock.Now())
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = s.svc.Authenticate("", b.Email, b.Pwhash, code)
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = s.svc.Authenticate("", b.Email, b.Pwhash, code)
+	c.Check(err, gc.ErrorMatches, `reused code ".*" not valid`)
+
+	// The user's login is left alone.
+	after, err := s.svc.GetLogin(b.Email)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(after, jc.DeepEquals, login)
+
+	// Disabled users may not authenticate, even with their password.
+	c.Assert(s.svc.Disable(l.Email), jc.ErrorIsNil)
+	_, err = s.svc.Authenticate("", l.Email, l.Pwhash, "")
+	c.Check(err, gc.ErrorMatches, `user "larry@.*" is disabled`)
+	c.Check(err, jc.Satisfies, errors.IsUnauthorized)
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"time"
 
+	"github.com/boltdb/bolt"
 	"github.com/juju/errors"
 	"github.com/synapse-garden/mf-proto/db"
 	"github.com/synapse-garden/mf-proto/util"
@@ -12,73 +13,249 @@ import (
 type b []byte
 
 const (
+	// Users holds the Users by ID.
 	Users db.Bucket = "user-users"
+
+	// Emails indexes the IDs of Users by email.
+	Emails db.Bucket = "user-emails"
 )
 
 type User struct {
+	// ID identifies the user for good, even if their Email changes.
+	ID string `json:"id,omitempty"`
+
 	Email string    `json:"email,omitempty"`
 	Salt  util.Salt `json:"salt,omitempty"`
 	Hash  util.Hash `json:"hash,omitempty"`
 	Key   util.Key  `json:"key,omitempty"`
+
+	// Unverified is set until the user verifies their email address.
+	Unverified bool `json:"unverified,omitempty"`
+
+	// Disabled is set while an admin has stopped the user from logging in.
+	Disabled bool `json:"disabled,omitempty"`
+
+	// TOTP holds the user's two-factor authentication settings, if any.
+	TOTP *TOTP `json:"totp,omitempty"`
+
+	// Created and LastLogin are when the user was created and last
+	// completed a login.  Users made before they were kept have neither.
+	Created   *time.Time `json:"created,omitempty"`
+	LastLogin *time.Time `json:"last_login,omitempty"`
+
+	Profile *Profile `json:"profile,omitempty"`
 }
 
 func Buckets() []db.Bucket {
 	return []db.Bucket{
 		LoginKeys,
 		Users,
+		Emails,
+		Tokens,
+		Secrets,
+		Attempts,
+		Registration,
+		Invites,
+		AccessTokens,
+		JWTKeys,
+		JWTRevoked,
 	}
 }
 
-func Create(d db.DB, email, pwhash string) error {
-	userBytes, err := db.GetByKey(d, Users, []byte(email))
+// newID makes a new random user ID.
+func newID() (string, error) {
+	k, err := util.NewKey()
+	if err != nil {
+		return "", err
+	}
+	return string(k[:16]), nil
+}
 
-	switch {
-	case err != nil:
-		return err
-	case len(userBytes) != 0:
-		return errors.AlreadyExistsf("user for email %q", email)
+// Create makes a new user with the given email and pwhash.  If the Service
+// has a Mailer, the user is unverified and is sent a verification link.  If
+// the link can't be sent, the user is not made, so they may try again.
+func (s *Service) Create(email, pwhash string) error {
+	_, err := s.create(email, pwhash, s.Mailer != nil)
+	return err
+}
+
+// create makes and returns a new user, and sends them a verification link
+// if they are unverified.
+func (s *Service) create(email, pwhash string, unverified bool) (*User, error) {
+	if err := ValidEmail(email); err != nil {
+		return nil, err
+	}
+
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.Clock.Now()
+	hash, salt := util.HashedAndSalt(pwhash, now.String())
+	u := &User{
+		ID:         id,
+		Email:      email,
+		Salt:       salt,
+		Hash:       hash,
+		Unverified: unverified,
+		Created:    &now,
 	}
 
-	seed := time.Now().String()
-	hash, salt := util.HashedAndSalt(pwhash, seed)
-	return db.StoreKeyValue(d, Users, []byte(email), User{
-		Email: email,
-		Salt:  salt,
-		Hash:  hash,
+	err = s.DB.Update(func(tx *bolt.Tx) error {
+		es, us := tx.Bucket([]byte(Emails)), tx.Bucket([]byte(Users))
+		switch {
+		case es == nil:
+			return db.BucketNotFoundErr(Emails)
+		case us == nil:
+			return db.BucketNotFoundErr(Users)
+		case len(es.Get([]byte(email))) != 0:
+			return errors.AlreadyExistsf("user for email %q", email)
+		case len(us.Get([]byte(id))) != 0:
+			return errors.AlreadyExistsf("user %s", id)
+		}
+
+		bs, err := json.Marshal(u)
+		if err != nil {
+			return err
+		}
+
+		if err := es.Put([]byte(email), []byte(id)); err != nil {
+			return err
+		}
+		return us.Put([]byte(id), bs)
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	if unverified {
+		if err := s.SendVerification(email); err != nil {
+			if rerr := s.remove(u); rerr != nil {
+				return nil, errors.Annotatef(err, "removing unverifiable user %q failed: %s", email, rerr)
+			}
+			return nil, errors.Annotatef(err, "sending verification to %q failed", email)
+		}
+	}
+
+	return u, runHooks(s.Hooks.Created, email)
 }
 
-func Delete(d db.DB, email string) error {
-	userBytes, err := db.GetByKey(d, Users, []byte(email))
-	if err != nil {
+// remove deletes a user who was never fully made, without running Hooks.
+func (s *Service) remove(u *User) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		es, us := tx.Bucket([]byte(Emails)), tx.Bucket([]byte(Users))
+		switch {
+		case es == nil:
+			return db.BucketNotFoundErr(Emails)
+		case us == nil:
+			return db.BucketNotFoundErr(Users)
+		}
+
+		if err := es.Delete([]byte(u.Email)); err != nil {
+			return err
+		}
+		return us.Delete([]byte(u.ID))
+	})
+}
+
+func (s *Service) Delete(email string) error {
+	id, err := s.ID(email)
+	switch {
+	case errors.IsUserNotFound(err):
+		return errors.Errorf("user for email %q not found", email)
+	case err != nil:
 		return err
 	}
 
-	if len(userBytes) == 0 {
-		return errors.Errorf("user for email %q not found", email)
+	// Clear the login first, since it can't be found without the user,
+	// and likewise revoke credentials kept elsewhere.
+	if _, err := s.GetLogin(email); err == nil {
+		if err := s.ClearLogin(email); err != nil {
+			return err
+		}
+	}
+
+	if err := runHooks(s.Hooks.Revoked, email); err != nil {
+		return err
 	}
 
-	if err = db.DeleteByKey(d, Users, []byte(email)); err != nil {
+	err = s.DB.Update(func(tx *bolt.Tx) error {
+		es, us := tx.Bucket([]byte(Emails)), tx.Bucket([]byte(Users))
+		switch {
+		case es == nil:
+			return db.BucketNotFoundErr(Emails)
+		case us == nil:
+			return db.BucketNotFoundErr(Users)
+		}
+
+		if err := es.Delete([]byte(email)); err != nil {
+			return err
+		}
+		return us.Delete([]byte(id))
+	})
+	if err != nil {
 		return errors.Annotatef(err, "failed to delete user %q", email)
 	}
 
+	if err := s.deleteAccessTokens(id); err != nil {
+		return err
+	}
+
+	if err := s.revokeJWTs(email); err != nil {
+		return err
+	}
+
 	// TODO: figure out what to do with user's objects.  Delete?  What if
 	// another user has shared ownership?  What if an object is abandoned?
 
-	if _, err := GetLogin(d, email); err == nil {
-		return ClearLogin(d, email)
+	return runHooks(s.Hooks.Deleted, email)
+}
+
+// ID returns the ID of the user with the given email.
+func (s *Service) ID(email string) (string, error) {
+	var id string
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		id, err = s.IDIn(tx, email)
+		return err
+	})
+	return id, err
+}
+
+// IDIn is ID in the given transaction, for callers which are already in one.
+func (s *Service) IDIn(tx *bolt.Tx, email string) (string, error) {
+	b := tx.Bucket([]byte(Emails))
+	if b == nil {
+		return "", db.BucketNotFoundErr(Emails)
+	}
+
+	id := b.Get([]byte(email))
+	if len(id) == 0 {
+		return "", errors.UserNotFoundf("%q", email)
 	}
 
-	return nil
+	return string(id), nil
 }
 
-func Get(d db.DB, email string) (*User, error) {
-	userBytes, err := db.GetByKey(d, Users, []byte(email))
+// Get returns the user with the given email.
+func (s *Service) Get(email string) (*User, error) {
+	id, err := s.ID(email)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetByID(id)
+}
+
+// GetByID returns the user with the given ID.
+func (s *Service) GetByID(id string) (*User, error) {
+	userBytes, err := db.GetByKey(s.DB, Users, []byte(id))
 	if err != nil {
 		return nil, err
 	}
 	if len(userBytes) == 0 {
-		return nil, errors.UserNotFoundf("%q", email)
+		return nil, errors.UserNotFoundf("%s", id)
 	}
 
 	u := &User{}
@@ -89,3 +266,8 @@ func Get(d db.DB, email string) (*User, error) {
 
 	return u, nil
 }
+
+// put stores the given user by their ID.  Their email must not change.
+func (s *Service) put(u *User) error {
+	return db.StoreKeyValue(s.DB, Users, []byte(u.ID), u)
+}
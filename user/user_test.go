@@ -6,6 +6,7 @@ import (
 
 	jc "github.com/juju/testing/checkers"
 	"github.com/synapse-garden/mf-proto/db"
+	"github.com/synapse-garden/mf-proto/mail"
 	t "github.com/synapse-garden/mf-proto/testing"
 	"github.com/synapse-garden/mf-proto/user"
 	"github.com/synapse-garden/mf-proto/util"
@@ -44,12 +45,17 @@ func (s *UserSuite) TestCreate(c *gc.C) {
 }
 
 func (s *UserSuite) createTests(u t.TestUser, c *gc.C) error {
-	err := user.Create(s.d, u.Email, u.Pwhash)
+	err := s.svc.Create(u.Email, u.Pwhash)
 	if err != nil {
 		return err
 	}
 
-	userBytes, err := db.GetByKey(s.d, user.Users, []byte(u.Email))
+	id, err := s.svc.ID(u.Email)
+	if err != nil {
+		return err
+	}
+
+	userBytes, err := db.GetByKey(s.d, user.Users, []byte(id))
 	if err != nil {
 		return err
 	}
@@ -61,6 +67,7 @@ func (s *UserSuite) createTests(u t.TestUser, c *gc.C) error {
 		return err
 	}
 
+	c.Check(tmpUser.ID, gc.Equals, id)
 	c.Check(tmpUser.Email, gc.Equals, u.Email)
 	return nil
 }
@@ -91,11 +98,73 @@ func (s *UserSuite) TestDelete(c *gc.C) {
 }
 
 func (s *UserSuite) deleteTests(u t.TestUser, c *gc.C) error {
-	if err := user.Delete(s.d, u.Email); err != nil {
+	if err := s.svc.Delete(u.Email); err != nil {
 		return err
 	}
 
-	err := user.ValidLogin(s.d, u.Email, util.Key(u.LoginKey))
+	err := s.svc.ValidLogin(u.Email, util.Key(u.LoginKey))
 	c.Assert(err, gc.ErrorMatches, fmt.Sprintf("could not get login for email %q not valid", u.Email))
 	return nil
 }
+
+func (s *UserSuite) TestHooks(c *gc.C) {
+	var created, deleted []string
+	svc := user.NewService(s.d,
+		user.WithClock(s.clock),
+		user.OnCreated(func(email string) error {
+			created = append(created, email)
+			return nil
+		}),
+		user.OnDeleted(func(email string) error {
+			deleted = append(deleted, email)
+			return nil
+		}),
+	)
+
+	b := s.users["bob"]
+	c.Assert(svc.Create(b.Email, b.Pwhash), jc.ErrorIsNil)
+	c.Check(created, jc.DeepEquals, []string{b.Email})
+	c.Check(deleted, gc.HasLen, 0)
+
+	c.Assert(svc.Delete(b.Email), jc.ErrorIsNil)
+	c.Check(deleted, jc.DeepEquals, []string{b.Email})
+}
+
+func (s *UserSuite) TestRevokedHooks(c *gc.C) {
+	var revoked []string
+	m := new(mail.Memory)
+	var svc *user.Service
+	svc = user.NewService(s.d,
+		user.WithClock(s.clock),
+		user.WithMailer(m, "mf@synapsegarden.net"),
+		user.OnRevoked(func(email string) error {
+			// The user can still be found, even when being deleted.
+			_, err := svc.ID(email)
+			c.Check(err, jc.ErrorIsNil)
+			revoked = append(revoked, email)
+			return nil
+		}),
+	)
+
+	b := s.users["bob"]
+	c.Assert(svc.Create(b.Email, b.Pwhash), jc.ErrorIsNil)
+	_, err := svc.Verify(tokenFrom(m, b.Email, c))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(revoked, gc.HasLen, 0)
+
+	_, err = svc.ChangePassword(mustID(svc, b.Email, c), b.Pwhash, "new-password")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(revoked, gc.HasLen, 1)
+
+	c.Assert(svc.RequestPasswordReset(b.Email), jc.ErrorIsNil)
+	_, err = svc.ResetPassword(tokenFrom(m, b.Email, c), "other-password")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(revoked, gc.HasLen, 2)
+
+	c.Assert(svc.Disable(b.Email), jc.ErrorIsNil)
+	c.Assert(svc.Enable(b.Email), jc.ErrorIsNil)
+	c.Check(revoked, gc.HasLen, 3)
+
+	c.Assert(svc.Delete(b.Email), jc.ErrorIsNil)
+	c.Check(revoked, jc.DeepEquals, []string{b.Email, b.Email, b.Email, b.Email})
+}
@@ -0,0 +1,82 @@
+package user
+
+import (
+	"fmt"
+	"net/mail"
+	"net/url"
+
+	"github.com/juju/errors"
+	mfmail "github.com/synapse-garden/mf-proto/mail"
+)
+
+// ValidEmail returns an error if email is not a bare email address such as
+// "bob@tomato.com".
+func ValidEmail(email string) error {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return errors.NotValidf("email %q", email)
+	}
+	return nil
+}
+
+// linkTo returns base with the given token added as its "token" query value.
+func linkTo(base, tok string) string {
+	u, err := url.Parse(base)
+	if err != nil {
+		return base + "?token=" + url.QueryEscape(tok)
+	}
+	q := u.Query()
+	q.Set("token", tok)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// SendVerification mails the given unverified user a link containing a
+// single-use token which verifies their email address.
+func (s *Service) SendVerification(email string) error {
+	if s.Mailer == nil {
+		return errors.NotProvisionedf("mailer")
+	}
+
+	u, err := s.Get(email)
+	if err != nil {
+		return err
+	}
+
+	if !u.Unverified {
+		return errors.AlreadyExistsf("verification for user %q", email)
+	}
+
+	tok, err := s.issueToken(PurposeVerify, u.ID, email, s.VerifyTTL)
+	if err != nil {
+		return err
+	}
+
+	return s.Mailer.Send(mfmail.Message{
+		From:    s.MailFrom,
+		To:      email,
+		Subject: "Verify your Mindfork account",
+		Body: fmt.Sprintf(
+			"Visit the following link to verify your account:\n\n%s\n\n"+
+				"This link expires in %s.\n",
+			linkTo(s.VerifyURL, tok), s.VerifyTTL,
+		),
+	})
+}
+
+// Verify redeems a token sent by SendVerification and marks its user as
+// verified, returning the user's email.
+func (s *Service) Verify(tok string) (string, error) {
+	t, err := s.redeemToken(PurposeVerify, tok)
+	if err != nil {
+		return "", err
+	}
+
+	u, err := s.tokenUser(t)
+	if err != nil {
+		return "", err
+	}
+
+	u.Unverified = false
+	return u.Email, s.put(u)
+}
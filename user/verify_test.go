@@ -0,0 +1,148 @@
+package user_test
+
+import (
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	"github.com/synapse-garden/mf-proto/mail"
+	"github.com/synapse-garden/mf-proto/user"
+
+	gc "gopkg.in/check.v1"
+)
+
+var linkRE = regexp.MustCompile(`https?://\S+`)
+
+// tokenFrom gets the token from the link in the last mail sent to email.
+func tokenFrom(m *mail.Memory, email string, c *gc.C) string {
+	msg, ok := m.Last(email)
+	c.Assert(ok, gc.Equals, true)
+	link := linkRE.FindString(msg.Body)
+	c.Assert(link, gc.Not(gc.Equals), "")
+	u, err := url.Parse(link)
+	c.Assert(err, jc.ErrorIsNil)
+	return u.Query().Get("token")
+}
+
+func (s *UserSuite) TestValidEmail(c *gc.C) {
+	for i, t := range []struct {
+		given       string
+		expectError string
+	}{{
+		given: "bob@tomato.com",
+	}, {
+		given:       "bob",
+		expectError: `email "bob" not valid`,
+	}, {
+		given:       "Bob <bob@tomato.com>",
+		expectError: `email "Bob <bob@tomato.com>" not valid`,
+	}, {
+		given:       "",
+		expectError: `email "" not valid`,
+	}} {
+		c.Logf("test %d: %q", i, t.given)
+		err := user.ValidEmail(t.given)
+		if t.expectError != "" {
+			c.Check(err, gc.ErrorMatches, t.expectError)
+		} else {
+			c.Check(err, jc.ErrorIsNil)
+		}
+	}
+}
+
+func (s *UserSuite) TestVerify(c *gc.C) {
+	m := new(mail.Memory)
+	svc := user.NewService(s.d,
+		user.WithClock(s.clock),
+		user.WithMailer(m, "mf@synapsegarden.net"),
+		user.WithVerifyURL("https://mf.test/user/verify?lang=en"),
+	)
+
+	b := s.users["bob"]
+	c.Assert(svc.Create(b.Email, b.Pwhash), jc.ErrorIsNil)
+
+	msg, ok := m.Last(b.Email)
+	c.Assert(ok, gc.Equals, true)
+	c.Check(msg.From, gc.Equals, "mf@synapsegarden.net")
+
+	_, err := svc.LoginUser(b.Email, b.Pwhash)
+	c.Check(err, gc.ErrorMatches, `user "bob@tomato.com" has not verified their email`)
+
+	tok := tokenFrom(m, b.Email, c)
+	email, err := svc.Verify(tok)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(email, gc.Equals, b.Email)
+
+	_, err = svc.LoginUser(b.Email, b.Pwhash)
+	c.Check(err, jc.ErrorIsNil)
+
+	_, err = svc.Verify(tok)
+	c.Check(err, gc.ErrorMatches, `used verify token not valid`)
+
+	err = svc.SendVerification(b.Email)
+	c.Check(err, gc.ErrorMatches, `verification for user "bob@tomato.com" already exists`)
+}
+
+// brokenMailer fails to send every Message.
+type brokenMailer struct{}
+
+func (brokenMailer) Send(mail.Message) error { return errors.New("connection refused") }
+
+func (s *UserSuite) TestCreateUnsentVerification(c *gc.C) {
+	created := 0
+	svc := user.NewService(s.d,
+		user.WithClock(s.clock),
+		user.WithMailer(brokenMailer{}, "mf@synapsegarden.net"),
+		user.OnCreated(func(string) error { created++; return nil }),
+	)
+
+	b := s.users["bob"]
+	err := svc.Create(b.Email, b.Pwhash)
+	c.Check(err, gc.ErrorMatches, `sending verification to "bob@tomato.com" failed: connection refused`)
+	c.Check(created, gc.Equals, 0)
+
+	_, err = svc.ID(b.Email)
+	c.Check(err, jc.Satisfies, errors.IsUserNotFound)
+
+	m := new(mail.Memory)
+	svc = user.NewService(s.d,
+		user.WithClock(s.clock),
+		user.WithMailer(m, "mf@synapsegarden.net"),
+	)
+	c.Assert(svc.Create(b.Email, b.Pwhash), jc.ErrorIsNil)
+	_, ok := m.Last(b.Email)
+	c.Check(ok, gc.Equals, true)
+}
+
+func (s *UserSuite) TestVerifyRejectsBadTokens(c *gc.C) {
+	m := new(mail.Memory)
+	svc := user.NewService(s.d,
+		user.WithClock(s.clock),
+		user.WithMailer(m, "mf@synapsegarden.net"),
+	)
+
+	l := s.users["larry"]
+	c.Assert(svc.Create(l.Email, l.Pwhash), jc.ErrorIsNil)
+	tok := tokenFrom(m, l.Email, c)
+
+	other := user.NewService(s.d,
+		user.WithClock(s.clock),
+		user.WithSecret([]byte("some other secret")),
+	)
+	_, err := other.Verify(tok)
+	c.Check(err, gc.ErrorMatches, `signature of token ".*" not valid`)
+
+	_, err = svc.Verify("garbage")
+	c.Check(err, gc.ErrorMatches, `token "garbage" not valid`)
+
+	s.clock.Advance(user.DefaultVerifyTTL + time.Second)
+	_, err = svc.Verify(tok)
+	c.Check(err, gc.ErrorMatches, `expired verify token not valid`)
+}
+
+func (s *UserSuite) TestCreateRejectsBadEmail(c *gc.C) {
+	err := s.svc.Create("not an email", "12345")
+	c.Check(err, gc.ErrorMatches, `email "not an email" not valid`)
+}
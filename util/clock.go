@@ -0,0 +1,17 @@
+package util
+
+import "time"
+
+// Clock tells the current time.  Anything which depends on the time of day,
+// such as login timeouts, should take a Clock so that it can be tested.
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is a Clock which uses the system time.
+type SystemClock struct{}
+
+// Now implements Clock.Now using time.Now.
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
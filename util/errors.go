@@ -0,0 +1,41 @@
+package util
+
+import (
+	"github.com/juju/errors"
+)
+
+// forbidden is an Unauthorized error for a caller who is known, but may not
+// do what they asked.
+type forbidden struct {
+	error
+}
+
+// Cause makes a forbidden error satisfy errors.IsUnauthorized.
+func (f *forbidden) Cause() error { return errors.Cause(f.error) }
+
+// Underlying lets IsForbidden find a forbidden error under annotations.
+func (f *forbidden) Underlying() error { return f.error }
+
+// Forbiddenf returns an error satisfying both errors.IsUnauthorized and
+// IsForbidden, for a caller who lacks permission rather than credentials.
+func Forbiddenf(format string, args ...interface{}) error {
+	return &forbidden{errors.Unauthorizedf(format, args...)}
+}
+
+// IsForbidden reports whether err, or an error it annotates, was made by
+// Forbiddenf.
+func IsForbidden(err error) bool {
+	for err != nil {
+		if _, ok := err.(*forbidden); ok {
+			return true
+		}
+		u, ok := err.(interface {
+			Underlying() error
+		})
+		if !ok {
+			return false
+		}
+		err = u.Underlying()
+	}
+	return false
+}
@@ -0,0 +1,24 @@
+package util_test
+
+import (
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	"github.com/synapse-garden/mf-proto/util"
+	gc "gopkg.in/check.v1"
+)
+
+func (s *UtilSuite) TestForbidden(c *gc.C) {
+	err := util.Forbiddenf("user %q not read authorized", "bob")
+	c.Check(err, gc.ErrorMatches, `user "bob" not read authorized`)
+	c.Check(err, jc.Satisfies, util.IsForbidden)
+	c.Check(err, jc.Satisfies, errors.IsUnauthorized)
+
+	annotated := errors.Annotate(err, "reading object")
+	c.Check(annotated, gc.ErrorMatches, `reading object: user "bob" not read authorized`)
+	c.Check(annotated, jc.Satisfies, util.IsForbidden)
+	c.Check(annotated, jc.Satisfies, errors.IsUnauthorized)
+
+	c.Check(errors.Unauthorizedf("bad key"), gc.Not(jc.Satisfies), util.IsForbidden)
+	c.Check(errors.NotValidf("key"), gc.Not(jc.Satisfies), util.IsForbidden)
+	c.Check(util.IsForbidden(nil), jc.IsFalse)
+}
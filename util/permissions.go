@@ -1,26 +1,78 @@
 package util
 
-import "github.com/juju/errors"
+import (
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// UserPrincipal returns the principal naming the user with the given ID in
+// Permissions.
+func UserPrincipal(id string) string { return "user:" + id }
+
+// GroupPrincipal returns the principal naming the members of the group with
+// the given ID in Permissions.
+func GroupPrincipal(id string) string { return "group:" + id }
 
 // Permissions represents the permissions of an object.
 type Permissions struct {
+	// Owner is the ID of the user who owns the object.
 	Owner string
+
+	// Readers may read the object, and Writers may read and write it.
+	// Each is a principal made by UserPrincipal or GroupPrincipal.
+	Readers []string `json:",omitempty"`
+	Writers []string `json:",omitempty"`
 }
 
-// ReadAuthorized determines if a given user is read authorized.
-func (p *Permissions) ReadAuthorized(email string) error {
-	if p.Owner != email {
-		return errors.Unauthorizedf("user %q not read authorized", email)
+// Validate returns an error if any of the Readers or Writers is not a user
+// or group principal.
+func (p *Permissions) Validate() error {
+	for _, pr := range append(append([]string(nil), p.Readers...), p.Writers...) {
+		parts := strings.SplitN(pr, ":", 2)
+		if len(parts) != 2 || parts[1] == "" ||
+			(parts[0] != "user" && parts[0] != "group") {
+			return errors.NotValidf("principal %q", pr)
+		}
 	}
 
 	return nil
 }
 
-// WriteAuthorized determines if a given user is write authorized.
-func (p *Permissions) WriteAuthorized(email string) error {
-	if p.Owner != email {
-		return errors.Unauthorizedf("user %q not write authorized", email)
+// ReadAuthorized determines if a given user, who is a member of the given
+// groups, is read authorized.
+func (p *Permissions) ReadAuthorized(user string, groups ...string) error {
+	if p.Owner != user &&
+		!includes(p.Readers, user, groups) &&
+		!includes(p.Writers, user, groups) {
+		return Forbiddenf("user %q not read authorized", user)
 	}
 
 	return nil
 }
+
+// WriteAuthorized determines if a given user, who is a member of the given
+// groups, is write authorized.
+func (p *Permissions) WriteAuthorized(user string, groups ...string) error {
+	if p.Owner != user && !includes(p.Writers, user, groups) {
+		return Forbiddenf("user %q not write authorized", user)
+	}
+
+	return nil
+}
+
+// includes returns true if principals names the user or one of the groups.
+func includes(principals []string, user string, groups []string) bool {
+	for _, pr := range principals {
+		if pr == UserPrincipal(user) {
+			return true
+		}
+		for _, g := range groups {
+			if pr == GroupPrincipal(g) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -11,19 +11,44 @@ func (s *UtilSuite) TestReadAuthorized(c *gc.C) {
 		should      string
 		givenPerms  util.Permissions
 		givenEmail  string
+		givenGroups []string
 		expectError string
 	}{{
 		should:     "accept read for an authorized user",
-		givenPerms: util.Permissions{"joe"},
+		givenPerms: util.Permissions{Owner: "joe"},
 		givenEmail: "joe",
 	}, {
 		should:      "reject read for an unauthorized user",
-		givenPerms:  util.Permissions{"joe"},
+		givenPerms:  util.Permissions{Owner: "joe"},
 		givenEmail:  "fred",
 		expectError: `user "fred" not read authorized`,
+	}, {
+		should: "accept read for a reader",
+		givenPerms: util.Permissions{
+			Owner:   "joe",
+			Readers: []string{util.UserPrincipal("fred")},
+		},
+		givenEmail: "fred",
+	}, {
+		should: "accept read for a member of a writer group",
+		givenPerms: util.Permissions{
+			Owner:   "joe",
+			Writers: []string{util.GroupPrincipal("g1")},
+		},
+		givenEmail:  "fred",
+		givenGroups: []string{"g0", "g1"},
+	}, {
+		should: "reject read for a member of another group",
+		givenPerms: util.Permissions{
+			Owner:   "joe",
+			Readers: []string{util.GroupPrincipal("g1")},
+		},
+		givenEmail:  "fred",
+		givenGroups: []string{"g0"},
+		expectError: `user "fred" not read authorized`,
 	}} {
 		c.Logf("test %d: should %s", i, t.should)
-		err := t.givenPerms.ReadAuthorized(t.givenEmail)
+		err := t.givenPerms.ReadAuthorized(t.givenEmail, t.givenGroups...)
 		if t.expectError != "" {
 			c.Check(err, gc.ErrorMatches, t.expectError)
 		} else {
@@ -37,19 +62,37 @@ func (s *UtilSuite) TestWriteAuthorized(c *gc.C) {
 		should      string
 		givenPerms  util.Permissions
 		givenEmail  string
+		givenGroups []string
 		expectError string
 	}{{
 		should:     "accept write for an authorized user",
-		givenPerms: util.Permissions{"joe"},
+		givenPerms: util.Permissions{Owner: "joe"},
 		givenEmail: "joe",
 	}, {
 		should:      "reject write for an unauthorized user",
-		givenPerms:  util.Permissions{"joe"},
+		givenPerms:  util.Permissions{Owner: "joe"},
+		givenEmail:  "fred",
+		expectError: `user "fred" not write authorized`,
+	}, {
+		should: "accept write for a member of a writer group",
+		givenPerms: util.Permissions{
+			Owner:   "joe",
+			Writers: []string{util.GroupPrincipal("g1")},
+		},
+		givenEmail:  "fred",
+		givenGroups: []string{"g1"},
+	}, {
+		should: "reject write for a reader",
+		givenPerms: util.Permissions{
+			Owner:   "joe",
+			Readers: []string{util.UserPrincipal("fred"), util.GroupPrincipal("g1")},
+		},
 		givenEmail:  "fred",
+		givenGroups: []string{"g1"},
 		expectError: `user "fred" not write authorized`,
 	}} {
 		c.Logf("test %d: should %s", i, t.should)
-		err := t.givenPerms.WriteAuthorized(t.givenEmail)
+		err := t.givenPerms.WriteAuthorized(t.givenEmail, t.givenGroups...)
 		if t.expectError != "" {
 			c.Check(err, gc.ErrorMatches, t.expectError)
 		} else {
@@ -57,3 +100,17 @@ func (s *UtilSuite) TestWriteAuthorized(c *gc.C) {
 		}
 	}
 }
+
+func (s *UtilSuite) TestValidatePermissions(c *gc.C) {
+	p := util.Permissions{
+		Owner:   "joe",
+		Readers: []string{"user:fred"},
+		Writers: []string{"group:g1"},
+	}
+	c.Check(p.Validate(), jc.ErrorIsNil)
+
+	for _, bad := range []string{"fred", "user:", "robot:r2d2"} {
+		p.Writers = []string{bad}
+		c.Check(p.Validate(), gc.ErrorMatches, `principal ".*" not valid`)
+	}
+}
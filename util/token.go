@@ -0,0 +1,74 @@
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// NewKey makes a new random Key of 20 bytes, hex-encoded.
+func NewKey() (Key, error) {
+	bs, err := RandomBytes(20)
+	if err != nil {
+		return "", err
+	}
+	return Key(hex.EncodeToString(bs)), nil
+}
+
+// HashKey returns the hex SHA-256 hash of a random Key, so that it can be
+// stored and looked up without keeping the Key itself.  It is not for
+// passwords, which must be salted.
+func HashKey(k Key) Hash {
+	sum := sha256.Sum256([]byte(k))
+	return Hash(hex.EncodeToString(sum[:]))
+}
+
+// RandomBytes reads n cryptographically random bytes.
+func RandomBytes(n int) ([]byte, error) {
+	bs := make([]byte, n)
+	if _, err := rand.Read(bs); err != nil {
+		return nil, errors.Annotate(err, "reading random bytes failed")
+	}
+	return bs, nil
+}
+
+var b64 = base64.RawURLEncoding
+
+// Sign returns the given payload and its HMAC-SHA256 signature under secret,
+// each base64url-encoded and joined with a ".".
+func Sign(secret, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return b64.EncodeToString(payload) + "." + b64.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks that token was made by Sign with the same secret, and returns
+// its payload.
+func Verify(secret []byte, token string) ([]byte, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, errors.NotValidf("token %q", token)
+	}
+
+	payload, err := b64.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.NotValidf("token %q", token)
+	}
+	sig, err := b64.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.NotValidf("token %q", token)
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, errors.NotValidf("signature of token %q", token)
+	}
+
+	return payload, nil
+}
@@ -0,0 +1,66 @@
+package util_test
+
+import (
+	jc "github.com/juju/testing/checkers"
+	"github.com/synapse-garden/mf-proto/util"
+	gc "gopkg.in/check.v1"
+)
+
+func (s *UtilSuite) TestSignVerify(c *gc.C) {
+	signed := util.Sign([]byte("secret"), []byte("hello"))
+
+	for i, t := range []struct {
+		should       string
+		givenSecret  string
+		givenToken   string
+		expectResult string
+		expectError  string
+	}{{
+		should:       "verify a token signed with the same secret",
+		givenSecret:  "secret",
+		givenToken:   signed,
+		expectResult: "hello",
+	}, {
+		should:      "reject a token signed with a different secret",
+		givenSecret: "other",
+		givenToken:  signed,
+		expectError: `signature of token ".*" not valid`,
+	}, {
+		should:      "reject a token whose payload was changed",
+		givenSecret: "secret",
+		givenToken:  "aGVsbG8h" + signed[len("aGVsbG8"):],
+		expectError: `signature of token ".*" not valid`,
+	}, {
+		should:      "reject a malformed token",
+		givenSecret: "secret",
+		givenToken:  "hello",
+		expectError: `token "hello" not valid`,
+	}} {
+		c.Logf("test %d: should %s", i, t.should)
+		result, err := util.Verify([]byte(t.givenSecret), t.givenToken)
+		if t.expectError != "" {
+			c.Check(err, gc.ErrorMatches, t.expectError)
+			continue
+		}
+		c.Assert(err, jc.ErrorIsNil)
+		c.Check(string(result), gc.Equals, t.expectResult)
+	}
+}
+
+func (s *UtilSuite) TestNewKey(c *gc.C) {
+	k1, err := util.NewKey()
+	c.Assert(err, jc.ErrorIsNil)
+	k2, err := util.NewKey()
+	c.Assert(err, jc.ErrorIsNil)
+
+	c.Check(k1, gc.HasLen, 40)
+	c.Check(k1, gc.Not(gc.Equals), k2)
+}
+
+func (s *UtilSuite) TestHashKey(c *gc.C) {
+	k, err := util.NewKey()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(util.HashKey(k), gc.Equals, util.HashKey(k))
+	c.Check(util.HashKey(k), gc.HasLen, 64)
+	c.Check(util.HashKey(k), gc.Not(gc.Equals), util.HashKey(k+"0"))
+}